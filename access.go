@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+)
+
+// lxdAccess is how LXD is reached, so lxd-backup needn't run as root: its
+// unix socket, which the lxd group may use, or HTTPS with a client
+// certificate LXD trusts.
+type lxdAccess struct {
+	socket     string
+	url        string
+	cert, key  string
+	serverCert string
+}
+
+// lxdEndpoint is set when LXD is reached over HTTPS, for -api.
+var lxdEndpoint *lxdAccess
+
+// httpsRemote is what -lxd-url is called as an lxc remote.
+const httpsRemote = "lxd-backup"
+
+func addLxdFlags(fs *flag.FlagSet) *lxdAccess {
+	a := &lxdAccess{}
+	fs.StringVar(&a.socket, "lxd-socket", "", "Unix socket of LXD. Default is where the snap or the packages have it.")
+	fs.StringVar(&a.url, "lxd-url", "", "Reach LXD over HTTPS instead of its socket, IE https://lxd.example.com:8443.")
+	fs.StringVar(&a.cert, "lxd-cert", "", "With -lxd-url, client certificate in PEM LXD trusts.")
+	fs.StringVar(&a.key, "lxd-key", "", "With -lxd-url, private key of -lxd-cert in PEM.")
+	fs.StringVar(&a.serverCert, "lxd-server-cert", "", "With -lxd-url, the certificate in PEM LXD must have, IE its self-signed one. Default is trusting the CAs of the system.")
+	return a
+}
+
+// lxdSocket is the unix socket lxc and the API talk to.
+func lxdSocket() string {
+	if s := os.Getenv("LXD_SOCKET"); len(s) > 0 {
+		return s
+	}
+	return filepath.Join(lxdDir(), "unix.socket")
+}
+
+// setup points lxc at LXD as a asks, and when check is set, makes sure
+// LXD can be used by this user before anything is done. The returned
+// function cleans up.
+func (a *lxdAccess) setup(check bool) func() {
+
+	if a.trusted() {
+		slog.Info("Reaching LXD as set up by lxd-backup trust add", "url", a.url)
+	}
+	if len(a.url) == 0 {
+		if len(a.cert)+len(a.key)+len(a.serverCert) > 0 {
+			fatal("-lxd-cert, -lxd-key and -lxd-server-cert go with -lxd-url.")
+		}
+		if len(a.socket) > 0 {
+			os.Setenv("LXD_SOCKET", a.socket)
+		}
+		if check {
+			checkSocket(lxdSocket())
+		}
+		return func() {}
+	}
+
+	if len(a.socket) > 0 {
+		fatal("-lxd-socket and -lxd-url can't be combined.")
+	}
+	if len(a.cert) == 0 || len(a.key) == 0 {
+		fatal("-lxd-url needs -lxd-cert and -lxd-key.")
+	}
+
+	// lxc takes remotes and certificates from a directory of its own
+	dir, err := os.MkdirTemp("", "lxd-backup-lxc-")
+	if err != nil {
+		fatalf("Failed to create temporary directory. Error: %v\n", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	atExit(func(string) { cleanup() })
+
+	link := func(from, to string) {
+		abs, err := filepath.Abs(from)
+		if err == nil {
+			err = os.Symlink(abs, filepath.Join(dir, to))
+		}
+		if err != nil {
+			fatalf("Failed to link %s for lxc. Error: %v\n", from, err)
+		}
+	}
+	link(a.cert, "client.crt")
+	link(a.key, "client.key")
+	if len(a.serverCert) > 0 {
+		if err := os.Mkdir(filepath.Join(dir, "servercerts"), 0700); err != nil {
+			fatalf("Failed to create directory for lxc. Error: %v\n", err)
+		}
+		link(a.serverCert, filepath.Join("servercerts", httpsRemote+".crt"))
+	}
+	conf := fmt.Sprintf("default-remote: %s\nremotes:\n  %s:\n    addr: %s\n    protocol: lxd\n    auth_type: tls\n    public: false\n",
+		httpsRemote, httpsRemote, a.url)
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), []byte(conf), 0600); err != nil {
+		fatalf("Failed to write lxc config. Error: %v\n", err)
+	}
+	os.Setenv("LXD_CONF", dir)
+	lxdEndpoint = a
+
+	if check {
+		a.checkTrusted()
+	}
+	return cleanup
+}
+
+// tlsConfig is the client side of -lxd-url.
+func (a *lxdAccess) tlsConfig() *tls.Config {
+
+	cert, err := tls.LoadX509KeyPair(a.cert, a.key)
+	if err != nil {
+		fatalf("Failed to load %s and %s. Error: %v\n", a.cert, a.key, err)
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(a.serverCert) > 0 {
+		d, err := os.ReadFile(a.serverCert)
+		if err != nil {
+			fatalf("Failed to read %s. Error: %v\n", a.serverCert, err)
+		}
+		b, _ := pem.Decode(d)
+		if b == nil {
+			fatalf("No certificate in %s.\n", a.serverCert)
+		}
+		// Like lxc, the certificate is pinned, it is rarely of the name
+		// LXD is reached by
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 || !bytes.Equal(raw[0], b.Bytes) {
+				return fmt.Errorf("LXD at %s doesn't have the certificate of %s", a.url, a.serverCert)
+			}
+			return nil
+		}
+	}
+	return c
+}
+
+// checkTrusted makes sure LXD at -lxd-url answers and trusts the client
+// certificate, untrusted clients only see a few fields of /1.0.
+func (a *lxdAccess) checkTrusted() {
+
+	out, err := lxcOutput("query", "/1.0")
+	if err != nil {
+		fatalf("Failed to reach LXD at %s. Error: %v\n", a.url, err)
+	}
+	var server struct {
+		Auth string `json:"auth"`
+	}
+	if err := json.Unmarshal(out, &server); err != nil {
+		fatalf("Failed to decode server information of %s. Error: %v\n", a.url, err)
+	}
+	if server.Auth != "trusted" {
+		fatalf("LXD at %s doesn't trust %s. Add it there with: lxc config trust add %s\n", a.url, a.cert, a.cert)
+	}
+}
+
+// checkSocket makes sure this user may talk to LXD on its unix socket, and
+// says what to do about it if not.
+func checkSocket(socket string) {
+
+	if _, err := exec.LookPath("lxd"); err != nil {
+		fatal("The lxd binary is missing. Reach LXD on another machine with -lxd-url.")
+	}
+	if _, err := os.Stat(socket); errors.Is(err, fs.ErrNotExist) {
+		fatalf("LXD socket %s not found. Is LXD running? Give its socket with -lxd-socket.\n", socket)
+	}
+	conn, err := net.Dial("unix", socket)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		fatalf("Failed to connect to LXD on %s. Is LXD running? Error: %v\n", socket, err)
+	}
+
+	name := "this user"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	group, err := fileGroup(socket)
+	if err != nil {
+		group = "lxd"
+	}
+	fatalf("%s may not use the LXD socket %s. Run lxd-backup as root, add %s to the %s group, IE sudo usermod -aG %s %s and log in again, or reach LXD with -lxd-url and a client certificate it trusts.\n",
+		name, socket, name, group, group, name)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const agentEvents = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MODIFY
+
+// agent runs inside a container and journals every path that changes, so
+// the host doesn't have to hash the whole export to find the changes.
+type agent struct {
+	fd      int
+	journal *os.File
+	written int64
+	seen    map[string]bool
+	watches map[int]string
+	skip    map[string]bool
+}
+
+func (a *agent) write(l string) {
+
+	// The host truncates the journal when it makes a new quarter backup
+	if st, err := a.journal.Stat(); err == nil && st.Size() < a.written {
+		a.seen = make(map[string]bool)
+	}
+
+	if _, err := a.journal.WriteString(l + "\n"); err != nil {
+		fatalf("Failed to write journal. Error: %v\n", err)
+	}
+	if st, err := a.journal.Stat(); err == nil {
+		a.written = st.Size()
+	}
+}
+
+func (a *agent) changed(path string) {
+	if !a.seen[path] {
+		a.seen[path] = true
+		a.write(path)
+	}
+}
+
+func (a *agent) watch(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if a.skip[path] {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(a.fd, path, agentEvents)
+		if err != nil {
+			// Out of watches, changes below here would be missed
+			slog.Warn("Failed to watch directory", "path", path, "error", err)
+			a.write(journalGap)
+			return filepath.SkipDir
+		}
+		a.watches[wd] = path
+		return nil
+	})
+}
+
+func (a *agent) run() {
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := syscall.Read(a.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fatalf("Failed to read inotify events. Error: %v\n", err)
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)])
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				a.write(journalGap)
+				continue
+			}
+
+			dir, ok := a.watches[int(ev.Wd)]
+			if !ok {
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(a.watches, int(ev.Wd))
+				continue
+			}
+
+			path := filepath.Join(dir, strings.TrimRight(name, "\x00"))
+			if path == a.journal.Name() {
+				continue
+			}
+			a.changed(path)
+
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				a.watch(path)
+			}
+		}
+	}
+}
+
+func agentMain(args []string) {
+
+	var journalName, watchStr, skipStr string
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	fs.StringVar(&journalName, "journal", agentJournal, "Journal of changed paths.")
+	fs.StringVar(&watchStr, "w", "/", "Directories to watch. Comma separated.")
+	fs.StringVar(&skipStr, "s", "/proc,/sys,/dev,/run,/tmp", "Directories not to watch. Comma separated.")
+	fs.Parse(args)
+
+	if err := os.MkdirAll(filepath.Dir(journalName), 0700); err != nil {
+		fatalf("Failed to create journal directory. Error: %v\n", err)
+	}
+
+	// Nothing changes while the container is stopped. Anything else means
+	// the agent wasn't running while things could have changed.
+	last := ""
+	if f, err := os.Open(journalName); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			last = scanner.Text()
+		}
+		f.Close()
+	}
+
+	journal, err := os.OpenFile(journalName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fatalf("Failed to open journal %s. Error: %v\n", journalName, err)
+	}
+	defer journal.Close()
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		fatalf("Failed to initialize inotify. Error: %v\n", err)
+	}
+
+	a := &agent{
+		fd:      fd,
+		journal: journal,
+		seen:    make(map[string]bool),
+		watches: make(map[int]string),
+		skip:    make(map[string]bool),
+	}
+	for _, s := range strings.Split(skipStr, ",") {
+		if len(s) > 0 {
+			a.skip[filepath.Clean(s)] = true
+		}
+	}
+
+	if last != journalCleanStop {
+		a.write(journalGap)
+	}
+
+	for _, w := range strings.Split(watchStr, ",") {
+		if len(w) > 0 {
+			a.watch(filepath.Clean(w))
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sig
+		a.write(journalCleanStop)
+		journal.Sync()
+		os.Exit(0)
+	}()
+
+	a.run()
+}
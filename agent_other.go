@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func agentMain(args []string) {
+	fatal("The agent needs inotify and only runs on Linux.")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// anomalyFactor is -size-anomaly. An export or delta this many times
+// bigger or smaller than usual for the container is warned about, 0 means
+// never.
+var anomalyFactor float64
+
+const (
+	// anomalyRuns is how many runs of the history make up usual
+	anomalyRuns = 20
+	// anomalyMinRuns is how many it takes before anything is unusual
+	anomalyMinRuns = 5
+	// anomalyMinBytes is the size below which nothing is unusual, small
+	// deltas come and go
+	anomalyMinBytes = 1 << 20
+)
+
+// medianSize is the median of sizes, which isn't empty.
+func medianSize(sizes []int64) int64 {
+	s := slices.Clone(sizes)
+	slices.Sort(s)
+	return s[len(s)/2]
+}
+
+// unusualSize tells how size differs from the usual of history, "" if it
+// doesn't.
+func unusualSize(size int64, history []int64) string {
+
+	if len(history) < anomalyMinRuns {
+		return ""
+	}
+	usual := medianSize(history)
+	if max(size, usual) < anomalyMinBytes {
+		return ""
+	}
+	switch {
+	case float64(size) > float64(usual)*anomalyFactor:
+		return fmt.Sprintf("%s, more than %g times the usual %s", humanBytes(size), anomalyFactor, humanBytes(usual))
+	case float64(size)*anomalyFactor < float64(usual):
+		return fmt.Sprintf("%s, less than 1/%g of the usual %s", humanBytes(size), anomalyFactor, humanBytes(usual))
+	}
+	return ""
+}
+
+// sizeAnomalies compares the export and the delta, 0 if none, j made in
+// run runID with the run history of j. Runaway logs or encrypted files
+// make deltas big, a broken export is small.
+func sizeAnomalies(lxdBackupPrefix, runID string, j *backupJob) []string {
+
+	if anomalyFactor <= 1 {
+		return nil
+	}
+	var exports, deltas []int64
+	for _, r := range recentRunRecords(lxdBackupPrefix, j.name, anomalyRuns+1) {
+		if r.RunID == runID || r.Status == "failed" {
+			continue
+		}
+		if r.Bytes > 0 {
+			exports = append(exports, r.Bytes)
+		}
+		if r.Delta > 0 {
+			deltas = append(deltas, r.Delta)
+		}
+	}
+
+	var msgs []string
+	if msg := unusualSize(j.exported, exports); len(msg) > 0 && j.exported > 0 {
+		msgs = append(msgs, fmt.Sprintf("Export of %s is %s", j.name, msg))
+	}
+	if msg := unusualSize(j.deltaBytes, deltas); len(msg) > 0 && j.deltaBytes > 0 {
+		msgs = append(msgs, fmt.Sprintf("Delta of %s is %s", j.name, msg))
+	}
+	return msgs
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// useAPI is -api: exports are backups made through the LXD API on its unix
+// socket, downloaded from it and removed from the server afterwards,
+// instead of lxc export.
+var useAPI bool
+
+// lxdAPI is LXD through its unix socket, or -lxd-url, for -api.
+func lxdAPI() *lxdbackup.API {
+	if lxdEndpoint != nil {
+		return &lxdbackup.API{URL: lxdEndpoint.url, TLS: lxdEndpoint.tlsConfig()}
+	}
+	return &lxdbackup.API{Socket: lxdSocket()}
+}
+
+// optimizedDrivers are the storage drivers LXD makes optimized backups for.
+var optimizedDrivers = map[string]bool{"btrfs": true, "zfs": true}
+
+// apiExport is lxcExport through the API. --compression and
+// --optimized-storage of extraArgs are honored, the latter only on pools
+// whose driver supports it.
+func apiExport(name, to string, extraArgs []string, snapshots bool) {
+	slog.Info("Exporting", "container", name, "via", "api")
+
+	api := lxdAPI()
+	compress := compressHere && !hasExportArg(extraArgs, "--compression")
+	o := lxdbackup.BackupOptions{
+		Compression: exportCompression(),
+		// Should lxd-backup die, LXD cleans up by itself
+		Expires:   nowUTC().Add(24 * time.Hour),
+		Snapshots: snapshots,
+	}
+	if hasExportArg(extraArgs, "--compression") {
+		o.Compression = exportFormat(extraArgs)
+	}
+	if hasExportArg(extraArgs, "--optimized-storage") {
+		if pool, err := instancePool(name, ""); err == nil && optimizedDrivers[pool.driver] {
+			o.OptimizedStorage = true
+		} else {
+			slog.Info("Storage pool has no optimized backups, exporting as files", "container", name)
+		}
+	}
+
+	backup := "lxd-backup-" + fileTimestamp(nowUTC())
+	err := retryLxc("backup of "+name, lxcRetries, func() error {
+		last := time.Now()
+		err := api.CreateBackup(name, backup, o, func(progress string) {
+			if time.Since(last) >= 10*time.Second {
+				last = time.Now()
+				slog.Info("Export progress", "container", name, "progress", progress)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := api.DeleteBackup(name, backup); err != nil {
+				slog.Warn("Failed to remove backup from LXD", "container", name, "backup", backup, "error", err)
+			}
+		}()
+
+		w, done := exportSink(to, compress)
+		err = api.ExportBackup(name, backup, w)
+		done(err == nil)
+		if err != nil {
+			checkBudget(name)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		fatalf("Failed to export %s through the LXD API. Error: %v\n", name, err)
+	}
+	slog.Info("Exported", "container", name)
+}
+
+// checkAPI gives up unless -api can be used.
+func checkAPI() {
+	if len(lxcExporter) > 0 {
+		fatal("-api talks to LXD itself and can't be used with -exporter.")
+	}
+	ok, err := lxdAPI().Supports("container_backup")
+	if err != nil {
+		fatalf("Failed to reach the LXD API for -api. Error: %v\n", err)
+	}
+	if !ok {
+		fatal("LXD has no backup API for -api.")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+type archiveReader struct {
+	io.Reader
+	closers []func()
+}
+
+func (a *archiveReader) Close() {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i]()
+	}
+}
+
+// openArchive opens a tarball compressed with zstd, gzip, xz or not at all. The
+// compression is detected from the content, not the filename, since lxc
+// export may have been told to use something else than zstd.
+func openArchive(fname string) *archiveReader {
+	return openArchiveProgress(fname, nil)
+}
+
+// openArchiveProgress is openArchive, counting what is read of the archive
+// file in bar, if not nil.
+func openArchiveProgress(fname string, bar *progressBar) *archiveReader {
+
+	f, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+
+	a := &archiveReader{closers: []func(){func() { f.Close() }}}
+
+	var r io.Reader = throttleReader(f)
+	if bar != nil {
+		r = bar.reader(r)
+	}
+	in, _, err := lxdbackup.NewReader(r)
+	if err != nil {
+		f.Close()
+		fatalf("Failed to read %s. Error: %v\n", fname, err)
+	}
+	a.Reader = in
+	a.closers = append(a.closers, func() { in.Close() })
+	return a
+}
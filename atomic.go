@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Archives and manifests are written to <name>.partial first, synced to
+// disk and only then renamed to their name. A file by the name of a backup
+// is always complete, whether the run crashed or the disk filled up, and
+// what is left over is garbage the next run removes.
+
+// commitPartial syncs partial to disk and renames it to fname.
+func commitPartial(partial, fname string) {
+	f, err := os.Open(partial)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(partial, fname)
+	}
+	if err != nil {
+		fatalf("Failed to write %s. Error: %v\n", fname, err)
+	}
+	// The rename itself is only durable once the directory is synced
+	if d, err := os.Open(filepath.Dir(fname)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// writeFilePartial is os.WriteFile through a .partial file.
+func writeFilePartial(fname string, data []byte, perm os.FileMode) error {
+	if err := os.WriteFile(fname+".partial", data, perm); err != nil {
+		os.Remove(fname + ".partial")
+		return err
+	}
+	commitPartial(fname+".partial", fname)
+	return nil
+}
+
+// removePartials removes what crashed runs left half written.
+func removePartials(lxdBackupPrefix string) {
+	for _, f := range globBackups(filepath.Dir(lxdBackupPrefix), filepath.Base(lxdBackupPrefix)+"*.partial") {
+		slog.Warn("Removing half written file", "file", f)
+		os.Remove(f)
+	}
+}
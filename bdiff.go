@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// signatures reads the signatures of the named files out of a quarter
+// backup, see lxdbackup.WriteDiff.
+func signatures(quarter string, names map[string]bool) map[string]*lxdbackup.BlockSig {
+
+	in := openArchive(quarter)
+	defer in.Close()
+
+	sigs := make(map[string]*lxdbackup.BlockSig)
+	tarreader := tar.NewReader(in)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", quarter, err)
+		}
+		if !names[hdr.Name] {
+			continue
+		}
+		sig, err := lxdbackup.MakeSignature(tarreader)
+		if err != nil {
+			fatalf("Failed to read %s from %s. Error: %v\n", hdr.Name, quarter, err)
+		}
+		sigs[hdr.Name] = sig
+	}
+	return sigs
+}
+
+// extractEntries copies the named files out of a tarball into temporary
+// files in dir, for patches to be applied to.
+func extractEntries(src string, names map[string]bool, dir string) map[string]string {
+
+	in := openArchive(src)
+	defer in.Close()
+
+	files, err := lxdbackup.ExtractEntries(in, names, dir)
+	if err != nil {
+		for _, f := range files {
+			os.Remove(f)
+		}
+		fatalf("Failed to extract from %s. Error: %v\n", src, err)
+	}
+	return files
+}
+
+// patchEntry applies the binary diff of name to base, and writes the result
+// to w. want is its checksum.
+func patchEntry(name, want string, patch io.Reader, base string, w io.Writer) {
+	if err := lxdbackup.PatchEntry(name, want, patch, base, w); err != nil {
+		fatalf("Failed to patch %s. Error: %v\n", name, err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// btrfsSend is -btrfs-send: deltas of containers on btrfs pools are btrfs
+// send streams against a read-only snapshot kept since the quarter backup,
+// instead of tar deltas. Making one needs no export and no hashing, and it
+// has everything of the filesystem, ownership, xattrs and all.
+var btrfsSend bool
+
+// btrfsSnapshotDir is where the snapshots deltas are sent against are kept,
+// in the storage pool, as snapshots must be on the filesystem they are of.
+const btrfsSnapshotDir = "lxd-backup-snapshots"
+
+// lxdDir is where LXD keeps its storage pools mounted.
+func lxdDir() string {
+	if d := os.Getenv("LXD_DIR"); len(d) > 0 {
+		return d
+	}
+	if fileExists("/var/snap/lxd/common/lxd") {
+		return "/var/snap/lxd/common/lxd"
+	}
+	return "/var/lib/lxd"
+}
+
+// btrfsPool is the mount point of the btrfs pool of the container name in
+// project, "" when it isn't on btrfs.
+func btrfsPool(name, project string) string {
+	pool, err := instancePool(name, project)
+	if err != nil || pool.driver != "btrfs" {
+		return ""
+	}
+	return filepath.Join(lxdDir(), "storage-pools", pool.name)
+}
+
+// btrfsVolume is the subvolume of the container name in project, in the
+// pool mounted at pool.
+func btrfsVolume(pool, name, project string) string {
+	if len(project) > 0 && project != "default" {
+		name = project + "_" + name
+	}
+	return filepath.Join(pool, "containers", name)
+}
+
+// btrfsDeltaSuffix is the file name suffix of a btrfs delta in slot d.
+func btrfsDeltaSuffix(d deltaSlot) string {
+	return strings.TrimSuffix(d.suffix, ".tar") + ".btrfs.zst"
+}
+
+func btrfs(args ...string) error {
+	cmd := exec.Command("btrfs", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// btrfsSnapshot makes a read-only snapshot of the subvolume of name.
+func btrfsSnapshot(pool, name string) string {
+	dir := filepath.Join(pool, btrfsSnapshotDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dir, err)
+	}
+	snap := filepath.Join(dir, fileTimestamp(nowUTC()))
+	if err := btrfs("subvolume", "snapshot", "-r", btrfsVolume(pool, name, ""), snap); err != nil {
+		fatalf("Failed to snapshot %s. Error: %v\n", name, err)
+	}
+	return snap
+}
+
+// writeBtrfsStream writes btrfs send of snap, incremental against parent
+// unless it is empty, compressed in -format to dest.
+func writeBtrfsStream(dest, parent, snap string) {
+
+	args := []string{"send", "-q"}
+	if len(parent) > 0 {
+		args = append(args, "-p", parent)
+	}
+	args = append(args, snap)
+
+	f, err := os.OpenFile(dest+".partial", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dest, err)
+	}
+	w, err := newArchiveWriter(throttleWriter(f))
+	if err != nil {
+		fatalf("Failed write %s as %s compressed file. Error: %v\n", dest, archiveFormat, err)
+	}
+
+	cmd := exec.Command("btrfs", args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest + ".partial")
+		fatalf("Failed to run: btrfs %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+	commitPartial(dest+".partial", dest)
+}
+
+// btrfsFull runs before the export of a quarter backup: it replaces the
+// snapshot of the previous quarter with a new one, and stores a full send
+// stream of it next to the quarter backup, as what restore receives the
+// deltas on top of.
+func btrfsFull(j *backupJob, qBackup string) {
+
+	pool := btrfsPool(j.name, "")
+	if len(pool) == 0 {
+		return
+	}
+
+	old, _ := filepath.Glob(filepath.Join(pool, btrfsSnapshotDir, j.name, "*"))
+	for _, o := range old {
+		if err := btrfs("subvolume", "delete", o); err != nil {
+			slog.Warn("Failed to delete old snapshot", "snapshot", o, "error", err)
+		}
+	}
+
+	snap := btrfsSnapshot(pool, j.name)
+	slog.Info("Sending btrfs snapshot", "name", j.name, "snapshot", snap)
+	writeBtrfsStream(qBackup+".btrfs.zst", "", snap)
+	j.manifest.BtrfsSnapshot = snap
+}
+
+// backupBtrfsDelta makes the deltas of a container stopped for its backup
+// as btrfs send streams against the snapshot of the quarter backup. It
+// returns false, to make tar deltas instead, when there is no snapshot.
+func backupBtrfsDelta(j *backupJob, s *schedule, qManifest *manifest) bool {
+
+	if qManifest == nil || len(qManifest.BtrfsSnapshot) == 0 || !fileExists(qManifest.BtrfsSnapshot) {
+		return false
+	}
+	pool := btrfsPool(j.name, "")
+	if len(pool) == 0 {
+		return false
+	}
+
+	j.stage("snapshot")
+	snap := btrfsSnapshot(pool, j.name)
+	defer func() {
+		if err := btrfs("subvolume", "delete", snap); err != nil {
+			slog.Warn("Failed to delete snapshot", "snapshot", snap, "error", err)
+		}
+	}()
+
+	j.stage("start")
+	j.after()
+
+	j.stage("delta")
+	m := *j.manifest
+	m.Format = archiveFormat
+	m.BtrfsSnapshot = ""
+	m.BtrfsParent = filepath.Base(qManifest.BtrfsSnapshot)
+
+	for _, d := range s.deltas {
+		bd := d
+		bd.suffix = btrfsDeltaSuffix(d)
+		dest := backupPrefix(s.prefix, j.name, bd.suffix) + j.name + bd.suffix
+		due := s.tiers.due(s.prefix, j.name, bd)
+		if due {
+			removeBackupFile(dest)
+		}
+		if !fileExists(dest) {
+			slog.Info("Sending btrfs delta", "file", dest)
+			deltaIntent := intents.begin("write", j.name, dest, "")
+			writeBtrfsStream(dest, qManifest.BtrfsSnapshot, snap)
+			writeManifest(dest, &m)
+			intents.done(deltaIntent)
+		}
+		j.files = append(j.files, dest)
+		if due {
+			s.tiers.record(j.name, bd, s.now)
+		}
+		pruneTier(s.prefix, j.name, "-delta.btrfs.zst", d.tier)
+		if st, err := os.Stat(dest); err == nil {
+			j.exported += st.Size()
+		}
+	}
+
+	j.status = "delta"
+	appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+		Bytes: j.exported})
+	slog.Info("Backup done", "name", j.name, "at", displayTime(nowUTC()))
+	return true
+}
+
+// receiveBtrfsDelta replaces the filesystem of the container target, just
+// imported from the quarter backup, with the quarter receiving delta. Both
+// streams are received into the pool of target, and the result snapshotted
+// in place of its subvolume.
+func receiveBtrfsDelta(quarter, delta, target, project string) {
+
+	pool := btrfsPool(target, project)
+	if len(pool) == 0 {
+		fatalf("%s is not on a btrfs storage pool, which btrfs deltas can only be restored onto.\n", target)
+	}
+	m := loadManifest(manifestFile(delta))
+
+	dir := filepath.Join(pool, btrfsSnapshotDir, "restore-"+fileTimestamp(nowUTC()))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dir, err)
+	}
+	var received []string
+	defer func() {
+		for i := len(received) - 1; i >= 0; i-- {
+			btrfs("subvolume", "delete", received[i])
+		}
+		os.Remove(dir)
+	}()
+
+	for _, stream := range []string{quarter + ".btrfs.zst", delta} {
+		slog.Info("Receiving", "file", stream)
+		in := openArchive(stream)
+		cmd := exec.Command("btrfs", "receive", "-q", dir)
+		cmd.Stdin = in
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		in.Close()
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if p := filepath.Join(dir, e.Name()); !slices.Contains(received, p) {
+				received = append(received, p)
+			}
+		}
+		if err != nil {
+			fatalf("Failed to receive %s. Error: %v\n", stream, err)
+		}
+	}
+	// The delta is received next to its parent, under the name of the snapshot
+	if len(received) != 2 || filepath.Base(received[0]) != m.BtrfsParent {
+		fatalf("Receiving %s gave no subvolume on top of %s.\n", delta, m.BtrfsParent)
+	}
+
+	vol := btrfsVolume(pool, target, project)
+	slog.Info("Replacing filesystem", "container", target, "subvolume", vol)
+	if err := btrfs("subvolume", "delete", vol); err != nil {
+		fatalf("Failed to replace the filesystem of %s. Error: %v\n", target, err)
+	}
+	if err := btrfs("subvolume", "snapshot", received[1], vol); err != nil {
+		fatalf("Failed to replace the filesystem of %s. Error: %v\n", target, err)
+	}
+}
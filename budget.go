@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxDuration is -max-duration, how long a container may take unless the
+// config file gives it a max-duration of its own. 0 means forever.
+var maxDuration time.Duration
+
+// budgets are the max-durations of the containers being backed up, by
+// name, with when they are used up.
+var budgets = struct {
+	sync.Mutex
+	m map[string]jobBudget
+}{m: make(map[string]jobBudget)}
+
+type jobBudget struct {
+	deadline time.Time
+	budgetExceeded
+}
+
+// budgetExceeded is what a backup panics with when it runs out of time, to
+// be recovered by backupWithBudget.
+type budgetExceeded struct {
+	name   string
+	budget time.Duration
+}
+
+func (e budgetExceeded) Error() string {
+	return fmt.Sprintf("%s took longer than its max-duration %s, gave up on it", e.name, e.budget)
+}
+
+// checkBudget gives up on the backup of name if it is out of time. The
+// deadline is cleared first, so starting it again is not cut short.
+func checkBudget(name string) {
+	budgets.Lock()
+	b, ok := budgets.m[name]
+	if !ok || nowUTC().Before(b.deadline) {
+		budgets.Unlock()
+		return
+	}
+	delete(budgets.m, name)
+	budgets.Unlock()
+	panic(b.budgetExceeded)
+}
+
+// budgetTimeout is timeout shortened to what is left of the budget of the
+// container args of an lxc command are about.
+func budgetTimeout(timeout time.Duration, args []string) time.Duration {
+	budgets.Lock()
+	defer budgets.Unlock()
+	for _, a := range args {
+		b, ok := budgets.m[a]
+		if !ok {
+			continue
+		}
+		left := max(b.deadline.Sub(nowUTC()), time.Millisecond)
+		if timeout == 0 || left < timeout {
+			return left
+		}
+		return timeout
+	}
+	return timeout
+}
+
+// backupWithBudget runs backup, giving up on it when it takes longer than
+// budget, or when it fails while other containers are backed up in
+// parallel. What was stopped is started again on the way out, and the
+// error says why it was given up on.
+func backupWithBudget(j *backupJob, s *schedule, budget time.Duration) (err error) {
+
+	if budget > 0 {
+		budgets.Lock()
+		budgets.m[j.name] = jobBudget{deadline: nowUTC().Add(budget), budgetExceeded: budgetExceeded{name: j.name, budget: budget}}
+		budgets.Unlock()
+		defer func() {
+			budgets.Lock()
+			delete(budgets.m, j.name)
+			budgets.Unlock()
+		}()
+	}
+	defer func() {
+		r := recover()
+		switch e := r.(type) {
+		case nil:
+		case budgetExceeded:
+			slog.Error(e.Error())
+			j.status = "failed"
+			err = e
+		case fatalError:
+			// Logged already
+			j.status = "failed"
+			err = e
+		default:
+			panic(r)
+		}
+	}()
+	backup(j, s)
+	return nil
+}
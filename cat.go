@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// backupView is a container as one of its backups has it, the quarter backup
+// with a delta on top, as restore would put them together.
+type backupView struct {
+	quarter string
+	delta   string
+	removed map[string]bool
+}
+
+func openView(lxdBackupPrefix, name, deltaName string, rc *retentionConfig) *backupView {
+	v := &backupView{quarter: latestQuarter(lxdBackupPrefix, name, rc)}
+	if len(v.quarter) == 0 {
+		fatalf("No quarter backup of %s found.\n", name)
+	}
+	if len(deltaName) > 0 {
+		v.delta = namedDelta(lxdBackupPrefix, name, deltaName)
+		if isGeneration(v.delta) {
+			if v.quarter = generationQuarter(lxdBackupPrefix, name, v.delta, rc); len(v.quarter) == 0 {
+				fatalf("No quarter backup of %s found for %s.\n", name, filepath.Base(v.delta))
+			}
+		}
+		v.removed = loadRemoved(v.delta + ".removed")
+	}
+	return v
+}
+
+// entryName finds the name in the backup of a path, given as it is in the
+// tarball or as a path inside the container.
+func (v *backupView) entryName(p string) string {
+	names := v.names()
+	if names[p] {
+		return p
+	}
+	if n := rootfsPrefix + "/" + strings.TrimPrefix(p, "/"); names[n] {
+		return n
+	}
+	fatalf("%s is not in the backup.\n", p)
+	return ""
+}
+
+func (v *backupView) names() map[string]bool {
+	names := archiveEntries(v.quarter)
+	if len(v.delta) > 0 {
+		for n := range v.removed {
+			delete(names, n)
+		}
+		for n := range archiveEntries(v.delta) {
+			names[n] = true
+		}
+	}
+	return names
+}
+
+// copyFile writes the content of the entry name to w. Binary diffs are
+// applied to the quarter version.
+func (v *backupView) copyFile(name, tempDir string, w io.Writer) {
+
+	write := func(hdr *tar.Header, r io.Reader) {
+		if hdr.Typeflag != tar.TypeReg {
+			fatalf("%s is not a regular file.\n", name)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			fatalf("Failed to write %s. Error: %v\n", name, err)
+		}
+	}
+
+	if len(v.delta) > 0 {
+		meta := false
+		found := readEntry(v.delta, name, func(hdr *tar.Header, r io.Reader) {
+			if meta = lxdbackup.IsMetaEntry(hdr); meta {
+				return
+			}
+			if _, patched := hdr.PAXRecords[lxdbackup.PAXPatch]; !patched {
+				write(hdr, r)
+				return
+			}
+			bases := extractEntries(v.quarter, map[string]bool{name: true}, tempDir)
+			defer os.Remove(bases[name])
+			patchEntry(name, hdr.PAXRecords[lxdbackup.PAXPatchSum], r, bases[name], w)
+		})
+		if found && !meta {
+			return
+		}
+	}
+	if !readEntry(v.quarter, name, write) {
+		fatalf("%s is not in %s.\n", name, filepath.Base(v.quarter))
+	}
+}
+
+func viewFlags(fs *flag.FlagSet, backupTarget, tempDir, deltaName, configFile *string) {
+	fs.StringVar(backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(tempDir, "t", "", "Temporary directory.")
+	fs.StringVar(deltaName, "d", "", "Delta on top of the quarter backup, IE M10, WN2 or WD3.")
+	fs.StringVar(configFile, "config", "", "JSON config file, for the retention tiers the backups were made with.")
+}
+
+// catMain writes a file out of a backup to stdout.
+func catMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, configFile string
+
+	fs := flag.NewFlagSet("cat", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	viewFlags(fs, &backupTarget, &tempDir, &deltaName, &configFile)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s cat [options] container path\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+
+	conf := loadConfig(configFile)
+	v := openView(filepath.Join(backupTarget, "lxd-backup-"), fs.Arg(0), deltaName, conf.Retention)
+	v.copyFile(v.entryName(fs.Arg(1)), tempDir, os.Stdout)
+}
+
+// findMain lists the files of a backup matching a pattern.
+func findMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, configFile string
+
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	viewFlags(fs, &backupTarget, &tempDir, &deltaName, &configFile)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s find [options] container [pattern]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	pattern := fs.Arg(1)
+	if _, err := path.Match(pattern, ""); err != nil {
+		fatalf("Bad pattern %s. Error: %v\n", pattern, err)
+	}
+
+	conf := loadConfig(configFile)
+	v := openView(filepath.Join(backupTarget, "lxd-backup-"), fs.Arg(0), deltaName, conf.Retention)
+
+	var found []string
+	for n := range v.names() {
+		inside := "/" + strings.TrimPrefix(strings.TrimPrefix(n, rootfsPrefix), "/")
+		if len(pattern) == 0 {
+			found = append(found, n)
+		} else if m, _ := path.Match(pattern, path.Base(n)); m {
+			found = append(found, n)
+		} else if m, _ := path.Match(pattern, inside); m && strings.HasPrefix(n, rootfsPrefix) {
+			found = append(found, n)
+		}
+	}
+	sort.Strings(found)
+	for _, n := range found {
+		fmt.Println(n)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// rbdDiff is -rbd-diff: deltas of containers on ceph pools are rbd
+// export-diff streams against a snapshot of their RBD image kept since the
+// quarter backup, instead of tar deltas.
+var rbdDiff bool
+
+// rbdSnapshotPrefix is what the RBD snapshots lxd-backup makes are named
+// with, after the @.
+const rbdSnapshotPrefix = "lxd-backup-"
+
+// rbdImage is the RBD image of a container, and how to reach its cluster.
+type rbdImage struct {
+	cluster, user string
+	image         string // osd-pool/container_name
+}
+
+// cephImage is the RBD image of the container name in project, nil when it
+// isn't on a ceph pool.
+func cephImage(name, project string) *rbdImage {
+
+	pool, err := instancePool(name, project)
+	if err != nil || pool.driver != "ceph" {
+		return nil
+	}
+	osdPool := pool.config["ceph.osd.pool_name"]
+	if len(osdPool) == 0 {
+		osdPool = pool.name
+	}
+	if len(project) > 0 && project != "default" {
+		name = project + "_" + name
+	}
+	return &rbdImage{
+		cluster: pool.config["ceph.cluster_name"],
+		user:    pool.config["ceph.user.name"],
+		image:   osdPool + "/container_" + name,
+	}
+}
+
+// command is the rbd command args, for the cluster of the image.
+func (r *rbdImage) command(args ...string) *exec.Cmd {
+	var pre []string
+	if len(r.cluster) > 0 {
+		pre = append(pre, "--cluster", r.cluster)
+	}
+	if len(r.user) > 0 {
+		pre = append(pre, "--id", r.user)
+	}
+	cmd := exec.Command("rbd", append(pre, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (r *rbdImage) run(args ...string) error {
+	if err := r.command(args...).Run(); err != nil {
+		return fmt.Errorf("rbd %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// snapshots lists the snapshots of the image lxd-backup made.
+func (r *rbdImage) snapshots() ([]string, error) {
+	out, err := r.command("snap", "ls", "--format", "json", r.image).Output()
+	if err != nil {
+		return nil, fmt.Errorf("rbd snap ls %s: %w", r.image, err)
+	}
+	var snaps []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(out, &snaps); err != nil {
+		return nil, fmt.Errorf("bad snapshots of %s: %w", r.image, err)
+	}
+	var names []string
+	for _, s := range snaps {
+		if strings.HasPrefix(s.Name, rbdSnapshotPrefix) {
+			names = append(names, s.Name)
+		}
+	}
+	return names, nil
+}
+
+func (r *rbdImage) snapshot(prefix string) string {
+	snap := rbdSnapshotPrefix + prefix + fileTimestamp(nowUTC())
+	if err := r.run("snap", "create", r.image+"@"+snap); err != nil {
+		fatalf("Failed to snapshot %s. Error: %v\n", r.image, err)
+	}
+	return snap
+}
+
+// writeDiff writes rbd export-diff of the image at snap, against the
+// snapshot from unless it is empty, compressed in -format to dest.
+func (r *rbdImage) writeDiff(dest, from, snap string) {
+
+	args := []string{"export-diff", "--no-progress"}
+	if len(from) > 0 {
+		args = append(args, "--from-snap", from)
+	}
+	args = append(args, r.image+"@"+snap, "-")
+
+	f, err := os.OpenFile(dest+".partial", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dest, err)
+	}
+	w, err := newArchiveWriter(throttleWriter(f))
+	if err != nil {
+		fatalf("Failed write %s as %s compressed file. Error: %v\n", dest, archiveFormat, err)
+	}
+
+	cmd := r.command(args...)
+	cmd.Stdout = w
+	err = cmd.Run()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest + ".partial")
+		fatalf("Failed to run: rbd %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+	commitPartial(dest+".partial", dest)
+}
+
+// rbdDeltaSuffix is the file name suffix of an RBD delta in slot d.
+func rbdDeltaSuffix(d deltaSlot) string {
+	return strings.TrimSuffix(d.suffix, ".tar") + ".rbd.zst"
+}
+
+// rbdFull runs before the export of a quarter backup: it replaces the
+// snapshot of the previous quarter with a new one, and stores the whole
+// image as of it, as export-diff from the start, next to the quarter backup.
+func rbdFull(j *backupJob, qBackup string) {
+
+	img := cephImage(j.name, "")
+	if img == nil {
+		return
+	}
+
+	old, err := img.snapshots()
+	if err != nil {
+		slog.Warn("Failed to list RBD snapshots", "name", j.name, "error", err)
+		return
+	}
+	for _, o := range old {
+		if err := img.run("snap", "rm", img.image+"@"+o); err != nil {
+			slog.Warn("Failed to remove old RBD snapshot", "snapshot", o, "error", err)
+		}
+	}
+
+	snap := img.snapshot("")
+	slog.Info("Exporting RBD image", "name", j.name, "snapshot", snap)
+	img.writeDiff(qBackup+".rbd.zst", "", snap)
+	j.manifest.RBDSnapshot = snap
+}
+
+// backupRBDDelta is backupBtrfsDelta for containers on ceph pools, with
+// rbd export-diff against the snapshot of the quarter backup.
+func backupRBDDelta(j *backupJob, s *schedule, qManifest *manifest) bool {
+
+	if qManifest == nil || len(qManifest.RBDSnapshot) == 0 {
+		return false
+	}
+	img := cephImage(j.name, "")
+	if img == nil {
+		return false
+	}
+	if have, err := img.snapshots(); err != nil || !slices.Contains(have, qManifest.RBDSnapshot) {
+		slog.Warn("RBD snapshot of the quarter backup is gone, making tar deltas", "name", j.name)
+		return false
+	}
+
+	j.stage("snapshot")
+	snap := img.snapshot("delta-")
+	defer func() {
+		if err := img.run("snap", "rm", img.image+"@"+snap); err != nil {
+			slog.Warn("Failed to remove RBD snapshot", "snapshot", snap, "error", err)
+		}
+	}()
+
+	j.stage("start")
+	j.after()
+
+	j.stage("delta")
+	m := *j.manifest
+	m.Format = archiveFormat
+	m.RBDSnapshot = ""
+	m.RBDParent = qManifest.RBDSnapshot
+
+	for _, d := range s.deltas {
+		rd := d
+		rd.suffix = rbdDeltaSuffix(d)
+		dest := backupPrefix(s.prefix, j.name, rd.suffix) + j.name + rd.suffix
+		due := s.tiers.due(s.prefix, j.name, rd)
+		if due {
+			removeBackupFile(dest)
+		}
+		if !fileExists(dest) {
+			slog.Info("Exporting RBD diff", "file", dest)
+			deltaIntent := intents.begin("write", j.name, dest, "")
+			img.writeDiff(dest, qManifest.RBDSnapshot, snap)
+			writeManifest(dest, &m)
+			intents.done(deltaIntent)
+		}
+		j.files = append(j.files, dest)
+		if due {
+			s.tiers.record(j.name, rd, s.now)
+		}
+		pruneTier(s.prefix, j.name, "-delta.rbd.zst", d.tier)
+		if st, err := os.Stat(dest); err == nil {
+			j.exported += st.Size()
+		}
+	}
+
+	j.status = "delta"
+	appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+		Bytes: j.exported})
+	slog.Info("Backup done", "name", j.name, "at", displayTime(nowUTC()))
+	return true
+}
+
+// importRBDDelta replaces the RBD image of the container target, just
+// imported from the quarter backup, with the quarter image with the delta
+// applied. They are imported into a new image, which is renamed in place of
+// the one of target.
+func importRBDDelta(quarter, delta, target, project string) {
+
+	img := cephImage(target, project)
+	if img == nil {
+		fatalf("%s is not on a ceph storage pool, which RBD deltas can only be restored onto.\n", target)
+	}
+
+	tmp := &rbdImage{cluster: img.cluster, user: img.user, image: img.image + "-lxd-backup-restore"}
+	if err := tmp.run("create", "--size", "1M", "--image-feature", "layering", tmp.image); err != nil {
+		fatalf("Failed to create %s. Error: %v\n", tmp.image, err)
+	}
+	done := false
+	defer func() {
+		if !done {
+			tmp.run("snap", "purge", tmp.image)
+			tmp.run("rm", "--no-progress", tmp.image)
+		}
+	}()
+
+	// Each diff ends in a snapshot, which the next one starts from
+	for _, diff := range []string{quarter + ".rbd.zst", delta} {
+		slog.Info("Importing RBD diff", "file", diff, "image", tmp.image)
+		in := openArchive(diff)
+		cmd := tmp.command("import-diff", "--no-progress", "-", tmp.image)
+		cmd.Stdin = in
+		err := cmd.Run()
+		in.Close()
+		if err != nil {
+			fatalf("Failed to import %s. Error: %v\n", diff, err)
+		}
+	}
+	if err := tmp.run("snap", "purge", tmp.image); err != nil {
+		fatalf("Failed to remove the snapshots of %s. Error: %v\n", tmp.image, err)
+	}
+
+	slog.Info("Replacing RBD image", "container", target, "image", img.image)
+	if err := img.run("snap", "purge", img.image); err != nil {
+		fatalf("Failed to replace the image of %s. Error: %v\n", target, err)
+	}
+	if err := img.run("rm", "--no-progress", img.image); err != nil {
+		fatalf("Failed to replace the image of %s. Error: %v\n", target, err)
+	}
+	if err := tmp.run("rename", tmp.image, img.image); err != nil {
+		fatalf("Failed to rename %s to %s. Error: %v\n", tmp.image, img.image, err)
+	}
+	done = true
+}
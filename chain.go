@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chainProblems returns what is wrong with the chains of name, the full
+// backups and the deltas restored on top of them, one line per problem.
+// The archives themselves are for verify to look into.
+func chainProblems(lxdBackupPrefix, name string, rc *retentionConfig) []string {
+
+	var problems []string
+	problem := func(fname, format string, args ...any) {
+		problems = append(problems, filepath.Base(fname)+": "+fmt.Sprintf(format, args...))
+	}
+
+	// sidecars checks the files an archive is restored with, and returns its
+	// manifest
+	sidecars := func(fname string, delta bool) *manifest {
+		m := readManifest(fname)
+		if m == nil {
+			problem(fname, "no manifest")
+		}
+		if delta && !fileExists(fname+".removed") {
+			problem(fname, "no list of removed files, %s", filepath.Base(fname+".removed"))
+		}
+		if m != nil && len(m.Profiles) > 0 {
+			// Older versions wrote one for all profiles, named after all of them
+			have := make(map[string]bool)
+			profiles, _ := filepath.Glob(fname + ".*.profile")
+			for _, p := range profiles {
+				for _, n := range strings.Fields(strings.TrimSuffix(strings.TrimPrefix(p, fname+"."), ".profile")) {
+					have[n] = true
+				}
+			}
+			for _, p := range m.Profiles {
+				if !have[p.Name] {
+					problem(fname, "no profile %s", p.Name)
+				}
+			}
+		}
+		return m
+	}
+
+	fulls := tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full)
+	fullSHA256 := make(map[string]string)
+	for _, f := range fulls {
+		if m := sidecars(f, false); m != nil {
+			fullSHA256[f] = m.SHA256
+		}
+	}
+
+	for i := range rc.Deltas {
+		tc := &rc.Deltas[i]
+		for _, d := range append(tierFiles(lxdBackupPrefix, name, "-delta.tar", tc), tierGenerations(lxdBackupPrefix, name, tc)...) {
+			m := sidecars(d, true)
+
+			// Restore applies a delta to the newest full backup, a generation to
+			// the newest one made before it
+			var full string
+			if isGeneration(d) {
+				full = generationQuarter(lxdBackupPrefix, name, d, rc)
+			} else if len(fulls) > 0 {
+				full = fulls[0]
+			}
+			if len(full) == 0 {
+				problem(d, "no full backup to apply it to")
+				continue
+			}
+			dst, derr := os.Stat(d)
+			fst, ferr := os.Stat(full)
+			if derr == nil && ferr == nil && dst.ModTime().Before(fst.ModTime()) {
+				problem(d, "made before %s it applies to", filepath.Base(full))
+			}
+			if m != nil && len(m.FullSHA256) > 0 && len(fullSHA256[full]) > 0 && m.FullSHA256 != fullSHA256[full] {
+				problem(d, "made against a full backup with sha256 %s, %s has %s", m.FullSHA256, filepath.Base(full), fullSHA256[full])
+			}
+		}
+	}
+	return problems
+}
+
+// checkChainMain is lxd-backup check-chain, which finds the deltas that
+// can't be restored, before they are needed.
+func checkChainMain(args []string) {
+
+	var backupTarget, configFile, contExcStr, contIncStr string
+
+	fs := flag.NewFlagSet("check-chain", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups are made with.")
+	fs.StringVar(&contExcStr, "ec", "", "Containers to leave out. Comma separated.")
+	fs.StringVar(&contIncStr, "ic", "", "Only these containers. Comma separated.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-chain [options] -b dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(backupTarget) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	rc := loadConfig(configFile).Retention
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	names := historyNames(lxdBackupPrefix)
+	if len(contIncStr) > 0 {
+		names = strings.Split(contIncStr, ",")
+	}
+	exclude := make(map[string]bool)
+	for _, n := range strings.Split(contExcStr, ",") {
+		exclude[n] = true
+	}
+
+	checked, broken := 0, 0
+	for _, name := range names {
+		if exclude[name] {
+			continue
+		}
+		checked++
+		problems := chainProblems(lxdBackupPrefix, name, rc)
+		for _, p := range problems {
+			fmt.Printf("BROKEN %s: %s\n", name, p)
+		}
+		if len(problems) > 0 {
+			broken++
+		}
+	}
+	if broken > 0 {
+		fatalf("The chains of %d of %d containers are broken.\n", broken, checked)
+	}
+	fmt.Printf("The chains of all %d containers are intact.\n", checked)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"log/slog"
+	"os"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// changeDetector decides which files of a delta export have not changed
+// since the quarter backup, and can keep their checksum without hashing
+// them again. Hashing everything is always correct, a detector only has to
+// be right about the files it says are unchanged.
+type changeDetector interface {
+	// full runs before the export of a new quarter backup.
+	full(j *backupJob)
+	// delta runs before the export of a delta, and returns which files are
+	// unchanged, or nil to hash them all.
+	delta(j *backupJob, s *schedule, quarter *manifest) func(hdr *tar.Header) bool
+}
+
+// changeDetectors are what the change-detection of the config file selects.
+var changeDetectors = map[string]changeDetector{
+	"hash":  hashDetector{},
+	"agent": agentDetector{},
+	"mtime": mtimeDetector{},
+	"zfs":   zfsDetector{},
+}
+
+// defaultDetector is for containers without change-detection in the config
+// file. It uses the agent journal when there is an agent, -fast makes it
+// mtime.
+var defaultDetector = "agent"
+
+// hashDetector hashes every file.
+type hashDetector struct{}
+
+func (hashDetector) full(j *backupJob) {}
+
+func (hashDetector) delta(j *backupJob, s *schedule, quarter *manifest) func(hdr *tar.Header) bool {
+	return nil
+}
+
+// agentDetector trusts the journal of the agent in the container, see
+// journal.go, and hashes everything without one.
+type agentDetector struct{}
+
+func (agentDetector) full(j *backupJob) {
+	j.manifest.JournalEpoch = resetJournal(j.name)
+}
+
+func (agentDetector) delta(j *backupJob, s *schedule, quarter *manifest) func(hdr *tar.Header) bool {
+	changed := journalChanges(j.name, quarter.JournalEpoch)
+	if changed == nil {
+		return nil
+	}
+	slog.Info("Using agent journal", "name", j.name, "changed", len(changed))
+	return func(hdr *tar.Header) bool { return !journalCovers(changed, hdr.Name) }
+}
+
+// mtimeDetector trusts files with the size and mtime they had in the quarter
+// backup to be unchanged, like rsync does. Something that changes a file and
+// puts its mtime back goes unnoticed, so every file is hashed anyway when
+// that was last done longer ago than -fast-scrub.
+type mtimeDetector struct{}
+
+func (mtimeDetector) full(j *backupJob) {}
+
+func (mtimeDetector) delta(j *backupJob, s *schedule, quarter *manifest) func(hdr *tar.Header) bool {
+
+	qBackup := findArchive(backupPrefix(s.prefix, j.name, s.quarter) + j.name + s.quarter)
+	if !fileExists(qBackup + ".stat") {
+		return nil
+	}
+
+	scrubbed := lastRun(s.prefix, j.name, func(r *runRecord) bool { return r.Status == "full" || r.Scrub })
+	if s.scrubEvery > 0 && s.now.Sub(scrubbed) >= s.scrubEvery {
+		slog.Info("Hashing every file", "name", j.name, "last", displayTime(scrubbed))
+		return nil
+	}
+
+	stats := loadFileStats(qBackup + ".stat")
+	slog.Info("Using size and mtime", "name", j.name)
+	return func(hdr *tar.Header) bool {
+		st, ok := stats[hdr.Name]
+		return ok && st.Size == hdr.Size && st.MTime == hdr.ModTime.UnixNano()
+	}
+}
+
+func writeFileStats(out string, stats map[string]lxdbackup.FileStat) {
+
+	f, err := os.OpenFile(out, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fatalf("Failed to create stat file %s. Error: %v\n", out, err)
+	}
+	defer f.Close()
+
+	if err := lxdbackup.WriteStats(f, stats); err != nil {
+		fatalf("Fail to write stats to csv %s. Error: %v\n", out, err)
+	}
+}
+
+func loadFileStats(fname string) map[string]lxdbackup.FileStat {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		fatalf("Failed to open: %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+
+	stats, err := lxdbackup.ReadStats(f)
+	if err != nil {
+		fatalf("Failed to decode csv in %s. Error: %v\n", fname, err)
+	}
+	return stats
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"hash"
+	"os"
+	"runtime"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// hasher is a checksum algorithm for change detection. The crypto package
+// picks hardware accelerated implementations by itself when the CPU has
+// them, cpuFlags only tells which ones it will find.
+type hasher struct {
+	name     string
+	new      func() hash.Hash
+	cpuFlags map[string][]string
+}
+
+// hashCPUFlags are the CPU flags of the hardware accelerated
+// implementations of the checksum algorithms.
+var hashCPUFlags = map[string]map[string][]string{
+	"sha1": {
+		"amd64": {"sha_ni"},
+		"arm64": {"sha1"},
+	},
+	"sha256": {
+		"amd64": {"sha_ni"},
+		"arm64": {"sha2"},
+	},
+	"sha512": {
+		"amd64": {"avx2"},
+		"arm64": {"sha512"},
+	},
+}
+
+var hashers = make(map[string]*hasher)
+
+func init() {
+	for _, n := range lxdbackup.HasherNames() {
+		h, _ := lxdbackup.LookupHasher(n)
+		hashers[n] = &hasher{name: n, new: h.New, cpuFlags: hashCPUFlags[n]}
+	}
+}
+
+func lookupHasher(name string) *hasher {
+
+	h, err := lxdbackup.LookupHasher(name)
+	if err != nil {
+		fatalf("Unknown checksum algorithm %s. Supported: %s\n", name, strings.Join(lxdbackup.HasherNames(), ", "))
+	}
+	return hashers[h.Name()]
+}
+
+// suffix is the extension of the checksum file next to a quarter backup.
+func (h *hasher) suffix() string {
+	return "." + h.name + "sum"
+}
+
+// implementation describes which implementation the crypto package will use on this CPU.
+func (h *hasher) implementation() string {
+
+	flags := h.cpuFlags[runtime.GOARCH]
+	if len(flags) == 0 {
+		return h.name + " (generic)"
+	}
+
+	d, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return h.name + " (unknown)"
+	}
+
+	for _, l := range strings.Split(string(d), "\n") {
+		k, v, found := strings.Cut(l, ":")
+		k = strings.TrimSpace(k)
+		if !found || (k != "flags" && k != "Features") {
+			continue
+		}
+		have := make(map[string]bool)
+		for _, f := range strings.Fields(v) {
+			have[f] = true
+		}
+		for _, f := range flags {
+			if !have[f] {
+				return h.name + " (generic)"
+			}
+		}
+		return h.name + " (hardware accelerated, " + strings.Join(flags, ", ") + ")"
+	}
+	return h.name + " (generic)"
+}
+
+// hashWorkers is how many files are hashed at the same time, set by
+// -hash-jobs.
+var hashWorkers = runtime.NumCPU()
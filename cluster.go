@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+const (
+	// lockKey is the project config key locking an instance, with its name
+	// after a dot. Instance config would be exported along, and imported
+	// locked again. Older versions set it on the instance.
+	lockKey = "user.lxd-backup.lock"
+
+	// A lock older than this is left over from a crashed run
+	lockTimeout = 12 * time.Hour
+)
+
+type clusterInfo struct {
+	clustered bool
+	member    string
+	lockValue string
+}
+
+func lxdCluster() *clusterInfo {
+
+	// The hosts are on their own, this machine needn't have an LXD
+	if len(pullHosts) > 0 {
+		name, _ := os.Hostname()
+		return &clusterInfo{member: name, lockValue: fmt.Sprintf("%s %d %s", name, os.Getpid(), timestamp(nowUTC()))}
+	}
+
+	out, err := lxcOutput("query", "/1.0")
+	if err != nil {
+		fatalf("Failed to run: lxc query /1.0. Error: %v\n", err)
+	}
+
+	var server struct {
+		Environment struct {
+			ServerClustered bool   `json:"server_clustered"`
+			ServerName      string `json:"server_name"`
+		} `json:"environment"`
+	}
+	if err := json.Unmarshal(out, &server); err != nil {
+		fatalf("Failed to decode server information. Error: %v\n", err)
+	}
+
+	return &clusterInfo{
+		clustered: server.Environment.ServerClustered,
+		member:    server.Environment.ServerName,
+		lockValue: fmt.Sprintf("%s %d %s", server.Environment.ServerName, os.Getpid(), timestamp(nowUTC())),
+	}
+}
+
+// filterLocal keeps the containers running on this cluster member.
+func filterLocal(containers []*containerState, member string) []*containerState {
+
+	ctmp := make([]*containerState, 0, len(containers))
+
+	for i := range containers {
+		if containers[i].host == member {
+			ctmp = append(ctmp, containers[i])
+		}
+	}
+	return ctmp
+}
+
+// instanceLockKey is the project config key locking name.
+func instanceLockKey(name string) string {
+	return lockKey + "." + name
+}
+
+// lockInstance marks an instance as being backed up, in the cluster wide
+// config of its project, so that other members running lxd-backup leave it
+// alone. The project is only updated if it still has the ETag it was read
+// with, so of two members locking it at once one fails.
+func (ci *clusterInfo) lockInstance(name string) bool {
+
+	if !ci.clustered {
+		return true
+	}
+	if len(lxcExporter) > 0 {
+		return ci.lockInstanceLxc(name)
+	}
+
+	api, key := lxdAPI(), instanceLockKey(name)
+	p, etag, err := api.GetProject(lxcProject())
+	if err != nil {
+		slog.Warn("Skipping, failed to lock it", "container", name, "error", err)
+		return false
+	}
+	if !ci.lockFree(name, p.Config[key]) {
+		return false
+	}
+	p.Config[key] = ci.lockValue
+	if err := api.UpdateProject(lxcProject(), p, etag); errors.Is(err, lxdbackup.ErrChanged) {
+		slog.Info("Skipping, lost the lock", "container", name)
+		return false
+	} else if err != nil {
+		slog.Warn("Skipping, failed to lock it", "container", name, "error", err)
+		return false
+	}
+	return true
+}
+
+// lockFree tells whether the lock of name, held, is free or left over.
+func (ci *clusterInfo) lockFree(name, held string) bool {
+	held = strings.TrimSpace(held)
+	if len(held) == 0 {
+		return true
+	}
+	f := strings.Fields(held)
+	t, err := time.Parse(time.RFC3339, f[len(f)-1])
+	if err != nil || nowUTC().Sub(t) < lockTimeout {
+		slog.Info("Skipping, it is being backed up by another member", "container", name, "member", f[0])
+		return false
+	}
+	slog.Warn("Taking over stale lock", "container", name, "member", f[0])
+	return true
+}
+
+// lockInstanceLxc is lockInstance through the exporter, which only runs
+// lxc. It has no If-Match, the lock is set and read back, and of two
+// members locking it at once the last one wins.
+func (ci *clusterInfo) lockInstanceLxc(name string) bool {
+
+	key := instanceLockKey(name)
+	if !ci.lockFree(name, execLxc([]string{"project", "get", lxcProject(), key})) {
+		return false
+	}
+	if err := lxcRun("project", "set", lxcProject(), key, ci.lockValue); err != nil {
+		slog.Warn("Skipping, failed to lock it", "container", name, "error", err)
+		return false
+	}
+	if held := strings.TrimSpace(execLxc([]string{"project", "get", lxcProject(), key})); held != ci.lockValue {
+		slog.Info("Skipping, lost the lock", "container", name, "lock", held)
+		return false
+	}
+	return true
+}
+
+func (ci *clusterInfo) unlockInstance(name string) {
+
+	if !ci.clustered {
+		return
+	}
+	if err := lxcRun("project", "unset", lxcProject(), instanceLockKey(name)); err != nil {
+		slog.Warn("Failed to unlock", "container", name, "error", err)
+	}
+}
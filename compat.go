@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// indexKeys lists top level keys of backup/index.yaml and the LXD release
+// that introduced them. Older servers refuse to import an index with keys
+// they don't know about.
+var indexKeys = map[string]string{
+	"type":             "4.0",
+	"optimized_header": "4.0",
+	"config":           "4.11",
+}
+
+// lxdServerVersion returns the version of the LXD server lxc talks to.
+func lxdServerVersion() string {
+	return lxdRemoteVersion("")
+}
+
+// lxdRemoteVersion is lxdServerVersion of an lxc remote, the default one
+// when empty.
+func lxdRemoteVersion(remote string) string {
+
+	args := []string{"version"}
+	if len(remote) > 0 {
+		args = append(args, remote+":")
+	}
+	out, err := lxcOutput(args...)
+	if err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+	for _, l := range strings.Split(string(out), "\n") {
+		if v, found := strings.CutPrefix(l, "Server version:"); found {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// compareVersions returns -1, 0 or 1 when a is older, the same or newer than b.
+func compareVersions(a, b string) int {
+
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var av, bv int
+		if i < len(as) {
+			av, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bv, _ = strconv.Atoi(bs[i])
+		}
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+	}
+	return 0
+}
+
+// compatRewrites checks whether the backup described by m can be imported on
+// LXD version to, and returns the rewrites needed for that. It gives
+// up early when the backup can't be made to work.
+func compatRewrites(m *manifest, to string) map[string]func([]byte) []byte {
+
+	if m == nil || len(m.LXDVersion) == 0 || len(to) == 0 || compareVersions(m.LXDVersion, to) <= 0 {
+		return nil
+	}
+
+	slog.Info("Backup was made with a newer LXD", "name", m.Container, "backup-version", m.LXDVersion, "server-version", to)
+
+	if hasExportArg(m.ExportArgs, "--optimized-storage") {
+		fatalf("%s was exported with --optimized-storage which only imports on the same storage driver and LXD version %s or newer.\n", m.Container, m.LXDVersion)
+	}
+	if hasExportArg(m.ExportArgs, "--export-version") {
+		fatalf("%s was exported with an explicit --export-version, which LXD %s may not understand. Restore it on LXD %s or newer.\n", m.Container, to, m.LXDVersion)
+	}
+
+	var strip []string
+	for k, v := range indexKeys {
+		if compareVersions(v, to) > 0 {
+			strip = append(strip, k)
+		}
+	}
+	if len(strip) == 0 {
+		return nil
+	}
+
+	return map[string]func([]byte) []byte{
+		"backup/index.yaml": func(d []byte) []byte {
+			slog.Info("Removing keys from index.yaml", "keys", strings.Join(strip, ","), "server-version", to)
+			return stripYamlKeys(d, strip)
+		},
+	}
+}
+
+// addRewrites returns the rewrites of a followed by those of b.
+func addRewrites(a, b map[string]func([]byte) []byte) map[string]func([]byte) []byte {
+	if a == nil {
+		return b
+	}
+	for n, fb := range b {
+		if fa, ok := a[n]; ok {
+			a[n] = func(d []byte) []byte { return fb(fa(d)) }
+		} else {
+			a[n] = fb
+		}
+	}
+	return a
+}
+
+// instanceVolatile matches volatile keys that identify an instance, and
+// would clash with the original if restored next to it: its UUIDs, MAC
+// addresses and host side interface names.
+var instanceVolatile = regexp.MustCompile(`^\s*volatile\.(uuid(\.generation)?|[^.:]+\.(hwaddr|host_name)|cloud-init\.instance-id):`)
+
+// renameRewrites rewrites the metadata of a backup of the instance from, so
+// it imports as to: the name in index.yaml and backup.yaml, and the volatile
+// keys LXD makes again for a new instance.
+func renameRewrites(from, to string) map[string]func([]byte) []byte {
+
+	rename := func(d []byte) []byte {
+		var out strings.Builder
+		for _, l := range strings.SplitAfter(string(d), "\n") {
+			t := strings.TrimSpace(l)
+			if instanceVolatile.MatchString(l) {
+				continue
+			}
+			if t == "name: "+from {
+				l = strings.Replace(l, "name: "+from, "name: "+to, 1)
+			}
+			out.WriteString(l)
+		}
+		return []byte(out.String())
+	}
+
+	slog.Info("Renaming instance in backup", "from", from, "to", to)
+	return map[string]func([]byte) []byte{
+		"backup/index.yaml":                  rename,
+		"backup/container/backup.yaml":       rename,
+		"backup/virtual-machine/backup.yaml": rename,
+	}
+}
+
+// stripYamlKeys removes top level keys and everything nested below them.
+func stripYamlKeys(d []byte, keys []string) []byte {
+
+	var out strings.Builder
+	skipping := false
+
+	for _, l := range strings.SplitAfter(string(d), "\n") {
+		nested := strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") || strings.HasPrefix(l, "- ")
+		if !nested {
+			skipping = false
+			for _, k := range keys {
+				if strings.HasPrefix(l, k+":") {
+					skipping = true
+				}
+			}
+		}
+		if !skipping {
+			out.WriteString(l)
+		}
+	}
+	return []byte(out.String())
+}
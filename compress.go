@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// archiveFormats are the compressions of -format.
+var archiveFormats = lxdbackup.FormatNames()
+
+// archiveFormat is the compression of the archives lxd-backup makes, and
+// of exports unless export-args say otherwise.
+var archiveFormat = "zstd"
+
+// compressionLevel is the level of -compression-level, 1 to 19 for zstd
+// and 1 to 9 for gzip and xz. 0 is the default of the format.
+var compressionLevel int
+
+// compressionThreads is how many cores zstd and xz compress on, 0 is all of
+// them.
+var compressionThreads int
+
+// compressHere is -compress-here, exports are made uncompressed and
+// compressed by lxd-backup as they are written.
+var compressHere bool
+
+func validateFormat() {
+	f, err := lxdbackup.LookupFormat(archiveFormat)
+	if err != nil {
+		fatalf("Unknown -format %s. Supported: %s\n", archiveFormat, strings.Join(archiveFormats, ", "))
+	}
+	top := f.MaxLevel()
+	if compressionLevel < 0 || compressionLevel > top {
+		fatalf("Bad -compression-level %d for %s. Must be 0 to %d, 0 is the %s default.\n", compressionLevel, archiveFormat, top, archiveFormat)
+	}
+	if archiveFormat == "xz" {
+		if _, err := exec.LookPath("xz"); err != nil {
+			fatal("The xz binary is needed for -format xz.")
+		}
+	}
+}
+
+// exportCompression is the --compression of lxc export. LXD runs the
+// compressor named, with the arguments given.
+func exportCompression() string {
+	if compressHere || archiveFormat == "none" {
+		return "none"
+	}
+	c := archiveFormat
+	if compressionLevel > 0 {
+		c += fmt.Sprintf(" -%d", compressionLevel)
+	}
+	if archiveFormat != "gzip" && (compressionLevel > 0 || compressionThreads > 0) {
+		c += fmt.Sprintf(" -T%d", compressionThreads)
+	}
+	return c
+}
+
+// exportFormat is the compression an export made with args gets.
+func exportFormat(args []string) string {
+	for i, a := range args {
+		if v, found := strings.CutPrefix(a, "--compression="); found {
+			return v
+		}
+		if a == "--compression" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return archiveFormat
+}
+
+// archiveName is the archive stem, the name up to .tar, IE
+// lxd-backup-web-Q20264.tar, named for format, IE lxd-backup-web-Q20264.tar.gz
+// for gzip.
+func archiveName(stem, format string) string {
+	name, _, _ := strings.Cut(format, " ") // --compression may have arguments
+	f, err := lxdbackup.LookupFormat(name)
+	if err != nil {
+		f, _ = lxdbackup.LookupFormat("zstd")
+	}
+	return stem + f.Ext()
+}
+
+// findArchive returns the archive of stem in whatever format it was made,
+// or named for -format when there is none. A stem not ending in .tar, IE of
+// a btrfs send stream, is the file itself.
+func findArchive(stem string) string {
+	if !strings.HasSuffix(stem, ".tar") {
+		return stem
+	}
+	for _, ext := range lxdbackup.ArchiveExts() {
+		if fileExists(stem + ext) {
+			return stem + ext
+		}
+	}
+	return archiveName(stem, archiveFormat)
+}
+
+// detectFormat returns the format the archive fname is compressed in,
+// told by what it starts with.
+func detectFormat(fname string) string {
+	f, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+	r, format, err := lxdbackup.NewReader(f)
+	if err != nil {
+		fatalf("Failed to read %s. Error: %v\n", fname, err)
+	}
+	r.Close()
+	return format.Name()
+}
+
+// archiveStem is lxdbackup.ArchiveStem of a file name, the file name as it
+// is when it isn't an archive.
+func archiveStem(fname string) string {
+	stem, _ := lxdbackup.ArchiveStem(fname)
+	return stem
+}
+
+// archiveFile matches the name of an archive, or of a file next to one,
+// IE x.tar.zst.md5sum, up to the end of the archive name.
+var archiveFile = regexp.MustCompile(`^(.*?\.tar` + lxdbackup.ArchiveExtPattern() + `)(?:\..*)?$`)
+
+// archiveOf returns the archive the file fname is, or is next to.
+func archiveOf(fname string) (string, bool) {
+	m := archiveFile.FindStringSubmatch(fname)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+func formatOptions() lxdbackup.FormatOptions {
+	return lxdbackup.FormatOptions{Level: compressionLevel, Threads: compressionThreads}
+}
+
+// newZstdWriter is a zstd writer with the level and threads of the command
+// line.
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	f, _ := lxdbackup.LookupFormat("zstd")
+	return f.NewWriter(w, formatOptions())
+}
+
+// newArchiveWriter compresses what is written to w in -format.
+func newArchiveWriter(w io.Writer) (io.WriteCloser, error) {
+	f, err := lxdbackup.LookupFormat(archiveFormat)
+	if err != nil {
+		return nil, err
+	}
+	return f.NewWriter(w, formatOptions())
+}
+
+// countingWriter counts what goes through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts what is read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressionRatio is how many times smaller than the tarball an archive is.
+func compressionRatio(tarSize int64, archive string) float64 {
+	st, err := os.Stat(archive)
+	if err != nil || st.Size() == 0 {
+		return 0
+	}
+	return float64(tarSize) / float64(st.Size())
+}
+
+func logCompression(archive string, tarSize int64) float64 {
+	ratio := compressionRatio(tarSize, archive)
+	slog.Info("Compressed", "file", archive, "tar", humanBytes(tarSize), "ratio", fmt.Sprintf("%.2f", ratio))
+	return ratio
+}
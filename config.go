@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+type containerConfig struct {
+	ExportArgs      []string `json:"export-args"`
+	ChangeDetection string   `json:"change-detection"`
+	// MaxDuration is -max-duration for this container, IE 2h.
+	MaxDuration string `json:"max-duration"`
+	// Priority orders the containers of a run, highest first.
+	Priority *int `json:"priority"`
+	// Exclude are paths left out of the backups, see pathFilter.
+	Exclude []string `json:"exclude"`
+	// Include are the only paths backed up, see pathFilter.
+	Include []string `json:"include"`
+	// DeltaMaxFileSize and DeltaSkip leave changed files out of deltas,
+	// see deltaSkip.
+	DeltaMaxFileSize string   `json:"delta-max-file-size"`
+	DeltaSkip        []string `json:"delta-skip"`
+	// Snapshots is -snapshots for this container.
+	Snapshots *bool `json:"snapshots"`
+	// Live is -live for this container.
+	Live *bool `json:"live"`
+	// Freeze is -freeze for this container.
+	Freeze *bool `json:"freeze"`
+
+	maxDuration      time.Duration
+	deltaMaxFileSize int64
+}
+
+// config is the optional JSON file given with -config. Command line flags
+// still cover everything that isn't per container.
+type config struct {
+	Containers map[string]containerConfig `json:"containers"`
+	Notify     notifyConfig               `json:"notify"`
+	Retention  *retentionConfig           `json:"retention"`
+	Hosts      map[string]hostConfig      `json:"hosts"`
+}
+
+// exportFlags lists the lxc export flags that may be passed through, and
+// which values they accept. A nil list means the flag takes no value.
+var exportFlags = map[string][]string{
+	"--compression":       {"zstd", "gzip", "xz", "none"},
+	"--export-version":    {},
+	"--optimized-storage": nil,
+}
+
+func loadConfig(fname string) *config {
+
+	conf := &config{}
+
+	if len(fname) == 0 {
+		conf.Retention = lxdbackup.DefaultRetention()
+		return conf
+	}
+
+	d, err := os.ReadFile(fname)
+	if err != nil {
+		fatalf("Failed to read config %s. Error: %v\n", fname, err)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(d)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		fatalf("Failed to decode config %s. Error: %v\n", fname, err)
+	}
+
+	if conf.Retention == nil {
+		conf.Retention = lxdbackup.DefaultRetention()
+	}
+	validateRetention(conf.Retention)
+	validateHosts(conf.Hosts)
+
+	for name, c := range conf.Containers {
+		validateExportArgs(name, c.ExportArgs)
+		// An optimized export is one image of the storage, that deltas can't
+		// be made from file by file
+		if hasExportArg(c.ExportArgs, "--optimized-storage") && len(conf.Retention.Deltas) > 0 {
+			fatalf("Export argument --optimized-storage for %s only works with full backups, IE a retention without deltas.\n", name)
+		}
+		if _, ok := changeDetectors[c.ChangeDetection]; !ok && len(c.ChangeDetection) > 0 {
+			fatalf("Unknown change-detection %s for %s.\n", c.ChangeDetection, name)
+		}
+		if len(c.MaxDuration) > 0 {
+			d, err := time.ParseDuration(c.MaxDuration)
+			if err != nil || d <= 0 {
+				fatalf("Bad max-duration %s for %s.\n", c.MaxDuration, name)
+			}
+			c.maxDuration = d
+			conf.Containers[name] = c
+		}
+		if len(c.DeltaMaxFileSize) > 0 {
+			n, err := parseSize(c.DeltaMaxFileSize)
+			if err != nil {
+				fatalf("Bad delta-max-file-size %s for %s.\n", c.DeltaMaxFileSize, name)
+			}
+			c.deltaMaxFileSize = n
+			conf.Containers[name] = c
+		}
+	}
+	return conf
+}
+
+func (conf *config) container(name string) containerConfig {
+	c := conf.Containers[name]
+	if len(c.ChangeDetection) == 0 {
+		c.ChangeDetection = defaultDetector
+	}
+	return c
+}
+
+func validateExportArgs(name string, args []string) {
+
+	for i := 0; i < len(args); i++ {
+		arg, value, hasValue := strings.Cut(args[i], "=")
+
+		values, known := exportFlags[arg]
+		if !known {
+			fatalf("Export argument %s for %s is not supported.\n", args[i], name)
+		}
+
+		if values == nil {
+			if hasValue {
+				fatalf("Export argument %s for %s takes no value.\n", arg, name)
+			}
+			continue
+		}
+
+		if !hasValue {
+			if i+1 == len(args) {
+				fatalf("Export argument %s for %s needs a value.\n", arg, name)
+			}
+			i++
+			value = args[i]
+		}
+
+		if len(values) == 0 {
+			continue
+		}
+		ok := false
+		for _, v := range values {
+			ok = ok || v == value
+		}
+		if !ok {
+			fatalf("Bad value %s for export argument %s for %s. Supported: %s\n", value, arg, name, strings.Join(values, ", "))
+		}
+	}
+}
+
+func hasExportArg(args []string, flag string) bool {
+	for _, a := range args {
+		if a == flag || strings.HasPrefix(a, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
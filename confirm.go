@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// confirmOptions are the -yes and -dry-run flags every subcommand that
+// removes or replaces backups has.
+type confirmOptions struct {
+	yes    bool
+	dryRun bool
+}
+
+func addConfirmFlags(fs *flag.FlagSet) *confirmOptions {
+	o := &confirmOptions{}
+	fs.BoolVar(&o.yes, "yes", false, "Go ahead without asking.")
+	fs.BoolVar(&o.dryRun, "dry-run", false, "Only print what would be done.")
+	return o
+}
+
+// confirm prints what is about to be done and tells whether to go ahead.
+// Without -yes it asks, and gives up unless there is a terminal to ask on.
+func (o *confirmOptions) confirm(what string, affected []string) bool {
+
+	fmt.Printf("%s:\n", what)
+	for _, a := range affected {
+		fmt.Printf("  %s\n", a)
+	}
+
+	if o.dryRun {
+		fmt.Println("Dry run, nothing was done.")
+		return false
+	}
+	if o.yes {
+		return true
+	}
+
+	if st, err := os.Stdin.Stat(); err != nil || st.Mode()&os.ModeCharDevice == 0 {
+		fatal("Not asking without a terminal, give -yes to go ahead.")
+	}
+	fmt.Print("Go ahead? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// copySidecars copies the profiles next to a delta to the same names next
+// to dest. The list of removed files, the index, the parts and the parity
+// only belong to the delta, and the manifest is written for dest.
+func copySidecars(delta, dest string) {
+	for _, f := range sidecarFiles(delta) {
+		if strings.HasSuffix(f, ".removed") || strings.HasSuffix(f, ".index.json") || partFile.MatchString(f) ||
+			strings.Contains(f, ".parity") || strings.Contains(f, ".manifest.json") {
+			continue
+		}
+		d, err := os.ReadFile(f)
+		if err != nil {
+			fatalf("Failed to read %s. Error: %v\n", f, err)
+		}
+		to := dest + strings.TrimPrefix(f, delta)
+		if err := os.WriteFile(to, d, 0644); err != nil {
+			fatalf("Failed to write %s. Error: %v\n", to, err)
+		}
+	}
+}
+
+// consolidate merges delta into the quarter backup of name, which then
+// replaces it.
+func consolidate(lxdBackupPrefix, tempDir, name, quarter, delta string, rc *retentionConfig) {
+
+	hs := lookupHasher("")
+	var qManifest *manifest
+	if qManifest = readManifest(quarter); qManifest != nil {
+		hs = lookupHasher(qManifest.Hash)
+	}
+
+	merged := filepath.Join(tempDir, "lxd-temporary-consolidate-"+fileTimestamp(nowUTC())+".tar.zst")
+	defer removeBackupFile(merged)
+	mergeBackup(quarter, delta, merged, nil)
+
+	sums, stats, _ := fetchFileDataFromTar("", merged, nil, nil, hs)
+
+	// Finished by the next backup run if this one doesn't make it, the old
+	// quarter backup is only replaced once the new one is complete
+	partial := promotePartial(lxdBackupPrefix, name)
+	id := intents.begin("full", name, quarter, partial)
+	defer intents.done(id)
+
+	stageFull(name, quarter, partial, merged)
+	finishArchive(partial)
+
+	// The profiles and manifest of the delta are those of the merged backup,
+	// the manifest written last
+	copySidecars(delta, partial)
+	writeFileData(partial+hs.suffix(), sums)
+	writeFileStats(partial+".stat", stats)
+	cm := readManifest(delta)
+	if cm == nil {
+		cm = &manifest{Container: name, Created: timestamp(nowUTC())}
+	}
+	cm.Full, cm.FullSHA256 = "", ""
+	cm.Hash = hs.name
+	cm.Format = archiveFormat
+	// The base image is merged in
+	cm.BaseImage = ""
+	if qManifest != nil {
+		// The journal since the old full covers all changes since this one
+		cm.JournalEpoch = qManifest.JournalEpoch
+	}
+	writeManifest(partial, cm)
+	full := commitFull(lxdBackupPrefix, name, quarter, partial, rc)
+	writeRestorePlan(lxdBackupPrefix, name, rc)
+
+	fmt.Printf("Consolidated %s into %s.\n", filepath.Base(delta), filepath.Base(full))
+}
+
+func consolidateMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, configFile string
+	var all bool
+	var volumeSizeStr, signKeyFile string
+
+	fs := flag.NewFlagSet("consolidate", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	confirmOpts := addConfirmFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&tempDir, "t", "", "Temporary directory.")
+	fs.StringVar(&deltaName, "d", "", "Delta to merge into the quarter backup, IE M10. Default is the newest.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups were made with.")
+	fs.StringVar(&archiveFormat, "format", archiveFormat, "Compression of the consolidated backup: zstd, gzip, xz or none.")
+	fs.BoolVar(&seekable, "seekable", false, "Make the consolidated backup seekable, with an index of its files.")
+	fs.StringVar(&volumeSizeStr, "volume-size", "", "Split the consolidated backup into parts of this size, IE 4G.")
+	fs.IntVar(&parityPercent, "parity", 0, "Make this many percent of parity for the consolidated backup.")
+	fs.StringVar(&signKeyFile, "sign-key", "", "Sign the manifest of the consolidated backup with this ed25519 private key in PEM.")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "Wait this long for a backup of a container to finish, IE 30m, instead of skipping it.")
+	fs.BoolVar(&all, "all", false, "Consolidate every container and volume with deltas.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s consolidate [options] container...\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s consolidate [options] -all\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+	validateFormat()
+	var err error
+	if volumeSize, err = parseSize(volumeSizeStr); err != nil {
+		fatalf("Bad -volume-size %s. Error: %v\n", volumeSizeStr, err)
+	}
+	validateParity()
+	if len(signKeyFile) > 0 {
+		signKey = loadSignKey(signKeyFile)
+	}
+
+	conf := loadConfig(configFile)
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+
+	names := fs.Args()
+	if all {
+		names = historyNames(lxdBackupPrefix)
+	}
+	if len(names) == 0 || (all && fs.NArg() > 0) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	type plan struct {
+		name, quarter, delta string
+	}
+	var plans []plan
+	var affected []string
+
+	for _, name := range names {
+		quarter := latestQuarter(lxdBackupPrefix, name, conf.Retention)
+		if len(quarter) == 0 {
+			if !all {
+				fatalf("No quarter backup of %s found in %s.\n", name, backupTarget)
+			}
+			continue
+		}
+
+		if err := writeOnceError(quarter); err != nil {
+			fatalf("Can't consolidate %s. Error: %v\n", name, err)
+		}
+
+		deltas := deltasOf(lxdBackupPrefix, name, quarter, conf.Retention)
+		var delta string
+		if len(deltas) > 0 {
+			delta = deltas[0]
+		}
+		if len(deltaName) > 0 {
+			delta = namedDelta(lxdBackupPrefix, name, deltaName)
+		}
+		if len(delta) == 0 {
+			slog.Info("No deltas to consolidate", "name", name)
+			continue
+		}
+
+		plans = append(plans, plan{name, quarter, delta})
+		affected = append(affected, fmt.Sprintf("%s: merge %s into %s", name, filepath.Base(delta), filepath.Base(quarter)))
+		for _, d := range deltas {
+			affected = append(affected, fmt.Sprintf("%s: remove %s", name, filepath.Base(d)))
+		}
+	}
+
+	if len(plans) == 0 {
+		fmt.Println("Nothing to consolidate.")
+		return
+	}
+	if !confirmOpts.confirm("Consolidating", affected) {
+		return
+	}
+
+	// A backup run starting meanwhile would clean up after this one
+	defer lockTarget(backupTarget, "consolidate").release()
+
+	intents = openIntentLog(lxdBackupPrefix, conf.Retention)
+	for _, p := range plans {
+		l, err := acquireLock(lxdBackupPrefix+p.name+".lock", "consolidate of "+p.name)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			slog.Warn("Skipping, it is locked", "name", p.name, "held-by", locked.holder.String())
+			continue
+		} else if err != nil {
+			fatal(err)
+		}
+		consolidate(lxdBackupPrefix, tempDir, p.name, p.quarter, p.delta, conf.Retention)
+		l.release()
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// containerDirsFile marks a backup directory where each container and
+// volume has a directory of its own for its backups, made by
+// migrate-layout. In there full backups are in full, deltas in deltas and
+// the manifests of both in manifests, the other files next to their
+// archives. The files keep their names.
+func containerDirsFile(dir string) string {
+	return filepath.Join(dir, "lxd-backup-container-dirs")
+}
+
+// kindDirs are the directories of a container directory, see
+// containerDirsFile.
+var kindDirs = []string{"full", "deltas", "manifests"}
+
+// containerPrefix is lxdBackupPrefix for the files of name, in the
+// directory of name when the backup directory has container directories.
+// Given what it returned, it returns the same.
+func containerPrefix(lxdBackupPrefix, name string) string {
+	dir := filepath.Dir(lxdBackupPrefix)
+	if !fileExists(containerDirsFile(dir)) {
+		return lxdBackupPrefix
+	}
+	return filepath.Join(dir, name, filepath.Base(lxdBackupPrefix))
+}
+
+// backupPrefix is containerPrefix for the archives of name ending in
+// suffix, the deltas in deltas and the full backups in full.
+func backupPrefix(lxdBackupPrefix, name, suffix string) string {
+	p := containerPrefix(lxdBackupPrefix, name)
+	if p == lxdBackupPrefix {
+		return p
+	}
+	kind := "full"
+	if strings.Contains(suffix, "-delta") {
+		kind = "deltas"
+	}
+	return filepath.Join(filepath.Dir(p), kind, filepath.Base(p))
+}
+
+// inKindDir tells whether fname is in full or deltas of a container
+// directory.
+func inKindDir(fname string) bool {
+	dir := filepath.Dir(fname)
+	if k := filepath.Base(dir); k != "full" && k != "deltas" {
+		return false
+	}
+	return fileExists(containerDirsFile(filepath.Dir(filepath.Dir(dir))))
+}
+
+// sidecarFile is the file next to the archive fname ending in suffix, IE
+// .md5sum. The manifest and its signature are in manifests instead, in a
+// container directory.
+func sidecarFile(fname, suffix string) string {
+	if strings.HasPrefix(suffix, ".manifest.json") && inKindDir(fname) {
+		return filepath.Join(filepath.Dir(filepath.Dir(fname)), "manifests", filepath.Base(fname)+suffix)
+	}
+	return fname + suffix
+}
+
+// manifestFile is the manifest of archive.
+func manifestFile(archive string) string {
+	return sidecarFile(archive, ".manifest.json")
+}
+
+// movedSidecar is what the sidecar f of fname becomes when fname is
+// renamed to to.
+func movedSidecar(fname, f, to string) string {
+	return sidecarFile(to, strings.TrimPrefix(filepath.Base(f), filepath.Base(fname)))
+}
+
+// manifestArchive is the archive the manifest f is of.
+func manifestArchive(f string) string {
+	archive := strings.TrimSuffix(f, ".manifest.json")
+	if filepath.Base(filepath.Dir(f)) != "manifests" || !inContainerDir(f) {
+		return archive
+	}
+	dir, base := filepath.Dir(filepath.Dir(f)), filepath.Base(archive)
+	if full := filepath.Join(dir, "full", base); fileExists(full) {
+		return full
+	}
+	return filepath.Join(dir, "deltas", base)
+}
+
+// makeContainerDir makes the directories the files of name go in.
+func makeContainerDir(lxdBackupPrefix, name string) {
+	dir := filepath.Dir(containerPrefix(lxdBackupPrefix, name))
+	if dir == filepath.Dir(lxdBackupPrefix) {
+		return
+	}
+	for _, k := range kindDirs {
+		if err := os.MkdirAll(filepath.Join(dir, k), 0755); err != nil {
+			fatalf("Failed to create %s. Error: %v\n", dir, err)
+		}
+	}
+}
+
+// globBackups is filepath.Glob of pattern in the backup directory dir, and
+// in the directories of the containers, for files of their container.
+func globBackups(dir, pattern string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, pattern))
+	if !fileExists(containerDirsFile(dir)) {
+		return files
+	}
+	sub, _ := filepath.Glob(filepath.Join(dir, "*", pattern))
+	for _, k := range kindDirs {
+		s, _ := filepath.Glob(filepath.Join(dir, "*", k, pattern))
+		sub = append(sub, s...)
+	}
+	for _, f := range sub {
+		if inContainerDir(f) {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// containerDirOf is the container directory fname is in, or in full,
+// deltas or manifests of.
+func containerDirOf(fname string) string {
+	dir := filepath.Dir(fname)
+	if slices.Contains(kindDirs, filepath.Base(dir)) {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
+
+// inContainerDir tells whether fname is a file of the container whose
+// directory it is in.
+func inContainerDir(fname string) bool {
+	name := filepath.Base(containerDirOf(fname))
+	rest, ok := strings.CutPrefix(filepath.Base(fname), "lxd-backup-"+name)
+	return ok && (strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, "."))
+}
+
+// kindDirOf is the directory of a container directory the file fname of
+// name goes in, "" for the container directory itself: the history and
+// the restore plan are about all backups of name.
+func kindDirOf(fname, name string) string {
+	rest := strings.TrimPrefix(fname, "lxd-backup-"+name)
+	switch {
+	case strings.Contains(rest, ".manifest.json"):
+		return "manifests"
+	case strings.Contains(rest, "-delta."):
+		return "deltas"
+	case strings.Contains(rest, ".tar"):
+		return "full"
+	}
+	return ""
+}
+
+// backupDirs are the directories of dir that backup files are in: dir
+// itself, and the directories of the containers.
+func backupDirs(dir string) []string {
+	dirs := []string{dir}
+	seen := make(map[string]bool)
+	for _, f := range globBackups(dir, "lxd-backup-*") {
+		if d := filepath.Dir(f); d != dir && !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// sharedFile tells whether the file fname of the backup directory is about
+// all of it, not of a container, and stays where it is.
+func sharedFile(fname string) bool {
+	n := strings.TrimPrefix(fname, "lxd-backup-")
+	for _, p := range []string{"server-", "image-", "imagefiles-", "lastrun.", "repo"} {
+		if strings.HasPrefix(n, p) {
+			return true
+		}
+	}
+	switch n {
+	case "intents.jsonl", "tiers.json", "scrub.json", "history.json", "worm.json", "layout.json",
+		"copy.key", "container-dirs", "lock":
+		return true
+	}
+	return strings.HasSuffix(n, ".lock") || strings.HasSuffix(n, ".partial")
+}
+
+// ownerOf is the one of names the backup file fname is of, the longest
+// one as container names may be the start of others, or "".
+func ownerOf(fname string, names []string) string {
+	owner := ""
+	for _, n := range names {
+		rest, ok := strings.CutPrefix(fname, "lxd-backup-"+n)
+		if ok && (strings.HasPrefix(rest, "-") || strings.HasPrefix(rest, ".")) && len(n) > len(owner) {
+			owner = n
+		}
+	}
+	return owner
+}
+
+// ownerByName is the container the backup file fname is of by its name
+// alone, IE web of lxd-backup-web-WD3-delta.tar.zst.md5sum, or "".
+func ownerByName(fname string) string {
+	archive, ok := archiveOf(fname)
+	if !ok {
+		for _, s := range []string{"-delta.btrfs.zst", "-delta.rbd.zst"} {
+			if i := strings.Index(fname, s); i > 0 {
+				archive, ok = fname[:i]+"-delta.tar", true
+			}
+		}
+	}
+	if !ok || !strings.Contains(archive, "-") {
+		return ""
+	}
+	return containerOf(archive)
+}
+
+// moveBackupFile moves fname to the directory to, taking its write-once
+// state along.
+func moveBackupFile(fname, to string) {
+	dest := filepath.Join(to, filepath.Base(fname))
+	if err := os.Rename(fname, dest); err != nil {
+		fatalf("Failed to move %s to %s. Error: %v\n", fname, to, err)
+	}
+	moveWriteOnce(fname, dest)
+}
+
+// migrateLayoutMain is lxd-backup migrate-layout, which moves the backups
+// of each container into a directory of its own, or back with -flat.
+func migrateLayoutMain(args []string) {
+
+	var backupTarget, configFile string
+	var flat bool
+
+	fs := flag.NewFlagSet("migrate-layout", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	confirmOpts := addConfirmFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups are made with.")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "Wait this long for a backup run to finish, IE 30m.")
+	fs.BoolVar(&flat, "flat", false, "Move the backups out of the container directories again, into the backup directory.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate-layout [options] -b dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(backupTarget) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	rc := loadConfig(configFile).Retention
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	marker := containerDirsFile(backupTarget)
+	if fileExists(marker) != flat {
+		fmt.Println("Nothing to migrate, the backup directory has that layout already.")
+		return
+	}
+
+	defer lockTarget(backupTarget, "migrate-layout").release()
+
+	// Backups older than the run history only have their manifests to go by
+	names := historyNames(lxdBackupPrefix)
+	known := make(map[string]bool)
+	for _, n := range names {
+		known[n] = true
+	}
+	for _, f := range globBackups(backupTarget, "lxd-backup-*.manifest.json") {
+		if m := readManifest(manifestArchive(f)); m != nil && len(m.Container) > 0 && !known[m.Container] {
+			known[m.Container] = true
+			names = append(names, m.Container)
+		}
+	}
+	sort.Strings(names)
+
+	// What goes where
+	moves := make(map[string]string)
+	var affected []string
+	if flat {
+		for _, f := range globBackups(backupTarget, "lxd-backup-*") {
+			if filepath.Dir(f) == backupTarget {
+				continue
+			}
+			moves[f] = backupTarget
+			if name := filepath.Base(containerDirOf(f)); !known[name] {
+				known[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		affected = append(affected, fmt.Sprintf("move %d files of %d containers into %s", len(moves), len(names), backupTarget))
+	} else {
+		files, _ := filepath.Glob(lxdBackupPrefix + "*")
+		var unknown []string
+		for _, f := range files {
+			if sharedFile(filepath.Base(f)) || len(ownerOf(filepath.Base(f), names)) > 0 {
+				continue
+			}
+			// Of no run history or manifest, the archive name tells
+			if owner := ownerByName(filepath.Base(f)); len(owner) > 0 && !known[owner] {
+				known[owner] = true
+				names = append(names, owner)
+			} else if len(owner) == 0 {
+				unknown = append(unknown, filepath.Base(f))
+			}
+		}
+		if len(unknown) > 0 {
+			fatalf("Failed to tell which container %s are of, move or remove them first.\n", strings.Join(unknown, ", "))
+		}
+		sort.Strings(names)
+		count := make(map[string]int)
+		for _, f := range files {
+			if sharedFile(filepath.Base(f)) {
+				continue
+			}
+			owner := ownerOf(filepath.Base(f), names)
+			moves[f] = filepath.Join(backupTarget, owner, kindDirOf(filepath.Base(f), owner))
+			count[owner]++
+		}
+		for _, name := range names {
+			if count[name] > 0 {
+				affected = append(affected, fmt.Sprintf("%s: move %d files into %s", name, count[name], filepath.Join(backupTarget, name)))
+			}
+		}
+	}
+	if len(moves) == 0 {
+		affected = append(affected, "no files to move")
+	}
+	broken := make(map[string]bool)
+	for _, name := range names {
+		if len(chainProblems(lxdBackupPrefix, name, rc)) > 0 {
+			broken[name] = true
+		}
+	}
+	if !confirmOpts.confirm("Migrating "+backupTarget, affected) {
+		return
+	}
+
+	// Each container locked while its files move
+	byName := make(map[string][]string)
+	for f := range moves {
+		name := filepath.Base(containerDirOf(f))
+		if !flat {
+			name = ownerOf(filepath.Base(f), names)
+		}
+		byName[name] = append(byName[name], f)
+	}
+	moved := make(map[string]string)
+	for _, name := range names {
+		if len(byName[name]) == 0 {
+			continue
+		}
+		l, err := acquireLock(lxdBackupPrefix+name+".lock", "migrate-layout of "+name)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			fatalf("%s is locked by %s, run migrate-layout again once it is done.\n", name, locked.holder.String())
+		} else if err != nil {
+			fatal(err)
+		}
+		sort.Strings(byName[name])
+		for _, f := range byName[name] {
+			if err := os.MkdirAll(moves[f], 0755); err != nil {
+				fatalf("Failed to create %s. Error: %v\n", moves[f], err)
+			}
+			moveBackupFile(f, moves[f])
+			from, _ := filepath.Rel(backupTarget, f)
+			to, _ := filepath.Rel(backupTarget, filepath.Join(moves[f], filepath.Base(f)))
+			moved[from] = to
+		}
+		if dir := filepath.Join(backupTarget, name); flat {
+			for _, d := range append(kindDirs, ".") {
+				d = filepath.Join(dir, d)
+				if len(loadWriteOnce(d)) == 0 {
+					os.Remove(wormStateFile(d))
+				}
+				os.Remove(d)
+			}
+		}
+		l.release()
+		slog.Info("Moved backups", "name", name, "files", len(byName[name]))
+	}
+	moveLayoutLinks(backupTarget, moved)
+
+	// Only now the backups are looked for where they were moved to
+	if flat {
+		if err := os.Remove(marker); err != nil {
+			fatalf("Failed to remove %s. Error: %v\n", marker, err)
+		}
+	} else if err := writeFilePartial(marker, []byte("Each container has a directory of its own, see lxd-backup migrate-layout.\n"), 0644); err != nil {
+		fatalf("Failed to write %s. Error: %v\n", marker, err)
+	}
+
+	failed := 0
+	for _, name := range names {
+		if broken[name] {
+			continue
+		}
+		for _, p := range chainProblems(lxdBackupPrefix, name, rc) {
+			fmt.Printf("BROKEN %s: %s\n", name, p)
+			failed++
+		}
+	}
+	if failed > 0 {
+		fatalf("%d problems with chains that were intact before.\n", failed)
+	}
+	fmt.Printf("Moved %d files, the chains of %d containers are as they were.\n", len(moves), len(names))
+}
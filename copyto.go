@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// copyTo is -copy-to, and the -b after the first, the backends that get a
+// copy of the backup directory after each run.
+var copyTo stringList
+
+// copyTarget is a backend of -copy-to.
+type copyTarget struct {
+	name string
+	b    lxdbackup.Backend
+}
+
+// openCopyTargets gives up unless every -copy-to names a backend.
+func openCopyTargets() []*copyTarget {
+	var targets []*copyTarget
+	for _, t := range copyTo {
+		b, err := lxdbackup.OpenBackend(t)
+		if err != nil {
+			fatalf("Bad copy target %s. Error: %v\n", t, err)
+		}
+		targets = append(targets, &copyTarget{name: t, b: b})
+	}
+	return targets
+}
+
+// copyResult is how copying to one target went, for the run report.
+type copyResult struct {
+	Target  string `json:"target"`
+	Status  string `json:"status"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+	Deleted int    `json:"deleted,omitempty"`
+	Failed  int    `json:"failed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// copied tells whether fname is a file of the backup directory that is
+// copied. Locks and the intent log are about this host only, and the key
+// of encrypted copies is only there wrapped. Copies have no container
+// directories, the files of those are copied next to the others.
+func copied(fname string) bool {
+	return !strings.HasSuffix(fname, ".partial") && !strings.HasSuffix(fname, ".lock") &&
+		fname != "lxd-backup-intents.jsonl" && fname != filepath.Base(copyKeyFile("")) &&
+		fname != filepath.Base(layoutStateFile("")) && fname != filepath.Base(containerDirsFile(""))
+}
+
+// copyBackups makes dest a copy of the backup files in backupTarget: files
+// that are missing there, or changed here since they were put there, are
+// put and verified, and files that are gone here, IE pruned, are deleted.
+// The repository of -repo is not copied. Object stores get the files with
+// the artifactMeta of the run runID.
+func copyBackups(backupTarget string, dest *copyTarget, runID string, rc *retentionConfig, report *runReport) {
+
+	res := &copyResult{Target: dest.name, Status: "ok"}
+	report.Copies = append(report.Copies, res)
+	fail := func(msg string) {
+		report.warn(msg)
+		res.Status = "failed"
+		if len(res.Error) == 0 {
+			res.Error = msg
+		}
+	}
+
+	var local []lxdbackup.FileInfo
+	srcs := make(map[string]*lxdbackup.Dir)
+	for _, dir := range backupDirs(backupTarget) {
+		src := &lxdbackup.Dir{Path: dir}
+		files, err := src.List("lxd-backup-")
+		if err != nil {
+			fail(fmt.Sprintf("Failed to list %s for copying to %s: %v", dir, dest.name, err))
+			return
+		}
+		for _, f := range files {
+			if dir == backupTarget || inContainerDir(filepath.Join(dir, f.Name)) {
+				local = append(local, f)
+				srcs[f.Name] = src
+			}
+		}
+	}
+	remote, err := dest.b.List("lxd-backup-")
+	if err != nil {
+		fail(fmt.Sprintf("Failed to list %s: %v", dest.name, err))
+		return
+	}
+
+	there := make(map[string]lxdbackup.FileInfo, len(remote))
+	for _, f := range remote {
+		there[f.Name] = f
+	}
+
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	names := historyNames(lxdBackupPrefix)
+	here := make(map[string]bool, len(local))
+	for _, f := range local {
+		if !copied(f.Name) {
+			continue
+		}
+		here[f.Name] = true
+		if r, ok := there[f.Name]; ok && r.Size == f.Size && !f.ModTime.After(r.ModTime) {
+			continue
+		}
+		slog.Info("Copying", "file", f.Name, "to", dest.name, "size", humanBytes(f.Size))
+		src := srcs[f.Name]
+		fname := filepath.Join(src.Path, f.Name)
+		if err := copyFile(src, dest.b, f.Name, writeOnceUntil(fname), copyMeta(lxdBackupPrefix, names, fname, runID, rc)); err != nil {
+			fail(fmt.Sprintf("Failed to copy %s to %s: %v", f.Name, dest.name, err))
+			res.Failed++
+			// A copy that doesn't verify is worse than none, it would be trusted
+			dest.b.Delete(f.Name)
+			continue
+		}
+		res.Files++
+		res.Bytes += f.Size
+	}
+
+	// Only once all is there, a failed copy must not cost the old one
+	for _, f := range remote {
+		if here[f.Name] || !copied(f.Name) || res.Failed > 0 {
+			continue
+		}
+		slog.Info("Deleting copy", "file", f.Name, "from", dest.name)
+		if err := dest.b.Delete(f.Name); err != nil {
+			fail(fmt.Sprintf("Failed to delete %s from %s: %v", f.Name, dest.name, err))
+			continue
+		}
+		res.Deleted++
+	}
+	slog.Info("Copied backups", "to", dest.name, "files", res.Files, "size", humanBytes(res.Bytes),
+		"deleted", res.Deleted, "failed", res.Failed)
+}
+
+// copyMeta is the artifactMeta of the backup file fname, of the one of
+// names it is of, made by the run its manifest says or else runID.
+func copyMeta(lxdBackupPrefix string, names []string, fname, runID string, rc *retentionConfig) lxdbackup.ObjectMeta {
+	name := ownerOf(filepath.Base(fname), names)
+	if filepath.Dir(fname) != filepath.Dir(lxdBackupPrefix) {
+		name = filepath.Base(filepath.Dir(fname))
+	}
+	if archive, ok := archiveOf(fname); ok {
+		if m := readManifest(archive); m != nil && len(m.RunID) > 0 {
+			runID = m.RunID
+		}
+	}
+	return artifactMeta(lxdBackupPrefix, name, fname, runID, rc)
+}
+
+// copyFile puts name of src to dest with meta, where dest keeps it,
+// limited to -bwlimit, and checks that what dest has is what was put.
+// Unless until is zero, dest is to keep it write-once until then, if it
+// can.
+func copyFile(src, dest lxdbackup.Backend, name string, until time.Time, meta lxdbackup.ObjectMeta) error {
+
+	in, err := src.Get(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	put := dest.Put
+	if p, ok := dest.(lxdbackup.MetaPutter); ok {
+		put = func(name string, r io.Reader) error { return p.PutMeta(name, r, meta, until) }
+	} else if l, ok := dest.(lxdbackup.ObjectLocker); ok && !until.IsZero() {
+		put = func(name string, r io.Reader) error { return l.PutLocked(name, r, until) }
+	}
+	sum := md5.New()
+	if err := put(name, io.TeeReader(throttleReader(in), sum)); err != nil {
+		return err
+	}
+	want := hex.EncodeToString(sum.Sum(nil))
+
+	got, err := remoteChecksum(dest, name)
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("verifying: md5 is %s there, %s here", got, want)
+	}
+	return nil
+}
+
+// remoteChecksum is the md5 of name in b, asked of b if it knows it, read
+// back otherwise.
+func remoteChecksum(b lxdbackup.Backend, name string) (string, error) {
+
+	if c, ok := b.(lxdbackup.Checksummer); ok {
+		if sum, err := c.Checksum(name, "md5"); err != nil || len(sum) > 0 {
+			return sum, err
+		}
+	}
+
+	rc, err := b.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	sum := md5.New()
+	if _, err := io.Copy(sum, throttleReader(rc)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"sort"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// deltaMaxFileSize and deltaSkipPatterns are -delta-max-file-size and
+// -delta-skip, for the containers without their own in the config file.
+var deltaMaxFileSize int64
+var deltaSkipPatterns []string
+
+// deltaSkip leaves changed files out of deltas, files bigger than maxSize
+// and those matching patterns, which are like those of pathFilter. A skipped
+// file is restored as it was in the quarter backup, if it was in it.
+type deltaSkip struct {
+	maxSize  int64 // 0 means any size
+	patterns []string
+}
+
+// skippedFile is a changed file a delta left out, listed in its manifest.
+type skippedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+func newDeltaSkip(maxSize int64, patterns []string) *deltaSkip {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			fatalf("Bad delta-skip pattern %s. Error: %v\n", p, err)
+		}
+	}
+	if maxSize == 0 && len(patterns) == 0 {
+		return nil
+	}
+	return &deltaSkip{maxSize: maxSize, patterns: patterns}
+}
+
+// reason is why the entry name of size bytes is left out, "" if it isn't.
+func (d *deltaSkip) reason(name string, size int64) string {
+	if d == nil {
+		return ""
+	}
+	p, ok := rootfsPath(name)
+	if !ok {
+		return ""
+	}
+	for _, pattern := range d.patterns {
+		if matchPattern(pattern, p) {
+			return "matches " + pattern
+		}
+	}
+	if d.maxSize > 0 && size > d.maxSize {
+		return "larger than " + humanBytes(d.maxSize)
+	}
+	return ""
+}
+
+// apply removes the files it skips from changed, and returns them.
+func (d *deltaSkip) apply(name string, changed map[string]bool, stats map[string]lxdbackup.FileStat) []skippedFile {
+
+	if d == nil {
+		return nil
+	}
+	var skipped []skippedFile
+	for fname := range changed {
+		if r := d.reason(fname, stats[fname].Size); len(r) > 0 {
+			delete(changed, fname)
+			skipped = append(skipped, skippedFile{Path: fname, Size: stats[fname].Size, Reason: r})
+			slog.Info("Leaving file out of delta", "name", name, "file", fname, "size", humanBytes(stats[fname].Size), "reason", r)
+		}
+	}
+	sort.Slice(skipped, func(i, k int) bool { return skipped[i].Path < skipped[k].Path })
+	return skipped
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// liveGeneration is what diff calls a fresh export of the running container.
+const liveGeneration = "live"
+
+// generationView finds the backup generation g of name: a delta name, IE
+// WD3, the name of a full backup, IE Q20224, or the newest backup, the
+// newest delta of the newest full backup if there is one, when g is empty.
+func generationView(lxdBackupPrefix, name, g string, rc *retentionConfig) *backupView {
+
+	if len(g) == 0 {
+		v := &backupView{quarter: latestQuarter(lxdBackupPrefix, name, rc)}
+		if len(v.quarter) == 0 {
+			fatalf("No quarter backup of %s found.\n", name)
+		}
+		if deltas := deltasOf(lxdBackupPrefix, name, v.quarter, rc); len(deltas) > 0 {
+			v.delta = deltas[0]
+			v.removed = loadRemoved(v.delta + ".removed")
+		}
+		return v
+	}
+	if full := findArchive(backupPrefix(lxdBackupPrefix, name, ".tar") + name + "-" + g + ".tar"); fileExists(full) {
+		return &backupView{quarter: full}
+	}
+	return openView(lxdBackupPrefix, name, g, rc)
+}
+
+func (v *backupView) String() string {
+	if len(v.delta) > 0 {
+		return filepath.Base(v.delta)
+	}
+	return filepath.Base(v.quarter)
+}
+
+// hasher is the checksum algorithm the checksum file of the full backup is
+// made with.
+func (v *backupView) hasher() *hasher {
+	if m := readManifest(v.quarter); m != nil {
+		return lookupHasher(m.Hash)
+	}
+	return lookupHasher("")
+}
+
+// checksums returns the checksums with hs of the regular files of the
+// generation, and the EntrySum of the other entries. Those of the full
+// backup are taken from its checksum file when it was made with hs, those
+// of the delta are hashed.
+func (v *backupView) checksums(hs *hasher, tempDir string) map[string]string {
+
+	var sums map[string]string
+	if v.hasher() == hs && fileExists(v.quarter+hs.suffix()) {
+		sums = loadFileData(v.quarter + hs.suffix())
+	} else {
+		sums, _, _ = fetchFileDataFromTar("", v.quarter, nil, nil, hs)
+	}
+	if len(v.delta) == 0 {
+		return sums
+	}
+
+	for n := range v.removed {
+		delete(sums, n)
+	}
+
+	in := openArchive(v.delta)
+	defer in.Close()
+	tarreader := tar.NewReader(in)
+
+	var patched []string
+	xattrs := make(map[string]string)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", v.delta, err)
+		}
+		if lxdbackup.IsMetaEntry(hdr) {
+			continue // The content is that of the quarter backup
+		}
+		if sum, ok := lxdbackup.EntrySum(hdr); ok {
+			sums[hdr.Name] = sum
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if sum, ok := hdr.PAXRecords[lxdbackup.PAXPatchSum]; ok {
+			if hs.name == "sha256" {
+				sums[hdr.Name] = sum + lxdbackup.XattrSum(hdr)
+			} else {
+				patched = append(patched, hdr.Name)
+				xattrs[hdr.Name] = lxdbackup.XattrSum(hdr)
+			}
+			continue
+		}
+		h := hs.new()
+		if _, err := io.Copy(h, tarreader); err != nil {
+			fatalf("Failed to read %s in %s. Error: %v\n", hdr.Name, v.delta, err)
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil)) + lxdbackup.XattrSum(hdr)
+	}
+
+	// Binary diffs only say the sha256 of the patched file
+	for _, n := range patched {
+		h := hs.new()
+		v.copyFile(n, tempDir, h)
+		sums[n] = hex.EncodeToString(h.Sum(nil)) + xattrs[n]
+	}
+	return sums
+}
+
+// liveChecksums exports the running container name, as a backup would but
+// without stopping it, and returns the checksums with hs of its files.
+func liveChecksums(name, tempDir string, exportArgs []string, snapshots bool, hs *hasher) map[string]string {
+	export := tempExportName(tempDir, "diff")
+	defer removeBackupFile(export)
+	lxcExport(name, export, exportArgs, snapshots)
+	sums, _, _ := fetchFileDataFromTar("", export, nil, nil, hs)
+	return sums
+}
+
+// diffMain lists the files added, changed and removed between two backup
+// generations of a container, or between its newest backup and what it
+// looks like right now.
+func diffMain(args []string) {
+
+	var backupTarget, tempDir, configFile string
+
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&tempDir, "t", "", "Temporary directory, for the export of a live comparison.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups were made with.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [options] container [from [to]]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "from and to are delta names, IE WD3, names of full backups, IE Q20224, or %s for a fresh\n", liveGeneration)
+		fmt.Fprintf(fs.Output(), "export of the running container. from defaults to the newest backup, to to %s.\n", liveGeneration)
+		fs.PrintDefaults()
+	}
+	pos := parseAnywhere(fs, args)
+
+	logOpts.setup()
+
+	if len(pos) < 1 || len(pos) > 3 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	name := pos[0]
+	from, to := "", liveGeneration
+	if len(pos) > 1 {
+		from = pos[1]
+	}
+	if len(pos) > 2 {
+		to = pos[2]
+	}
+	if from == liveGeneration {
+		fatal("Only the second generation can be live.")
+	}
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+
+	conf := loadConfig(configFile)
+	prefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	fromView := generationView(prefix, name, from, conf.Retention)
+	hs := fromView.hasher()
+	old := fromView.checksums(hs, tempDir)
+
+	var cur map[string]string
+	toName := liveGeneration
+	if to == liveGeneration {
+		var exportArgs []string
+		var snapshots bool
+		if qm := readManifest(fromView.quarter); qm != nil {
+			exportArgs, snapshots = qm.ExportArgs, len(qm.Snapshots) > 0
+		}
+		cur = liveChecksums(name, tempDir, exportArgs, snapshots, hs)
+	} else {
+		toView := generationView(prefix, name, to, conf.Retention)
+		cur = toView.checksums(hs, tempDir)
+		toName = toView.String()
+	}
+
+	type change struct {
+		what, name string
+	}
+	var changes []change
+	for n, sum := range old {
+		if now, present := cur[n]; !present {
+			changes = append(changes, change{"D", n})
+		} else if now != sum {
+			changes = append(changes, change{"M", n})
+		}
+	}
+	for n := range cur {
+		if _, present := old[n]; !present {
+			changes = append(changes, change{"A", n})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].name < changes[j].name })
+
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.what, c.name)
+	}
+	slog.Info("Compared", "from", fromView.String(), "to", toName, "changes", len(changes))
+}
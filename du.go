@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// usage is the storage a container or volume takes in the backup
+// directory, by tier of the retention scheme.
+type usage struct {
+	Name string `json:"name"`
+	// Full is the newest full backup, Fulls all of them
+	Full  int64 `json:"full"`
+	Fulls int64 `json:"fulls"`
+	// Deltas are by the name template of their tier, generations included
+	Deltas map[string]int64 `json:"deltas"`
+	Total  int64            `json:"total"`
+	// Growth is the newest full backup less the one before it
+	Growth int64 `json:"growth"`
+	// Projected is the total once the next full backup is made
+	Projected int64 `json:"projected"`
+}
+
+// backupFilesSize is the size of the backup file fname with its parts,
+// checksums and everything else next to it.
+func backupFilesSize(fname string) int64 {
+	var size int64
+	sidecars := sidecarFiles(fname)
+	for _, f := range append(sidecars, fname) {
+		if st, err := os.Stat(f); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// diskUsage is the usage of name with the retention scheme rc.
+func diskUsage(lxdBackupPrefix, name string, rc *retentionConfig) *usage {
+
+	u := &usage{Name: name, Deltas: make(map[string]int64)}
+
+	fulls := tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full)
+	sizes := make([]int64, len(fulls))
+	for i, f := range fulls {
+		sizes[i] = backupFilesSize(f)
+		u.Fulls += sizes[i]
+	}
+	if len(sizes) > 0 {
+		u.Full = sizes[0]
+	}
+	if len(sizes) > 1 {
+		u.Growth = sizes[0] - sizes[1]
+	}
+	u.Total = u.Fulls
+
+	for i := range rc.Deltas {
+		tc := &rc.Deltas[i]
+		for _, f := range append(tierFiles(lxdBackupPrefix, name, "-delta.tar", tc), tierGenerations(lxdBackupPrefix, name, tc)...) {
+			size := backupFilesSize(f)
+			u.Deltas[tc.Name] += size
+			u.Total += size
+		}
+	}
+
+	// The next full is as much bigger again, and pushes out the oldest one
+	// beyond Keep. Delta slots are made over, they stay about the same.
+	u.Projected = u.Total
+	if len(sizes) > 0 {
+		u.Projected += max(u.Full+u.Growth, 0)
+		if k := rc.Full.Keep; k > 0 && len(sizes) >= k {
+			u.Projected -= sizes[len(sizes)-1]
+		}
+	}
+	return u
+}
+
+// growthPercent is the growth of u as percent of the full before it.
+func (u *usage) growthPercent() string {
+	if before := u.Full - u.Growth; u.Growth != 0 && before > 0 {
+		return fmt.Sprintf("%+d%%", u.Growth*100/before)
+	}
+	return "-"
+}
+
+// duMain is lxd-backup du, how much the backups of each container take
+// by tier, how much they grew since the full backup before, and what they
+// will take once the next full backups are made.
+func duMain(args []string) {
+
+	var backupTarget, configFile, contExcStr, contIncStr string
+	var jsonOut bool
+
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups are made with.")
+	fs.StringVar(&contExcStr, "ec", "", "Containers to leave out. Comma separated.")
+	fs.StringVar(&contIncStr, "ic", "", "Only these containers. Comma separated.")
+	fs.BoolVar(&jsonOut, "json", false, "Print JSON instead of a table.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s du [options] -b dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(backupTarget) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	conf := loadConfig(configFile)
+	rc := conf.Retention
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	names := historyNames(lxdBackupPrefix)
+	if len(contIncStr) > 0 {
+		names = strings.Split(contIncStr, ",")
+	}
+	exclude := make(map[string]bool)
+	for _, n := range strings.Split(contExcStr, ",") {
+		exclude[n] = true
+	}
+
+	var usages []*usage
+	for _, name := range names {
+		if !exclude[name] {
+			usages = append(usages, diskUsage(lxdBackupPrefix, name, rc))
+		}
+	}
+	// The biggest first, that is where the space goes
+	sort.SliceStable(usages, func(i, j int) bool { return usages[i].Total > usages[j].Total })
+
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(usages); err != nil {
+			fatalf("Failed to encode usage. Error: %v\n", err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	head := []string{"NAME", "FULL", "FULLS"}
+	for _, tc := range rc.Deltas {
+		head = append(head, tc.Name)
+	}
+	fmt.Fprintln(w, strings.Join(append(head, "TOTAL", "GROWTH", "PROJECTED"), "\t"))
+
+	sum := &usage{Name: "TOTAL", Deltas: make(map[string]int64)}
+	row := func(u *usage) {
+		cols := []string{u.Name, humanBytes(u.Full), humanBytes(u.Fulls)}
+		for _, tc := range rc.Deltas {
+			cols = append(cols, humanBytes(u.Deltas[tc.Name]))
+		}
+		cols = append(cols, humanBytes(u.Total), u.growthPercent(), humanBytes(u.Projected))
+		fmt.Fprintln(w, strings.Join(cols, "\t"))
+	}
+	for _, u := range usages {
+		row(u)
+		sum.Full += u.Full
+		sum.Fulls += u.Fulls
+		for n, size := range u.Deltas {
+			sum.Deltas[n] += size
+		}
+		sum.Total += u.Total
+		sum.Growth += u.Growth
+		sum.Projected += u.Projected
+	}
+	row(sum)
+	w.Flush()
+
+	if free, err := diskFree(backupTarget); err == nil {
+		fmt.Printf("\n%s free in %s, %s more needed by the next full backups.\n",
+			humanBytes(free), backupTarget, humanBytes(max(sum.Projected-sum.Total, 0)))
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// encryptTo is -encrypt-to, the file with the age recipients copies are
+// encrypted for, one per line.
+var encryptTo string
+
+// copyKeyFile keeps the repository key copies are encrypted with. It is
+// never copied, the copies have it wrapped for the recipients.
+func copyKeyFile(backupTarget string) string {
+	return filepath.Join(backupTarget, "lxd-backup-copy.key")
+}
+
+// loadCopyKey returns the repository key of backupTarget, nil if it has
+// none. With create, one is made then.
+func loadCopyKey(backupTarget string, create bool) []byte {
+
+	fname := copyKeyFile(backupTarget)
+	if d, err := os.ReadFile(fname); err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(d)))
+		if err != nil || len(key) != 32 {
+			fatalf("Bad repository key in %s.\n", fname)
+		}
+		return key
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fatalf("Failed to read %s. Error: %v\n", fname, err)
+	}
+	if !create {
+		return nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatalf("Failed to make repository key. Error: %v\n", err)
+	}
+	if err := writeFilePartial(fname, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		fatalf("Failed to write %s. Error: %v\n", fname, err)
+	}
+	slog.Info("Made repository key for encrypted copies", "file", fname)
+	return key
+}
+
+// copyKeyID returns the KeyID of the repository key of the copy b, empty
+// if it has none recorded, IE as made by older versions.
+func copyKeyID(b lxdbackup.Backend) (string, error) {
+	rc, err := b.Get(lxdbackup.KeyIDObject)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	d, err := io.ReadAll(rc)
+	return strings.TrimSpace(string(d)), err
+}
+
+// putCopyKey puts key to the copy b, wrapped, and its KeyID. The KeyID
+// goes first, so a copy never has a key without one.
+func putCopyKey(b lxdbackup.Backend, key, wrapped []byte) error {
+	if err := b.Put(lxdbackup.KeyIDObject, strings.NewReader(lxdbackup.KeyID(key)+"\n")); err != nil {
+		return err
+	}
+	return b.Put(lxdbackup.KeyObject, bytes.NewReader(wrapped))
+}
+
+// ageCommand runs age with args on in, and returns what it writes.
+func ageCommand(in []byte, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return nil, fmt.Errorf("age: %s", msg)
+		}
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return out, nil
+}
+
+// wrapKey encrypts the repository key for the age recipients in the file
+// recipients, any of them can unwrap it.
+func wrapKey(key []byte, recipients string) ([]byte, error) {
+	return ageCommand([]byte(hex.EncodeToString(key)+"\n"), "-e", "-a", "-R", recipients)
+}
+
+// unwrapKey decrypts a repository key wrapped by wrapKey with the age
+// identity file identity.
+func unwrapKey(wrapped []byte, identity string) ([]byte, error) {
+	out, err := ageCommand(wrapped, "-d", "-i", identity)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("no repository key in it")
+	}
+	return key, nil
+}
+
+// targetKey is the repository key of the copy b, unwrapped with the age
+// identity file identity.
+func targetKey(b lxdbackup.Backend, identity string) ([]byte, error) {
+	rc, err := b.Get(lxdbackup.KeyObject)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	wrapped, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(wrapped, identity)
+}
+
+// encryptCopies makes the copy targets encrypt with the repository key of
+// backupTarget, and puts the key wrapped for -encrypt-to to those that
+// don't have it yet. A copy with another key, or one of unknown KeyID, is
+// refused, as is making a key while a copy has one already.
+func encryptCopies(backupTarget string, targets []*copyTarget) {
+
+	if len(encryptTo) == 0 || len(targets) == 0 {
+		return
+	}
+	key := loadCopyKey(backupTarget, false)
+	keyed := make(map[*copyTarget]bool)
+	for _, t := range targets {
+		_, err := t.b.Stat(lxdbackup.KeyObject)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			fatalf("Failed to look for the repository key in %s. Error: %v\n", t.name, err)
+		}
+		if key == nil {
+			fatalf("%s has a repository key, but %s is missing. Put it back, IE with age -d -i identity -o %s %s from the copy.\n",
+				t.name, copyKeyFile(backupTarget), copyKeyFile(backupTarget), lxdbackup.KeyObject)
+		}
+		id, err := copyKeyID(t.b)
+		if err != nil {
+			fatalf("Failed to read the repository key id of %s. Error: %v\n", t.name, err)
+		}
+		if len(id) == 0 {
+			fatalf("%s has a repository key of unknown id, run rekey -i on it first.\n", t.name)
+		}
+		if id != lxdbackup.KeyID(key) {
+			fatalf("%s is encrypted with another repository key than the one in %s.\n", t.name, copyKeyFile(backupTarget))
+		}
+		keyed[t] = true
+	}
+	if key == nil {
+		key = loadCopyKey(backupTarget, true)
+	}
+
+	var wrapped []byte
+	for _, t := range targets {
+		if !keyed[t] {
+			if wrapped == nil {
+				var err error
+				if wrapped, err = wrapKey(key, encryptTo); err != nil {
+					fatalf("Failed to wrap the repository key for %s. Error: %v\n", encryptTo, err)
+				}
+			}
+			if err := putCopyKey(t.b, key, wrapped); err != nil {
+				fatalf("Failed to put the repository key to %s. Error: %v\n", t.name, err)
+			}
+			slog.Info("Put repository key", "to", t.name, "recipients", encryptTo)
+		}
+		t.b = &lxdbackup.Encrypted{Backend: t.b, Key: key}
+	}
+}
+
+// rekeyMain is lxd-backup rekey: it wraps the repository key of encrypted
+// copies for a new set of recipients. The archives stay as they are, only
+// the key file is replaced.
+func rekeyMain(args []string) {
+
+	var backupTarget, identity, recipients string
+
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory whose repository key it is. Default is unwrapping the key of each copy with -i.")
+	fs.StringVar(&identity, "i", "", "age identity file, of one of the recipients the copies are encrypted for now.")
+	fs.StringVar(&recipients, "recipients", "", "File with the age recipients to encrypt for from now on, one per line.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s rekey [options] -recipients file copy...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(recipients) == 0 || (len(backupTarget) == 0) == (len(identity) == 0) || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var key []byte
+	if len(backupTarget) > 0 {
+		if key = loadCopyKey(backupTarget, false); key == nil {
+			fatalf("No repository key in %s.\n", backupTarget)
+		}
+	}
+
+	for _, target := range fs.Args() {
+		b, err := lxdbackup.OpenBackend(target)
+		if err != nil {
+			fatalf("Bad copy %s. Error: %v\n", target, err)
+		}
+		id, err := copyKeyID(b)
+		if err != nil {
+			fatalf("Failed to read the repository key id of %s. Error: %v\n", target, err)
+		}
+		k := key
+		if k == nil {
+			if k, err = targetKey(b, identity); err != nil {
+				fatalf("Failed to unwrap the repository key of %s. Error: %v\n", target, err)
+			}
+		} else if _, err := b.Stat(lxdbackup.KeyObject); err != nil {
+			fatalf("%s is not an encrypted copy. Error: %v\n", target, err)
+		} else if len(id) == 0 {
+			// Can't tell whether it's the key of the backup directory
+			fatalf("%s has a repository key of unknown id, rekey it with -i instead.\n", target)
+		}
+		if len(id) > 0 && id != lxdbackup.KeyID(k) {
+			fatalf("%s is encrypted with another repository key.\n", target)
+		}
+		wrapped, err := wrapKey(k, recipients)
+		if err != nil {
+			fatalf("Failed to wrap the repository key for %s. Error: %v\n", recipients, err)
+		}
+		if err := putCopyKey(b, k, wrapped); err != nil {
+			fatalf("Failed to put the repository key to %s. Error: %v\n", target, err)
+		}
+		fmt.Printf("%s is encrypted for the recipients of %s now.\n", target, recipients)
+	}
+}
+
+// decryptMain is lxd-backup decrypt, which fetches an encrypted copy into
+// a directory, to restore from.
+func decryptMain(args []string) {
+
+	var identity, to string
+
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&identity, "i", "", "age identity file, of one of the recipients the copy is encrypted for.")
+	fs.StringVar(&to, "to", "", "Directory to fetch the copy to.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s decrypt [options] -i identity -to dir copy [file...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(identity) == 0 || len(to) == 0 || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	b, err := lxdbackup.OpenBackend(fs.Arg(0))
+	if err != nil {
+		fatalf("Bad copy %s. Error: %v\n", fs.Arg(0), err)
+	}
+	key, err := targetKey(b, identity)
+	if err != nil {
+		fatalf("Failed to unwrap the repository key of %s. Error: %v\n", fs.Arg(0), err)
+	}
+	src := &lxdbackup.Encrypted{Backend: b, Key: key}
+	if err := os.MkdirAll(to, 0755); err != nil {
+		fatalf("Failed to create %s. Error: %v\n", to, err)
+	}
+	dest := &lxdbackup.Dir{Path: to}
+
+	names := fs.Args()[1:]
+	if len(names) == 0 {
+		files, err := src.List("lxd-backup-")
+		if err != nil {
+			fatalf("Failed to list %s. Error: %v\n", fs.Arg(0), err)
+		}
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+	}
+	for _, n := range names {
+		slog.Info("Decrypting", "file", n, "to", to)
+		if err := copyFile(src, dest, n, time.Time{}, lxdbackup.ObjectMeta{}); err != nil {
+			fatalf("Failed to decrypt %s. Error: %v\n", n, err)
+		}
+	}
+	fmt.Printf("Decrypted %d files to %s.\n", len(names), to)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// excludePaths is -exclude-path, left out of the backups of all containers.
+var excludePaths []string
+
+// includePaths is -include-path, the only paths backed up of the containers
+// without include in the config file.
+var includePaths []string
+
+// pathFilter decides what of the filesystem of a container goes into its
+// backups. Patterns are globs of path.Match, relative to the rootfs. One
+// starting with / matches the whole path, IE /var/cache/*, others the name
+// at any depth, IE *.tmp. What is in a matching directory is left out as
+// well, the directory itself is kept, empty.
+//
+// With include patterns, which must start with /, only what they match is
+// kept, with the directories leading to it, and the backups are partial.
+type pathFilter struct {
+	include []string
+	exclude []string
+}
+
+func newPathFilter(include, exclude []string) *pathFilter {
+	for _, p := range append(slices.Clone(include), exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			fatalf("Bad path pattern %s. Error: %v\n", p, err)
+		}
+	}
+	for _, p := range include {
+		if !strings.HasPrefix(p, "/") {
+			fatalf("Include path %s must start with /.\n", p)
+		}
+	}
+	return &pathFilter{include: include, exclude: exclude}
+}
+
+func (f *pathFilter) empty() bool {
+	return f == nil || len(f.include)+len(f.exclude) == 0
+}
+
+// partial tells whether only some paths are backed up.
+func (f *pathFilter) partial() bool {
+	return f != nil && len(f.include) > 0
+}
+
+// rootfsPath is the path in the container of the tar entry name, ok is
+// false for what isn't in the rootfs, IE the backup.yaml.
+func rootfsPath(name string) (string, bool) {
+	p, found := strings.CutPrefix(strings.TrimSuffix(name, "/"), rootfsPrefix)
+	if !found || (len(p) > 0 && p[0] != '/') {
+		return "", false
+	}
+	if len(p) == 0 {
+		return "/", true
+	}
+	return p, true
+}
+
+func matchPattern(pattern, p string) bool {
+	if !strings.HasPrefix(pattern, "/") {
+		p = path.Base(p)
+	}
+	ok, _ := path.Match(pattern, p)
+	return ok
+}
+
+// leadsTo tells whether the directory p is on the way to what pattern
+// matches, IE /srv for /srv/www/*.
+func leadsTo(pattern, p string) bool {
+	pp := strings.Split(strings.Trim(pattern, "/"), "/")
+	ps := strings.Split(strings.Trim(p, "/"), "/")
+	if p == "/" {
+		return true
+	}
+	if len(ps) >= len(pp) {
+		return false
+	}
+	for i := range ps {
+		if ok, _ := path.Match(pp[i], ps[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// included tells whether p is kept by the include patterns.
+func (f *pathFilter) included(p string, dir bool) bool {
+	for _, pattern := range f.include {
+		for q := p; ; q = path.Dir(q) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+			if q == "/" {
+				break
+			}
+		}
+		if dir && leadsTo(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// skip tells whether the tar entry hdr is to be left out.
+func (f *pathFilter) skip(hdr *tar.Header) bool {
+	if f.empty() {
+		return false
+	}
+	p, ok := rootfsPath(hdr.Name)
+	if !ok {
+		return false
+	}
+	if f.partial() && !f.included(p, hdr.Typeflag == tar.TypeDir) {
+		return true
+	}
+	for q := p; q != "/"; q = path.Dir(q) {
+		for _, pattern := range f.exclude {
+			if matchPattern(pattern, q) {
+				return q != p || hdr.Typeflag != tar.TypeDir
+			}
+		}
+	}
+	return false
+}
+
+// filterExport rewrites the export fname of j without what its filter
+// leaves out, with -sparse with sparse files as sparse entries, and with
+// -reproducible sorted. It is then compressed like the archives lxd-backup
+// writes itself.
+func filterExport(j *backupJob, fname string) {
+
+	if j.filter.empty() && !sparseFiles && !reproducible {
+		return
+	}
+
+	in := openArchive(fname)
+	defer in.Close()
+	tr := tar.NewReader(in)
+	// Of the export as it was, a new one is written if seekable
+	os.Remove(fname + ".index.json")
+	out := createArchive(fname, 0644)
+
+	var skipped int
+	var skippedBytes int64
+	err := eachEntry(tr, filepath.Dir(fname), func(hdr *tar.Header, r io.Reader) error {
+		if j.filter.skip(hdr) {
+			skipped++
+			skippedBytes += hdr.Size
+			return nil
+		}
+		if err := writeEntry(out, hdr, r); err != nil {
+			out.abort()
+			fatalf("Failed to copy %s of %s. Error: %v\n", hdr.Name, fname, err)
+		}
+		return nil
+	})
+	if err != nil {
+		out.abort()
+		fatalf("Failed to read content of tarfile: %s. Error: %v\n", fname, err)
+	}
+	out.Close()
+
+	j.manifest.Format = archiveFormat
+	if !j.filter.empty() {
+		j.manifest.Excluded = j.filter.exclude
+		j.manifest.Included = j.filter.include
+		slog.Info("Left out excluded paths", "name", j.name, "entries", skipped, "bytes", humanBytes(skippedBytes))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// exitHooks are registered from the goroutines of parallel backups too.
+var exitHooks struct {
+	sync.Mutex
+	hooks []func(msg string)
+}
+
+// atExit registers a function to run when lxd-backup gives up. Hooks run in
+// reverse order of registration and get the error message.
+func atExit(f func(msg string)) {
+	exitHooks.Lock()
+	defer exitHooks.Unlock()
+	exitHooks.hooks = append(exitHooks.hooks, f)
+}
+
+// exitTargetUnavailable is the exit code when the backup target can't be
+// used, EX_TEMPFAIL of sysexits.h, so the run may be retried later.
+const exitTargetUnavailable = 75
+
+// fatalPanics is set by the server, which gives up on an upload and not on
+// all of them, and while containers are backed up in parallel: fatalf
+// panics with a fatalError instead of exiting.
+var fatalPanics bool
+
+// fatalError is what fatalf panics with when fatalPanics is set, with the
+// code it would have exited with.
+type fatalError struct {
+	msg  string
+	code int
+}
+
+func (e fatalError) Error() string {
+	return e.msg
+}
+
+// fatalf is log.Fatalf, but runs the exit hooks before exiting.
+func fatalf(format string, v ...any) {
+	fatalExit(1, format, v...)
+}
+
+// fatalExit is fatalf with another exit code than 1.
+func fatalExit(code int, format string, v ...any) {
+	msg := fmt.Sprintf(format, v...)
+	slog.Error(strings.TrimSpace(msg))
+	if fatalPanics {
+		panic(fatalError{strings.TrimSpace(msg), code})
+	}
+	exit(code, msg)
+}
+
+// exit runs the exit hooks and exits with code.
+func exit(code int, msg string) {
+	exitHooks.Lock()
+	hooks := exitHooks.hooks
+	exitHooks.hooks = nil // A failing hook must not run the hooks again
+	exitHooks.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](msg)
+	}
+	os.Exit(code)
+}
+
+// recoverPanic turns a panic into fatalf, so the exit hooks run, IE to start
+// the stopped containers again. It is deferred first thing in main, and in
+// the goroutines lxd-backup starts, as a panic there can't be recovered
+// anywhere else. So it exits even when fatalPanics is set.
+func recoverPanic() {
+	r := recover()
+	if e, ok := r.(fatalError); ok {
+		exit(e.code, e.msg+"\n")
+	} else if r != nil {
+		msg := fmt.Sprintf("Panic: %v\n%s\n", r, debug.Stack())
+		slog.Error(strings.TrimSpace(msg))
+		exit(1, msg)
+	}
+}
+
+func fatal(v ...any) {
+	fatalf("%s", fmt.Sprint(v...))
+}
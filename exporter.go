@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// lxcExporter is the command that runs the exporter half of lxd-backup, IE
+// sudo -u lxd-exporter /usr/local/bin/lxd-backup. When set, this process
+// never talks to LXD itself, and the exporter never touches backup storage.
+var lxcExporter []string
+
+// exporterInstances are the instances of the current run, those it backs up
+// and those a crashed run left stopped. The exporter is told them with each
+// command, and only stops, starts or pauses those.
+var exporterInstances struct {
+	sync.Mutex
+	names []string
+}
+
+// exporterRun adds names to the instances of the current run.
+func exporterRun(names ...string) {
+	exporterInstances.Lock()
+	defer exporterInstances.Unlock()
+	exporterInstances.names = append(exporterInstances.names, names...)
+}
+
+// lxd is LXD for what the lxdbackup package knows how to ask of it.
+var lxd = &lxdbackup.CLI{Command: lxcCommand}
+
+func lxcCommand(args ...string) (*exec.Cmd, context.CancelFunc) {
+	return timedCommand(lxcTimeoutFor(args), "lxc", args)
+}
+
+func lxdCommand(args ...string) (*exec.Cmd, context.CancelFunc) {
+	return timedCommand(lxcTimeout, "lxd", args)
+}
+
+// lxcRun runs the lxc command args.
+func lxcRun(args ...string) error {
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	return cmd.Run()
+}
+
+// lxcOutput runs the lxc command args and returns what it printed.
+func lxcOutput(args ...string) ([]byte, error) {
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	return cmd.Output()
+}
+
+// timedCommand runs the lxc or lxd command args, through the exporter if
+// there is one, and kills it if it takes longer than timeout. The returned
+// function is called once the command is done.
+func timedCommand(timeout time.Duration, command string, args []string) (*exec.Cmd, context.CancelFunc) {
+
+	var cmd *exec.Cmd
+	ctx, cancel := timeoutContext(budgetTimeout(timeout, args))
+	if len(lxcExporter) == 0 && command == "lxc" {
+		name, args := pullCommand(args)
+		cmd = exec.CommandContext(ctx, name, args...)
+	} else if len(lxcExporter) == 0 {
+		cmd = exec.CommandContext(ctx, command, args...)
+	} else {
+		exporterInstances.Lock()
+		instances := strings.Join(exporterInstances.names, ",")
+		exporterInstances.Unlock()
+		exporterArgs := append(lxcExporter[1:len(lxcExporter):len(lxcExporter)], "exporter", "-instances", instances, command)
+		cmd = exec.CommandContext(ctx, lxcExporter[0], append(exporterArgs, args...)...)
+	}
+	cmd.Cancel = func() error {
+		slog.Warn("LXD command timed out, killing it", "command", command+" "+strings.Join(args, " "), "timeout", timeout)
+		return cmd.Process.Kill()
+	}
+	// Don't wait forever for what it started to let go of stdout
+	cmd.WaitDelay = 10 * time.Second
+	return cmd, cancel
+}
+
+// exportCommand runs an lxc export to the file to. With an exporter, or
+// when lxd-backup compresses, the export is streamed over stdout and
+// written here, as it is with -bwlimit or from a host over ssh. The export is written to
+// to.partial, and renamed to to by the returned function if it succeeded,
+// which is called once the command is done.
+func exportCommand(args []string, to string, compress bool) (*exec.Cmd, func()) {
+
+	var cmd *exec.Cmd
+	var cancel context.CancelFunc
+	succeeded := func() bool {
+		return cmd.ProcessState != nil && cmd.ProcessState.Success()
+	}
+
+	if len(lxcExporter) == 0 && !compress && bwLimit == 0 && !overSSH(args) {
+		partial := to + ".partial"
+		for i := range args {
+			if args[i] == to {
+				args[i] = partial
+			}
+		}
+		cmd, cancel = lxcCommand(args...)
+		return cmd, func() {
+			cancel()
+			if succeeded() {
+				commitPartial(partial, to)
+			} else {
+				os.Remove(partial)
+			}
+		}
+	}
+
+	for i := range args {
+		if args[i] == to {
+			args[i] = "-"
+		}
+	}
+
+	cmd, cancel = lxcCommand(args...)
+	w, done := exportSink(to, compress)
+	cmd.Stdout = w
+	return cmd, func() {
+		cancel()
+		done(succeeded())
+	}
+}
+
+// exportSink is where an export streamed to the file to is written,
+// compressed in -format if compress, and limited to -bwlimit. The returned
+// function is called once all is written, with whether the export
+// succeeded, and commits or removes it.
+func exportSink(to string, compress bool) (io.Writer, func(ok bool)) {
+
+	partial := to + ".partial"
+	commit := func(ok bool) {
+		if ok {
+			commitPartial(partial, to)
+		} else {
+			os.Remove(partial)
+		}
+	}
+
+	if compress && seekable && archiveFormat == "zstd" {
+		// Frames can only be cut where tar entries start
+		pr, pw := io.Pipe()
+		a := createArchive(to, 0600)
+		copied := make(chan error)
+		go func() {
+			defer recoverPanic()
+			err := copyTarStream(pr, a)
+			pr.CloseWithError(err)
+			copied <- err
+		}()
+		return pw, func(ok bool) {
+			pw.Close()
+			err := <-copied
+			if err != nil && ok {
+				a.abort()
+				fatalf("Failed to write %s. Error: %v\n", to, err)
+			} else if err != nil || !ok {
+				a.abort()
+				return
+			}
+			a.Close()
+		}
+	}
+
+	f, err := os.OpenFile(partial, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", to, err)
+	}
+	if !compress {
+		return throttleWriter(f), func(ok bool) {
+			f.Close()
+			commit(ok)
+		}
+	}
+
+	zw, err := newArchiveWriter(throttleWriter(f))
+	if err != nil {
+		fatalf("Failed write %s as %s compressed file. Error: %v\n", to, archiveFormat, err)
+	}
+	return zw, func(ok bool) {
+		if err := zw.Close(); err != nil && ok {
+			fatalf("Failed to compress %s. Error: %v\n", to, err)
+		}
+		f.Close()
+		commit(ok)
+	}
+}
+
+// exporterQueries are the API paths the exporter may GET for the archiver.
+var exporterQueries = []*regexp.Regexp{
+	regexp.MustCompile(`^/1\.0$`),
+	regexp.MustCompile(`^/1\.0/instances/[^/?]+(\?project=[^/&]+)?$`),
+	regexp.MustCompile(`^/1\.0/instances/[^/?]+/(state|snapshots)$`),
+	regexp.MustCompile(`^/1\.0/storage-pools/[^/?]+$`),
+	regexp.MustCompile(`^/1\.0/storage-pools/[^/?]+/volumes/custom/[^/?]+/state$`),
+}
+
+// exportCompressionArg is what --compression of an export may be, IE
+// zstd -19 -T0, and exportVersionArg what --export-version may be.
+var (
+	exportCompressionArg = regexp.MustCompile(`^(none|zstd|gzip|xz)( -T?\d+)*$`)
+	exportVersionArg     = regexp.MustCompile(`^\d+$`)
+)
+
+// operand tells whether a is a name or value, and not an option.
+func operand(a string) bool {
+	return len(a) > 0 && !strings.HasPrefix(a, "-")
+}
+
+// isJournal tells whether a is the agent journal of an instance, as lxc
+// file takes it.
+func isJournal(a string) bool {
+	name, ok := strings.CutSuffix(a, agentJournal)
+	return ok && operand(name) && !strings.Contains(name, "/")
+}
+
+// exportOptions tells whether a are options lxd-backup gives an export,
+// see exportFlags.
+func exportOptions(a []string) bool {
+	for i := 0; i < len(a); i++ {
+		f, v, hasValue := strings.Cut(a[i], "=")
+		if !hasValue && (f == "--compression" || f == "--export-version") && i+1 < len(a) {
+			i++
+			v, hasValue = a[i], true
+		}
+		switch {
+		case !hasValue && (f == "-q" || f == "--instance-only" || f == "--volume-only" || f == "--optimized-storage"):
+		case hasValue && f == "--compression" && exportCompressionArg.MatchString(v):
+		case hasValue && f == "--export-version" && exportVersionArg.MatchString(v):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// exporterAllowed tells whether the exporter agrees to run args: only the
+// lxc commands lxd-backup runs, with all their arguments checked. Only the
+// instances of the run may be stopped, started or paused, and only the
+// devices of the instance being restored, restore, masked. Nothing else
+// changes an instance beyond its lock, or writes to the API.
+func exporterAllowed(args []string, instances map[string]bool, restore string) bool {
+
+	if len(args) == 3 && args[0] == "lxd" && args[1] == "init" && args[2] == "--dump" {
+		return true
+	}
+	if len(args) < 2 || args[0] != "lxc" {
+		return false
+	}
+	a := args[1:]
+	// As projectArgs adds it
+	if n := len(a); n > 2 && a[n-2] == "--project" && operand(a[n-1]) {
+		a = a[:n-2]
+	}
+
+	// is tells whether a is shape, "" for any operand
+	is := func(shape ...string) bool {
+		if len(a) < len(shape) || (len(a) > len(shape) && shape[len(shape)-1] != "...") {
+			return false
+		}
+		for i, s := range shape {
+			switch {
+			case s == "...":
+				return true
+			case s == "" && !operand(a[i]), s != "" && a[i] != s:
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case is("version"), is("project", "get-current"), is("list", "-c", "nsLP", "-f", "csv"),
+		is("image", "list", "-f", "csv", "-c", "F"), is("storage", "list", "-f", "csv"),
+		is("storage", "volume", "list", "", "-f", "csv"), is("storage", "volume", "show", "", ""),
+		is("profile", "show", ""), is("config", "get", "", ""), is("config", "show", ""),
+		is("config", "show", "", "--expanded"), is("config", "device", "show", ""),
+		is("config", "unset", "", lockKey):
+		return true
+	case is("stop", ""), is("start", ""), is("pause", ""):
+		return instances[a[1]]
+	case is("config", "device", "remove", "", ""), is("config", "device", "add", "", "", "none"):
+		return len(restore) > 0 && a[3] == restore
+	case is("version", ""):
+		return strings.HasSuffix(a[1], ":")
+	case is("query", ""):
+		for _, re := range exporterQueries {
+			if re.MatchString(a[1]) && !strings.Contains(a[1], "..") {
+				return true
+			}
+		}
+	case is("project", "get", "", ""), is("project", "set", "", "", ""), is("project", "unset", "", ""):
+		return strings.HasPrefix(a[3], lockKey+".")
+	case is("file", "pull", "", "-"):
+		return isJournal(a[2])
+	case is("file", "push", "-", ""):
+		return isJournal(a[3])
+	case is("export", "", "-", "..."):
+		return exportOptions(a[3:])
+	case is("storage", "volume", "export", "", "", "-", "..."):
+		return exportOptions(a[6:])
+	}
+	return false
+}
+
+// exporterMain is the half of lxd-backup that talks to LXD. It runs lxc
+// for the archiver, and streams exports to stdout instead of writing them.
+func exporterMain(args []string) {
+
+	var instanceList, restore string
+
+	fs := flag.NewFlagSet("exporter", flag.ExitOnError)
+	fs.StringVar(&instanceList, "instances", "", "Comma separated instances of the run, the only ones that may be stopped, started or paused.")
+	fs.StringVar(&restore, "restore", "", "Instance being restored, the only one whose network devices may be masked.")
+	fs.Parse(args)
+	args = fs.Args()
+
+	instances := make(map[string]bool)
+	for _, n := range strings.Split(instanceList, ",") {
+		if len(n) > 0 {
+			instances[n] = true
+		}
+	}
+
+	if len(args) < 2 {
+		fatal("Usage: lxd-backup exporter lxc|lxd args...")
+	}
+
+	if !exporterAllowed(args, instances, restore) && !liveCommand(args) {
+		fatalf("The exporter refuses to run: %s\n", strings.Join(args, " "))
+	}
+
+	// Where the export is written, streamed from there
+	export := -1
+	if args[0] == "lxc" && args[1] == "export" {
+		export = 3
+	} else if args[0] == "lxc" && args[1] == "storage" && args[3] == "export" {
+		export = 6
+	}
+
+	var tmp string
+	if export >= 0 {
+		dir, err := os.MkdirTemp("", "lxd-backup-exporter-")
+		if err != nil {
+			fatalf("Failed to create temporary directory. Error: %v\n", err)
+		}
+		defer os.RemoveAll(dir)
+		tmp = filepath.Join(dir, "export")
+		args[export] = tmp
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	if export < 0 {
+		cmd.Stdout = os.Stdout
+	}
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			os.Exit(e.ExitCode())
+		}
+		fatalf("Failed to run %s. Error: %v\n", args[0], err)
+	}
+
+	if export >= 0 {
+		f, err := os.Open(tmp)
+		if err != nil {
+			fatalf("Failed to open export. Error: %v\n", err)
+		}
+		defer f.Close()
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			fatalf("Failed to stream export. Error: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExporterAllowed(t *testing.T) {
+
+	for _, c := range []struct {
+		args string
+		want bool
+	}{
+		{"lxd init --dump", true},
+		{"lxd init", false},
+		{"lxc version", true},
+		{"lxc version remote:", true},
+		{"lxc version remote", false},
+		{"lxc list -c nsLP -f csv", true},
+		{"lxc list -c nsLP -f csv --project web", true},
+		{"lxc list -c n -f csv", false},
+		{"lxc stop web", true},
+		{"lxc stop db", false}, // Not of the run
+		{"lxc start web", true},
+		{"lxc pause db", false},
+		{"lxc stop --force web", false},
+		{"lxc stop web --project", false},
+		{"lxc delete web", false},
+		{"lxc exec web -- sh", false},
+		{"lxc config show web --expanded", true},
+		{"lxc config set web limits.cpu 2", false},
+		{"lxc config device remove web eth0", false}, // Not restored
+		{"lxc config device remove new eth0", true},
+		{"lxc config device add new eth0 none", true},
+		{"lxc config device add web eth0 none", false},
+		{"lxc config device add new eth0 nic", false},
+		{"lxc config unset web user.lxd-backup.lock", true},
+		{"lxc config unset web security.privileged", false},
+		{"lxc project set default user.lxd-backup.lock.web run", true},
+		{"lxc project set default limits.instances 1", false},
+		{"lxc query /1.0/instances/web", true},
+		{"lxc query /1.0/instances/web/state", true},
+		{"lxc query /1.0/instances/../certificates", false},
+		{"lxc query -X DELETE /1.0/instances/web", false},
+		{"lxc file pull web/var/lib/lxd-backup/journal -", true},
+		{"lxc file pull web/etc/shadow -", false},
+		{"lxc file push - web/var/lib/lxd-backup/journal", true},
+		{"lxc export web - -q --instance-only", true},
+		{"lxc export web - --compression zstd", true},
+		{"lxc export web - --compression=xz -T4", false},
+		{"lxc export web - --compression", false},
+		{"lxc export web - --export-version 2", true},
+		{"lxc export web /tmp/x", false},
+		{"lxc export web - --compression zstd;rm", false},
+		{"lxc storage volume export default data - --volume-only", true},
+		{"lxc storage volume export default data /tmp/x", false},
+		{"sh -c true", false},
+		{"lxc", false},
+	} {
+		if got := exporterAllowed(strings.Fields(c.args), map[string]bool{"web": true}, "new"); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.args, got, c.want)
+		}
+	}
+
+	// Nothing is restored, and nothing is of the run
+	for _, args := range []string{"lxc config device remove web eth0", "lxc config device add web eth0 none", "lxc stop web"} {
+		if exporterAllowed(strings.Fields(args), nil, "") {
+			t.Errorf("%s: allowed without instances", args)
+		}
+	}
+}
+
+func TestLiveCommand(t *testing.T) {
+
+	for _, c := range []struct {
+		args string
+		want bool
+	}{
+		{"lxc snapshot web lxd-backup-live --stateful", true},
+		{"lxc snapshot web other --stateful", false},
+		{"lxc snapshot web lxd-backup-live", false},
+		{"lxc copy web/lxd-backup-live web-lxd-backup-live", true},
+		{"lxc copy web/lxd-backup-live db-lxd-backup-live", false},
+		{"lxc copy web db", false},
+		{"lxc delete web/lxd-backup-live", true},
+		{"lxc delete --force web-lxd-backup-live", true},
+		{"lxc delete --force web", false},
+		{"lxc delete web", false},
+		{"lxc delete -f web-lxd-backup-live", false},
+		{"lxc delete --force web-lxd-backup-live db", false},
+		{"lxc stop web", false},
+	} {
+		if got := liveCommand(strings.Fields(c.args)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.args, got, c.want)
+		}
+	}
+}
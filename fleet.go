@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestHeader carries the manifest of an upload, JSON in base64.
+const manifestHeader = "X-Lxd-Backup-Manifest"
+
+// serverMode is set by lxd-backup server. Instead of backing up the
+// containers of this host, exports uploaded by host agents are backed up.
+var serverMode bool
+
+// tlsFiles are the certificate, key and CA in PEM of one side of the
+// mutual TLS between host agents and the server.
+type tlsFiles struct {
+	cert, key, ca string
+}
+
+// config is the TLS config of the server or, with server false, of an
+// agent. Both only trust certificates signed by the CA.
+func (t *tlsFiles) config(server bool) *tls.Config {
+	if len(t.cert) == 0 || len(t.key) == 0 || len(t.ca) == 0 {
+		fatal("-tls-cert, -tls-key and -tls-ca are all needed.")
+	}
+	cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+	if err != nil {
+		fatalf("Failed to load %s and %s. Error: %v\n", t.cert, t.key, err)
+	}
+	pem, err := os.ReadFile(t.ca)
+	if err != nil {
+		fatalf("Failed to read %s. Error: %v\n", t.ca, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		fatalf("No certificates in %s.\n", t.ca)
+	}
+	c := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if server {
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		c.RootCAs = pool
+	}
+	return c
+}
+
+// uploadResult is the answer of the server to an upload.
+type uploadResult struct {
+	Status  string `json:"status"`
+	Changed int    `json:"changed,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// agentServer backs up what host agents upload, one at a time.
+type agentServer struct {
+	mu      sync.Mutex
+	s       *schedule
+	conf    *config
+	hc      *healthcheck
+	budget  time.Duration
+	tempDir string
+}
+
+// serveAgents listens on addr for host agents until killed.
+func serveAgents(addr string, t *tlsFiles, a *agentServer) {
+
+	fatalPanics = true
+	concurrentJobs = true // Bars are logged
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/backups/", a.upload)
+	srv := &http.Server{Addr: addr, Handler: mux, TLSConfig: t.config(true)}
+
+	slog.Info("Waiting for host agents", "listen", addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		fatalPanics = false
+		fatalf("Failed to listen on %s. Error: %v\n", addr, err)
+	}
+}
+
+func (a *agentServer) upload(w http.ResponseWriter, r *http.Request) {
+
+	reply := func(code int, res uploadResult) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(res)
+	}
+
+	host := r.TLS.PeerCertificates[0].Subject.CommonName
+	name := strings.TrimPrefix(r.URL.Path, "/v1/backups/")
+	if r.Method != http.MethodPut {
+		reply(http.StatusMethodNotAllowed, uploadResult{Status: "failed", Error: "only PUT"})
+		return
+	}
+	if !safeName(host) || strings.HasPrefix(host, "lxd-backup-") {
+		reply(http.StatusForbidden, uploadResult{Status: "failed", Error: "bad certificate common name"})
+		return
+	}
+	if !safeName(name) {
+		reply(http.StatusBadRequest, uploadResult{Status: "failed", Error: "bad container name"})
+		return
+	}
+	m := &manifest{}
+	d, err := base64.StdEncoding.DecodeString(r.Header.Get(manifestHeader))
+	if err == nil {
+		err = json.Unmarshal(d, m)
+	}
+	if err != nil || m.Container != name {
+		reply(http.StatusBadRequest, uploadResult{Status: "failed", Error: "bad manifest"})
+		return
+	}
+
+	// Received before waiting for the others, so the agent is done sooner
+	tmp := tempExportName(a.tempDir, "upload-"+name)
+	defer os.Remove(tmp)
+	if err := receiveUpload(r, tmp); err != nil {
+		slog.Warn("Upload failed", "name", name, "host", host, "error", err)
+		reply(http.StatusBadRequest, uploadResult{Status: "failed", Error: err.Error()})
+		return
+	}
+	slog.Info("Received", "name", name, "host", host)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	res, code := a.backup(host, name, tmp, m)
+	reply(code, res)
+}
+
+// safeName tells whether name can be a file name in the backup directory.
+func safeName(name string) bool {
+	return len(name) > 0 && !strings.ContainsAny(name, "/\\") && !strings.HasPrefix(name, ".")
+}
+
+// hostPrefix is the lxdBackupPrefix of the backups of host, in a directory
+// of its own, so the containers of two hosts may have the same name.
+func hostPrefix(lxdBackupPrefix, host string) string {
+	return filepath.Join(filepath.Dir(lxdBackupPrefix), host, filepath.Base(lxdBackupPrefix))
+}
+
+// receiveUpload writes the body of r to fname, all of it or an error.
+func receiveUpload(r *http.Request, fname string) error {
+	f, err := os.OpenFile(fname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, r.Body)
+	if err != nil {
+		return err
+	}
+	if r.ContentLength >= 0 && n != r.ContentLength {
+		return fmt.Errorf("got %d bytes of %d", n, r.ContentLength)
+	}
+	return f.Close()
+}
+
+// backup backs up the export fname of name uploaded by host, as a backup
+// run would have.
+func (a *agentServer) backup(host, name, fname string, m *manifest) (res uploadResult, code int) {
+
+	// Containers of different hosts may have the same name
+	prefix := hostPrefix(a.s.prefix, host)
+	if dir := filepath.Dir(prefix); !fileExists(dir) {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return uploadResult{Status: "failed", Error: err.Error()}, http.StatusInternalServerError
+		}
+	}
+	m.Host = host
+
+	jobLock, err := acquireLock(prefix+name+".lock", "backup of "+name)
+	var locked *lockedError
+	if errors.As(err, &locked) {
+		slog.Warn("Skipping, it is locked", "name", name, "held-by", locked.holder.String())
+		return uploadResult{Status: "skipped"}, http.StatusConflict
+	} else if err != nil {
+		return uploadResult{Status: "failed", Error: err.Error()}, http.StatusInternalServerError
+	}
+	defer jobLock.release()
+
+	now := nowUTC()
+	s := *a.s
+	s.prefix = prefix
+	s.tiers = loadTierState(prefix)
+	if s.repo != nil {
+		s.repo = openRepo(filepath.Dir(prefix))
+	}
+	s.now = now
+	s.runID = fileTimestamp(now)
+	s.quarter = s.retention.FullSuffix(now)
+	s.deltas = deltaSlots(s.retention, now)
+
+	j := &backupJob{
+		name:     name,
+		before:   func() {},
+		after:    func() {},
+		manifest: m,
+		export: func(to string) {
+			if err := moveFile(fname, to); err != nil {
+				fatalf("Failed to move %s to %s. Error: %v\n", fname, to, err)
+			}
+		},
+	}
+	j.profiles = m.Profiles
+
+	a.hc.containerStart(name)
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		e, ok := r.(fatalError)
+		if !ok {
+			panic(r)
+		}
+		a.hc.containerDone(name, true, e.Error())
+		appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: name, Status: "failed", Error: e.Error()})
+		res, code = uploadResult{Status: "failed", Error: e.Error()}, http.StatusInternalServerError
+	}()
+
+	configureJob(j, a.conf)
+	if st, err := os.Stat(fname); err == nil {
+		if err := checkSpace(j, &s, st.Size()); err != nil {
+			fatalf("Not enough space to back up %s: %v\n", name, err)
+		}
+	}
+	budget := a.budget
+	if d := a.conf.container(name).maxDuration; d > 0 {
+		budget = d
+	}
+	if err := backupWithBudget(j, &s, budget); err != nil {
+		a.hc.containerDone(name, true, err.Error())
+		appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: name, Status: "failed", Error: err.Error()})
+		return uploadResult{Status: "failed", Error: err.Error()}, http.StatusInternalServerError
+	}
+	a.hc.containerDone(name, false, j.status)
+	for _, msg := range sizeAnomalies(s.prefix, s.runID, j) {
+		slog.Warn(msg, "host", host)
+	}
+	writeRestorePlan(s.prefix, name, s.retention)
+	linkLayout(s.prefix, name, s.retention)
+	slog.Info("Backed up upload", "name", name, "host", host, "status", j.status)
+	return uploadResult{Status: j.status, Changed: j.changed}, http.StatusOK
+}
+
+// hostAgentMain exports the containers of this host and uploads them to
+// an lxd-backup server, which does everything else.
+func hostAgentMain(args []string) {
+
+	var server, tempDir, configFile string
+	var contExcStr, contIncStr string
+	var t tlsFiles
+
+	fs := flag.NewFlagSet("host-agent", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	lxdOpts := addLxdFlags(fs)
+	fs.StringVar(&server, "server", "", "URL of the lxd-backup server, IE https://backup.example.com:8443.")
+	fs.StringVar(&t.cert, "tls-cert", "", "Certificate of this agent in PEM, signed by -tls-ca. Its common name is the host the server knows it as.")
+	fs.StringVar(&t.key, "tls-key", "", "Private key of -tls-cert in PEM.")
+	fs.StringVar(&t.ca, "tls-ca", "", "CA certificate in PEM the server certificate must be signed by.")
+	fs.StringVar(&tempDir, "t", os.TempDir(), "Directory to export to before uploading.")
+	fs.StringVar(&configFile, "config", "", "JSON config file with per container settings, for how they are exported.")
+	fs.StringVar(&contExcStr, "ec", "", "Containers to exclude from backup. Comma separated.")
+	fs.StringVar(&contIncStr, "ic", "", "Containers to include in backup. Comma separated.")
+	fs.BoolVar(&freezeBackup, "freeze", false, "Pause running containers for their export instead of stopping them.")
+	fs.BoolVar(&liveBackup, "live", false, "Checkpoint running containers with CRIU instead of stopping them.")
+	fs.BoolVar(&backupSnapshots, "snapshots", false, "Include the snapshots of the containers.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s host-agent [options] -server url\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(server) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(contExcStr) > 0 && len(contIncStr) > 0 {
+		fatal("You can only include or exclude containers. Not include and exclude.")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: t.config(false)}}
+	defer lxdOpts.setup(true)()
+	conf := loadConfig(configFile)
+
+	// Stopped containers are started again should the agent die
+	intents = openIntentLog(filepath.Join(tempDir, "lxd-backup-agent-"), nil)
+	intents.recover()
+	atExit(func(string) { intents.recover() })
+
+	toMap := func(s string) map[string]bool {
+		m := make(map[string]bool)
+		for _, v := range strings.Split(s, ",") {
+			if len(v) > 0 {
+				m[v] = true
+			}
+		}
+		return m
+	}
+	containers := filterCont(lxcList(), toMap(contExcStr), false)
+	containers = filterCont(containers, toMap(contIncStr), true)
+
+	var failed []string
+	for _, c := range containers {
+		j := containerJob(c, conf)
+		if err := exportAndUpload(client, server, j, tempDir); err != nil {
+			slog.Error("Backup failed", "name", j.name, "error", err)
+			failed = append(failed, j.name)
+		}
+	}
+	if len(failed) > 0 {
+		fatalf("%d of %d containers failed: %s\n", len(failed), len(containers), strings.Join(failed, ", "))
+	}
+}
+
+// exportAndUpload exports j to tempDir, starts it again and uploads the
+// export to the server.
+func exportAndUpload(client *http.Client, server string, j *backupJob, tempDir string) error {
+
+	fname := tempExportName(tempDir, j.name)
+	defer os.Remove(fname)
+
+	j.before()
+	func() {
+		defer j.after()
+		j.export(fname)
+	}()
+
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	m, err := json.Marshal(j.manifest)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(server, "/")+"/v1/backups/"+url.PathEscape(j.name), f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = st.Size()
+	req.Header.Set(manifestHeader, base64.StdEncoding.EncodeToString(m))
+
+	slog.Info("Uploading", "name", j.name, "size", humanBytes(st.Size()))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res uploadResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("%s from server", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", resp.Status, res.Status, res.Error)
+	}
+	slog.Info("Backed up", "name", j.name, "status", res.Status, "changed", res.Changed)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// forecastDays is how long before a quarter rollover it is forecast.
+const forecastDays = 7
+
+// nextRollover returns when, within forecastDays, the quarter, or whatever
+// full backups are made of, is going to change, or the zero time if it isn't.
+func nextRollover(rc *retentionConfig, now time.Time) time.Time {
+	for d := 1; d <= forecastDays; d++ {
+		t := now.AddDate(0, 0, d)
+		if rc.FullSuffix(t) != rc.FullSuffix(now) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// forecastRollover checks the week before a quarter rollover that there is
+// room for the new full backups, which are about the size of the current
+// ones. Problems are added as warnings to the run report, so they are alerted on
+// while there still is time to do something about it.
+func forecastRollover(s *schedule, backupTarget string, names []string, history map[string]historyEntry, report *runReport) {
+
+	rollover := nextRollover(s.retention, s.now)
+	if rollover.IsZero() {
+		return
+	}
+
+	var need int64
+	for _, name := range names {
+		if size := archiveSize(findArchive(backupPrefix(s.prefix, name, s.quarter) + name + s.quarter)); size > 0 {
+			need += size
+		} else {
+			need += history[name].Bytes
+		}
+	}
+
+	free, err := diskFree(backupTarget)
+	if err != nil {
+		slog.Warn("Can't forecast quarter rollover", "error", err)
+		return
+	}
+
+	slog.Info("Quarter rollover forecast", "rollover", displayTime(rollover), "needed", humanBytes(need), "free", humanBytes(free))
+
+	if need > free {
+		report.warn(fmt.Sprintf("Quarter rollover %s needs about %s for new full backups, only %s is free in %s",
+			displayTime(rollover), humanBytes(need), humanBytes(free), backupTarget))
+	}
+}
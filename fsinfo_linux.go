@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// diskFree returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// isMountPoint tells whether path is where a filesystem is mounted, IE not
+// on the same device as its parent.
+func isMountPoint(path string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Join(path, ".."), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino, nil
+}
+
+// networkFilesystems are the statfs magic numbers of filesystems reached
+// over the network, and FUSE, which often is, IE sshfs or rclone mount.
+var networkFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x5346414f: "afs",
+	0x65735546: "fuse",
+}
+
+// networkFilesystem returns the kind of network filesystem path is on, or
+// an empty string if it is local.
+func networkFilesystem(path string) (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", err
+	}
+	return networkFilesystems[int64(st.Type)], nil
+}
+
+// fileGroup is the name of the group owning path.
+func fileGroup(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(int(st.Gid)))
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free space is only known on Linux")
+}
+
+func isMountPoint(path string) (bool, error) {
+	return false, errors.New("mount points are only known on Linux")
+}
+
+func networkFilesystem(path string) (string, error) {
+	return "", errors.New("filesystem types are only known on Linux")
+}
+
+func fileGroup(path string) (string, error) {
+	return "", errors.New("groups of files are only known on Linux")
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// A small read only FUSE server, speaking the kernel protocol over
+// /dev/fuse directly, see linux/fuse.h. Requests are served one at a time.
+
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseReadlink    = 5
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseMaxWrite = 128 << 10
+
+	// Nothing ever changes, the kernel may cache names and attributes as
+	// long as it likes
+	fuseValid = 24 * 60 * 60
+)
+
+var ne = binary.NativeEndian
+
+// fuseConn is a mounted FUSE filesystem.
+type fuseConn struct {
+	fd         int
+	mountpoint string
+	viaHelper  bool // Mounted by fusermount, as lxd-backup isn't root
+}
+
+// mountFuse mounts a FUSE filesystem at mountpoint. As root it does so
+// itself, otherwise it has fusermount do it. Only its owner may use it,
+// other users too with allowOther.
+func mountFuse(mountpoint, fsname string, allowOther bool) *fuseConn {
+
+	c := &fuseConn{mountpoint: mountpoint}
+	if os.Geteuid() != 0 {
+		c.fd = fusermount(mountpoint, fsname)
+		c.viaHelper = true
+		return c
+	}
+
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		fatalf("Failed to open /dev/fuse. Error: %v\n", err)
+	}
+	if st, err := os.Stat(mountpoint); err != nil || !st.IsDir() {
+		fatalf("%s is not a directory to mount on.\n", mountpoint)
+	}
+	opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0,default_permissions", fd)
+	if allowOther {
+		opts += ",allow_other"
+	}
+	if err := syscall.Mount("lxd-backup:"+fsname, mountpoint, "fuse.lxd-backup", syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, opts); err != nil {
+		fatalf("Failed to mount %s. Error: %v\n", mountpoint, err)
+	}
+	c.fd = fd
+	return c
+}
+
+// fusermount mounts mountpoint with the setuid fusermount helper, which
+// hands back the /dev/fuse descriptor over a socket.
+func fusermount(mountpoint, fsname string) int {
+
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		fatalf("Failed to create socket for fusermount. Error: %v\n", err)
+	}
+	ours, theirs := os.NewFile(uintptr(pair[0]), "fusermount"), os.NewFile(uintptr(pair[1]), "fusermount")
+	defer ours.Close()
+
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		helper, err = exec.LookPath("fusermount")
+	}
+	if err != nil {
+		fatal("Mounting without being root needs fusermount3 or fusermount.")
+	}
+	cmd := exec.Command(helper, "-o", "ro,nosuid,nodev,default_permissions,fsname=lxd-backup:"+fsname+",subtype=lxd-backup", "--", mountpoint)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{theirs}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	theirs.Close()
+	if err != nil {
+		fatalf("Failed to run %s. Error: %v\n", helper, err)
+	}
+
+	buf, oob := make([]byte, 4), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(pair[0], buf, oob, 0)
+	if err != nil {
+		fatalf("Failed to receive /dev/fuse from %s. Error: %v\n", helper, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err == nil && len(msgs) > 0 {
+		var fds []int
+		if fds, err = syscall.ParseUnixRights(&msgs[0]); err == nil && len(fds) > 0 {
+			return fds[0]
+		}
+	}
+	fatalf("%s didn't hand over /dev/fuse. Error: %v\n", helper, err)
+	return -1
+}
+
+func (c *fuseConn) unmount() {
+	if c.viaHelper {
+		for _, helper := range []string{"fusermount3", "fusermount"} {
+			if exec.Command(helper, "-u", "-z", c.mountpoint).Run() == nil {
+				return
+			}
+		}
+		slog.Warn("Failed to unmount", "mountpoint", c.mountpoint)
+		return
+	}
+	if err := syscall.Unmount(c.mountpoint, syscall.MNT_DETACH); err != nil {
+		slog.Warn("Failed to unmount", "mountpoint", c.mountpoint, "error", err)
+	}
+}
+
+func (c *fuseConn) reply(unique uint64, errno syscall.Errno, data []byte) {
+	out := make([]byte, 16, 16+len(data))
+	ne.PutUint32(out[0:], uint32(16+len(data)))
+	ne.PutUint32(out[4:], uint32(-int32(errno)))
+	ne.PutUint64(out[8:], unique)
+	out = append(out, data...)
+	if _, err := syscall.Write(c.fd, out); err != nil && !errors.Is(err, syscall.ENOENT) {
+		// ENOENT is an interrupted request, anything else is worth knowing
+		slog.Warn("Failed to answer FUSE request", "error", err)
+	}
+}
+
+// fuseMode is the file type and permissions of n.
+func fuseMode(n *mountNode) uint32 {
+	mode := uint32(n.hdr.Mode) & 07777
+	switch n.hdr.Typeflag {
+	case tar.TypeDir:
+		return mode | syscall.S_IFDIR
+	case tar.TypeSymlink:
+		return mode | syscall.S_IFLNK
+	case tar.TypeChar:
+		return mode | syscall.S_IFCHR
+	case tar.TypeBlock:
+		return mode | syscall.S_IFBLK
+	case tar.TypeFifo:
+		return mode | syscall.S_IFIFO
+	}
+	return mode | syscall.S_IFREG
+}
+
+// fuseAttr is struct fuse_attr of n.
+func fuseAttr(n *mountNode) []byte {
+
+	var rdev uint32
+	if n.hdr.Typeflag == tar.TypeChar || n.hdr.Typeflag == tar.TypeBlock {
+		major, minor := uint32(n.hdr.Devmajor), uint32(n.hdr.Devminor)
+		rdev = (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12
+	}
+	nlink := uint32(1)
+	if n.children != nil {
+		nlink = 2
+	}
+	size := uint64(n.size)
+	if n.hdr.Typeflag == tar.TypeSymlink {
+		size = uint64(len(n.hdr.Linkname))
+	}
+	mtime := n.hdr.ModTime
+
+	b := make([]byte, 0, 88)
+	b = ne.AppendUint64(b, n.ino)
+	b = ne.AppendUint64(b, size)
+	b = ne.AppendUint64(b, (size+511)/512)
+	for i := 0; i < 3; i++ { // atime, mtime, ctime
+		b = ne.AppendUint64(b, uint64(mtime.Unix()))
+	}
+	for i := 0; i < 3; i++ {
+		b = ne.AppendUint32(b, uint32(mtime.Nanosecond()))
+	}
+	b = ne.AppendUint32(b, fuseMode(n))
+	b = ne.AppendUint32(b, nlink)
+	b = ne.AppendUint32(b, uint32(n.hdr.Uid))
+	b = ne.AppendUint32(b, uint32(n.hdr.Gid))
+	b = ne.AppendUint32(b, rdev)
+	b = ne.AppendUint32(b, 4096) // blksize
+	b = ne.AppendUint32(b, 0)    // flags
+	return b
+}
+
+// fuseEntry is struct fuse_entry_out of n.
+func fuseEntry(n *mountNode) []byte {
+	b := make([]byte, 0, 128)
+	b = ne.AppendUint64(b, n.ino)
+	b = ne.AppendUint64(b, 0) // generation
+	b = ne.AppendUint64(b, fuseValid)
+	b = ne.AppendUint64(b, fuseValid)
+	b = ne.AppendUint32(b, 0)
+	b = ne.AppendUint32(b, 0)
+	return append(b, fuseAttr(n)...)
+}
+
+// fuseDirents packs the entries of directory n from number off on, as much
+// as fits into size bytes.
+func fuseDirents(n *mountNode, off uint64, size int) []byte {
+
+	var b []byte
+	names := append([]string{".", ".."}, n.names...)
+	for i := off; i < uint64(len(names)); i++ {
+		name := names[i]
+		child := n
+		if i >= 2 {
+			child = n.children[name]
+		}
+		rec := 24 + len(name)
+		pad := (rec + 7) &^ 7
+		if len(b)+pad > size {
+			break
+		}
+		b = ne.AppendUint64(b, child.ino)
+		b = ne.AppendUint64(b, i+1) // Offset of the next
+		b = ne.AppendUint32(b, uint32(len(name)))
+		b = ne.AppendUint32(b, (fuseMode(child)&syscall.S_IFMT)>>12)
+		b = append(b, name...)
+		b = append(b, make([]byte, pad-rec)...)
+	}
+	return b
+}
+
+// serveFuse mounts t at mountpoint and answers the kernel until it is
+// unmounted.
+func serveFuse(t *mountTree, mountpoint, fsname string, allowOther bool) {
+
+	if allowOther && os.Geteuid() != 0 {
+		fatal("-allow-other needs root.")
+	}
+	if allowOther {
+		// Other users only get in with the capabilities of root
+		t.restrictRoot()
+	}
+	c := mountFuse(mountpoint, fsname, allowOther)
+	atExit(func(string) { c.unmount() })
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		slog.Info("Unmounting", "mountpoint", mountpoint)
+		c.unmount()
+	}()
+
+	buf := make([]byte, fuseMaxWrite+4096)
+	for {
+		n, err := syscall.Read(c.fd, buf)
+		if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOENT) {
+			continue
+		} else if errors.Is(err, syscall.ENODEV) {
+			break // Unmounted
+		} else if err != nil {
+			fatalf("Failed to read from /dev/fuse. Error: %v\n", err)
+		}
+		if n < 40 {
+			continue
+		}
+		if !c.handle(t, buf[:n]) {
+			break
+		}
+	}
+	syscall.Close(c.fd)
+	slog.Info("Unmounted", "mountpoint", mountpoint)
+}
+
+// handle answers one request. Returns false once the filesystem is done.
+func (c *fuseConn) handle(t *mountTree, req []byte) bool {
+
+	opcode := ne.Uint32(req[4:])
+	unique := ne.Uint64(req[8:])
+	node := t.lookup(ne.Uint64(req[16:]))
+	in := req[40:]
+
+	if opcode == fuseForget || opcode == fuseBatchForget || opcode == fuseInterrupt {
+		return true // Never answered
+	}
+	if node == nil && opcode != fuseInit && opcode != fuseDestroy && opcode != fuseStatfs {
+		c.reply(unique, syscall.ENOENT, nil)
+		return true
+	}
+
+	switch opcode {
+	case fuseInit:
+		if len(in) < 16 || ne.Uint32(in) != 7 {
+			c.reply(unique, syscall.EPROTO, nil)
+			return false
+		}
+		b := make([]byte, 0, 64)
+		b = ne.AppendUint32(b, 7)
+		b = ne.AppendUint32(b, 31)
+		b = ne.AppendUint32(b, ne.Uint32(in[8:])) // max_readahead as the kernel likes
+		b = ne.AppendUint32(b, 0)                 // flags
+		b = ne.AppendUint16(b, 0)                 // max_background
+		b = ne.AppendUint16(b, 0)                 // congestion_threshold
+		b = ne.AppendUint32(b, fuseMaxWrite)
+		b = ne.AppendUint32(b, 1) // time_gran
+		c.reply(unique, 0, append(b, make([]byte, 64-len(b))...))
+
+	case fuseLookup:
+		name := string(bytes.TrimRight(in, "\x00"))
+		child, ok := node.children[name]
+		if !ok {
+			c.reply(unique, syscall.ENOENT, nil)
+			return true
+		}
+		c.reply(unique, 0, fuseEntry(child))
+
+	case fuseGetattr:
+		b := make([]byte, 0, 104)
+		b = ne.AppendUint64(b, fuseValid)
+		b = ne.AppendUint64(b, 0)
+		c.reply(unique, 0, append(b, fuseAttr(node)...))
+
+	case fuseReadlink:
+		if node.hdr.Typeflag != tar.TypeSymlink {
+			c.reply(unique, syscall.EINVAL, nil)
+			return true
+		}
+		c.reply(unique, 0, []byte(node.hdr.Linkname))
+
+	case fuseOpen:
+		if ne.Uint32(in)&syscall.O_ACCMODE != syscall.O_RDONLY {
+			c.reply(unique, syscall.EROFS, nil)
+			return true
+		}
+		if node.children != nil {
+			c.reply(unique, syscall.EISDIR, nil)
+			return true
+		}
+		if err := t.open(node); err != nil {
+			slog.Warn("Failed to open", "name", node.entry, "error", err)
+			c.reply(unique, syscall.EIO, nil)
+			return true
+		}
+		b := ne.AppendUint64(nil, node.ino)
+		b = ne.AppendUint32(b, 1<<1) // FOPEN_KEEP_CACHE
+		c.reply(unique, 0, ne.AppendUint32(b, 0))
+
+	case fuseRead:
+		off, size := ne.Uint64(in[8:]), ne.Uint32(in[16:])
+		if node.f == nil {
+			c.reply(unique, syscall.EBADF, nil)
+			return true
+		}
+		b := make([]byte, size)
+		n, err := node.f.ReadAt(b, int64(off))
+		if n == 0 && err != nil && off < uint64(node.size) {
+			c.reply(unique, syscall.EIO, nil)
+			return true
+		}
+		c.reply(unique, 0, b[:n])
+
+	case fuseRelease:
+		if node.opens > 0 {
+			t.release(node)
+		}
+		c.reply(unique, 0, nil)
+
+	case fuseOpendir:
+		if node.children == nil {
+			c.reply(unique, syscall.ENOTDIR, nil)
+			return true
+		}
+		c.reply(unique, 0, make([]byte, 16))
+
+	case fuseReaddir:
+		off, size := ne.Uint64(in[8:]), ne.Uint32(in[16:])
+		c.reply(unique, 0, fuseDirents(node, off, int(size)))
+
+	case fuseReleasedir, fuseFlush:
+		c.reply(unique, 0, nil)
+
+	case fuseStatfs:
+		b := make([]byte, 80)
+		ne.PutUint64(b[24:], uint64(len(t.nodes))) // files
+		ne.PutUint32(b[40:], 4096)                 // bsize
+		ne.PutUint32(b[44:], 255)                  // namelen
+		ne.PutUint32(b[48:], 4096)                 // frsize
+		c.reply(unique, 0, b)
+
+	case fuseDestroy:
+		c.reply(unique, 0, nil)
+		return false
+
+	default:
+		c.reply(unique, syscall.ENOSYS, nil)
+	}
+	return true
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func serveFuse(t *mountTree, mountpoint, fsname string, allowOther bool) {
+	fatal("Mounting backups needs FUSE and only works on Linux.")
+}
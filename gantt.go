@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var stageColors = map[string]string{
+	"stop":   "#e07b39",
+	"export": "#3b7dd8",
+	"start":  "#e0b339",
+	"hash":   "#5aa55a",
+	"delta":  "#9b59b6",
+}
+
+// writeGantt draws the stages of every container of a run on a common
+// timeline, as an HTML page with an inline SVG.
+func writeGantt(w io.Writer, r *runReport) {
+
+	const rowHeight, labelWidth, width = 22, 220, 1000
+
+	start, err := time.Parse(time.RFC3339, r.Start)
+	if err != nil {
+		fatalf("Bad start time in run report: %v\n", err)
+	}
+	end := start
+	for _, res := range r.Results {
+		for _, st := range res.Stages {
+			if t, err := time.Parse(time.RFC3339, st.End); err == nil && t.After(end) {
+				end = t
+			}
+		}
+	}
+	total := end.Sub(start).Seconds()
+	if total <= 0 {
+		total = 1
+	}
+	x := func(ts string) float64 {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return labelWidth
+		}
+		return labelWidth + t.Sub(start).Seconds()/total*(width-labelWidth)
+	}
+
+	height := rowHeight*(len(r.Results)+2) + 10
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>lxd-backup run %s</title></head><body>\n", html.EscapeString(r.Start))
+	fmt.Fprintf(w, "<h1>lxd-backup on %s</h1>\n<p>Run started %s, ended %s, %s.</p>\n", html.EscapeString(r.Host),
+		html.EscapeString(displayTime(start)), html.EscapeString(r.End), end.Sub(start).Round(time.Second))
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height)
+
+	for i, res := range r.Results {
+		y := rowHeight * i
+		fmt.Fprintf(w, "<text x=\"4\" y=\"%d\">%s</text>\n", y+15, html.EscapeString(res.Name))
+		for _, st := range res.Stages {
+			x0, x1 := x(st.Start), x(st.End)
+			if x1-x0 < 1 {
+				x1 = x0 + 1
+			}
+			color, ok := stageColors[st.Name]
+			if !ok {
+				color = "#888888"
+			}
+			fmt.Fprintf(w, "<rect x=\"%.1f\" y=\"%d\" width=\"%.1f\" height=\"%d\" fill=\"%s\"><title>%s %s: %s - %s</title></rect>\n",
+				x0, y+3, x1-x0, rowHeight-6, color, html.EscapeString(res.Name), st.Name, st.Start, st.End)
+		}
+	}
+
+	// Legend
+	lx := labelWidth
+	ly := rowHeight*len(r.Results) + rowHeight
+	for _, n := range []string{"stop", "export", "start", "hash", "delta"} {
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"%d\" width=\"12\" height=\"12\" fill=\"%s\"/><text x=\"%d\" y=\"%d\">%s</text>\n", lx, ly, stageColors[n], lx+16, ly+11, n)
+		lx += 90
+	}
+
+	fmt.Fprintln(w, "</svg>\n</body></html>")
+}
+
+func reportMain(args []string) {
+
+	var backupTarget, output, displayTimezone string
+	var gantt, htmlOut bool
+
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.BoolVar(&gantt, "gantt", false, "Write a timeline of the stages of each container in the last run as HTML.")
+	fs.BoolVar(&htmlOut, "html", false, "Write the report of the last run as HTML, with size and change trends.")
+	fs.StringVar(&output, "o", "", "Output file. Default is stdout.")
+	fs.StringVar(&displayTimezone, "display-timezone", "", "Timezone for human readable output.")
+	fs.Parse(args)
+
+	logOpts.setup()
+	setDisplayTimezone(displayTimezone)
+
+	if !gantt && !htmlOut {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	r := loadRunReport(lxdBackupPrefix)
+
+	w := io.Writer(os.Stdout)
+	if len(output) > 0 {
+		f, err := os.Create(output)
+		if err != nil {
+			fatalf("Failed to create %s. Error: %v\n", output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if htmlOut {
+		writeHTMLReport(w, r, lxdBackupPrefix)
+		return
+	}
+	writeGantt(w, r)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// gcMain prunes snapshots out of the repository and removes the chunks
+// nothing refers to anymore.
+func gcMain(args []string) {
+
+	var backupTarget string
+	var keep int
+
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	confirmOpts := addConfirmFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.DurationVar(&lockWait, "lock-wait", 0, "Wait this long for a backup run to finish, IE 30m.")
+	fs.IntVar(&keep, "keep", 0, "Number of snapshots to keep of each container and volume. 0 keeps them all.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gc [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	if len(backupTarget) == 0 || keep < 0 || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	r := &repo{dir: filepath.Join(backupTarget, "lxd-backup-repo")}
+	if !fileExists(r.dir) {
+		fatalf("No repository found in %s.\n", backupTarget)
+	}
+	// Chunks stored by a running backup aren't referenced yet
+	defer lockTarget(backupTarget, "gc").release()
+
+	var affected []string
+	drop := make(map[string]map[string]bool)
+	if keep > 0 {
+		names := r.names()
+		sort.Strings(names)
+		for _, n := range names {
+			for _, id := range r.prunable(n, keep) {
+				if drop[n] == nil {
+					drop[n] = make(map[string]bool)
+				}
+				drop[n][id] = true
+				affected = append(affected, fmt.Sprintf("%s: remove snapshot %s", n, id))
+			}
+		}
+	}
+
+	unused, size := r.unreferenced(drop)
+	if len(affected) == 0 && len(unused) == 0 {
+		fmt.Println("Nothing to clean up.")
+		return
+	}
+	affected = append(affected, fmt.Sprintf("remove %d unused chunks, %s", len(unused), humanBytes(size)))
+
+	if !confirmOpts.confirm("Cleaning up "+r.dir, affected) {
+		return
+	}
+
+	for n, ids := range drop {
+		for id := range ids {
+			r.removeSnapshot(n, id)
+		}
+	}
+	for _, c := range unused {
+		os.Remove(c)
+	}
+	fmt.Printf("Removed %d snapshots and %d chunks, %s freed.\n", len(affected)-1, len(unused), humanBytes(size))
+}
@@ -1,6 +1,6 @@
 module lxd-backup
 
-go 1.19
+go 1.21
 
 require (
 	github.com/davecgh/go-spew v1.1.1
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// healthcheck pings healthchecks.io style dead man's switches: url/start when
+// something begins, url when it succeeded and url/fail when it failed.
+type healthcheck struct {
+	url          string
+	containerURL string
+}
+
+func (hc *healthcheck) ping(u, suffix, body string) {
+
+	if len(u) == 0 {
+		return
+	}
+
+	u = strings.TrimRight(u, "/") + suffix
+	resp, err := httpClient.Post(u, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to ping healthcheck", "url", u, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Healthcheck ping failed", "url", u, "status", resp.Status)
+	}
+}
+
+func (hc *healthcheck) forContainer(name string) string {
+	if len(hc.containerURL) == 0 {
+		return ""
+	}
+	return strings.ReplaceAll(hc.containerURL, "{name}", name)
+}
+
+func (hc *healthcheck) start() { hc.ping(hc.url, "/start", "") }
+
+func (hc *healthcheck) done(r *runReport) {
+	suffix := ""
+	if r.failed() {
+		suffix = "/fail"
+	}
+	subject, body := r.summary()
+	hc.ping(hc.url, suffix, subject+"\n\n"+body)
+}
+
+func (hc *healthcheck) containerStart(name string) {
+	hc.ping(hc.forContainer(name), "/start", "")
+}
+
+func (hc *healthcheck) containerDone(name string, failed bool, msg string) {
+	suffix := ""
+	if failed {
+		suffix = "/fail"
+	}
+	hc.ping(hc.forContainer(name), suffix, msg)
+}
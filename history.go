@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// runRecord is one line of the per container run history, appended to
+// lxd-backup-name.log as text and to lxd-backup-name.log.jsonl as JSON.
+type runRecord struct {
+	Time    string `json:"time"`
+	RunID   string `json:"run-id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Changed int    `json:"changed"`
+	Removed int    `json:"removed"`
+	Bytes   int64  `json:"bytes"`
+	// Delta is the size of the delta written, 0 if none.
+	Delta int64  `json:"delta,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Scrub is set when every file was hashed, none trusted unchanged.
+	Scrub bool `json:"scrub,omitempty"`
+}
+
+func (r *runRecord) String() string {
+	switch r.Status {
+	case "no changes":
+		return fmt.Sprintf("%s: No changes\n", r.Time)
+	case "full":
+		return fmt.Sprintf("%s: Full backup, %s.\n", r.Time, humanBytes(r.Bytes))
+	case "failed":
+		return fmt.Sprintf("%s: Failed: %s\n", r.Time, r.Error)
+	case "stored":
+		return fmt.Sprintf("%s: Stored in repository, %d new chunks.\n", r.Time, r.Changed)
+	}
+	return fmt.Sprintf("%s: %d files changed/added, %d removed.\n", r.Time, r.Changed, r.Removed)
+}
+
+// appendRunRecord adds a record to the run history of a container. With
+// maxSize above zero the history files are rotated when they grow beyond it.
+func appendRunRecord(lxdBackupPrefix string, maxSize int64, r runRecord) {
+
+	r.Time = timestamp(nowUTC())
+	makeContainerDir(lxdBackupPrefix, r.Name)
+	lxdBackupPrefix = containerPrefix(lxdBackupPrefix, r.Name)
+
+	text := &rotatingFile{name: lxdBackupPrefix + r.Name + ".log", maxSize: maxSize, keep: 3}
+	if _, err := text.Write([]byte(r.String())); err != nil {
+		slog.Warn("Failed to write run history", "name", r.Name, "error", err)
+	}
+	if text.f != nil {
+		text.f.Close()
+	}
+
+	d, err := json.Marshal(&r)
+	if err != nil {
+		slog.Warn("Failed to encode run history", "name", r.Name, "error", err)
+		return
+	}
+	jsonl := &rotatingFile{name: lxdBackupPrefix + r.Name + ".log.jsonl", maxSize: maxSize, keep: 3}
+	if _, err := jsonl.Write(append(d, '\n')); err != nil {
+		slog.Warn("Failed to write run history", "name", r.Name, "error", err)
+	}
+	if jsonl.f != nil {
+		jsonl.f.Close()
+	}
+}
+
+// recentRunRecords returns the last n records of the run history of name,
+// oldest first. Rotated history files are not looked into.
+func recentRunRecords(lxdBackupPrefix, name string, n int) []runRecord {
+
+	fh, err := os.Open(containerPrefix(lxdBackupPrefix, name) + name + ".log.jsonl")
+	if err != nil {
+		return nil
+	}
+	defer fh.Close()
+
+	var recs []runRecord
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		var r runRecord
+		if json.Unmarshal(sc.Bytes(), &r) == nil {
+			recs = append(recs, r)
+		}
+	}
+	if len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	return recs
+}
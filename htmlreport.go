@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// htmlReport is -html-report: the report of each run is also written as
+// lxd-backup-lastrun.html to the backup directory.
+var htmlReport bool
+
+// renderHTMLReport makes the HTML report of r, when -html-report or a
+// notification attaching it wants it, and writes it to the backup directory
+// for -html-report.
+func renderHTMLReport(r *runReport, lxdBackupPrefix string, nc *notifyConfig) {
+
+	if !htmlReport && (nc.SMTP == nil || !nc.SMTP.AttachHTML) {
+		return
+	}
+	var b bytes.Buffer
+	writeHTMLReport(&b, r, lxdBackupPrefix)
+	r.html = b.Bytes()
+
+	if htmlReport {
+		if err := os.WriteFile(lxdBackupPrefix+"lastrun.html", r.html, 0644); err != nil {
+			slog.Warn("Failed to save HTML report", "error", err)
+		}
+	}
+}
+
+// trendRuns is how many runs back the trends of the HTML report go.
+const trendRuns = 14
+
+// writeHTMLReport writes the report of a run as an HTML page, for people
+// rather than programs: a table of the containers and volumes with what
+// became of them, failures in red, and the trend of their sizes and changes
+// over the last runs from the run history in lxdBackupPrefix.
+func writeHTMLReport(w io.Writer, r *runReport, lxdBackupPrefix string) {
+
+	subject, _ := r.summary()
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n", html.EscapeString(subject))
+	fmt.Fprint(w, `<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+td.n { text-align: right; }
+tr.failed { background: #f8d7da; }
+tr.skipped { background: #fff3cd; }
+</style></head><body>
+`)
+	fmt.Fprintf(w, "<h1>%s</h1>\n", html.EscapeString(subject))
+
+	start, _ := time.Parse(time.RFC3339, r.Start)
+	end, _ := time.Parse(time.RFC3339, r.End)
+	fmt.Fprintf(w, "<p>Run on %s started %s, took %s.</p>\n", html.EscapeString(r.Host),
+		html.EscapeString(displayTime(start)), end.Sub(start).Round(time.Second))
+	if len(r.Error) > 0 {
+		fmt.Fprintf(w, "<p style=\"color: #b00\"><b>The run failed:</b> %s</p>\n", html.EscapeString(r.Error))
+	}
+
+	var total int64
+	failed := 0
+	for _, res := range r.Results {
+		total += res.Bytes
+		if res.Status == "failed" {
+			failed++
+		}
+	}
+	fmt.Fprintf(w, "<p>%d backed up, %d failed, %s exported.</p>\n", len(r.Results)-failed, failed, humanBytes(total))
+
+	fmt.Fprint(w, "<table>\n<tr><th>Name</th><th>Status</th><th>Took</th><th>Size</th><th>Changed</th><th>Removed</th><th>Ratio</th><th>Size trend</th><th>Changes trend</th><th>Error</th></tr>\n")
+	for _, res := range r.Results {
+		class := ""
+		if res.Status == "failed" || res.Status == "skipped" {
+			class = " class=\"" + res.Status + "\""
+		}
+		var ratio string
+		if res.Ratio > 0 {
+			ratio = fmt.Sprintf("%.1f", res.Ratio)
+		}
+		recs := recentRunRecords(lxdBackupPrefix, res.Name, trendRuns)
+		var sizes, changes []float64
+		for _, rec := range recs {
+			if rec.Status == "failed" {
+				continue
+			}
+			sizes = append(sizes, float64(rec.Bytes))
+			changes = append(changes, float64(rec.Changed+rec.Removed))
+		}
+		fmt.Fprintf(w, "<tr%s><td>%s</td><td>%s</td><td class=\"n\">%s</td><td class=\"n\">%s</td><td class=\"n\">%d</td><td class=\"n\">%d</td><td class=\"n\">%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			class, html.EscapeString(res.Name), html.EscapeString(res.Status),
+			(time.Duration(res.Seconds) * time.Second).String(), humanBytes(res.Bytes), res.Changed, res.Removed, ratio,
+			sparkline(sizes), sparkline(changes), html.EscapeString(res.Error))
+	}
+	fmt.Fprint(w, "</table>\n")
+
+	if len(r.Copies) > 0 {
+		fmt.Fprint(w, "<h2>Copies</h2>\n<table>\n<tr><th>Target</th><th>Status</th><th>Files</th><th>Size</th><th>Deleted</th><th>Failed</th><th>Error</th></tr>\n")
+		for _, c := range r.Copies {
+			class := ""
+			if c.Status == "failed" {
+				class = " class=\"failed\""
+			}
+			fmt.Fprintf(w, "<tr%s><td>%s</td><td>%s</td><td class=\"n\">%d</td><td class=\"n\">%s</td><td class=\"n\">%d</td><td class=\"n\">%d</td><td>%s</td></tr>\n",
+				class, html.EscapeString(c.Target), html.EscapeString(c.Status), c.Files, humanBytes(c.Bytes), c.Deleted, c.Failed,
+				html.EscapeString(c.Error))
+		}
+		fmt.Fprint(w, "</table>\n")
+	}
+
+	if len(r.Warnings) > 0 {
+		fmt.Fprint(w, "<h2>Warnings</h2>\n<ul>\n")
+		for _, msg := range r.Warnings {
+			fmt.Fprintf(w, "<li>%s</li>\n", html.EscapeString(msg))
+		}
+		fmt.Fprint(w, "</ul>\n")
+	}
+	fmt.Fprintln(w, "</body></html>")
+}
+
+// sparkline draws values as a small inline SVG line, the last one as a dot.
+func sparkline(values []float64) string {
+
+	const width, height = 100, 20
+	if len(values) < 2 {
+		return ""
+	}
+	top := 0.0
+	for _, v := range values {
+		top = max(top, v)
+	}
+	if top == 0 {
+		top = 1
+	}
+	var pts []string
+	var x, y float64
+	for i, v := range values {
+		x = float64(i) * width / float64(len(values)-1)
+		y = height - 2 - v/top*(height-4)
+		pts = append(pts, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return fmt.Sprintf("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\"><polyline fill=\"none\" stroke=\"#3b7dd8\" points=\"%s\"/><circle cx=\"%.1f\" cy=\"%.1f\" r=\"2\" fill=\"#3b7dd8\"/></svg>",
+		width+2, height, strings.Join(pts, " "), x, y)
+}
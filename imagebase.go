@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// imageBase is -image-base. Full backups leave out what is the same as in
+// the image the container was created from, which is backed up once, and
+// restore puts them back together.
+var imageBase bool
+
+// imageMu is held while an image is backed up and its checksums made, by
+// one of the containers created from it.
+var imageMu sync.Mutex
+
+// imageRootfs writes the rootfs of the backed up image fp to dest, its
+// entries named like in an export. A unified image is read as is, the
+// squashfs of a split one is unpacked next to dest with unsquashfs.
+func imageRootfs(lxdBackupPrefix, fp, dest string) {
+
+	files := imageFiles(lxdBackupPrefix, fp)
+	if len(files) == 0 {
+		fatalf("No backup of image %s found.\n", fp)
+	}
+	out := createArchive(dest, 0600)
+
+	if len(files) == 1 {
+		in := openArchive(files[0])
+		defer in.Close()
+		tr := tar.NewReader(in)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				out.abort()
+				fatalf("Failed to read content of image %s. Error: %v\n", files[0], err)
+			}
+			name, ok := imageRootfsName(hdr.Name)
+			if !ok {
+				continue
+			}
+			hdr.Name = name
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname, _ = imageRootfsName(hdr.Linkname)
+			}
+			if err := writeEntry(out, hdr, tr); err != nil {
+				out.abort()
+				fatalf("Failed to copy %s of image %s. Error: %v\n", hdr.Name, fp, err)
+			}
+		}
+		out.Close()
+		return
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(dest), "lxd-temporary-image-")
+	if err != nil {
+		out.abort()
+		fatalf("Failed to create temporary directory. Error: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("unsquashfs", "-no-progress", "-f", "-d", dir, files[1])
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		out.abort()
+		fatalf("Failed to run: unsquashfs %s. Error: %v\n", files[1], err)
+	}
+
+	err = filepath.Walk(dir, func(p string, fi fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSocket != 0 {
+			return nil // Not in exports either
+		}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		hdr.Name = rootfsPrefix
+		if rel != "." {
+			hdr.Name += "/" + filepath.ToSlash(rel)
+		}
+		// Owners are numeric in the container
+		hdr.Uname, hdr.Gname = "", ""
+		if hdr.Typeflag != tar.TypeReg {
+			return out.WriteHeader(hdr)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return writeEntry(out, hdr, f)
+	})
+	if err != nil {
+		out.abort()
+		fatalf("Failed to read unpacked image %s. Error: %v\n", fp, err)
+	}
+	out.Close()
+}
+
+// imageRootfsName is the name in an export of the entry name of a unified
+// image, ok is false for what isn't in its rootfs.
+func imageRootfsName(name string) (string, bool) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	p, found := strings.CutPrefix(name, "rootfs")
+	if !found || (len(p) > 0 && p[0] != '/') {
+		return "", false
+	}
+	return rootfsPrefix + p, true
+}
+
+// imageSums returns the checksums with hs and the stats of the files of
+// the image fp. They are kept next to the image backup, images never
+// change.
+func imageSums(lxdBackupPrefix, tempDir, fp string, hs *hasher) (map[string]string, map[string]lxdbackup.FileStat) {
+
+	cache := lxdBackupPrefix + "imagefiles-" + fp
+	if fileExists(cache+hs.suffix()) && fileExists(cache+".stat") {
+		return loadFileData(cache + hs.suffix()), loadFileStats(cache + ".stat")
+	}
+
+	rootfs := filepath.Join(tempDir, "lxd-temporary-image-"+fp+".tar.zst")
+	defer removeBackupFile(rootfs)
+	imageRootfs(lxdBackupPrefix, fp, rootfs)
+	sums, stats, _ := fetchFileDataFromTar("", rootfs, nil, nil, hs)
+
+	writeFileData(cache+hs.suffix(), sums)
+	writeFileStats(cache+".stat", stats)
+	return sums, stats
+}
+
+// trimToImage rewrites the full backup qBackup of j without the entries
+// that are the same as in the image the container was created from, with
+// the same mode, owner and mtime. What was removed from the image is listed
+// in qBackup.removed. sums and stats are those of the whole export.
+func trimToImage(j *backupJob, s *schedule, qBackup string, sums map[string]string, stats map[string]lxdbackup.FileStat, hs *hasher) {
+
+	// A partial backup is unpacked onto an instance, which has the image
+	if !imageBase || j.filter.partial() {
+		return
+	}
+	fp := strings.TrimSpace(execLxc([]string{"config", "get", j.name, "volatile.base_image"}))
+	if len(fp) == 0 {
+		slog.Info("No base image, full backup stored whole", "name", j.name)
+		return
+	}
+	imageMu.Lock()
+	backupImages(s.prefix, []string{fp})
+	imgSums, imgStats := imageSums(s.prefix, s.tempDir, fp, hs)
+	imageMu.Unlock()
+
+	same := make(map[string]bool)
+	var removed []string
+	for n, sum := range imgSums {
+		if cur, present := sums[n]; !present {
+			removed = append(removed, n)
+		} else if cur == sum && !lxdbackup.MetaChanged(imgStats[n], stats[n]) {
+			same[n] = true
+		}
+	}
+	sort.Strings(removed)
+
+	in := openArchive(qBackup)
+	defer in.Close()
+	tr := tar.NewReader(in)
+	os.Remove(qBackup + ".index.json")
+	out := createArchive(qBackup, 0644)
+
+	var left int64
+	err := eachEntry(tr, filepath.Dir(qBackup), func(hdr *tar.Header, r io.Reader) error {
+		if same[hdr.Name] {
+			left += hdr.Size
+			return nil
+		}
+		return writeEntry(out, hdr, r)
+	})
+	if err != nil {
+		out.abort()
+		fatalf("Failed to rewrite %s without image %s. Error: %v\n", qBackup, fp, err)
+	}
+	out.Close()
+
+	if err := os.WriteFile(qBackup+".removed", []byte(strings.Join(removed, "\n")+"\n"), 0644); err != nil {
+		fatalf("Failed to create list of removed files %s. Error: %v\n", qBackup+".removed", err)
+	}
+	j.manifest.BaseImage = fp
+	j.manifest.Format = archiveFormat
+	slog.Info("Left out files of the base image", "name", j.name, "image", fp, "entries", len(same),
+		"bytes", humanBytes(left), "removed", len(removed))
+}
+
+// copyImageEntries writes the entries of the base image of quarter that
+// it left out to tw, except those in skip, with the headers of metas.
+func copyImageEntries(quarter, fp string, tw *tarArchive, skip map[string]bool, metas map[string]*tar.Header) {
+
+	prefix := filepath.Join(filepath.Dir(quarter), "lxd-backup-")
+	rootfs := filepath.Join(filepath.Dir(tw.name), "lxd-temporary-image-"+fp+".tar.zst")
+	defer removeBackupFile(rootfs)
+	imageRootfs(prefix, fp, rootfs)
+
+	imageSkip := make(map[string]bool)
+	for n := range skip {
+		imageSkip[n] = true
+	}
+	for n := range tarEntryNames(quarter) {
+		imageSkip[n] = true
+	}
+	for n := range loadRemoved(quarter + ".removed") {
+		imageSkip[n] = true
+	}
+	copyTarEntries(rootfs, tw, imageSkip, metas)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// referencedImages returns the fingerprints of the images the containers were created from.
+func referencedImages(containers []*containerState) []string {
+
+	seen := make(map[string]bool)
+	var fps []string
+
+	for _, c := range containers {
+		fp := strings.TrimSpace(execLxc([]string{"config", "get", c.name, "volatile.base_image"}))
+		if len(fp) > 0 && !seen[fp] {
+			seen[fp] = true
+			fps = append(fps, fp)
+		}
+	}
+	return fps
+}
+
+func localImages() []string {
+
+	var fps []string
+	for _, l := range strings.Split(execLxc([]string{"image", "list", "-f", "csv", "-c", "F"}), "\n") {
+		if fp := strings.TrimSpace(l); len(fp) > 0 {
+			fps = append(fps, fp)
+		}
+	}
+	return fps
+}
+
+func imageFiles(lxdBackupPrefix, fp string) []string {
+
+	files, err := filepath.Glob(lxdBackupPrefix + "image-" + fp + ".*")
+	if err != nil {
+		fatalf("Failed to look for backup of image %s. Error: %v\n", fp, err)
+	}
+
+	// The metadata tarball goes first, then the rootfs if the image is split
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Contains(files[i], ".tar.") && !strings.Contains(files[j], ".tar.")
+	})
+	return files
+}
+
+// backupImages exports images not already in the backup. Images never change
+// once created, so the fingerprint is enough to know whether we have it.
+func backupImages(lxdBackupPrefix string, fps []string) {
+
+	for _, fp := range fps {
+		if len(imageFiles(lxdBackupPrefix, fp)) > 0 {
+			continue
+		}
+
+		slog.Info("Exporting image", "fingerprint", fp)
+
+		cmd, cancel := lxcCommand("image", "export", fp, lxdBackupPrefix+"image-"+fp)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			fatalf("Failed to run: lxc image export %s. Error: %v\n", fp, err)
+		}
+	}
+}
+
+func restoreImage(lxdBackupPrefix, fp string) {
+
+	files := imageFiles(lxdBackupPrefix, fp)
+	if len(files) == 0 {
+		fatalf("No backup of image %s found.\n", fp)
+	}
+
+	slog.Info("Importing image", "fingerprint", fp)
+
+	cmd, cancel := lxcCommand(append([]string{"image", "import"}, files...)...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc image import %s. Error: %v\n", strings.Join(files, " "), err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// intent is a step of a run that leaves things in a bad state if lxd-backup
+// dies half way through it:
+//
+//	stop   Name was stopped and has to be started again
+//	write  File is a delta or temporary export being written
+//	full   File is a full backup being made, Temp the one made in its place
+//	       before it replaces File
+type intent struct {
+	ID   int    `json:"id"`
+	Op   string `json:"op,omitempty"`
+	Name string `json:"name,omitempty"`
+	File string `json:"file,omitempty"`
+	Temp string `json:"temp,omitempty"`
+	Time string `json:"time,omitempty"`
+	Done bool   `json:"done,omitempty"`
+}
+
+// intentLog is a write-ahead log of intents, lxd-backup-intents.jsonl in the
+// backup directory. Intents that aren't done when a run starts are from a
+// run that crashed, and are finished or rolled back.
+type intentLog struct {
+	fname     string
+	retention *retentionConfig // Of the deltas dropped with a replaced full backup
+	mu        sync.Mutex
+	seq       int
+}
+
+// intents is the log of the running backup. A nil log records nothing.
+var intents *intentLog
+
+func openIntentLog(lxdBackupPrefix string, rc *retentionConfig) *intentLog {
+	return &intentLog{fname: lxdBackupPrefix + "intents.jsonl", retention: rc}
+}
+
+func (l *intentLog) write(in intent) {
+	d, err := json.Marshal(&in)
+	if err != nil {
+		fatalf("Failed to encode intent. Error: %v\n", err)
+	}
+	f, err := os.OpenFile(l.fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fatalf("Failed to open intent log %s. Error: %v\n", l.fname, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(d, '\n')); err != nil {
+		fatalf("Failed to write intent log %s. Error: %v\n", l.fname, err)
+	}
+	if err := f.Sync(); err != nil {
+		fatalf("Failed to sync intent log %s. Error: %v\n", l.fname, err)
+	}
+}
+
+// begin records an intent before it is carried out, and returns its id.
+func (l *intentLog) begin(op, name, file, temp string) int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.write(intent{ID: l.seq, Op: op, Name: name, File: file, Temp: temp, Time: timestamp(nowUTC())})
+	return l.seq
+}
+
+func (l *intentLog) done(id int) {
+	if l == nil || id == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(intent{ID: id, Done: true})
+}
+
+// pending returns the intents that were begun but never done.
+func (l *intentLog) pending() []intent {
+
+	f, err := os.Open(l.fname)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var order []int
+	begun := make(map[int]intent)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var in intent
+		if err := json.Unmarshal(sc.Bytes(), &in); err != nil {
+			slog.Warn("Ignoring broken intent", "file", l.fname, "error", err)
+			continue
+		}
+		if in.Done {
+			delete(begun, in.ID)
+			continue
+		}
+		begun[in.ID] = in
+		order = append(order, in.ID)
+	}
+
+	var p []intent
+	for _, id := range order {
+		if in, ok := begun[id]; ok {
+			p = append(p, in)
+		}
+	}
+	return p
+}
+
+// recover cleans up after a crashed run and starts the log over.
+func (l *intentLog) recover() {
+
+	p := l.pending()
+	// Newest first, so what was made last is undone first
+	for i := len(p) - 1; i >= 0; i-- {
+		in := p[i]
+		slog.Warn("Cleaning up after a crashed run", "op", in.Op, "name", in.Name, "since", in.Time)
+		if in.Op == "stop" || in.Op == "freeze" {
+			exporterRun(in.Name)
+		}
+		switch in.Op {
+		case "stop":
+			if lxcInstanceStatus(in.Name) == "Stopped" {
+				lxcStart(in.Name)
+			}
+		case "freeze":
+			if lxcInstanceStatus(in.Name) == "Frozen" {
+				lxcStart(in.Name)
+			}
+		case "live":
+			removeLive(in.Name)
+		case "write":
+			removeBackupFile(in.File)
+		case "full":
+			// The manifest is written last, without it the full backup is useless.
+			// One made in place of another is complete with it, and replaces it.
+			if len(in.Temp) > 0 && fileExists(in.Temp+".manifest.json") && l.retention != nil {
+				commitFull(strings.TrimSuffix(in.Temp, in.Name+"-promote.partial"), in.Name, in.File, in.Temp, l.retention)
+			} else if len(in.Temp) > 0 {
+				removeBackupFile(in.Temp)
+			}
+			if !fileExists(manifestFile(in.File)) {
+				removeBackupFile(in.File)
+			}
+		default:
+			slog.Warn("Unknown intent", "op", in.Op)
+		}
+	}
+
+	if err := os.WriteFile(l.fname, nil, 0644); err != nil {
+		fatalf("Failed to reset intent log %s. Error: %v\n", l.fname, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The agent journal lists one changed path per line. Lines not starting
+// with a slash are markers.
+const (
+	agentJournal     = "/var/lib/lxd-backup/journal"
+	journalEpoch     = "epoch "
+	journalGap       = "gap"
+	journalCleanStop = "clean-stop"
+	rootfsPrefix     = "backup/container/rootfs"
+)
+
+// pullJournal fetches the agent journal of a container. ok is false if
+// there is no agent in the container.
+func pullJournal(name string) (lines []string, ok bool) {
+
+	out, err := lxcOutput("file", "pull", name+agentJournal, "-")
+	if err != nil {
+		return nil, false
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err() == nil
+}
+
+// resetJournal starts a new journal epoch. The container must be stopped so
+// that the agent isn't holding the old journal open.
+func resetJournal(name string) string {
+
+	if _, ok := pullJournal(name); !ok {
+		return ""
+	}
+
+	epoch := fileTimestamp(nowUTC())
+
+	cmd, cancel := lxcCommand("file", "push", "-", name+agentJournal)
+	defer cancel()
+	cmd.Stdin = strings.NewReader(journalEpoch + epoch + "\n" + journalCleanStop + "\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		slog.Warn("Failed to reset journal", "container", name, "error", err)
+		return ""
+	}
+	return epoch
+}
+
+// journalChanges returns the tar entry names the agent has seen changing
+// since the epoch, or nil if the journal can't be trusted.
+func journalChanges(name, epoch string) map[string]bool {
+
+	if len(epoch) == 0 {
+		return nil
+	}
+
+	lines, ok := pullJournal(name)
+	if !ok || len(lines) == 0 || lines[0] != journalEpoch+epoch || lines[len(lines)-1] != journalCleanStop {
+		return nil
+	}
+
+	changed := make(map[string]bool)
+	for _, l := range lines[1:] {
+		if l == journalGap {
+			return nil
+		}
+		if strings.HasPrefix(l, "/") {
+			changed[rootfsPrefix+l] = true
+		}
+	}
+	return changed
+}
+
+// journalCovers reports whether a tar entry, or any directory above it, is in the journal.
+func journalCovers(changed map[string]bool, entry string) bool {
+	for p := entry; len(p) > len(rootfsPrefix); p = filepath.Dir(p) {
+		if changed[p] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// layoutTemplate is -layout, the path of a hard link to each archive in
+// the backup directory, IE {{.Host}}/{{.Name}}/{{.Tier}}-{{.Date}}{{.Ext}}.
+// The archives stay where they are, lxd-backup only goes by those.
+var layoutTemplate *template.Template
+
+// layoutFields is what a -layout template is given of an archive.
+type layoutFields struct {
+	Host    string // Where the container is, this host when it is here
+	Project string // Its LXD project, IE default
+	Name    string
+	Tier    string // IE Q20263 or WD3
+	Kind    string // full or delta
+	Date    string // When the archive was made, IE 20221014
+	Time    string // and the time of day, IE 031500
+	Ext     string // IE .tar.zst, as the archive is named for its format
+}
+
+// parseLayout parses a -layout template, and checks it names a file in the
+// backup directory.
+func parseLayout(text string) (*template.Template, error) {
+
+	t, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := renderLayout(t, &layoutFields{Host: "host", Project: "default", Name: "name",
+		Tier: "Q20221", Kind: "full", Date: "20221014", Time: "031500", Ext: ".tar.zst"}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func renderLayout(t *template.Template, f *layoutFields) (string, error) {
+	var b bytes.Buffer
+	if err := t.Execute(&b, f); err != nil {
+		return "", err
+	}
+	p := filepath.Clean(b.String())
+	if filepath.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", errors.New(b.String() + " is not in the backup directory")
+	}
+	// In a container directory too
+	if strings.HasPrefix(filepath.Base(p), "lxd-backup-") {
+		return "", errors.New(b.String() + " may be taken for a backup")
+	}
+	return p, nil
+}
+
+// layoutMu guards the layout state files of all backup directories.
+var layoutMu sync.Mutex
+
+// layoutLink is a link -layout made, to File of the container Name.
+type layoutLink struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// layoutStateFile keeps the links -layout made, by path relative to the
+// backup directory. Only those are ever removed again.
+func layoutStateFile(dir string) string {
+	return filepath.Join(dir, "lxd-backup-layout.json")
+}
+
+// hostName is this host, for the backups of containers on it.
+var hostName = sync.OnceValue(func() string {
+	h, _ := os.Hostname()
+	return h
+})
+
+// archivesOf returns the full backups and the deltas of name, generations
+// too.
+func archivesOf(lxdBackupPrefix, name string, rc *retentionConfig) []string {
+	archives := tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full)
+	for i := range rc.Deltas {
+		tc := &rc.Deltas[i]
+		archives = append(archives, tierFiles(lxdBackupPrefix, name, "-delta.tar", tc)...)
+		archives = append(archives, tierGenerations(lxdBackupPrefix, name, tc)...)
+	}
+	return archives
+}
+
+// layoutOf is what the -layout template is given of the archive fname of
+// name.
+func layoutOf(lxdBackupPrefix, name, fname string) (*layoutFields, error) {
+
+	st, err := os.Stat(fname)
+	if err != nil {
+		return nil, err
+	}
+	made := st.ModTime().UTC()
+	f := &layoutFields{Host: hostName(), Project: "default", Name: name, Kind: "full",
+		Date: made.Format("20060102"), Time: made.Format("150405")}
+
+	stem := archiveStem(fname)
+	f.Ext = ".tar" + strings.TrimPrefix(fname, stem)
+	tier := strings.TrimPrefix(filepath.Base(stem), filepath.Base(lxdBackupPrefix+name)+"-")
+	if t, found := strings.CutSuffix(tier, "-delta.tar"); found {
+		tier, f.Kind = t, "delta"
+	} else {
+		tier = strings.TrimSuffix(tier, ".tar")
+	}
+	// A generation is named after its tier and when it was made
+	f.Tier, _, _ = strings.Cut(tier, ".")
+
+	if m := readManifest(fname); m != nil {
+		if len(m.Host) > 0 {
+			f.Host = m.Host
+		}
+		if len(m.Project) > 0 {
+			f.Project = m.Project
+		}
+		if t, err := time.Parse(time.RFC3339, m.Created); err == nil {
+			f.Date, f.Time = t.UTC().Format("20060102"), t.UTC().Format("150405")
+		}
+	}
+	return f, nil
+}
+
+// linkLayout makes the -layout links of the archives of name, and their
+// sidecars, and removes those of archives that are gone or made over.
+func linkLayout(lxdBackupPrefix, name string, rc *retentionConfig) {
+
+	if layoutTemplate == nil {
+		return
+	}
+	dir := filepath.Dir(lxdBackupPrefix)
+
+	// Link to what, relative to dir
+	want := make(map[string]string)
+	for _, a := range archivesOf(lxdBackupPrefix, name, rc) {
+		f, err := layoutOf(lxdBackupPrefix, name, a)
+		if err != nil {
+			continue
+		}
+		link, err := renderLayout(layoutTemplate, f)
+		if err != nil {
+			slog.Warn("Failed to name layout link", "file", a, "error", err)
+			continue
+		}
+		sidecars := sidecarFiles(a)
+		for _, s := range append(sidecars, a) {
+			rel, err := filepath.Rel(dir, s)
+			if err == nil && !strings.HasSuffix(s, ".partial") {
+				want[link+strings.TrimPrefix(s, a)] = rel
+			}
+		}
+	}
+
+	layoutMu.Lock()
+	defer layoutMu.Unlock()
+	state := make(map[string]layoutLink)
+	if d, err := os.ReadFile(layoutStateFile(dir)); err == nil {
+		json.Unmarshal(d, &state)
+	}
+
+	// Links of this container not wanted anymore, and of any whose file is
+	// gone
+	for link, l := range state {
+		if _, ok := want[link]; ok && l.Name == name {
+			continue
+		}
+		if l.Name == name || !fileExists(filepath.Join(dir, l.File)) {
+			os.Remove(filepath.Join(dir, link))
+			removeEmptyDirs(dir, filepath.Dir(filepath.Join(dir, link)))
+			delete(state, link)
+		}
+	}
+
+	links := make([]string, 0, len(want))
+	for link := range want {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	for _, link := range links {
+		from, to := filepath.Join(dir, link), filepath.Join(dir, want[link])
+		lst, lerr := os.Stat(from)
+		tst, terr := os.Stat(to)
+		if terr != nil {
+			continue
+		}
+		if lerr == nil && os.SameFile(lst, tst) {
+			// Moved into a container directory since it was linked
+			if l, ours := state[link]; ours && l.File != want[link] {
+				state[link] = layoutLink{Name: name, File: want[link]}
+			}
+			continue
+		}
+		if _, ours := state[link]; lerr == nil && !ours {
+			slog.Warn("Not making layout link, there is a file by its name", "link", link, "to", want[link])
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(from), 0755); err != nil {
+			slog.Warn("Failed to make layout link", "link", link, "error", err)
+			continue
+		}
+		// Made over since it was linked
+		os.Remove(from)
+		if err := os.Link(to, from); err != nil {
+			slog.Warn("Failed to make layout link", "link", link, "error", err)
+			continue
+		}
+		state[link] = layoutLink{Name: name, File: want[link]}
+	}
+
+	d, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFilePartial(layoutStateFile(dir), d, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to write layout state", "file", layoutStateFile(dir), "error", err)
+	}
+}
+
+// moveLayoutLinks makes the -layout links of the files in moved, by path
+// relative to dir, links to where they were moved to.
+func moveLayoutLinks(dir string, moved map[string]string) {
+
+	layoutMu.Lock()
+	defer layoutMu.Unlock()
+	d, err := os.ReadFile(layoutStateFile(dir))
+	if err != nil {
+		return
+	}
+	state := make(map[string]layoutLink)
+	if json.Unmarshal(d, &state) != nil {
+		return
+	}
+	for link, l := range state {
+		if to, ok := moved[l.File]; ok {
+			l.File = to
+			state[link] = l
+		}
+	}
+	if d, err = json.MarshalIndent(state, "", "  "); err == nil {
+		err = writeFilePartial(layoutStateFile(dir), d, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to write layout state", "file", layoutStateFile(dir), "error", err)
+	}
+}
+
+// removeEmptyDirs removes d and the directories above it up to dir, as long
+// as they are empty.
+func removeEmptyDirs(dir, d string) {
+	for d != dir && strings.HasPrefix(d, dir+"/") {
+		if os.Remove(d) != nil {
+			return
+		}
+		d = filepath.Dir(d)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// liveBackup is -live. Running containers are checkpointed with CRIU into
+// a stateful snapshot instead of stopped, and the copy of the snapshot is
+// exported, with the state of its processes.
+var liveBackup bool
+
+// freezeBackup is -freeze. Running containers are paused for their export
+// instead of stopped, and thawed right after.
+var freezeBackup bool
+
+// liveSnapshot is the name of the stateful snapshot of a live backup.
+const liveSnapshot = "lxd-backup-live"
+
+// liveCopy is the instance the stateful snapshot of name is copied to for
+// the export.
+func liveCopy(name string) string {
+	return name + "-" + liveSnapshot
+}
+
+// lxcCheckpoint copies name to liveCopy(name) through a stateful snapshot,
+// without stopping it. It fails when CRIU can't checkpoint the container.
+func lxcCheckpoint(name string) error {
+
+	removeLive(name)
+	slog.Info("Checkpointing", "container", name)
+
+	for _, args := range [][]string{
+		{"snapshot", name, liveSnapshot, "--stateful"},
+		{"copy", name + "/" + liveSnapshot, liveCopy(name)},
+	} {
+		cmd, cancel := lxcCommand(args...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			removeLive(name)
+			return err
+		}
+	}
+	// The copy has the state, the snapshot is no longer needed
+	lxcRun("delete", name+"/"+liveSnapshot)
+	return nil
+}
+
+// removeLive removes what lxcCheckpoint of name made, if it is there.
+func removeLive(name string) {
+	lxcRun("delete", name+"/"+liveSnapshot)
+	lxcRun("delete", "--force", liveCopy(name))
+}
+
+// liveCommand tells whether the exporter may run args for a live backup:
+// only the snapshot and copy of lxcCheckpoint may be made and removed.
+func liveCommand(args []string) bool {
+	if len(args) < 3 || args[0] != "lxc" {
+		return false
+	}
+	switch args[1] {
+	case "snapshot":
+		return len(args) == 5 && args[3] == liveSnapshot && args[4] == "--stateful"
+	case "copy":
+		if len(args) != 4 {
+			return false
+		}
+		name, ok := strings.CutSuffix(args[3], "-"+liveSnapshot)
+		return ok && args[2] == name+"/"+liveSnapshot
+	case "delete":
+		if len(args) == 4 && args[2] != "--force" || len(args) > 4 {
+			return false
+		}
+		n := args[len(args)-1]
+		return strings.HasSuffix(n, "/"+liveSnapshot) || strings.HasSuffix(n, "-"+liveSnapshot)
+	}
+	return false
+}
+
+// resumeLive starts the restored live backup ref with the state of its
+// processes if start is set, which needs CRIU on this host.
+func resumeLive(ref, project string, start bool) {
+	if !start {
+		slog.Info("Restored a live backup, lxc start resumes its processes, lxc start --stateless boots it", "container", ref)
+		return
+	}
+	slog.Info("Resuming", "container", ref)
+	args := projectArgs(project, "start", ref)
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to resume %s, lxc start --stateless boots it instead. Error: %v\n", ref, err)
+	}
+}
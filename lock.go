@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockWait is -lock-wait, how long to wait for a lock held by another run
+// before giving up. 0 means not at all.
+var lockWait time.Duration
+
+// lockInfo is what a lock file says about who holds it.
+type lockInfo struct {
+	Host  string `json:"host"`
+	PID   int    `json:"pid"`
+	Since string `json:"since"`
+	What  string `json:"what"`
+}
+
+func (li *lockInfo) String() string {
+	return fmt.Sprintf("%s on %s, pid %d, since %s", li.What, li.Host, li.PID, li.Since)
+}
+
+// lockedError is the error of a lock held by another run.
+type lockedError struct {
+	fname  string
+	holder *lockInfo
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", filepath.Base(e.fname), e.holder)
+}
+
+// A lock is held with flock(2) on its file, for as long as the file is
+// open. The kernel lets go of it when the holder dies, and the NFS server
+// when its host does. What is in the file only tells who holds it.
+type lockFile struct {
+	fname string
+	f     *os.File
+}
+
+var heldLocks = struct {
+	sync.Mutex
+	m map[*lockFile]bool
+}{m: make(map[*lockFile]bool)}
+
+func init() {
+	// The kernel lets go of them as the process exits, none are left behind
+	atExit(func(string) {
+		heldLocks.Lock()
+		defer heldLocks.Unlock()
+		for l := range heldLocks.m {
+			os.Remove(l.fname)
+		}
+	})
+}
+
+// readLockInfo reads who holds the lock f, as much as has been written.
+func readLockInfo(f *os.File) *lockInfo {
+	var li lockInfo
+	d, _ := io.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+	json.Unmarshal(d, &li)
+	return &li
+}
+
+// sameFile tells whether f is still the file at fname, and not one removed
+// by its holder on release.
+func sameFile(f *os.File, fname string) bool {
+	fst, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	st, err := os.Stat(fname)
+	return err == nil && os.SameFile(fst, st)
+}
+
+// tryLock takes the lock fname if no one holds it.
+func tryLock(fname, what string) (*lockFile, *lockInfo, error) {
+
+	host, _ := os.Hostname()
+	d, _ := json.Marshal(&lockInfo{Host: host, PID: os.Getpid(), Since: timestamp(nowUTC()), What: what})
+
+	for {
+		f, err := os.OpenFile(fname, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); errors.Is(err, syscall.EWOULDBLOCK) {
+			li := readLockInfo(f)
+			f.Close()
+			return nil, li, nil
+		} else if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if !sameFile(f, fname) {
+			f.Close()
+			continue // Released meanwhile
+		}
+
+		if li := readLockInfo(f); li.PID > 0 {
+			slog.Warn("Taking over lock of a run that died", "file", fname, "held-by", li.String())
+		}
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if _, err := f.WriteAt(d, 0); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return &lockFile{fname: fname, f: f}, nil, nil
+	}
+}
+
+// acquireLock takes the lock fname for what, waiting up to -lock-wait for
+// another run to release it. Gives a *lockedError if that doesn't happen.
+func acquireLock(fname, what string) (*lockFile, error) {
+
+	deadline := time.Now().Add(lockWait)
+	logged := false
+	for {
+		l, li, err := tryLock(fname, what)
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock %s: %v", fname, err)
+		}
+		if l != nil {
+			heldLocks.Lock()
+			heldLocks.m[l] = true
+			heldLocks.Unlock()
+			return l, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, &lockedError{fname, li}
+		}
+		if !logged {
+			slog.Info("Waiting for lock", "file", fname, "held-by", li.String())
+			logged = true
+		}
+		time.Sleep(min(5*time.Second, time.Until(deadline)))
+	}
+}
+
+// lockTarget takes the lock of a whole backup directory. If another run
+// holds it, lxd-backup exits with exitTargetUnavailable, without it being a
+// failure to notify about.
+func lockTarget(backupTarget, what string) *lockFile {
+	l, err := acquireLock(filepath.Join(backupTarget, "lxd-backup.lock"), what)
+	var locked *lockedError
+	if errors.As(err, &locked) {
+		slog.Warn("Another run is using the backup directory, exiting", "held-by", locked.holder.String())
+		os.Exit(exitTargetUnavailable)
+	} else if err != nil {
+		fatal(err)
+	}
+	return l
+}
+
+func (l *lockFile) release() {
+	heldLocks.Lock()
+	delete(heldLocks.m, l)
+	heldLocks.Unlock()
+	// Removed before it is let go of, so whoever gets it next sees it's gone
+	os.Remove(l.fname)
+	l.f.Close()
+}
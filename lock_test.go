@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTryLock(t *testing.T) {
+
+	host, _ := os.Hostname()
+	lockInfoFile := func(li lockInfo) []byte {
+		d, _ := json.Marshal(&li)
+		return d
+	}
+
+	for _, c := range []struct {
+		name  string
+		held  []byte // Content of the lock file, nil for none
+		flock bool   // Whether another open file holds it
+		taken bool
+	}{
+		{"free", nil, false, true},
+		{"held", lockInfoFile(lockInfo{Host: host, PID: os.Getpid(), What: "backup run"}), true, false},
+		{"held on another host", lockInfoFile(lockInfo{Host: "elsewhere", PID: 1 << 30, What: "backup run"}), true, false},
+		{"being written", []byte{}, true, false},
+		{"holder died", lockInfoFile(lockInfo{Host: host, PID: 1 << 30, What: "backup run"}), false, true},
+		{"half written", []byte("{"), false, true},
+	} {
+		fname := filepath.Join(t.TempDir(), "lxd-backup.lock")
+		if c.held != nil {
+			if err := os.WriteFile(fname, c.held, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.flock {
+			f, err := os.Open(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		l, li, err := tryLock(fname, "test")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if (l != nil) != c.taken {
+			t.Errorf("%s: taken %v, want %v", c.name, l != nil, c.taken)
+		}
+		if l == nil {
+			if li == nil {
+				t.Errorf("%s: not taken, but no holder", c.name)
+			}
+			continue
+		}
+		var got lockInfo
+		d, _ := os.ReadFile(fname)
+		if err := json.Unmarshal(d, &got); err != nil || got.PID != os.Getpid() || got.What != "test" {
+			t.Errorf("%s: lock file has %s", c.name, d)
+		}
+		if l2, _, _ := tryLock(fname, "again"); l2 != nil {
+			t.Errorf("%s: taken twice", c.name)
+		}
+		l.f.Close()
+	}
+}
+
+func TestTryLockReleased(t *testing.T) {
+
+	fname := filepath.Join(t.TempDir(), "lxd-backup.lock")
+	l, _, err := tryLock(fname, "first")
+	if err != nil || l == nil {
+		t.Fatalf("first: %v", err)
+	}
+
+	// Opened before the release, locked after it
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	l.release()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	if sameFile(f, fname) {
+		t.Error("the removed lock file is still taken for the lock")
+	}
+
+	l, _, err = tryLock(fname, "second")
+	if err != nil || l == nil {
+		t.Fatalf("second: %v", err)
+	}
+	l.release()
+}
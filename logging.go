@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logOutput is where the log is written, besides -log-file.
+var logOutput io.Writer = os.Stdout
+
+type logOptions struct {
+	level   string
+	format  string
+	file    string
+	maxSize int64
+	keep    int
+}
+
+// addLogFlags registers the logging flags shared by all subcommands.
+func addLogFlags(fs *flag.FlagSet) *logOptions {
+	o := &logOptions{}
+	fs.BoolVar(&verbose, "v", false, "Enable verbose printing. Same as -log-level info.")
+	fs.StringVar(&o.level, "log-level", "", "Log level: debug, info, warn or error. (default warn)")
+	fs.StringVar(&o.format, "log-format", "text", "Log format: text or json.")
+	fs.StringVar(&o.file, "log-file", "", "Also log to this file.")
+	fs.Int64Var(&o.maxSize, "log-max-size", 10, "Rotate the log file when it grows beyond this many MiB.")
+	fs.IntVar(&o.keep, "log-keep", 5, "Number of rotated log files to keep.")
+	return o
+}
+
+func (o *logOptions) setup() {
+
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelInfo
+	}
+	if len(o.level) > 0 {
+		if err := level.UnmarshalText([]byte(o.level)); err != nil {
+			fatalf("Unknown log level %s.\n", o.level)
+		}
+	}
+	verbose = level <= slog.LevelInfo
+
+	newHandler := func(w io.Writer) slog.Handler {
+		hopts := &slog.HandlerOptions{Level: level}
+		switch o.format {
+		case "json":
+			return slog.NewJSONHandler(w, hopts)
+		case "text":
+			return &humanHandler{w: w, level: level}
+		}
+		fatalf("Unknown log format %s. Only text and json are supported.\n", o.format)
+		return nil
+	}
+
+	handlers := []slog.Handler{newHandler(logOutput)}
+	if len(o.file) > 0 {
+		rf := &rotatingFile{name: o.file, maxSize: o.maxSize << 20, keep: o.keep}
+		if o.format == "text" {
+			// Files are read later, they need to say when things happened
+			handlers = append(handlers, slog.NewTextHandler(rf, &slog.HandlerOptions{Level: level}))
+		} else {
+			handlers = append(handlers, newHandler(rf))
+		}
+	}
+	slog.SetDefault(slog.New(&multiHandler{handlers: handlers}))
+}
+
+// humanHandler writes the message followed by key=value pairs, the way
+// lxd-backup always talked to humans.
+type humanHandler struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func (h *humanHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *humanHandler) Handle(_ context.Context, r slog.Record) error {
+
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+
+	write := func(a slog.Attr) bool {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \t\"") {
+			d, _ := json.Marshal(v)
+			v = string(d)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, v)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *humanHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &humanHandler{w: h.w, level: h.level, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *humanHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+type multiHandler struct {
+	handlers []slog.Handler
+}
+
+func (m *multiHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range m.handlers {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, h := range m.handlers {
+		if h.Enabled(ctx, r.Level) {
+			h.Handle(ctx, r.Clone())
+		}
+	}
+	return nil
+}
+
+func (m *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	hs := make([]slog.Handler, len(m.handlers))
+	for i, h := range m.handlers {
+		hs[i] = h.WithAttrs(attrs)
+	}
+	return &multiHandler{handlers: hs}
+}
+
+func (m *multiHandler) WithGroup(name string) slog.Handler {
+	hs := make([]slog.Handler, len(m.handlers))
+	for i, h := range m.handlers {
+		hs[i] = h.WithGroup(name)
+	}
+	return &multiHandler{handlers: hs}
+}
+
+// rotatingFile is an append only file that is renamed to name.1, name.2 and
+// so on when it grows beyond maxSize.
+type rotatingFile struct {
+	mu      sync.Mutex
+	name    string
+	maxSize int64
+	keep    int
+	f       *os.File
+	size    int64
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() {
+	rf.f.Close()
+	rf.f = nil
+	for i := rf.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.name, i), fmt.Sprintf("%s.%d", rf.name, i+1))
+	}
+	if rf.keep > 0 {
+		os.Rename(rf.name, rf.name+".1")
+	} else {
+		os.Remove(rf.name)
+	}
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		rf.rotate()
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
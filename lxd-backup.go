@@ -3,23 +3,20 @@ package main
 
 import (
 	"archive/tar"
-	"bufio"
-	"crypto/md5"
-	"encoding/csv"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"lxd-backup/pkg/lxdbackup"
 )
 
 var verbose bool
@@ -31,281 +28,422 @@ const (
 	stateStopped
 )
 
+func (s runningState) String() string {
+	if s == stateRunning {
+		return "running"
+	}
+	return "stopped"
+}
+
 type containerState struct {
-	name        string
-	host        string
-	state       runningState
-	profile     string
-	profileName string
+	name     string
+	host     string
+	state    runningState
+	profiles []profileEntry // In the order they apply
+	manifest *manifest
+	remote   string // The pulled host it is on, see pullHosts
 }
 
 func execLxc(args []string) string {
 
-	cmd := exec.Command("lxc", args...)
-	cmd.Stderr = os.Stderr
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		log.Fatalf("Failed to get stdout of 'lxc list'. Error: %v\n", err)
-	}
-
-	var s strings.Builder
-
-	reader := bufio.NewReader(stdout)
-
-	go func(reader io.Reader) {
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			s.WriteString(scanner.Text() + "\n")
-		}
-	}(reader)
+	var out []byte
 
-	if err := cmd.Start(); err != nil {
-		log.Fatalf("Failed to start 'lxc list'. Error %v\n", err)
-	}
-	cmd.Wait()
+	// Failures are not fatal since IE lxc config get fails for missing keys
+	retryLxc("lxc "+strings.Join(args, " "), 0, func() error {
+		cmd, cancel := lxcCommand(args...)
+		defer cancel()
+		cmd.Stderr = os.Stderr
+		var err error
+		out, err = cmd.Output()
+		return err
+	}, nil)
 
-	return s.String()
+	return string(out)
 }
 
 func lxcList() []*containerState {
+	if len(pullHosts) > 0 {
+		return pullList()
+	}
+	return listInstances(lxd, "")
+}
 
-	stdout := execLxc([]string{"list", "-c", "nsLP", "-f", "csv"})
-
-	r := csv.NewReader(strings.NewReader(stdout))
-
-	containersCsv, err := r.ReadAll()
+// listInstances lists the containers of l, which is the pulled host host,
+// or this LXD if empty.
+func listInstances(l lxdbackup.LXD, host string) []*containerState {
 
+	var instances []lxdbackup.Instance
+	err := retryLxc("lxc list "+onHost(host, ""), 0, func() error {
+		var err error
+		instances, err = l.List()
+		return err
+	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to convert raw CSV to [][]string. Error: %v\n", err)
+		fatalf("Failed to list containers. Error: %v\n", err)
 	}
 
-	containers := make([]*containerState, 0, len(containersCsv))
+	containers := make([]*containerState, 0, len(instances))
 
-	for i := range containersCsv {
+	for _, in := range instances {
 
 		var s runningState
 
-		switch containersCsv[i][1] {
-		case "STOPPED":
+		switch in.Status {
+		case "Stopped":
 			s = stateStopped
-		case "RUNNING":
+		case "Running":
 			s = stateRunning
 		default:
-			log.Fatalf("Unknown state for %s - %s - Giving up.\n", containersCsv[i][0], containersCsv[i][1])
+			fatalf("Unknown state for %s - %s - Giving up.\n", in.Name, in.Status)
+		}
+		profiles := make([]profileEntry, 0, len(in.Profiles))
+		for _, p := range in.Profiles {
+			data, _ := l.Profile(onHost(host, p))
+			profiles = append(profiles, profileEntry{Name: p, Data: data})
 		}
 		containers = append(containers, &containerState{
-			name:        containersCsv[i][0],
-			state:       s,
-			profileName: containersCsv[i][3],
-			host:        containersCsv[i][2],
-			profile:     execLxc([]string{"profile", "show"}),
+			name:     in.Name,
+			state:    s,
+			host:     in.Location,
+			profiles: profiles,
+			remote:   host,
 		})
 	}
 
 	return containers
 }
 
-func lxcStop(name string) {
-	if verbose {
-		fmt.Printf("Stopping %s\n", name)
-	}
-	cmd := exec.Command("lxc", "stop", name)
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to run: lxc stop %s. Error: %v\n", name, err)
-	}
+// schedule holds the filename suffixes of the current quarter, or whatever
+// the full backups are made of, and deltas.
+type schedule struct {
+	prefix  string
+	tempDir string
+	hash    *hasher
+	runID   string
+
+	// Rotate run history files beyond this size, 0 means never
+	historyMaxSize int64
+	now            time.Time
+	retention      *retentionConfig
+	promoteAt      int                     // Percent of the full a delta may be, 0 means no limit
+	repo           *repo                   // Repository mode instead of quarters and deltas
+	store          lxdbackup.SnapshotStore // -backend instead of quarters and deltas
+	repoKeep       int
+	diffMinSize    int64         // Binary diffs of files at least this big, 0 means never
+	scrubEvery     time.Duration // Hash everything this often in fast mode
+	writeOnceUntil time.Time     // Archives made are write-once until then, zero for not
+	quarter        string
+	deltas         []deltaSlot
+	tiers          *tierState
 }
 
-func lxcStart(name string) {
-	if verbose {
-		fmt.Printf("Restarting %s\n", name)
+// backupJob is one thing to back up, a container or a custom storage volume.
+// name is what the backup files are named after.
+type backupJob struct {
+	name      string
+	before    func()
+	after     func()
+	export    func(to string)
+	diskUsage func() int64 // Bytes of storage used, for the free space check
+	profiles  []profileEntry
+	manifest  *manifest
+
+	// Size of the export and what was made of it, filled in by backup
+	exported   int64
+	deltaBytes int64
+	status     string
+	changed    int
+	removed    int
+	files      []string
+	stages     []stageTiming
+	ratio      float64 // Compression ratio of the export
+
+	// How unchanged files are found, nil hashes them all
+	detector changeDetector
+	// What of the filesystem is left out, nil for nothing
+	filter *pathFilter
+	// What changed files deltas leave out, nil for nothing
+	deltaSkip *deltaSkip
+}
+
+func containerJob(c *containerState, conf *config) *backupJob {
+
+	j := &backupJob{
+		name:     c.name,
+		before:   func() {},
+		after:    func() {},
+		profiles: c.profiles,
 	}
 
-	cmd := exec.Command("lxc", "start", name)
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to run: lxc start %s. Error: %v\n", name, err)
+	// What is exported, the copy of the checkpoint of a live backup
+	from := c.name
+	live, freeze := liveBackup, freezeBackup
+	if l := conf.container(c.name).Live; l != nil {
+		live = *l
+	}
+	if f := conf.container(c.name).Freeze; f != nil {
+		freeze = *f
 	}
-}
 
-func lxcExport(name, to string) {
-	if verbose {
-		fmt.Printf("Exporting %s..\n", name)
+	if c.state == stateRunning {
+		var stopped, checkpointed int
+		var down bool
+		j.before = func() {
+			if live {
+				checkpointed = intents.begin("live", c.name, "", "")
+				err := lxcCheckpoint(c.name)
+				if err == nil {
+					from = liveCopy(c.name)
+					c.manifest.Live = true
+					if len(c.manifest.Snapshots) > 0 {
+						slog.Warn("Live backups have no snapshots", "container", c.name)
+						c.manifest.Snapshots = nil
+					}
+					return
+				}
+				intents.done(checkpointed)
+				slog.Warn("Failed to checkpoint", "container", c.name, "error", err)
+			}
+			if freeze {
+				stopped = intents.begin("freeze", c.name, "", "")
+				down = true
+				lxcFreeze(c.name)
+				return
+			}
+			stopped = intents.begin("stop", c.name, "", "")
+			down = true
+			lxcStop(c.name)
+		}
+		// Also deferred, so it may be called twice
+		j.after = func() {
+			if from != c.name {
+				// After the export, the copy is no longer needed
+				removeLive(c.name)
+				from = c.name
+				intents.done(checkpointed)
+			}
+			if !down {
+				return
+			}
+			lxcStart(c.name)
+			down = false
+			intents.done(stopped)
+		}
 	}
 
-	cmd := exec.Command("lxc", "export", name, to, "--instance-only", "-q", "--compression", "zstd")
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("Failed to run: lxc export %s %s --instance-only. Error: %v\n", name, to, err)
+	c.manifest = newManifest(c)
+	c.manifest.ExportArgs = conf.container(c.name).ExportArgs
+	j.manifest = c.manifest
+	configureJob(j, conf)
+	cc := conf.container(c.name)
+
+	snapshots := backupSnapshots
+	if cc.Snapshots != nil {
+		snapshots = *cc.Snapshots
 	}
-	if verbose {
-		fmt.Printf("Exported %s\n", name)
+	if snapshots {
+		c.manifest.Snapshots = lxcSnapshots(c.name)
 	}
+	j.export = func(to string) {
+		snapshots := len(c.manifest.Snapshots) > 0
+		if useAPI {
+			apiExport(from, to, c.manifest.ExportArgs, snapshots)
+		} else {
+			lxcExport(from, to, c.manifest.ExportArgs, snapshots)
+		}
+	}
+	j.diskUsage = func() int64 { return lxcDiskUsage(c.name) }
+	j.detector = changeDetectors[conf.container(c.name).ChangeDetection]
+	return j
 }
 
-func fetchFileDataFromTar(fname string) map[string]string {
-
-	if verbose {
-		fmt.Println("Calculating MD5Sums..")
+// configureJob sets what of the container j leaves out of its backups,
+// from the config file and the command line.
+func configureJob(j *backupJob, conf *config) {
+	cc := conf.container(j.name)
+	include := cc.Include
+	if len(include) == 0 {
+		include = includePaths
 	}
+	j.filter = newPathFilter(include, append(slices.Clone(excludePaths), cc.Exclude...))
+	maxSize, skip := deltaMaxFileSize, deltaSkipPatterns
+	if len(cc.DeltaMaxFileSize) > 0 {
+		maxSize = cc.deltaMaxFileSize
+	}
+	if cc.DeltaSkip != nil {
+		skip = cc.DeltaSkip
+	}
+	j.deltaSkip = newDeltaSkip(maxSize, skip)
+}
 
-	f, err := os.Open(fname)
-
+func lxcStop(name string) {
+	slog.Info("Stopping", "container", name)
+	err := retryLxc("lxc stop "+name, lxcRetries, func() error {
+		return lxd.Stop(name)
+	}, func() bool { return lxcInstanceStatus(name) == "Stopped" })
 	if err != nil {
-		log.Fatalf("Failed to open %s. Error: %v\n", fname, err)
+		fatalf("Failed to run: lxc stop %s. Error: %v\n", name, err)
 	}
-	defer f.Close()
-
-	in, err := zstd.NewReader(f)
+}
 
+// lxcFreeze pauses name, its processes are frozen until lxcStart.
+func lxcFreeze(name string) {
+	slog.Info("Freezing", "container", name)
+	err := retryLxc("lxc pause "+name, lxcRetries, func() error {
+		return lxd.Pause(name)
+	}, func() bool { return lxcInstanceStatus(name) == "Frozen" })
 	if err != nil {
-		log.Fatalf("Failed to read %s as zstd compressed file. Error: %v\n", fname, err)
+		fatalf("Failed to run: lxc pause %s. Error: %v\n", name, err)
 	}
-	defer in.Close()
-
-	fd := make(map[string]string)
-
-	tarreader := tar.NewReader(in)
-
-	for {
-		hdr, err := tarreader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Failed to read content of tarfile: %s. Error: %v\n", fname, err)
-		}
+}
 
-		if hdr.Typeflag != tar.TypeReg {
-			continue
-		}
+func lxcStart(name string) {
+	slog.Info("Restarting", "container", name)
 
-		h := md5.New()
-		if size, err := io.Copy(h, tarreader); err != nil {
-			log.Fatalf("Failed to io.copy from tar to md5sum. Error: %v\n", err)
-		} else if int64(size) != hdr.Size {
-			log.Fatalf("Failed to read all data of file %s inside %s. Wanted %d got %d\n", hdr.Name, fname, hdr.Size, size)
-		}
+	err := retryLxc("lxc start "+name, lxcRetries, func() error {
+		return lxd.Start(name)
+	}, func() bool { return lxcInstanceStatus(name) == "Running" })
+	if err != nil {
+		fatalf("Failed to run: lxc start %s. Error: %v\n", name, err)
+	}
+}
 
-		var s strings.Builder
-		for _, v := range h.Sum(nil) {
-			s.WriteString(fmt.Sprintf("%02x", v))
+// auditStates warns about containers that are not running or stopped as
+// they were when the run started.
+func auditStates(containers []*containerState, report *runReport) {
+	for _, c := range containers {
+		now := strings.ToLower(lxcInstanceStatus(c.name))
+		if len(now) == 0 {
+			slog.Warn("State of container unknown after the run", "container", c.name)
+		} else if now != c.state.String() {
+			report.warn(fmt.Sprintf("%s was %s before the run, and is %s after it", c.name, c.state, now))
 		}
-		fd[hdr.Name] = s.String()
-	}
-	if verbose {
-		fmt.Printf("Calculated MD5Sums for %d files.\n", len(fd))
 	}
-
-	return fd
 }
 
-func createDeltaBackup(src string, filesChanged map[string]bool, filesRemoved []string, dest, profileName, profileData string) {
+// lxcExport exports name to to, with its snapshots if snapshots is set.
+func lxcExport(name, to string, extraArgs []string, snapshots bool) {
+	slog.Info("Exporting", "container", name)
 
-	if _, err := os.Stat(dest); err == nil {
-		// Do nothing, if destination exists
-		return
+	args := []string{"export", name, to, "-q"}
+	if !snapshots {
+		args = append(args, "--instance-only")
 	}
-
-	if verbose {
-		fmt.Printf("Creating delta backup containing %d file(s).\n", len(filesChanged))
+	compress := compressHere && !hasExportArg(extraArgs, "--compression")
+	if !hasExportArg(extraArgs, "--compression") {
+		args = append(args, "--compression", exportCompression())
 	}
-
-	fin, err := os.Open(src)
-
+	args = append(args, extraArgs...)
+
+	// A partial export is useless, start over after reconnecting
+	err := retryLxc("lxc export "+name, lxcRetries, func() error {
+		os.Remove(to)
+		cmd, done := exportCommand(args, to, compress)
+		defer done()
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			// Killed for being out of time, not worth retrying
+			checkBudget(name)
+		}
+		return err
+	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to open %s. Error: %v\n", src, err)
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
 	}
-	defer fin.Close()
+	slog.Info("Exported", "container", name)
+}
+
+// fetchFileDataFromTar is lxdbackup.TarSums of the tarball fname, with the
+// size of the tarball uncompressed. Sums found in known are used as they
+// are, without hashing the file again, for the files unchanged says are
+// unchanged. job is the container or volume it is of, "" for none.
+func fetchFileDataFromTar(job, fname string, known map[string]string, unchanged func(hdr *tar.Header) bool, hs *hasher) (map[string]string, map[string]lxdbackup.FileStat, int64) {
 
-	in, err := zstd.NewReader(fin)
+	slog.Info("Calculating checksums", "file", fname, "hash", hs.implementation())
 
+	bar := startProgress(job, "Hashing "+filepath.Base(fname), archiveSize(fname))
+	defer bar.finish()
+	in := openArchiveProgress(fname, bar)
+	defer in.Close()
+
+	h, _ := lxdbackup.LookupHasher(hs.name)
+	raw := &countingReader{r: in}
+	fd, stats, err := lxdbackup.TarSums(raw, lxdbackup.SumOptions{Hasher: h, Workers: max(hashWorkers, 1), Known: known, Unchanged: unchanged,
+		Entry: func(*tar.Header) { checkBudget(job) }})
 	if err != nil {
-		log.Fatalf("Failed to read %s as zstd compressed file. Error: %v\n", src, err)
+		fatalf("Failed to calculate checksums of tarfile: %s. Error: %v\n", fname, err)
 	}
-	defer in.Close()
+	slog.Info("Calculated checksums", "file", fname, "files", len(fd))
 
-	tarreader := tar.NewReader(in)
+	// The padding at the end is left unread
+	io.Copy(io.Discard, raw)
+	return fd, stats, raw.n
+}
 
-	fout, err := os.OpenFile(dest, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+// createDeltaBackup writes the changed files of src to dest. Files with a
+// signature in sigs are stored as binary diffs against the quarter backup,
+// those in metaOnly as their header only.
+func createDeltaBackup(src string, filesChanged, metaOnly map[string]bool, filesRemoved []string, sigs map[string]*lxdbackup.BlockSig, dest string, profiles []profileEntry, m *manifest) {
 
-	if err != nil {
-		log.Fatalf("Failed to create %s. Error: %v\n", dest, err)
+	if fileExists(dest) && fileExists(manifestFile(dest)) {
+		// Do nothing, if destination exists. The manifest is written last, so
+		// with it the delta and its sidecars are complete
+		return
 	}
-	defer fout.Close()
 
-	out, err := zstd.NewWriter(fout)
+	slog.Info("Creating delta backup", "file", dest, "files", len(filesChanged), "metadata-only", len(metaOnly))
 
-	if err != nil {
-		log.Fatalf("Failed write %s as zstd compressed file. Error: %v\n", dest, err)
+	var removed strings.Builder
+	for i := range filesRemoved {
+		removed.WriteString(filesRemoved[i] + "\n")
 	}
-	defer out.Close()
-
-	tarwriter := tar.NewWriter(out)
-	defer tarwriter.Close()
+	if err := writeFilePartial(dest+".removed", []byte(removed.String()), 0644); err != nil {
+		fatalf("Failed to create list of removed files %s. Error: %v\n", dest+".removed", err)
+	}
+	writeProfiles(dest, profiles)
 
-	for {
-		hdr, err := tarreader.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatalf("Failed to read content of tarfile: %s. Error: %v\n", src, err)
-		}
-		if _, present := filesChanged[hdr.Name]; present {
+	in := openArchive(src)
+	defer in.Close()
 
-			if err := tarwriter.WriteHeader(hdr); err != nil {
-				log.Fatalf("Failed to write tar header: %v\n", err)
-			}
-			d := make([]byte, hdr.Size)
-			if d, err = io.ReadAll(tarreader); err != nil {
-				log.Fatalf("Failed to read %s from tar: %v (%d bytes of %d)\n", hdr.Name, err, len(d), hdr.Size)
-			}
+	tarreader := tar.NewReader(in)
 
-			if _, err := tarwriter.Write(d); err != nil {
-				log.Fatalf("Failed to write data to file: %v\n", err)
-			}
-		}
-	}
+	tarwriter := createArchive(dest, 0644)
 
-	fr, err := os.OpenFile(dest+".removed", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	d := &lxdbackup.Delta{Changed: filesChanged, MetaOnly: metaOnly, Sigs: sigs, TempDir: filepath.Dir(dest),
+		WriteEntry: func(hdr *tar.Header, r io.Reader) error { return writeEntry(tarwriter, hdr, r) }}
+	err := eachEntry(tarreader, filepath.Dir(dest), func(hdr *tar.Header, r io.Reader) error {
+		return d.Entry(tarwriter, hdr, r)
+	})
 	if err != nil {
-		log.Fatalf("Failed to create list of removed files %s. Error: %v\n", dest+".removed", err)
+		fatalf("Failed to write delta %s of %s. Error: %v\n", dest, src, err)
 	}
-	defer fr.Close()
-	for i := range filesRemoved {
-		fr.WriteString(filesRemoved[i] + "\n")
-	}
-	writeProfile(dest, profileName, profileData)
+
+	tarwriter.Close()
+	finishArchive(dest)
+	writeManifest(dest, m)
 }
 
-func writeProfile(dest, profileName, profileData string) {
-	if err := ioutil.WriteFile(dest+"."+profileName+".profile", []byte(profileData), 0644); err != nil {
-		log.Fatalf("Failed to write profile data to: %s: %v\n", dest+"."+profileName+".profile", err)
+// writeProfiles writes each profile next to dest, as
+// <dest>.<profile>.profile.
+func writeProfiles(dest string, profiles []profileEntry) {
+	for _, p := range profiles {
+		if err := ioutil.WriteFile(dest+"."+p.Name+".profile", []byte(p.Data), 0644); err != nil {
+			fatalf("Failed to write profile data to: %s: %v\n", dest+"."+p.Name+".profile", err)
+		}
 	}
 }
 
 func writeFileData(out string, fd map[string]string) {
 
-	fdnames := make([]string, 0, len(fd))
-	for v := range fd {
-		fdnames = append(fdnames, v)
-	}
-	sort.Strings(fdnames)
-
-	fl := make([][]string, 0, len(fd))
-	for i := range fdnames {
-		fl = append(fl, []string{fdnames[i], fd[fdnames[i]]})
-	}
-
 	f, err := os.OpenFile(out, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("Failed to create filedata file %s. Error: %v\n", out, err)
+		fatalf("Failed to create filedata file %s. Error: %v\n", out, err)
 	}
 	defer f.Close()
 
-	csvWriter := csv.NewWriter(f)
-	if err := csvWriter.WriteAll(fl); err != nil {
-		log.Fatalf("Fail to write filedata to csv %s. Error: %v\n", out, err)
+	if err := lxdbackup.WriteSums(f, fd); err != nil {
+		fatalf("Fail to write filedata to csv %s. Error: %v\n", out, err)
 	}
 }
 
@@ -313,19 +451,13 @@ func loadFileData(fname string) map[string]string {
 
 	f, err := os.Open(fname)
 	if err != nil {
-		log.Fatalf("Failed to open: %s. Error: %v\n", fname, err)
+		fatalf("Failed to open: %s. Error: %v\n", fname, err)
 	}
 	defer f.Close()
 
-	r := csv.NewReader(f)
-	c, err := r.ReadAll()
+	checksums, err := lxdbackup.ReadSums(f)
 	if err != nil {
-		log.Fatalf("Failed to decode csv in %s. Error: %v\n", fname, err)
-	}
-
-	checksums := make(map[string]string)
-	for _, l := range c {
-		checksums[l[0]] = l[1]
+		fatalf("Failed to decode csv in %s. Error: %v\n", fname, err)
 	}
 	return checksums
 }
@@ -362,56 +494,418 @@ func filterCont(containers []*containerState, names map[string]bool, inc bool) [
 	return ctmp
 }
 
+func filterProfile(containers []*containerState, profiles map[string]bool) []*containerState {
+
+	if len(profiles) == 0 {
+		return containers
+	}
+
+	ctmp := make([]*containerState, 0, len(containers))
+
+	for i := range containers {
+		for _, p := range containers[i].profiles {
+			if _, present := profiles[p.Name]; present {
+				ctmp = append(ctmp, containers[i])
+				break
+			}
+		}
+	}
+	return ctmp
+}
+
+func filterStatus(containers []*containerState, states map[string]bool) []*containerState {
+
+	if len(states) == 0 {
+		return containers
+	}
+
+	ctmp := make([]*containerState, 0, len(containers))
+
+	for i := range containers {
+		if _, present := states[containers[i].state.String()]; present {
+			ctmp = append(ctmp, containers[i])
+		}
+	}
+	return ctmp
+}
+
+// filterMatch keeps the containers where every key=value pair matches the container config.
+func filterMatch(containers []*containerState, matches map[string]bool) []*containerState {
+
+	if len(matches) == 0 {
+		return containers
+	}
+
+	ctmp := make([]*containerState, 0, len(containers))
+
+	for i := range containers {
+		all := true
+		for m := range matches {
+			kv := strings.SplitN(m, "=", 2)
+			if strings.TrimSpace(execLxc([]string{"config", "get", containers[i].name, kv[0]})) != kv[1] {
+				all = false
+				break
+			}
+		}
+		if all {
+			ctmp = append(ctmp, containers[i])
+		}
+	}
+	return ctmp
+}
+
+func fileExists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// moveFile renames a file, copying it when the destination is on another
+// filesystem.
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
 func main() {
 
-	if _, err := exec.LookPath("lxd"); err != nil {
-		fmt.Println("The lxd binary is missing.")
-		os.Exit(1)
+	defer recoverPanic()
+
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restoreMain(os.Args[2:])
+		return
 	}
 
-	if _, err := exec.LookPath("zstd"); err != nil {
-		fmt.Println("You have to install zstd to run lxd-backup.")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "test-restore" {
+		testRestoreMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		reportMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "consolidate" {
+		consolidateMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cat" {
+		catMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "find" {
+		findMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "mount" {
+		mountMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diffMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "check-chain" {
+		checkChainMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate-layout" {
+		migrateLayoutMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		repairMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		gcMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "du" {
+		duMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		statusMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "exporter" {
+		exporterMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		agentMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "trust" {
+		trustMain(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		rekeyMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		decryptMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "host-agent" {
+		hostAgentMain(os.Args[2:])
+		return
+	}
+
+	// A backup run, which takes its exports from host agents
+	if len(os.Args) > 1 && os.Args[1] == "server" {
+		serverMode = true
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
 	}
 
 	var backupTarget, tempDir string
 	var contExcStr, contIncStr string
 	var hostExcStr, hostIncStr string
-
-	flag.BoolVar(&verbose, "v", false, "Enable verbose printing.")
-	flag.StringVar(&backupTarget, "b", "", "Backup output directory.")
-	flag.StringVar(&tempDir, "t", "", "Temporary directory.")
+	var profileStr, statusStr, matchStr string
+	var displayTimezone string
+	var serverConfig bool
+	var configFile string
+	var backupVolumes bool
+	var volExcStr string
+	var images string
+	var localOnly bool
+	var hashName string
+	var hc healthcheck
+	var listen string
+	var serverTLS tlsFiles
+	var historyMaxSize int64
+	var promoteAt int
+	var requireMount bool
+	var useRepo bool
+	var diffMinSize int64
+	var repoKeep int
+	var fast bool
+	var volumeSizeStr, signKeyFile, bwLimitStr string
+	var nice bool
+	var scrubDays int
+	var exporter string
+	var backend string
+	var reportJSON string
+	var priorityStr string
+	var jobs, hostJobs int
+	var excludePathStr, includePathStr string
+	var deltaMaxFileSizeStr, deltaSkipStr string
+	var layout string
+
+	logOpts := addLogFlags(flag.CommandLine)
+	lxdOpts := addLxdFlags(flag.CommandLine)
+	var targets stringList
+	flag.Var(&targets, "b", "Backup output directory. When given more than once, the others get copies like -copy-to.")
+	flag.StringVar(&tempDir, "tmpdir", "", "Temporary directory, for the exports deltas are made from. Default is the backup directory, unless that is on network storage.")
+	flag.StringVar(&tempDir, "t", "", "Same as -tmpdir.")
 	flag.StringVar(&contExcStr, "ec", "", "Containers to exclude from backup. Comma separated.")
 	flag.StringVar(&contIncStr, "ic", "", "Containers to include in backup. Comma separated.")
+	flag.StringVar(&excludePathStr, "exclude-path", "", "Paths inside the containers to leave out of backups, globs like /var/cache/* or *.tmp. Comma separated.")
+	flag.StringVar(&includePathStr, "include-path", "", "Only back up these paths inside the containers, IE /srv,/etc, making partial backups. Comma separated.")
 	flag.StringVar(&hostExcStr, "eh", "", "Hosts to exclude from backup. Comma separated.")
 	flag.StringVar(&hostIncStr, "ih", "", "Hosts to include in backup. Comma separated.")
+	flag.StringVar(&profileStr, "profile", "", "Only backup containers using any of these profiles. Comma separated.")
+	flag.StringVar(&statusStr, "status", "", "Only backup containers in this state, running or stopped. Comma separated.")
+	flag.IntVar(&jobs, "jobs", 1, "Back up this many containers at the same time, on different cluster members unless -host-jobs allows more.")
+	flag.IntVar(&hostJobs, "host-jobs", 1, "Back up at most this many containers of the same cluster member at the same time.")
+	flag.StringVar(&priorityStr, "priority", "", "Back up containers with higher priority first, as name=priority. Comma separated, IE db1=100,web1=50.")
+	flag.StringVar(&matchStr, "match", "", "Only backup containers where config key=value. Comma separated, all must match.")
+
+	flag.BoolVar(&backupVolumes, "volumes", false, "Also back up custom storage volumes.")
+	flag.StringVar(&volExcStr, "ev", "", "Custom storage volumes to exclude from backup, as pool/volume. Comma separated.")
+	flag.StringVar(&images, "images", "", "Also back up images, referenced by the backed up containers or all.")
+	flag.BoolVar(&localOnly, "local-only", false, "In a cluster, only back up containers on this member.")
+	flag.IntVar(&parityPercent, "parity", 0, "Make Reed-Solomon parity of this many percent of full backups and deltas, 1 to 100. 0 means none.")
+	flag.StringVar(&signKeyFile, "sign-key", "", "Sign manifests with this ed25519 private key in PEM.")
+	flag.StringVar(&bwLimitStr, "bwlimit", "", "Limit reading and writing archives to this many bytes per second, IE 50M.")
+	flag.BoolVar(&nice, "nice", false, "Run at low CPU and I/O priority, and so the compression in lxd-backup too.")
+	flag.DurationVar(&lxcTimeout, "lxc-timeout", lxcTimeout, "Kill lxc commands that take longer than this. 0 means no timeout.")
+	flag.DurationVar(&lxcExportTimeout, "export-timeout", 0, "Kill exports and imports that take longer than this, IE 6h. 0 means no timeout.")
+	flag.IntVar(&lxcRetries, "lxc-retries", lxcRetries, "Try stopping, starting and exporting this many more times when they fail.")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "Wait this long for another run to finish with the backup directory or a container, IE 30m, instead of skipping it.")
+	flag.IntVar(&spaceMargin, "space-margin", 10, "Percent more free space than the estimated size of an export needed to start it. Negative means no check.")
+	flag.StringVar(&volumeSizeStr, "volume-size", "", "Split archives bigger than this into parts, IE 4G or 700M.")
+	flag.BoolVar(&seekable, "seekable", false, "Write zstd archives in frames with an index of their files, for fetching single files. Full backups need -compress-here.")
+	flag.StringVar(&archiveFormat, "format", archiveFormat, "Compression of exports and deltas: zstd, gzip, xz or none.")
+	flag.IntVar(&compressionLevel, "compression-level", 0, "Compression level of exports and deltas, 1 to 19 for zstd, 1 to 9 for gzip and xz. 0 is the default of the format.")
+	flag.BoolVar(&compressHere, "compress-here", false, "Export uncompressed and compress in lxd-backup, which needs no zstd binary.")
+	flag.IntVar(&compressionThreads, "compression-threads", 0, "Number of cores to compress on, for zstd and xz. 0 means all.")
+	flag.StringVar(&hashName, "hash", "md5", "Checksum algorithm for new quarter backups: md5, sha1, sha256 or sha512.")
+	flag.IntVar(&hashWorkers, "hash-jobs", hashWorkers, "Number of files to hash at the same time.")
+	flag.StringVar(&hc.url, "healthcheck-url", "", "Ping this URL at start (/start), success and failure (/fail) of the run.")
+	flag.StringVar(&hc.containerURL, "healthcheck-container-url", "", "Like -healthcheck-url, per container. {name} is replaced with the container name.")
+	flag.Int64Var(&historyMaxSize, "history-max-size", 0, "Rotate per container run history when it grows beyond this many MiB. 0 means never.")
+	flag.Float64Var(&anomalyFactor, "size-anomaly", 10, "Warn when an export or delta is this many times bigger or smaller than usual for the container. 0 means never.")
+	flag.IntVar(&promoteAt, "promote-at", 0, "Make a new full backup when a delta would hold more than this percent of the full. 0 means never.")
+	flag.BoolVar(&requireMount, "require-mount", false, "Give up unless the backup output directory is a mount point.")
+	flag.StringVar(&deltaMaxFileSizeStr, "delta-max-file-size", "", "Leave changed files larger than this out of deltas, IE 1G. Default is any size.")
+	flag.StringVar(&deltaSkipStr, "delta-skip", "", "Leave changed files matching these globs out of deltas, IE *.iso,core.*. Comma separated.")
+	flag.StringVar(&layout, "layout", "", "Also hard link each archive and its sidecars under this name in the backup directory, IE {{.Host}}/{{.Name}}/{{.Tier}}-{{.Date}}{{.Ext}}. Also has .Project, .Kind and .Time.")
+	flag.BoolVar(&sparseFiles, "sparse", false, "Store files with holes as sparse tar entries, rewriting full backups for it.")
+	flag.StringVar(&listen, "listen", ":8443", "With server, address to wait for host agents on.")
+	flag.StringVar(&serverTLS.cert, "tls-cert", "", "With server, certificate of the server in PEM, signed by -tls-ca.")
+	flag.StringVar(&serverTLS.key, "tls-key", "", "With server, private key of -tls-cert in PEM.")
+	flag.StringVar(&serverTLS.ca, "tls-ca", "", "With server, CA certificate in PEM the certificates of host agents must be signed by.")
+	flag.BoolVar(&freezeBackup, "freeze", false, "Pause running containers for their export instead of stopping them.")
+	flag.BoolVar(&liveBackup, "live", false, "Checkpoint running containers with CRIU into a stateful snapshot instead of stopping them, and export its copy.")
+	flag.BoolVar(&backupSnapshots, "snapshots", false, "Include the snapshots of the containers in their backups, instead of exporting them with --instance-only.")
+	flag.BoolVar(&imageBase, "image-base", false, "Leave the files of the image a container was created from out of its full backups. The image is backed up once instead.")
+	flag.IntVar(&immutableDays, "immutable", 0, "Make archives write-once for this many days: read-only here, with S3 Object Lock on copies, and not pruned or made over before. 0 means never.")
+	flag.BoolVar(&reproducible, "reproducible", false, "Write byte-stable archives: entries sorted, no access and change times, one compression thread. Rewrites full backups for it.")
+	flag.Int64Var(&diffMinSize, "binary-diff", 0, "Store changed files of at least this many MiB as binary diffs against the quarter backup. 0 means never.")
+	flag.BoolVar(&fast, "fast", false, "Trust size and mtime to tell a file unchanged, for containers without change-detection in the config file.")
+	flag.IntVar(&scrubDays, "fast-scrub", 7, "In -fast mode, hash every file anyway when it was last done this many days ago.")
+	flag.BoolVar(&btrfsSend, "btrfs-send", false, "For containers on btrfs pools, store deltas as btrfs send streams against a snapshot kept since the quarter backup.")
+	flag.BoolVar(&rbdDiff, "rbd-diff", false, "For containers on ceph pools, store deltas as rbd export-diff against a snapshot kept since the quarter backup.")
+	flag.BoolVar(&useRepo, "repo", false, "Store exports chunked and deduplicated in a repository instead of as quarters and deltas.")
+	flag.IntVar(&repoKeep, "repo-keep", 0, "Keep this many snapshots per container in the repository or -backend. 0 means all, or for -backend as the retention tiers would.")
+	flag.StringVar(&backend, "backend", "", "Store exports in this backup program instead of as quarters and deltas, IE restic:///srv/restic or borg:///srv/borg.")
+	flag.BoolVar(&useAPI, "api", false, "Export through the backup API on the LXD unix socket, with optimized storage where export-args ask for it and the pool supports it.")
+	flag.StringVar(&exporter, "exporter", "", "Talk to LXD through this command, IE \"sudo -u lxd-exporter lxd-backup\", instead of running lxc.")
+	flag.StringVar(&encryptTo, "encrypt-to", "", "Encrypt the copies of -copy-to for the age recipients in this file, one per line.")
+	flag.Var(&copyTo, "copy-to", "After the run, copy the backup directory to this directory, rclone:remote:path, s3://bucket/path or sftp://user@host/path. Can be given more than once.")
+	flag.StringVar(&configFile, "config", "", "JSON config file with per container settings and retention tiers.")
+	flag.BoolVar(&serverConfig, "server-config", false, "Also back up profiles, networks, storage pools and projects.")
+	flag.BoolVar(&htmlReport, "html-report", false, "Also write the report of the run as HTML, with size and change trends, to lxd-backup-lastrun.html.")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "Give up on a container that takes longer than this, IE 2h, start it again and go on with the next. 0 means never.")
+	flag.StringVar(&reportJSON, "report-json", "", "At the end of the run, write its report as JSON to this file, - for stdout.")
+	flag.BoolVar(&tui, "tui", false, "Show a live table of the containers and how far each is, with the log under it, instead of the log alone.")
+	flag.StringVar(&displayTimezone, "display-timezone", "", "Timezone for human readable output, IE Europe/Stockholm. Stored timestamps are always UTC.")
 
 	flag.Parse()
 
-	if len(contExcStr) > 0 && len(contIncStr) > 0 {
-		log.Fatal("You can only include or exclude containers. Not include and exclude.")
+	if tui {
+		startDashboard()
 	}
+	logOpts.setup()
 
-	if len(hostExcStr) > 0 && len(hostIncStr) > 0 {
-		log.Fatal("You can only include or exclude hosts. Not include and exclude.")
+	if len(targets) > 0 {
+		backupTarget = targets[0]
+		copyTo = append(targets[1:], copyTo...)
 	}
 
-	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	if nice {
+		lowerPriority()
+	}
+
+	if _, err := exec.LookPath("zstd"); err != nil && archiveFormat == "zstd" && !compressHere && !serverMode {
+		fmt.Println("You have to install zstd to run lxd-backup, or give -compress-here.")
+		os.Exit(1)
+	}
+
+	setDisplayTimezone(displayTimezone)
+
+	if fast {
+		defaultDetector = "mtime"
+	}
+	conf := loadConfig(configFile)
+	lxcExporter = strings.Fields(exporter)
+	pullHosts = conf.Hosts
+	if len(pullHosts) > 0 && (len(lxcExporter) > 0 || serverMode) {
+		fatal("Hosts in the config file can't be combined with -exporter or server.")
+	}
+	if !serverMode && len(pullHosts) == 0 {
+		// The exporter is another user, it is its business
+		defer lxdOpts.setup(len(lxcExporter) == 0)()
+	}
 
-	if len(backupTarget) > 0 {
-		if err := os.MkdirAll(backupTarget, 0755); err != nil && !os.IsExist(err) {
-			log.Fatalf("Failed to create backup output directory: %v\n", err)
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	now := nowUTC()
+
+	report := newRunReport()
+	hc.start()
+	atExit(func(msg string) {
+		for _, name := range report.runningJobs() {
+			hc.containerDone(name, true, msg)
+			appendRunRecord(lxdBackupPrefix, historyMaxSize<<20, runRecord{RunID: fileTimestamp(now), Name: name,
+				Status: "failed", Error: strings.TrimSpace(msg)})
+		}
+		report.fail(msg)
+		report.save(lxdBackupPrefix)
+		if len(reportJSON) > 0 {
+			report.writeJSON(reportJSON)
 		}
+		renderHTMLReport(report, lxdBackupPrefix, &conf.Notify)
+		conf.Notify.notify(report)
+		hc.done(report)
+	})
+
+	if len(contExcStr) > 0 && len(contIncStr) > 0 {
+		fatal("You can only include or exclude containers. Not include and exclude.")
+	}
+
+	if len(hostExcStr) > 0 && len(hostIncStr) > 0 {
+		fatal("You can only include or exclude hosts. Not include and exclude.")
 	}
 
-	if len(tempDir) > 0 {
-		if err := os.MkdirAll(tempDir, 0755); err != nil && !os.IsExist(err) {
-			log.Fatalf("Failed to create temporary output directory: %v\n", err)
+	if len(layout) > 0 {
+		t, err := parseLayout(layout)
+		if err != nil {
+			fatalf("Bad -layout %s. Error: %v\n", layout, err)
 		}
+		layoutTemplate = t
 	}
 
 	if len(tempDir) == 0 && len(backupTarget) > 0 {
-		tempDir = backupTarget
+		tempDir = defaultTempDir(backupTarget)
+	}
+
+	checkTarget(backupTarget, tempDir, requireMount)
+	defer lockTarget(backupTarget, "backup run").release()
+
+	intents = openIntentLog(lxdBackupPrefix, conf.Retention)
+	intents.recover()
+	removePartials(lxdBackupPrefix)
+	// When giving up, what was stopped is started again right away
+	atExit(func(string) { intents.recover() })
+	removeTempExports(tempDir)
+	if tempDir != backupTarget {
+		removeTempExports(backupTarget) // Of runs with another -tmpdir
 	}
 
 	toMap := func(s string) map[string]bool {
@@ -428,14 +922,123 @@ func main() {
 	hostInc := toMap(hostIncStr)
 	contExc := toMap(contExcStr)
 	contInc := toMap(contIncStr)
+	profiles := toMap(profileStr)
+	states := toMap(strings.ToLower(statusStr))
+	matches := toMap(matchStr)
+	for _, p := range strings.Split(excludePathStr, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			excludePaths = append(excludePaths, p)
+		}
+	}
+	for _, p := range strings.Split(deltaSkipStr, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			deltaSkipPatterns = append(deltaSkipPatterns, p)
+		}
+	}
+	for _, p := range strings.Split(includePathStr, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			includePaths = append(includePaths, p)
+		}
+	}
+
+	for s := range states {
+		if s != "running" && s != "stopped" {
+			fatalf("Unknown status %s. Only running and stopped are supported.\n", s)
+		}
+	}
+
+	for m := range matches {
+		if !strings.Contains(m, "=") {
+			fatalf("Bad match %s. Must be on the form key=value.\n", m)
+		}
+	}
+
+	if images != "" && images != "referenced" && images != "all" {
+		fatalf("Unknown image selection %s. Only referenced and all are supported.\n", images)
+	}
+
+	if promoteAt < 0 || promoteAt > 100 {
+		fatalf("Bad -promote-at %d. Must be a percentage, 0 to 100.\n", promoteAt)
+	}
+
+	if reproducible {
+		// More threads may split the zstd stream differently
+		compressionThreads = 1
+	}
+	validateFormat()
 
-	now := time.Now()
-	_, w := now.ISOWeek()
+	var err error
+	if volumeSize, err = parseSize(volumeSizeStr); err != nil {
+		fatalf("Bad -volume-size %s. Error: %v\n", volumeSizeStr, err)
+	}
+	validateParity()
+	if bwLimit, err = parseSize(bwLimitStr); err != nil {
+		fatalf("Bad -bwlimit %s. Error: %v\n", bwLimitStr, err)
+	}
+	if deltaMaxFileSize, err = parseSize(deltaMaxFileSizeStr); err != nil {
+		fatalf("Bad -delta-max-file-size %s. Error: %v\n", deltaMaxFileSizeStr, err)
+	}
+	if len(signKeyFile) > 0 {
+		signKey = loadSignKey(signKeyFile)
+	}
 
-	quarter := fmt.Sprintf("-Q%d%d.tar.zst", now.Year(), now.Month()/4) // Lasts "forever"
-	monthDelta := fmt.Sprintf("-M%d-delta.tar.zst", now.Month())        // Last a year
-	weekDelta := fmt.Sprintf("-WN%d-delta.tar.zst", w%4)                // Lasts a month
-	dayDelta := fmt.Sprintf("-WD%d-delta.tar.zst", now.Weekday())       // Last a week, 0 = Sunday
+	copyTargets := openCopyTargets()
+	encryptCopies(backupTarget, copyTargets)
+
+	if useAPI {
+		checkAPI()
+	}
+
+	if images != "" && len(lxcExporter) > 0 {
+		fatal("Images can't be backed up through an exporter.")
+	}
+
+	s := &schedule{
+		prefix:  lxdBackupPrefix,
+		tempDir: tempDir,
+		hash:    lookupHasher(hashName),
+		runID:   fileTimestamp(now),
+
+		historyMaxSize: historyMaxSize << 20,
+		now:            now,
+		retention:      conf.Retention,
+		promoteAt:      promoteAt,
+		repoKeep:       repoKeep,
+		diffMinSize:    diffMinSize << 20,
+		scrubEvery:     time.Duration(scrubDays) * 24 * time.Hour,
+		quarter:        conf.Retention.FullSuffix(now),
+		deltas:         deltaSlots(conf.Retention, now),
+		tiers:          loadTierState(lxdBackupPrefix),
+	}
+	if immutableDays > 0 {
+		s.writeOnceUntil = now.AddDate(0, 0, immutableDays)
+	}
+
+	if useRepo && len(backend) > 0 {
+		fatal("Give either -repo or -backend, not both.")
+	}
+	if jobs < 1 || hostJobs < 1 {
+		fatal("-jobs and -host-jobs must be at least 1.")
+	}
+	if jobs > 1 && (useRepo || len(backend) > 0) {
+		fatal("-jobs can't be used with -repo or -backend, they take one backup at a time.")
+	}
+	if serverMode && len(backend) > 0 {
+		fatal("-backend can't be used with server, it keeps the snapshots of containers by name alone.")
+	}
+	if useRepo {
+		s.repo = openRepo(backupTarget)
+	}
+	s.store = openSnapshotStore(backend)
+
+	if serverMode {
+		serveAgents(listen, &serverTLS, &agentServer{s: s, conf: conf, hc: &hc, budget: maxDuration, tempDir: tempDir})
+		return
+	}
+
+	if serverConfig {
+		backupServerConfig(lxdBackupPrefix)
+	}
 
 	containers := lxcList()
 
@@ -445,88 +1048,407 @@ func main() {
 	containers = filterCont(containers, contExc, false)
 	containers = filterCont(containers, contInc, true)
 
+	containers = filterProfile(containers, profiles)
+	containers = filterStatus(containers, states)
+	containers = filterMatch(containers, matches)
+
+	cluster := lxdCluster()
+	if localOnly && cluster.clustered {
+		containers = filterLocal(containers, cluster.member)
+	}
+	orderByPriority(containers, parsePriorities(priorityStr), conf)
 	for _, c := range containers {
+		exporterRun(c.name)
+	}
 
-		if c.state == stateRunning {
-			lxcStop(c.name)
-		}
+	var volumes []*volumeState
+	if backupVolumes {
+		volumes = filterVolumes(lxcVolumeList(), toMap(volExcStr))
+	}
 
-		var exportName string
-		doDelta := false
+	names := make([]string, 0, len(containers)+len(volumes))
+	for _, c := range containers {
+		names = append(names, c.name)
+	}
+	for _, v := range volumes {
+		names = append(names, v.backupName())
+	}
+	progress := newFleetProgress(lxdBackupPrefix, names)
+	dash.names(names)
 
-		qBackup := lxdBackupPrefix + c.name + quarter
-		if _, err := os.Stat(qBackup); errors.Is(err, os.ErrNotExist) {
-			exportName = qBackup
-		} else {
-			exportName = filepath.Join(tempDir, fmt.Sprintf("lxd-temporary-backup-%d.tar.zstd", time.Now().UnixNano()))
-			doDelta = true
-		}
+	forecastRollover(s, backupTarget, names, progress.history, report)
 
-		lxcExport(c.name, exportName)
+	run := func(j *backupJob) {
+		if err := probeTarget(backupTarget); err != nil {
+			fatalExit(exitTargetUnavailable, "Backup target %s is not available. Error: %v\n", backupTarget, err)
+		}
+		// IE a consolidate of it is running
+		jobLock, err := acquireLock(s.prefix+j.name+".lock", "backup of "+j.name)
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			slog.Warn("Skipping, it is locked", "name", j.name, "held-by", locked.holder.String())
+			report.end(report.begin(j.name), "skipped", 0)
+			progress.skip(j.name)
+			return
+		} else if err != nil {
+			fatal(err)
+		}
+		defer jobLock.release()
+		start := time.Now()
+		progress.begin(j.name)
+		res := report.begin(j.name)
+		if err := checkSpace(j, s, progress.lastBytes(j.name)); err != nil {
+			msg := fmt.Sprintf("Not enough space to back up %s: %v", j.name, err)
+			slog.Error(msg)
+			res.Error = msg
+			report.end(res, "failed", 0)
+			hc.containerDone(j.name, true, msg)
+			progress.skip(j.name)
+			return
+		}
+		hc.containerStart(j.name)
+		budget := maxDuration
+		if d := conf.container(j.name).maxDuration; d > 0 {
+			budget = d
+		}
+		if err := backupWithBudget(j, s, budget); err != nil {
+			res.Stages = j.stages
+			res.Error = err.Error()
+			report.end(res, "failed", j.exported)
+			hc.containerDone(j.name, true, err.Error())
+			appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: "failed",
+				Error: err.Error()})
+			progress.skip(j.name)
+			return
+		}
+		res.Stages = j.stages
+		res.Ratio = j.ratio
+		res.Changed, res.Removed = j.changed, j.removed
+		res.Files = j.files
+		report.end(res, j.status, j.exported)
+		for _, msg := range sizeAnomalies(s.prefix, s.runID, j) {
+			report.warn(msg)
+		}
+		writeRestorePlan(s.prefix, j.name, s.retention)
+		linkLayout(s.prefix, j.name, s.retention)
+		hc.containerDone(j.name, false, j.status)
+		progress.finish(j.name, j.exported, time.Since(start))
+	}
 
-		if c.state == stateRunning {
-			lxcStart(c.name)
+	runByHost(containers, jobs, hostJobs, func(c *containerState) {
+		if !cluster.lockInstance(c.name) {
+			report.end(report.begin(c.name), "skipped", 0)
+			progress.skip(c.name)
+			return
 		}
+		run(containerJob(c, conf))
+		cluster.unlockInstance(c.name)
+	})
 
-		sums := fetchFileDataFromTar(exportName) // calculate md5sums
+	for _, v := range volumes {
+		run(volumeJob(v, conf))
+	}
 
-		if !doDelta {
-			// Save md5sums for quarterly
-			writeFileData(exportName+".md5sum", sums)
-			writeProfile(exportName, c.profileName, c.profile)
-			continue
-		}
+	if s.repo != nil && repoKeep > 0 {
+		s.repo.gc()
+	}
 
-		quarterSums := loadFileData(qBackup + ".md5sum")
+	auditStates(containers, report)
 
-		filesChangedAdded := make(map[string]bool)
-		var filesRemoved []string
+	for _, t := range copyTargets {
+		copyBackups(backupTarget, t, s.runID, s.retention, report)
+	}
+
+	progress.save()
+	report.finish()
+	report.save(lxdBackupPrefix)
+	if len(reportJSON) > 0 {
+		report.writeJSON(reportJSON)
+	}
+	renderHTMLReport(report, lxdBackupPrefix, &conf.Notify)
+	conf.Notify.notify(report)
+	hc.done(report)
+
+	switch images {
+	case "referenced":
+		backupImages(lxdBackupPrefix, referencedImages(containers))
+	case "all":
+		backupImages(lxdBackupPrefix, localImages())
+	}
+	dash.close()
+}
 
-		// Look for files changed or delete compared with quarter
-		for fname, md5sumOld := range quarterSums {
-			if md5sumCurr, present := sums[fname]; present {
-				if md5sumCurr != md5sumOld {
-					filesChangedAdded[fname] = true
+// stage marks the start of a stage of the backup, and the end of the previous one.
+func (j *backupJob) stage(name string) {
+	t := nowUTC()
+	if n := len(j.stages); n > 0 && len(j.stages[n-1].End) == 0 {
+		j.stages[n-1].End = timestamp(t)
+	}
+	if len(name) > 0 {
+		j.stages = append(j.stages, stageTiming{Name: name, Start: timestamp(t)})
+	}
+	dash.stage(j.name, name)
+}
+
+func backup(j *backupJob, s *schedule) {
+
+	if s.repo != nil {
+		backupToRepo(j, s)
+		return
+	}
+	if s.store != nil {
+		backupToStore(j, s)
+		return
+	}
+
+	defer j.stage("")
+
+	j.stage("stop")
+	j.before()
+	// Started again even if the backup returns early or panics
+	defer j.after()
+
+	var exportName string
+	doDelta := false
+
+	makeContainerDir(s.prefix, j.name)
+	qStem := backupPrefix(s.prefix, j.name, s.quarter) + j.name + s.quarter
+	qBackup := findArchive(qStem)
+	if _, err := os.Stat(qBackup); errors.Is(err, os.ErrNotExist) {
+		qBackup = archiveName(qStem, exportFormat(j.manifest.ExportArgs))
+		exportName = qBackup
+	} else {
+		exportName = tempExportName(s.tempDir, j.name)
+		doDelta = true
+		// Unless promoted to the new full backup, it is only needed for the delta
+		defer removeBackupFile(exportName)
+	}
+	if !doDelta {
+		// A full backup given up on half way must not be taken for one
+		defer func() {
+			if r := recover(); r != nil {
+				switch r.(type) {
+				case budgetExceeded, fatalError:
+					removeBackupFile(qBackup)
 				}
-			} else {
-				filesRemoved = append(filesRemoved, fname)
+				panic(r)
 			}
+		}()
+	}
+
+	// Deltas must be hashed like the quarter they are compared with
+	hs := s.hash
+	var qManifest *manifest
+	if doDelta {
+		hs = lookupHasher("")
+		if qManifest = upgradeManifest(qBackup); qManifest != nil {
+			hs = lookupHasher(qManifest.Hash)
 		}
+	}
+	j.manifest.Hash = hs.name
+	j.manifest.RunID = s.runID
+	j.manifest.Format = exportFormat(j.manifest.ExportArgs)
 
-		// New files compared with quarter?
-		for fname := range sums {
-			if _, present := quarterSums[fname]; !present {
-				filesChangedAdded[fname] = true
-			}
+	// Block level deltas can't leave paths out
+	if doDelta && btrfsSend && j.filter.empty() && backupBtrfsDelta(j, s, qManifest) {
+		return
+	}
+	if doDelta && rbdDiff && j.filter.empty() && backupRBDDelta(j, s, qManifest) {
+		return
+	}
+
+	// Only files the change detector can't vouch for need hashing
+	var known map[string]string
+	var unchanged func(hdr *tar.Header) bool
+	if j.detector != nil && !doDelta {
+		j.detector.full(j)
+	} else if j.detector != nil && qManifest != nil {
+		if unchanged = j.detector.delta(j, s, qManifest); unchanged != nil {
+			known = loadFileData(qBackup + hs.suffix())
 		}
+	}
 
-		if len(filesChangedAdded) == 0 && len(filesRemoved) == 0 {
-			ioutil.WriteFile(lxdBackupPrefix+c.name+".log", []byte(fmt.Sprintf("%s: No changes\n", now.String())), 0644)
-			continue
+	var exportIntent int
+	if doDelta {
+		exportIntent = intents.begin("write", j.name, exportName, "")
+	} else {
+		exportIntent = intents.begin("full", j.name, qBackup, "")
+	}
+	defer intents.done(exportIntent)
+
+	if !doDelta && btrfsSend {
+		j.stage("snapshot")
+		btrfsFull(j, qBackup)
+	}
+	if !doDelta && rbdDiff {
+		j.stage("snapshot")
+		rbdFull(j, qBackup)
+	}
+
+	j.stage("export")
+	exportWithProgress(j, exportName, qBackup)
+
+	j.stage("start")
+	j.after()
+
+	if st, err := os.Stat(exportName); err == nil {
+		j.exported = st.Size()
+	}
+	filterExport(j, exportName)
+
+	j.stage("hash")
+	sums, stats, tarSize := fetchFileDataFromTar(j.name, exportName, known, unchanged, hs)
+	j.stage("")
+	j.ratio = logCompression(exportName, tarSize)
+
+	// A full backup made in place of another is written as partial, and only
+	// replaces it once complete
+	saveFull := func(dest string) {
+		trimToImage(j, s, dest, sums, stats, hs)
+		// Named for the format it ended up in, IE rewritten by lxd-backup
+		j.manifest.Format = detectFormat(dest)
+		if full := archiveName(qStem, j.manifest.Format); dest == qBackup && full != qBackup {
+			defer intents.done(intents.begin("full", j.name, full, ""))
+			renameArchive(qBackup, full)
+			dest, qBackup = full, full
+		}
+		finishArchive(dest)
+		// Save checksums for quarterly
+		writeFileData(dest+hs.suffix(), sums)
+		writeFileStats(dest+".stat", stats)
+		writeProfiles(dest, j.profiles)
+		writeManifest(dest, j.manifest)
+		if dest != qBackup {
+			qBackup = commitFull(s.prefix, j.name, qBackup, dest, s.retention)
 		}
+		pruneTier(s.prefix, j.name, ".tar", &s.retention.Full)
+		if !s.writeOnceUntil.IsZero() {
+			makeWriteOnce(qBackup, s.writeOnceUntil)
+		}
+		j.status = "full"
+		j.changed = len(sums)
+		j.files = append(j.files, qBackup)
+		appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+			Changed: len(sums), Bytes: j.exported})
+	}
+
+	if !doDelta {
+		saveFull(qBackup)
+		return
+	}
 
-		// Create delta(s)
-		if now.Day() == 1 {
-			os.Remove(lxdBackupPrefix + c.name + monthDelta)
+	quarterSums := loadFileData(qBackup + hs.suffix())
+
+	filesChangedAdded, filesRemoved := lxdbackup.Changes(quarterSums, sums)
+	skipped := j.deltaSkip.apply(j.name, filesChangedAdded, stats)
+
+	// Files with the same content, but chmod, chown or touch since
+	metaChangedOnly := make(map[string]bool)
+	if fileExists(qBackup + ".stat") {
+		metaChangedOnly = lxdbackup.MetaOnly(loadFileStats(qBackup+".stat"), stats, filesChangedAdded)
+	}
+
+	noChanges := len(filesChangedAdded) == 0 && len(filesRemoved) == 0 && len(metaChangedOnly) == 0
+	if noChanges && !s.tiers.anyDue(s, j.name) {
+		j.status = "no changes"
+		appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status, Bytes: j.exported,
+			Scrub: unchanged == nil})
+		return
+	} else if noChanges {
+		slog.Info("No changes, catching up on due delta tiers", "name", j.name)
+	}
+
+	// With lots of churn a delta is nearly a full backup, only slower to restore
+	if s.promoteAt > 0 {
+		changedBytes, totalBytes := lxdbackup.ChangedBytes(stats, filesChangedAdded)
+		if err := writeOnceError(qBackup); changedBytes*100 > totalBytes*int64(s.promoteAt) && err != nil {
+			slog.Info("Delta too large, but the full backup can't be replaced", "name", j.name, "reason", err)
+		} else if changedBytes*100 > totalBytes*int64(s.promoteAt) {
+			slog.Info("Delta too large, making a new full backup", "name", j.name,
+				"changed", humanBytes(changedBytes), "of", humanBytes(totalBytes))
+			partial := promotePartial(s.prefix, j.name)
+			promoteIntent := intents.begin("full", j.name, qBackup, partial)
+			defer intents.done(promoteIntent)
+			stageFull(j.name, qBackup, partial, exportName)
+			// The journal since the old full covers all changes since the new one, and
+			// so does a diff with its ZFS snapshot
+			if qManifest != nil {
+				j.manifest.JournalEpoch = qManifest.JournalEpoch
+				j.manifest.ZFSSnapshot = qManifest.ZFSSnapshot
+			}
+			saveFull(partial)
+			return
+		}
+	}
+
+	// Create delta(s), slots left from an earlier period are made over, or
+	// kept as a generation first
+	due := make(map[string]bool)
+	for _, d := range s.deltas {
+		if s.tiers.due(s.prefix, j.name, d) {
+			due[d.suffix] = true
 		}
-		if now.Weekday() == 1 { // monday
-			os.Remove(lxdBackupPrefix + c.name + weekDelta)
+		// Write-once deltas are kept until they may go
+		slot := findArchive(backupPrefix(s.prefix, j.name, d.suffix) + j.name + d.suffix)
+		if d.tier.Generations > 0 || !writeOnceUntil(slot).IsZero() {
+			keepGeneration(s.prefix, j.name, slot, d.tier)
+		} else if due[d.suffix] {
+			removeBackupFile(slot)
 		}
-		os.Remove(lxdBackupPrefix + c.name + dayDelta)
+	}
 
-		// FIXME: There is no delta of delta, month, week and day will sometimes contain the same data
-		createDeltaBackup(exportName, filesChangedAdded, filesRemoved, lxdBackupPrefix+c.name+monthDelta, c.profileName, c.profile)
-		createDeltaBackup(exportName, filesChangedAdded, filesRemoved, lxdBackupPrefix+c.name+weekDelta, c.profileName, c.profile)
-		createDeltaBackup(exportName, filesChangedAdded, filesRemoved, lxdBackupPrefix+c.name+dayDelta, c.profileName, c.profile)
+	j.stage("delta")
 
-		status := fmt.Sprintf("%s: %d files changed/added, %d removed.\n", now.String(), len(filesChangedAdded), len(filesRemoved))
-		if err := ioutil.WriteFile(lxdBackupPrefix+c.name+".log", []byte(status), 0644); err != nil {
-			log.Fatalf("Failed to write log for %s: %v\n", c.name, err)
+	// Large files that were in the quarter backup are stored as binary diffs
+	var sigs map[string]*lxdbackup.BlockSig
+	if s.diffMinSize > 0 {
+		big := make(map[string]bool)
+		for fname := range filesChangedAdded {
+			if _, inQuarter := quarterSums[fname]; inQuarter && stats[fname].Size >= s.diffMinSize {
+				big[fname] = true
+			}
+		}
+		if len(big) > 0 {
+			sigs = signatures(qBackup, big)
 		}
-		os.Remove(exportName)
+	}
+
+	// Deltas are written by lxd-backup, whatever the export was made with
+	deltaManifest := *j.manifest
+	deltaManifest.Format = archiveFormat
+	deltaManifest.Skipped = skipped
+	if qManifest != nil {
+		deltaManifest.Full, deltaManifest.FullSHA256 = filepath.Base(qBackup), qManifest.SHA256
+	}
 
-		if verbose {
-			fmt.Printf("Backup of %s done.\n", c.name)
+	// FIXME: There is no delta of delta, month, week and day will sometimes contain the same data
+	for _, d := range s.deltas {
+		// One kept from earlier this period stays in the format it was made in
+		dest := findArchive(backupPrefix(s.prefix, j.name, d.suffix) + j.name + d.suffix)
+		var deltaIntent int
+		if !fileExists(manifestFile(dest)) {
+			deltaIntent = intents.begin("write", j.name, dest, "")
 		}
+		createDeltaBackup(exportName, filesChangedAdded, metaChangedOnly, filesRemoved, sigs, dest, j.profiles, &deltaManifest)
+		intents.done(deltaIntent)
+		if !s.writeOnceUntil.IsZero() {
+			makeWriteOnce(dest, s.writeOnceUntil)
+		}
+		j.files = append(j.files, dest)
+		j.deltaBytes = archiveSize(dest)
+		if due[d.suffix] {
+			s.tiers.record(j.name, d, s.now)
+		}
+		pruneTier(s.prefix, j.name, "-delta.tar", d.tier)
 	}
+
+	j.status = "delta"
+	if noChanges {
+		j.status = "no changes"
+	}
+	j.changed, j.removed = len(filesChangedAdded)+len(metaChangedOnly), len(filesRemoved)
+	appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+		Changed: j.changed, Removed: len(filesRemoved), Bytes: j.exported, Delta: j.deltaBytes, Scrub: unchanged == nil})
+
+	slog.Info("Backup done", "name", j.name, "at", displayTime(nowUTC()))
 }
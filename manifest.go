@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+type profileEntry struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// manifestVersion is the version of the manifest format written. 2 has no
+// sums of the sidecars, 1 is that of the manifests before it was recorded,
+// and 0 is of archives that only have a checksum file and a profile next to
+// them.
+const manifestVersion = 3
+
+// manifest describes everything needed to recreate a container besides its
+// filesystem. It is stored next to each archive as <archive>.manifest.json,
+// in manifests with container directories.
+type manifest struct {
+	// Version is manifestVersion of the manifest, Tool the version of
+	// lxd-backup that wrote it.
+	Version int    `json:"version,omitempty"`
+	Tool    string `json:"tool,omitempty"`
+
+	Container string `json:"container"`
+	Kind      string `json:"kind,omitempty"`
+
+	// LXDVersion is the version of the server that made the export.
+	LXDVersion string         `json:"lxd-version,omitempty"`
+	Created    string         `json:"created"`
+	Config     string         `json:"config"`
+	Devices    string         `json:"devices"`
+	Profiles   []profileEntry `json:"profiles"`
+
+	// ExportArgs are the extra lxc export flags the archive was made with.
+	ExportArgs []string `json:"export-args,omitempty"`
+
+	// RunID identifies the run that made the backup.
+	RunID string `json:"run-id,omitempty"`
+
+	// Hash is the checksum algorithm of the checksum file, md5 when empty.
+	Hash string `json:"hash,omitempty"`
+
+	// Format is the compression of the archive, zstd, gzip, xz or none. It
+	// is detected when reading, this is for other tools.
+	Format string `json:"format,omitempty"`
+
+	// SHA256 is the checksum of the archive as stored, all parts together,
+	// to verify it without unpacking.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Sidecars are the sha256 of the files next to the archive, by what
+	// follows its name, IE .removed, see signedSidecars.
+	Sidecars map[string]string `json:"sidecars,omitempty"`
+
+	// Full and FullSHA256 are the name and the SHA256 of the full backup a
+	// delta was made against, which check-chain holds the full backup it
+	// applies to against.
+	Full       string `json:"full,omitempty"`
+	FullSHA256 string `json:"full-sha256,omitempty"`
+
+	// JournalEpoch identifies the agent journal started with a quarter backup.
+	JournalEpoch string `json:"journal-epoch,omitempty"`
+
+	// ZFSSnapshot is the snapshot of the dataset made with a quarter backup,
+	// for the zfs change detection.
+	ZFSSnapshot string `json:"zfs-snapshot,omitempty"`
+
+	// BtrfsSnapshot is the snapshot a quarter backup sent with -btrfs-send
+	// was made of, kept on the host for the deltas to be sent against.
+	// BtrfsParent is its name in a btrfs delta, which only applies to the
+	// quarter backup of that snapshot.
+	BtrfsSnapshot string `json:"btrfs-snapshot,omitempty"`
+	BtrfsParent   string `json:"btrfs-parent,omitempty"`
+
+	// RBDSnapshot and RBDParent are the same for -rbd-diff, the snapshot
+	// of the RBD image of the container.
+	RBDSnapshot string `json:"rbd-snapshot,omitempty"`
+	RBDParent   string `json:"rbd-parent,omitempty"`
+
+	// Excluded are the patterns of the paths left out of the archive on
+	// purpose, see pathFilter.
+	Excluded []string `json:"excluded,omitempty"`
+
+	// Included are the only paths in the archive when set, it is then a
+	// partial backup, restored onto an instance instead of as one.
+	Included []string `json:"included,omitempty"`
+
+	// Skipped are the changed files a delta left out, see deltaSkip.
+	Skipped []skippedFile `json:"skipped,omitempty"`
+
+	// Snapshots are the names of the snapshots of the instance in the
+	// archive, which restore recreates. None when it was exported alone.
+	Snapshots []string `json:"snapshots,omitempty"`
+
+	// Live is set when the archive is of a CRIU checkpoint of the running
+	// container, exported as its copy liveCopy, with the state of its
+	// processes.
+	Live bool `json:"live,omitempty"`
+
+	// Project is the LXD project the container is in, when not default.
+	Project string `json:"project,omitempty"`
+
+	// Host is the name of the host agent that uploaded the archive to an
+	// lxd-backup server, the common name of its certificate, or the host of
+	// the config file it was pulled from.
+	Host string `json:"host,omitempty"`
+
+	// BaseImage is the fingerprint of the image a full backup made with
+	// -image-base left out the files of, see trimToImage.
+	BaseImage string `json:"base-image,omitempty"`
+}
+
+// partial tells whether the archive only holds some paths of the container.
+func (m *manifest) partial() bool {
+	return len(m.Included) > 0
+}
+
+func newManifest(c *containerState) *manifest {
+
+	m := &manifest{
+		Container: c.name,
+		Created:   timestamp(nowUTC()),
+		Config:    execLxc([]string{"config", "show", c.name, "--expanded"}),
+		Devices:   execLxc([]string{"config", "device", "show", c.name}),
+
+		LXDVersion: lxdRemoteVersion(c.remote),
+		Host:       c.remote,
+	}
+	if len(c.remote) == 0 && lxcProject() != "default" {
+		m.Project = lxcProject()
+	}
+
+	m.Profiles = c.profiles
+	return m
+}
+
+// writeManifest writes the manifest of the archive dest, with its checksum,
+// and signs it with -sign-key. The signature goes first, a manifest that is
+// there is complete.
+func writeManifest(dest string, m *manifest) {
+
+	m.Version, m.Tool = manifestVersion, toolVersion()
+	m.SHA256 = archiveSHA256(dest)
+	m.Sidecars = sidecarSums(dest)
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fatalf("Failed to encode manifest for %s. Error: %v\n", m.Container, err)
+	}
+
+	if signKey != nil {
+		signManifest(dest, d)
+	} else {
+		os.Remove(manifestFile(dest) + ".sig") // Of a manifest rewritten since
+	}
+	if err := writeFilePartial(manifestFile(dest), d, 0644); err != nil {
+		fatalf("Failed to write manifest to: %s: %v\n", manifestFile(dest), err)
+	}
+}
+
+func loadManifest(fname string) *manifest {
+
+	d, err := os.ReadFile(fname)
+	if err != nil {
+		fatalf("Failed to read manifest %s. Error: %v\n", fname, err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		fatalf("Failed to decode manifest %s. Error: %v\n", fname, err)
+	}
+	return &m
+}
+
+// lxcProject is the LXD project lxc works in, default when lxc can't tell.
+var lxcProject = sync.OnceValue(func() string {
+	out, err := lxcOutput("project", "get-current")
+	if p := strings.TrimSpace(string(out)); err == nil && len(p) > 0 {
+		return p
+	}
+	return "default"
+})
+
+// toolVersion is the version of lxd-backup, the commit it was built from
+// when not built from a release.
+func toolVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" {
+			return "devel-" + s.Value[:min(len(s.Value), 12)]
+		}
+	}
+	return "devel"
+}
+
+// readManifest returns the manifest of archive, upgraded to the current
+// format as far as it can be without rewriting it, or nil when there is
+// none. Archives made before there were manifests get one made up of their
+// checksum file and profile.
+func readManifest(archive string) *manifest {
+
+	if fileExists(manifestFile(archive)) {
+		m := loadManifest(manifestFile(archive))
+		if m.Version == 0 {
+			m.Version = 1
+		}
+		if len(m.Hash) == 0 {
+			m.Hash = "md5"
+		}
+		return m
+	}
+
+	st, err := os.Stat(archive)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fatalf("Failed to stat %s. Error: %v\n", archive, err)
+		}
+		return nil
+	}
+	m := &manifest{Container: containerOf(archive), Created: timestamp(st.ModTime())}
+	for _, h := range lxdbackup.HasherNames() {
+		if fileExists(archive + lookupHasher(h).suffix()) {
+			m.Hash = h
+			break
+		}
+	}
+	if len(m.Hash) == 0 && !strings.HasSuffix(archiveStem(archive), "-delta.tar") {
+		// Neither a quarter backup nor a delta lxd-backup knows
+		return nil
+	}
+	if len(m.Hash) == 0 {
+		m.Hash = "md5"
+	}
+
+	// One per profile, or of older versions one named after all of them with
+	// the first one's data in it
+	profiles, _ := filepath.Glob(archive + ".*.profile")
+	for _, p := range profiles {
+		names := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(p, archive+"."), ".profile"))
+		d, err := os.ReadFile(p)
+		if err != nil {
+			fatalf("Failed to read profile %s. Error: %v\n", p, err)
+		}
+		for i, n := range names {
+			pe := profileEntry{Name: n}
+			if i == 0 {
+				pe.Data = string(d)
+			}
+			m.Profiles = append(m.Profiles, pe)
+		}
+	}
+
+	if f, err := openParts(archive); err == nil {
+		if r, format, err := lxdbackup.NewReader(f); err == nil {
+			m.Format = format.Name()
+			r.Close()
+		}
+		f.Close()
+	}
+	return m
+}
+
+// containerOf is the name of the container the archive is of.
+func containerOf(archive string) string {
+	n := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archiveStem(archive)), "lxd-backup-"), "-delta.tar")
+	if i := strings.LastIndex(n, "-"); i > 0 {
+		n = n[:i]
+	}
+	return n
+}
+
+// upgradeManifest writes the manifest of archive in the current format,
+// when it is of an older one. A signed manifest is only rewritten when it
+// can be signed again.
+func upgradeManifest(archive string) *manifest {
+
+	m := readManifest(archive)
+	if m == nil {
+		return nil
+	}
+	if m.Version == manifestVersion || (signKey == nil && fileExists(manifestFile(archive)+".sig")) {
+		return m
+	}
+	from := m.Version
+	writeManifest(archive, m)
+	slog.Info("Upgraded manifest", "file", archive, "from", from, "to", manifestVersion)
+	return m
+}
+
+// nicDevices returns the names of the network devices in the expanded config.
+func (m *manifest) nicDevices() []string {
+
+	var nics []string
+	inDevices := false
+	dev := ""
+
+	for _, l := range strings.Split(m.Config, "\n") {
+		indent := len(l) - len(strings.TrimLeft(l, " "))
+		t := strings.TrimSpace(l)
+		switch {
+		case indent == 0:
+			inDevices = t == "devices:"
+		case inDevices && indent == 2 && strings.HasSuffix(t, ":"):
+			dev = strings.TrimSuffix(t, ":")
+		case inDevices && indent == 4 && t == "type: nic":
+			nics = append(nics, dev)
+		}
+	}
+	return nics
+}
+
+// diskDevices returns the names of the disk devices in the expanded config
+// other than the root disk, IE host directories and custom volumes.
+func (m *manifest) diskDevices() []string {
+
+	var disks []string
+	inDevices := false
+	dev, typ, path := "", "", ""
+	flush := func() {
+		if typ == "disk" && path != "/" {
+			disks = append(disks, dev)
+		}
+		dev, typ, path = "", "", ""
+	}
+
+	for _, l := range strings.Split(m.Config, "\n") {
+		indent := len(l) - len(strings.TrimLeft(l, " "))
+		t := strings.TrimSpace(l)
+		switch {
+		case indent == 0:
+			flush()
+			inDevices = t == "devices:"
+		case inDevices && indent == 2 && strings.HasSuffix(t, ":"):
+			flush()
+			dev = strings.TrimSuffix(t, ":")
+		case inDevices && indent == 4 && strings.HasPrefix(t, "type: "):
+			typ = strings.TrimPrefix(t, "type: ")
+		case inDevices && indent == 4 && strings.HasPrefix(t, "path: "):
+			path = strings.TrimPrefix(t, "path: ")
+		}
+	}
+	flush()
+	return disks
+}
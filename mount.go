@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// mountNode is a file of a mounted backup. Its content is extracted to a
+// temporary file while it is open.
+type mountNode struct {
+	ino      uint64
+	entry    string // Name in the tarball, of the link target for hard links
+	hdr      *tar.Header
+	size     int64
+	children map[string]*mountNode
+	names    []string // Of the children, sorted
+
+	f     *os.File
+	opens int
+}
+
+// mountTree is the files of one generation of a backup, as restore would
+// put it together, for mount.
+type mountTree struct {
+	mu      sync.Mutex
+	v       *backupView
+	tempDir string
+	nodes   []*mountNode // By inode number - 1, the root first
+	made    time.Time    // For directories the tarball leaves out
+}
+
+// archiveHeaders returns the tar headers of all entries of archive.
+func archiveHeaders(archive string) map[string]*tar.Header {
+
+	in := openArchive(archive)
+	defer in.Close()
+
+	headers := make(map[string]*tar.Header)
+	tarreader := tar.NewReader(in)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			return headers
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", archive, err)
+		}
+		headers[hdr.Name] = hdr
+	}
+}
+
+// newMountTree reads the entries of v. Only the root filesystem of a
+// container is shown, the whole tarball for anything else.
+func newMountTree(v *backupView, tempDir string) *mountTree {
+
+	headers := archiveHeaders(v.quarter)
+	if len(v.delta) > 0 {
+		for n := range v.removed {
+			delete(headers, n)
+		}
+		for n, hdr := range archiveHeaders(v.delta) {
+			if q, ok := headers[n]; ok && lxdbackup.IsMetaEntry(hdr) {
+				hdr = lxdbackup.ApplyMeta(q, hdr)
+			}
+			headers[n] = hdr
+		}
+	}
+
+	root := ""
+	for n := range headers {
+		if strings.HasPrefix(n, rootfsPrefix+"/") {
+			root = rootfsPrefix
+			break
+		}
+	}
+
+	t := &mountTree{v: v, tempDir: tempDir}
+	if st, err := os.Stat(v.quarter); err == nil {
+		t.made = st.ModTime()
+	}
+	rootHdr := &tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: t.made}
+	for _, n := range []string{root, root + "/"} {
+		if hdr, ok := headers[n]; ok && hdr.Typeflag == tar.TypeDir {
+			rootHdr = hdr
+		}
+	}
+	t.node(nil, "", rootHdr)
+
+	byEntry := make(map[string]*mountNode)
+	for n, hdr := range headers {
+		p := path.Clean(n)
+		if len(root) > 0 {
+			if !strings.HasPrefix(p, root+"/") {
+				continue
+			}
+			p = strings.TrimPrefix(p, root+"/")
+		}
+		if p == "." {
+			continue
+		}
+		byEntry[path.Clean(n)] = t.add(p, n, hdr)
+	}
+
+	// A hard link is shown as its target, the tarball has the data only once
+	for _, n := range t.nodes {
+		if n.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		if target, ok := byEntry[path.Clean(n.hdr.Linkname)]; ok && target.hdr.Typeflag == tar.TypeReg {
+			n.entry, n.hdr, n.size = target.entry, target.hdr, target.size
+		} else {
+			slog.Warn("Hard link to a missing file", "name", n.entry, "target", n.hdr.Linkname)
+			n.hdr = &tar.Header{Typeflag: tar.TypeReg, Mode: n.hdr.Mode, ModTime: n.hdr.ModTime}
+			n.size = 0
+		}
+	}
+
+	for _, n := range t.nodes {
+		sort.Strings(n.names)
+	}
+	return t
+}
+
+func (t *mountTree) node(parent *mountNode, name string, hdr *tar.Header) *mountNode {
+	n := &mountNode{ino: uint64(len(t.nodes) + 1), hdr: hdr, size: hdr.Size}
+	if hdr.Typeflag == tar.TypeDir {
+		n.children = make(map[string]*mountNode)
+	}
+	t.nodes = append(t.nodes, n)
+	if parent != nil {
+		parent.children[name] = n
+		parent.names = append(parent.names, name)
+	}
+	return n
+}
+
+// restrictRoot makes the root directory of the tree root's alone, 0700.
+func (t *mountTree) restrictRoot() {
+	hdr := *t.nodes[0].hdr
+	hdr.Mode, hdr.Uid, hdr.Gid = 0700, 0, 0
+	t.nodes[0].hdr = &hdr
+}
+
+// add puts the entry at path p into the tree, with the directories above
+// it if the tarball doesn't have them.
+func (t *mountTree) add(p, entry string, hdr *tar.Header) *mountNode {
+
+	dir := t.nodes[0]
+	parts := strings.Split(p, "/")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.children[part]
+		if !ok {
+			next = t.node(dir, part, &tar.Header{Typeflag: tar.TypeDir, Mode: 0755, ModTime: t.made})
+		} else if next.children == nil {
+			return next // A file where a directory should be, keep the file
+		}
+		dir = next
+	}
+
+	name := parts[len(parts)-1]
+	n, ok := dir.children[name]
+	if ok && n.children != nil && hdr.Typeflag == tar.TypeDir {
+		n.hdr = hdr // The directory came after its content
+	} else if !ok {
+		n = t.node(dir, name, hdr)
+	}
+	n.entry = entry
+	// A binary diff is only the size of the patch
+	if s, ok := hdr.PAXRecords[lxdbackup.PAXPatch]; ok {
+		n.size, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return n
+}
+
+func (t *mountTree) lookup(ino uint64) *mountNode {
+	if ino == 0 || ino > uint64(len(t.nodes)) {
+		return nil
+	}
+	return t.nodes[ino-1]
+}
+
+// open extracts the content of n to a temporary file, unless it is open
+// already.
+func (t *mountTree) open(n *mountNode) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n.opens > 0 {
+		n.opens++
+		return nil
+	}
+	f, err := os.CreateTemp(t.tempDir, "lxd-temporary-mount-")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name()) // Gone on close, whatever happens
+	if n.size > 0 {
+		t.v.copyFile(n.entry, t.tempDir, f)
+	}
+	n.f = f
+	n.opens = 1
+	return nil
+}
+
+func (t *mountTree) release(n *mountNode) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n.opens--; n.opens == 0 {
+		n.f.Close()
+		n.f = nil
+	}
+}
+
+// generationAsOf returns the newest generation of name from no later than
+// asOf: a full backup, or a delta on top of the full backup it was made
+// against.
+func generationAsOf(lxdBackupPrefix, name string, asOf time.Time, rc *retentionConfig) *backupView {
+
+	made := func(archive string) time.Time {
+		if m := readManifest(archive); m != nil {
+			if t, err := time.Parse(time.RFC3339, m.Created); err == nil {
+				return t
+			}
+		}
+		if st, err := os.Stat(archive); err == nil {
+			return st.ModTime()
+		}
+		return time.Time{}
+	}
+
+	var best *backupView
+	var bestTime time.Time
+	for _, full := range tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full) {
+		if t := made(full); !t.After(asOf) && t.After(bestTime) {
+			best, bestTime = &backupView{quarter: full}, t
+		}
+		for _, d := range deltasOf(lxdBackupPrefix, name, full, rc) {
+			// A delta made the same second as its full is the newer one
+			if t := made(d); !t.After(asOf) && !t.Before(bestTime) {
+				best, bestTime = &backupView{quarter: full, delta: d}, t
+			}
+		}
+	}
+	if best == nil {
+		fatalf("No backup of %s from %s or earlier found.\n", name, displayTime(asOf))
+	}
+	if len(best.delta) > 0 {
+		best.removed = loadRemoved(best.delta + ".removed")
+	}
+	return best
+}
+
+// parseAsOf parses a date, IE 2022-10-14 or 2022-10-14 15:04, in the display
+// timezone. A date alone is the end of that day.
+func parseAsOf(s string) time.Time {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		if t, err := time.ParseInLocation(layout, s, displayLocation); err == nil {
+			return t
+		}
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, displayLocation); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	fatalf("Bad date %s, use IE 2022-10-14 or 2022-10-14 15:04.\n", s)
+	return time.Time{}
+}
+
+// mountMain mounts a backup read only with FUSE, until it is unmounted or
+// lxd-backup is interrupted.
+func mountMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, configFile string
+	var asOf, displayTimezone string
+	var allowOther bool
+
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	viewFlags(fs, &backupTarget, &tempDir, &deltaName, &configFile)
+	fs.StringVar(&asOf, "as-of", "", "Mount the newest backup from this date or earlier, IE 2022-10-14 or \"2022-10-14 15:04\".")
+	fs.StringVar(&displayTimezone, "display-timezone", "", "Timezone of -as-of and of human readable output.")
+	fs.BoolVar(&allowOther, "allow-other", false, "As root, mount with allow_other, through a root directory of mode 0700 that only root can enter.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s mount [options] container mountpoint\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	pos := parseAnywhere(fs, args)
+
+	logOpts.setup()
+
+	if len(pos) != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(asOf) > 0 && len(deltaName) > 0 {
+		fatal("Give either -as-of or -d, not both.")
+	}
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+	setDisplayTimezone(displayTimezone)
+
+	conf := loadConfig(configFile)
+	prefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	var v *backupView
+	if len(asOf) > 0 {
+		v = generationAsOf(prefix, pos[0], parseAsOf(asOf), conf.Retention)
+	} else {
+		v = generationView(prefix, pos[0], deltaName, conf.Retention)
+	}
+
+	slog.Info("Reading backup", "generation", v.String())
+	t := newMountTree(v, tempDir)
+	slog.Info("Mounting", "generation", v.String(), "files", len(t.nodes), "at", pos[1])
+	serveFuse(t, pos[1], v.String(), allowOther)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+type smtpConfig struct {
+	Server   string   `json:"server"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// AttachHTML attaches the HTML report of the run to the mail.
+	AttachHTML bool `json:"attach-html"`
+}
+
+type webhookConfig struct {
+	URL string `json:"url"`
+	// Format is json (the run report), slack or mattermost.
+	Format string `json:"format"`
+}
+
+type matrixConfig struct {
+	Homeserver string `json:"homeserver"`
+	Room       string `json:"room"`
+	Token      string `json:"token"`
+}
+
+type gotifyConfig struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+type notifyConfig struct {
+	FailureOnly bool            `json:"failure-only"`
+	SMTP        *smtpConfig     `json:"smtp"`
+	Webhooks    []webhookConfig `json:"webhooks"`
+	Matrix      *matrixConfig   `json:"matrix"`
+	Ntfy        []string        `json:"ntfy"`
+	Gotify      *gotifyConfig   `json:"gotify"`
+}
+
+type notifier interface {
+	send(subject, body string, r *runReport) error
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+func post(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+func postJSON(method, u string, v any, header map[string]string) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return post(req)
+}
+
+func (c *smtpConfig) send(subject, body string, r *runReport) error {
+
+	host, _, _ := strings.Cut(c.Server, ":")
+
+	var auth smtp.Auth
+	if len(c.Username) > 0 {
+		password, err := lxdbackup.ResolveSecret(c.Password)
+		if err != nil {
+			return fmt.Errorf("smtp password: %w", err)
+		}
+		auth = smtp.PlainAuth("", c.Username, password, host)
+	}
+
+	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n",
+		c.From, strings.Join(c.To, ", "), subject, nowUTC().Format(time.RFC1123Z))
+	text := strings.ReplaceAll(body, "\n", "\r\n")
+
+	if !c.AttachHTML || len(r.html) == 0 {
+		msg := header + "Content-Type: text/plain; charset=utf-8\r\n\r\n" + text
+		return smtp.SendMail(c.Server, auth, c.From, c.To, []byte(msg))
+	}
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	tw, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	tw.Write([]byte(text))
+	hw, _ := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {"attachment; filename=\"lxd-backup-report.html\""},
+	})
+	enc := base64.StdEncoding.EncodeToString(r.html)
+	for len(enc) > 76 {
+		hw.Write([]byte(enc[:76] + "\r\n"))
+		enc = enc[76:]
+	}
+	hw.Write([]byte(enc + "\r\n"))
+	mw.Close()
+
+	msg := header + "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n" + b.String()
+	return smtp.SendMail(c.Server, auth, c.From, c.To, []byte(msg))
+}
+
+func (c *webhookConfig) send(subject, body string, r *runReport) error {
+	// Slack and Mattermost webhooks are secrets of their own
+	u, err := lxdbackup.ResolveSecret(c.URL)
+	if err != nil {
+		return fmt.Errorf("webhook url: %w", err)
+	}
+	switch c.Format {
+	case "slack", "mattermost":
+		return postJSON("POST", u, map[string]string{"text": subject + "\n```\n" + body + "```"}, nil)
+	case "", "json":
+		return postJSON("POST", u, struct {
+			Subject string `json:"subject"`
+			Failed  bool   `json:"failed"`
+			*runReport
+		}{subject, r.failed(), r}, nil)
+	}
+	return fmt.Errorf("unknown webhook format %s", c.Format)
+}
+
+func (c *matrixConfig) send(subject, body string, r *runReport) error {
+	token, err := lxdbackup.ResolveSecret(c.Token)
+	if err != nil {
+		return fmt.Errorf("matrix token: %w", err)
+	}
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/lxd-backup-%d",
+		strings.TrimRight(c.Homeserver, "/"), url.PathEscape(c.Room), time.Now().UnixNano())
+	return postJSON("PUT", u, map[string]string{"msgtype": "m.text", "body": subject + "\n\n" + body},
+		map[string]string{"Authorization": "Bearer " + token})
+}
+
+type ntfyTopic string
+
+func (t ntfyTopic) send(subject, body string, r *runReport) error {
+	u, err := lxdbackup.ResolveSecret(string(t))
+	if err != nil {
+		return fmt.Errorf("ntfy topic: %w", err)
+	}
+	req, err := http.NewRequest("POST", u, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", subject)
+	if r.failed() {
+		req.Header.Set("Priority", "high")
+		req.Header.Set("Tags", "warning")
+	}
+	return post(req)
+}
+
+func (c *gotifyConfig) send(subject, body string, r *runReport) error {
+	token, err := lxdbackup.ResolveSecret(c.Token)
+	if err != nil {
+		return fmt.Errorf("gotify token: %w", err)
+	}
+	priority := 2
+	if r.failed() {
+		priority = 8
+	}
+	return postJSON("POST", strings.TrimRight(c.URL, "/")+"/message",
+		map[string]any{"title": subject, "message": body, "priority": priority},
+		map[string]string{"X-Gotify-Key": token})
+}
+
+func (nc *notifyConfig) notifiers() []notifier {
+	var n []notifier
+	if nc.SMTP != nil {
+		n = append(n, nc.SMTP)
+	}
+	for i := range nc.Webhooks {
+		n = append(n, &nc.Webhooks[i])
+	}
+	if nc.Matrix != nil {
+		n = append(n, nc.Matrix)
+	}
+	for _, t := range nc.Ntfy {
+		n = append(n, ntfyTopic(t))
+	}
+	if nc.Gotify != nil {
+		n = append(n, nc.Gotify)
+	}
+	return n
+}
+
+// notify sends the run summary through all configured notifiers. A failing
+// notifier is reported but doesn't stop the others.
+func (nc *notifyConfig) notify(r *runReport) {
+
+	if nc.FailureOnly && !r.failed() && len(r.Warnings) == 0 {
+		return
+	}
+
+	subject, body := r.summary()
+	for _, n := range nc.notifiers() {
+		if err := n.send(subject, body, r); err != nil {
+			slog.Warn("Failed to send notification", "error", err)
+		}
+	}
+}
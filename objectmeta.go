@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// artifactKinds maps the suffix of a backup file to what it is. Longest
+// suffix first, order matters.
+var artifactKinds = []struct {
+	suffix      string
+	kind        string
+	contentType string
+}{
+	{".manifest.json.sig", "signature", "text/plain"},
+	{".manifest.json", "manifest", "application/json"},
+	{".preseed.yaml", "server-config", "application/yaml"},
+	{".profile", "profile", "application/yaml"},
+	{".removed", "removed", "text/plain"},
+	{"sum", "checksums", "text/csv"},
+	{"-delta.tar.zst", "delta", "application/zstd"},
+	{"-delta.tar.gz", "delta", "application/gzip"},
+	{"-delta.tar.xz", "delta", "application/x-xz"},
+	{"-delta.tar", "delta", "application/x-tar"},
+	{".tar.zst", "full", "application/zstd"},
+	{".tar.gz", "full", "application/gzip"},
+	{".tar.xz", "full", "application/x-xz"},
+	{".tar", "full", "application/x-tar"},
+	{".log", "log", "text/plain"},
+	{".json", "state", "application/json"},
+}
+
+// retentionClass tells which tier of rc the backup file fname of name
+// belongs to, sidecars going with their archive, or none.
+func retentionClass(lxdBackupPrefix, name, fname string, rc *retentionConfig) string {
+
+	archive, ok := archiveOf(filepath.Base(fname))
+	if len(name) == 0 || !ok {
+		return "none"
+	}
+	owner := filepath.Base(lxdBackupPrefix + name)
+
+	if rc.Full.Pattern(owner, ".tar").MatchString(archive) {
+		return rc.Full.Class("full")
+	}
+	for j := range rc.Deltas {
+		tc := &rc.Deltas[j]
+		if tc.Pattern(owner, "-delta.tar").MatchString(archive) || tc.GenerationPattern(owner).MatchString(archive) {
+			return tc.Class(tc.Every)
+		}
+	}
+	return "none"
+}
+
+// artifactMeta is the ObjectMeta of the backup file fname of name, "" for
+// the files of no container, made by the run runID.
+func artifactMeta(lxdBackupPrefix, name, fname, runID string, rc *retentionConfig) lxdbackup.ObjectMeta {
+
+	base := filepath.Base(fname)
+	m := lxdbackup.ObjectMeta{
+		ContentType: "application/octet-stream",
+		Tags: map[string]string{
+			"lxd-backup-name":      name,
+			"lxd-backup-kind":      "unknown",
+			"lxd-backup-run":       runID,
+			"lxd-backup-retention": retentionClass(lxdBackupPrefix, name, fname, rc),
+		},
+	}
+
+	for _, k := range artifactKinds {
+		if strings.HasSuffix(base, k.suffix) {
+			m.ContentType = k.contentType
+			m.Tags["lxd-backup-kind"] = k.kind
+			break
+		}
+	}
+	return m
+}
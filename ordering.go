@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// priorityKey is the instance config key that gives a container its
+// priority, when neither -priority nor the config file does.
+const priorityKey = "user.lxd-backup.priority"
+
+// parsePriorities parses -priority, name=priority comma separated.
+func parsePriorities(s string) map[string]int {
+	p := make(map[string]int)
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) == 0 {
+			continue
+		}
+		name, v, found := strings.Cut(kv, "=")
+		n, err := strconv.Atoi(v)
+		if !found || err != nil {
+			fatalf("Bad -priority %s. Give name=priority, IE db1=100.\n", kv)
+		}
+		p[name] = n
+	}
+	return p
+}
+
+// orderByPriority sorts containers by priority, highest first, so critical
+// ones are backed up early in the run. Equal priorities keep the order of
+// lxc list. The priority of a container is that of -priority, of the config
+// file or of its user.lxd-backup.priority key, the first that has one, and
+// 0 without.
+func orderByPriority(containers []*containerState, flagPriorities map[string]int, conf *config) {
+
+	prio := make(map[string]int, len(containers))
+	for _, c := range containers {
+		if p, ok := flagPriorities[c.name]; ok {
+			prio[c.name] = p
+			continue
+		}
+		if p := conf.Containers[c.name].Priority; p != nil {
+			prio[c.name] = *p
+			continue
+		}
+		v := strings.TrimSpace(execLxc([]string{"config", "get", c.name, priorityKey}))
+		if len(v) == 0 {
+			continue
+		}
+		p, err := strconv.Atoi(v)
+		if err != nil {
+			slog.Warn("Ignoring bad priority", "container", c.name, "key", priorityKey, "value", v)
+			continue
+		}
+		prio[c.name] = p
+	}
+
+	sort.SliceStable(containers, func(i, j int) bool {
+		return prio[containers[i].name] > prio[containers[j].name]
+	})
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Reed-Solomon parity, in the .parity file next to an archive. The archive
+// is cut into blocks, and every group of parityGroup blocks gets parity
+// blocks computed with a Cauchy matrix over GF(2^8). Any parityGroup of the
+// data and parity blocks of a group give back the others, so as many blocks
+// of a group as it has parity blocks may rot away. Checksums of all blocks
+// tell which ones did.
+//
+// The file is a header, then for each group the checksums of its data and
+// parity blocks followed by the parity blocks:
+//
+//	"LXDPAR01" block size, blocks per group, parity blocks per group, archive size
+//	group 0: crc32 * (k + m), parity block * m
+//	group 1: ...
+const (
+	parityMagic = "LXDPAR01"
+	parityBlock = 64 << 10
+	parityGroup = 64
+)
+
+// parityPercent is -parity, how much parity to make, in percent of the
+// archive. 0 means none.
+var parityPercent int
+
+func validateParity() {
+	if parityPercent < 0 || parityPercent > 100 {
+		fatalf("Bad -parity %d. Must be a percentage, 0 to 100.\n", parityPercent)
+	}
+}
+
+var gfExp [512]byte
+var gfLog [256]byte
+var gfMul [256][256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd adds c times src to dst.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	row := &gfMul[c]
+	for i, v := range src {
+		dst[i] ^= row[v]
+	}
+}
+
+// parityMatrix is the m by k Cauchy matrix parity blocks are made with.
+// Stacked under the identity every k rows of it are invertible.
+func parityMatrix(k, m int) [][]byte {
+	c := make([][]byte, m)
+	for i := range c {
+		c[i] = make([]byte, k)
+		for j := range c[i] {
+			c[i][j] = gfInv(byte(i) ^ byte(m+j))
+		}
+	}
+	return c
+}
+
+// gfInvert inverts a square matrix, Gauss-Jordan.
+func gfInvert(a [][]byte) ([][]byte, error) {
+	n := len(a)
+	w := make([][]byte, n)
+	for i := range a {
+		w[i] = make([]byte, 2*n)
+		copy(w[i], a[i])
+		w[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		p := col
+		for p < n && w[p][col] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("singular matrix")
+		}
+		w[col], w[p] = w[p], w[col]
+		inv := gfInv(w[col][col])
+		for j := range w[col] {
+			w[col][j] = gfMul[inv][w[col][j]]
+		}
+		for r := 0; r < n; r++ {
+			if r != col && w[r][col] != 0 {
+				c := w[r][col]
+				mulAdd(w[r], w[col], c)
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range w {
+		inv[i] = w[i][n:]
+	}
+	return inv, nil
+}
+
+type parityHeader struct {
+	BlockSize uint32
+	K, M      uint32
+	Size      uint64
+}
+
+func (h *parityHeader) groups() int64 {
+	blocks := (int64(h.Size) + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+	return (blocks + int64(h.K) - 1) / int64(h.K)
+}
+
+// groupOffset is where the record of group g starts in the parity file.
+func (h *parityHeader) groupOffset(g int64) int64 {
+	return int64(len(parityMagic)+binary.Size(h)) + g*(4*int64(h.K+h.M)+int64(h.M)*int64(h.BlockSize))
+}
+
+// readGroup reads the data blocks of group g, zero padded. Returns how many
+// blocks of it are in the archive.
+func readGroup(r io.ReaderAt, h *parityHeader, g int64, data [][]byte) (int, error) {
+	n := 0
+	for j := range data {
+		clear(data[j])
+		off := (g*int64(h.K) + int64(j)) * int64(h.BlockSize)
+		if off >= int64(h.Size) {
+			continue
+		}
+		n++
+		want := min(int64(h.BlockSize), int64(h.Size)-off)
+		if _, err := r.ReadAt(data[j][:want], off); err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeParity makes the .parity file of an archive with -parity.
+func writeParity(fname string) {
+
+	if parityPercent == 0 {
+		return
+	}
+
+	slog.Info("Making parity", "file", fname, "percent", parityPercent)
+
+	in, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer in.Close()
+	r := readerAt(in)
+
+	h := parityHeader{BlockSize: parityBlock, K: parityGroup, Size: uint64(archiveSize(fname))}
+	h.M = uint32(max((parityGroup*parityPercent+99)/100, 1))
+	c := parityMatrix(int(h.K), int(h.M))
+
+	// Written next to it first, a parity file that is there is complete
+	partial := fname + ".parity.partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", partial, err)
+	}
+	defer os.Remove(partial)
+	defer f.Close()
+	w := bufio.NewWriterSize(f, 1<<20)
+
+	w.WriteString(parityMagic)
+	binary.Write(w, binary.BigEndian, &h)
+
+	data := makeBlocks(int(h.K), int(h.BlockSize))
+	parity := makeBlocks(int(h.M), int(h.BlockSize))
+	for g := int64(0); g < h.groups(); g++ {
+		if _, err := readGroup(r, &h, g, data); err != nil {
+			fatalf("Failed to read %s. Error: %v\n", fname, err)
+		}
+		for i := range parity {
+			clear(parity[i])
+			for j := range data {
+				mulAdd(parity[i], data[j], c[i][j])
+			}
+		}
+		for _, b := range append(data, parity...) {
+			binary.Write(w, binary.BigEndian, crc32.ChecksumIEEE(b))
+		}
+		for _, b := range parity {
+			w.Write(b)
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		err = os.Rename(partial, fname+".parity")
+	}
+	if err != nil {
+		fatalf("Failed to write %s. Error: %v\n", fname+".parity", err)
+	}
+}
+
+func makeBlocks(n, size int) [][]byte {
+	b := make([][]byte, n)
+	for i := range b {
+		b[i] = make([]byte, size)
+	}
+	return b
+}
+
+// readerAt reads at offsets from an archive, split or not.
+func readerAt(r io.ReadSeeker) io.ReaderAt {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra
+	}
+	return &seekReaderAt{r}
+}
+
+type seekReaderAt struct{ r io.ReadSeeker }
+
+func (s *seekReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, b)
+}
+
+// writeArchiveAt writes b at offset off of an archive, into the right parts
+// if it is split.
+func writeArchiveAt(fname string, b []byte, off int64) error {
+	parts := loadParts(fname)
+	if parts == nil {
+		parts = []archivePart{{Size: int64(len(b)) + off}}
+	}
+	var start int64
+	for i, p := range parts {
+		if off < start+p.Size && len(b) > 0 {
+			n := min(int64(len(b)), start+p.Size-off)
+			f, err := os.OpenFile(partName(fname, i), os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(b[:n], off-start)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			b, off = b[n:], off+n
+		}
+		start += p.Size
+	}
+	return nil
+}
+
+// parityDamage is what checkParity found wrong with a group of an archive.
+type parityDamage struct {
+	group    int64
+	data     []int // Damaged data blocks
+	parity   []int // Damaged parity blocks
+	fixable  bool
+	repaired [][]byte
+}
+
+// checkParity finds damaged blocks of an archive, and works out the content
+// they should have where there is parity enough.
+func checkParity(fname string) ([]parityDamage, *parityHeader) {
+
+	pf, err := os.Open(fname + ".parity")
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname+".parity", err)
+	}
+	defer pf.Close()
+
+	magic := make([]byte, len(parityMagic))
+	var h parityHeader
+	if _, err := io.ReadFull(pf, magic); err != nil || string(magic) != parityMagic {
+		fatalf("%s is not a parity file.\n", fname+".parity")
+	}
+	if err := binary.Read(pf, binary.BigEndian, &h); err != nil || h.K == 0 || h.M == 0 || h.K+h.M > 256 {
+		fatalf("Bad header in %s.\n", fname+".parity")
+	}
+	if size := archiveSize(fname); size != int64(h.Size) {
+		fatalf("%s is %d bytes, but was %d. Parity can't help with that.\n", fname, size, h.Size)
+	}
+
+	in, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer in.Close()
+	r := readerAt(in)
+
+	k, m := int(h.K), int(h.M)
+	c := parityMatrix(k, m)
+	data := makeBlocks(k, int(h.BlockSize))
+	parity := makeBlocks(m, int(h.BlockSize))
+	sums := make([]uint32, k+m)
+
+	var damage []parityDamage
+	for g := int64(0); g < h.groups(); g++ {
+		present, err := readGroup(r, &h, g, data)
+		if err != nil {
+			fatalf("Failed to read %s. Error: %v\n", fname, err)
+		}
+		if _, err := pf.Seek(h.groupOffset(g), io.SeekStart); err != nil {
+			fatalf("Failed to seek in %s. Error: %v\n", fname+".parity", err)
+		}
+		if err := binary.Read(pf, binary.BigEndian, sums); err != nil {
+			fatalf("Failed to read %s. Error: %v\n", fname+".parity", err)
+		}
+
+		d := parityDamage{group: g}
+		for j := 0; j < present; j++ {
+			if crc32.ChecksumIEEE(data[j]) != sums[j] {
+				d.data = append(d.data, j)
+			}
+		}
+		if len(d.data) == 0 {
+			continue
+		}
+
+		for i := range parity {
+			if _, err := io.ReadFull(pf, parity[i]); err != nil || crc32.ChecksumIEEE(parity[i]) != sums[k+i] {
+				d.parity = append(d.parity, i)
+			}
+		}
+
+		// The good data blocks, with parity blocks in place of the damaged ones
+		bad := make(map[int]bool)
+		for _, j := range d.data {
+			bad[j] = true
+		}
+		badParity := make(map[int]bool)
+		for _, i := range d.parity {
+			badParity[i] = true
+		}
+		rows := make([][]byte, 0, k)
+		blocks := make([][]byte, 0, k)
+		for j := 0; j < k; j++ {
+			if !bad[j] {
+				row := make([]byte, k)
+				row[j] = 1
+				rows = append(rows, row)
+				blocks = append(blocks, data[j])
+			}
+		}
+		for i := 0; i < m && len(rows) < k; i++ {
+			if !badParity[i] {
+				rows = append(rows, c[i])
+				blocks = append(blocks, parity[i])
+			}
+		}
+
+		if len(rows) == k {
+			inv, err := gfInvert(rows)
+			if err != nil {
+				fatalf("Failed to repair %s. Error: %v\n", fname, err)
+			}
+			d.fixable = true
+			for _, j := range d.data {
+				b := make([]byte, h.BlockSize)
+				for t := range blocks {
+					mulAdd(b, blocks[t], inv[j][t])
+				}
+				if crc32.ChecksumIEEE(b) != sums[j] {
+					d.fixable = false
+					break
+				}
+				d.repaired = append(d.repaired, b)
+			}
+		}
+		damage = append(damage, d)
+	}
+	return damage, &h
+}
+
+// repairMain checks archives against their parity and repairs what can be
+// repaired.
+func repairMain(args []string) {
+
+	var backupTarget string
+
+	fs := flag.NewFlagSet("repair", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	confirmOpts := addConfirmFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory, to check every archive with parity in it.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s repair [options] -b dir\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s repair [options] archive...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+
+	archives := fs.Args()
+	if len(backupTarget) > 0 {
+		files := globBackups(backupTarget, "lxd-backup-*.parity")
+		for _, f := range files {
+			archives = append(archives, f[:len(f)-len(".parity")])
+		}
+	}
+	if len(archives) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	sort.Strings(archives)
+
+	type found struct {
+		fname  string
+		h      *parityHeader
+		damage []parityDamage
+	}
+	var todo []found
+	var affected []string
+	lost := false
+
+	for _, a := range archives {
+		damage, h := checkParity(a)
+		if len(damage) == 0 {
+			slog.Info("No damage", "file", a)
+			continue
+		}
+		var blocks, unfixable int
+		for _, d := range damage {
+			blocks += len(d.data)
+			if !d.fixable {
+				unfixable += len(d.data)
+			}
+		}
+		if unfixable > 0 {
+			lost = true
+			affected = append(affected, fmt.Sprintf("%s: %d damaged blocks, %d beyond repair", filepath.Base(a), blocks, unfixable))
+		} else {
+			affected = append(affected, fmt.Sprintf("%s: repair %d damaged blocks", filepath.Base(a), blocks))
+		}
+		todo = append(todo, found{a, h, damage})
+	}
+
+	if len(todo) == 0 {
+		fmt.Println("No damage found.")
+		return
+	}
+	if confirmOpts.confirm("Repairing", affected) {
+		for _, t := range todo {
+			for _, d := range t.damage {
+				if !d.fixable {
+					continue
+				}
+				for n, j := range d.data {
+					off := (d.group*int64(t.h.K) + int64(j)) * int64(t.h.BlockSize)
+					b := d.repaired[n][:min(int64(t.h.BlockSize), int64(t.h.Size)-off)]
+					if err := writeArchiveAt(t.fname, b, off); err != nil {
+						fatalf("Failed to repair %s. Error: %v\n", t.fname, err)
+					}
+				}
+			}
+			fmt.Printf("Repaired %s.\n", filepath.Base(t.fname))
+		}
+	}
+	if lost {
+		fatal("Some archives have more damage than their parity can repair.")
+	}
+}
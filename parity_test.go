@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParityRepair(t *testing.T) {
+
+	defer func(p int) { parityPercent = p }(parityPercent)
+	parityPercent = 5 // 4 parity blocks per group of 64
+
+	data := make([]byte, 70*parityBlock+123) // Two groups, the second short
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, c := range []struct {
+		name    string
+		damage  []int64 // Blocks overwritten
+		fixable bool
+	}{
+		{"one block", []int64{3}, true},
+		{"as many as parity", []int64{0, 10, 20, 63}, true},
+		{"last short block", []int64{70}, true},
+		{"both groups", []int64{1, 65}, true},
+		{"too many", []int64{0, 1, 2, 3, 4}, false},
+	} {
+		fname := filepath.Join(t.TempDir(), "lxd-backup-web-Q20264.tar.zst")
+		if err := os.WriteFile(fname, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		writeParity(fname)
+
+		if damage, _ := checkParity(fname); len(damage) > 0 {
+			t.Fatalf("%s: damage before it was damaged: %+v", c.name, damage)
+		}
+		for _, b := range c.damage {
+			if err := writeArchiveAt(fname, []byte("rot"), b*parityBlock); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		damage, h := checkParity(fname)
+		bad := 0
+		for _, d := range damage {
+			bad += len(d.data)
+			if d.fixable != c.fixable {
+				t.Errorf("%s: group %d fixable %v, want %v", c.name, d.group, d.fixable, c.fixable)
+			}
+			if !d.fixable {
+				continue
+			}
+			for i, j := range d.data {
+				off := (d.group*int64(h.K) + int64(j)) * int64(h.BlockSize)
+				b := d.repaired[i][:min(int64(h.BlockSize), int64(h.Size)-off)]
+				if err := writeArchiveAt(fname, b, off); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if bad != len(c.damage) {
+			t.Errorf("%s: found %d damaged blocks, want %d", c.name, bad, len(c.damage))
+		}
+		if !c.fixable {
+			continue
+		}
+		if got, _ := os.ReadFile(fname); !bytes.Equal(got, data) {
+			t.Errorf("%s: not repaired", c.name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// overlayPartial restores the partial backup archive by unpacking its paths
+// in the instance target, which is launched from o.baseImage if it doesn't
+// exist. Files are overwritten, but nothing is removed, not even what was
+// removed in the delta. Returns the name it can be found by with lxc.
+func overlayPartial(o *restoreOptions, archive, target string, m *manifest) string {
+
+	ref := remoteName(o.remote, target)
+	if err := lxcRun(projectArgs(o.project, "info", ref)...); err != nil {
+		if len(o.baseImage) == 0 {
+			fatalf("The backup of %s is partial, only %s, and %s doesn't exist. Give -base-image to launch it from, or restore onto an existing instance.\n",
+				m.Container, strings.Join(m.Included, ","), target)
+		}
+		slog.Info("Launching instance for partial backup", "container", target, "image", o.baseImage)
+		args := projectArgs(o.project, "launch", o.baseImage, ref)
+		cmd, cancel := lxcCommand(args...)
+		defer cancel()
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+		}
+	} else {
+		// Fails when it is running already
+		lxcRun(projectArgs(o.project, "start", ref)...)
+	}
+
+	slog.Info("Unpacking partial backup", "container", target, "paths", strings.Join(m.Included, ","))
+
+	args := []string{"exec", ref}
+	args = projectArgs(o.project, args...)
+	args = append(args, "--", "tar", "-xpf", "-", "-C", "/")
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	pr, pw := io.Pipe()
+	cmd.Stdin = pr
+	go func() {
+		pw.CloseWithError(writeRootfs(archive, pw))
+	}()
+	err := cmd.Run()
+	pr.Close()
+	if err != nil {
+		fatalf("Failed to unpack partial backup in %s. Error: %v\n", target, err)
+	}
+	return ref
+}
+
+// writeRootfs writes the rootfs of the archive to w, as a tar relative to
+// the root of the container.
+func writeRootfs(archive string, w io.Writer) error {
+
+	in := openArchive(archive)
+	defer in.Close()
+	tr := tar.NewReader(in)
+	tw := tar.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		p, ok := rootfsPath(hdr.Name)
+		if !ok || p == "/" {
+			continue
+		}
+		hdr.Name = "." + p
+		if hdr.Typeflag == tar.TypeLink {
+			if l, ok := rootfsPath(hdr.Linkname); ok {
+				hdr.Linkname = "." + l
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
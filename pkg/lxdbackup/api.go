@@ -0,0 +1,308 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API is LXD through its REST API on the unix socket, or over HTTPS, for
+// what lxc does no better: backups made by LXD, and their progress.
+type API struct {
+	// Socket is the unix socket of LXD, IE /var/snap/lxd/common/lxd/unix.socket.
+	Socket string
+	// URL is LXD over HTTPS instead, IE https://lxd.example.com:8443, with
+	// the client certificate of TLS.
+	URL string
+	TLS *tls.Config
+	// Project is the project of the instances, the default one when empty.
+	Project string
+
+	client *http.Client
+}
+
+// BackupOptions are what a backup made by LXD is made with.
+type BackupOptions struct {
+	// Compression is the compression_algorithm, IE zstd or none.
+	Compression string
+	// OptimizedStorage makes the backup in the format of the storage
+	// driver, IE a zfs send stream, which only imports onto that driver.
+	OptimizedStorage bool
+	// Snapshots includes the snapshots of the instance in the backup.
+	Snapshots bool
+	// Expires is when LXD removes the backup by itself, should it not be
+	// deleted.
+	Expires time.Time
+}
+
+func (a *API) httpClient() *http.Client {
+	if a.client == nil && len(a.URL) > 0 {
+		a.client = &http.Client{Transport: &http.Transport{TLSClientConfig: a.TLS}}
+	} else if a.client == nil {
+		a.client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", a.Socket)
+			},
+		}}
+	}
+	return a.client
+}
+
+func (a *API) url(path string, query url.Values) string {
+	if len(a.Project) > 0 {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("project", a.Project)
+	}
+	u := "http://lxd" + path
+	if len(a.URL) > 0 {
+		u = strings.TrimSuffix(a.URL, "/") + path
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// apiResponse is the envelope LXD answers in.
+type apiResponse struct {
+	Type      string          `json:"type"`
+	Error     string          `json:"error"`
+	Operation string          `json:"operation"`
+	Metadata  json.RawMessage `json:"metadata"`
+}
+
+// operation is a background operation of LXD.
+type operation struct {
+	ID         string                 `json:"id"`
+	Status     string                 `json:"status"`
+	StatusCode int                    `json:"status_code"`
+	Err        string                 `json:"err"`
+	Metadata   map[string]interface{} `json:"metadata"`
+}
+
+// ErrChanged is the error of an update of what changed since it was read.
+var ErrChanged = errors.New("changed since it was read")
+
+func (a *API) do(method, path string, query url.Values, body interface{}) (*apiResponse, error) {
+	r, _, err := a.doETag(method, path, query, body, "")
+	return r, err
+}
+
+// doETag is do with the If-Match header etag, when not empty, and returns
+// the ETag of the response.
+func (a *API) doETag(method, path string, query url.Values, body interface{}, etag string) (*apiResponse, string, error) {
+
+	var in io.Reader
+	if body != nil {
+		d, err := json.Marshal(body)
+		if err != nil {
+			return nil, "", err
+		}
+		in = bytes.NewReader(d)
+	}
+	req, err := http.NewRequest(method, a.url(path, query), in)
+	if err != nil {
+		return nil, "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	var r apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, "", fmt.Errorf("%s %s: bad response: %w", method, path, err)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, "", fmt.Errorf("%s %s: %w", method, path, ErrChanged)
+	}
+	if r.Type == "error" || resp.StatusCode >= 400 {
+		return nil, "", fmt.Errorf("%s %s: %s", method, path, r.Error)
+	}
+	return &r, resp.Header.Get("ETag"), nil
+}
+
+// Extensions returns the API extensions of the server.
+func (a *API) Extensions() ([]string, error) {
+	r, err := a.do("GET", "/1.0", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var server struct {
+		Extensions []string `json:"api_extensions"`
+	}
+	if err := json.Unmarshal(r.Metadata, &server); err != nil {
+		return nil, fmt.Errorf("bad server info: %w", err)
+	}
+	return server.Extensions, nil
+}
+
+// AddCertificate has LXD trust the client certificate of the connection as
+// name, with a trust token made by lxc config trust add, or with the trust
+// password of older servers when token is empty.
+func (a *API) AddCertificate(name, token, password string) error {
+
+	body := map[string]interface{}{"type": "client", "name": name}
+	if len(token) > 0 {
+		body["trust_token"] = token
+	} else {
+		body["password"] = password
+	}
+	_, err := a.do("POST", "/1.0/certificates", nil, body)
+	return err
+}
+
+// Supports tells whether the server has the API extension ext.
+func (a *API) Supports(ext string) (bool, error) {
+	exts, err := a.Extensions()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(exts, ext), nil
+}
+
+// wait waits for the operation of r to finish, calling progress with its
+// metadata every time it changes, and returns an error if it failed.
+func (a *API) wait(r *apiResponse, progress func(map[string]interface{})) error {
+
+	if len(r.Operation) == 0 {
+		return nil
+	}
+	path := r.Operation
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	var last string
+	for {
+		resp, err := a.do("GET", path+"/wait", url.Values{"timeout": {"2"}}, nil)
+		if err != nil {
+			return err
+		}
+		var op operation
+		if err := json.Unmarshal(resp.Metadata, &op); err != nil {
+			return fmt.Errorf("bad operation: %w", err)
+		}
+		if progress != nil && len(op.Metadata) > 0 {
+			if d, _ := json.Marshal(op.Metadata); string(d) != last {
+				last = string(d)
+				progress(op.Metadata)
+			}
+		}
+		switch op.Status {
+		case "Success":
+			return nil
+		case "Failure", "Cancelled":
+			return fmt.Errorf("operation %s: %s", op.ID, op.Err)
+		}
+	}
+}
+
+// CreateBackup makes the backup backup of the instance name, without its
+// snapshots, and waits for it. progress, if not nil, gets the progress LXD
+// reports, IE "Exporting: 45%".
+func (a *API) CreateBackup(name, backup string, o BackupOptions, progress func(string)) error {
+
+	body := map[string]interface{}{
+		"name":              backup,
+		"instance_only":     !o.Snapshots,
+		"optimized_storage": o.OptimizedStorage,
+	}
+	if len(o.Compression) > 0 {
+		body["compression_algorithm"] = o.Compression
+	}
+	if !o.Expires.IsZero() {
+		body["expires_at"] = o.Expires.UTC().Format(time.RFC3339)
+	}
+	r, err := a.do("POST", "/1.0/instances/"+url.PathEscape(name)+"/backups", nil, body)
+	if err != nil {
+		return err
+	}
+	return a.wait(r, func(md map[string]interface{}) {
+		if progress == nil {
+			return
+		}
+		for k, v := range md {
+			if strings.HasSuffix(k, "_progress") {
+				progress(fmt.Sprint(v))
+			}
+		}
+	})
+}
+
+// ExportBackup writes the tarball of the backup backup of name to w.
+func (a *API) ExportBackup(name, backup string, w io.Writer) error {
+
+	path := "/1.0/instances/" + url.PathEscape(name) + "/backups/" + url.PathEscape(backup) + "/export"
+	resp, err := a.httpClient().Get(a.url(path, nil))
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var r apiResponse
+		json.NewDecoder(resp.Body).Decode(&r)
+		return fmt.Errorf("GET %s: %s %s", path, resp.Status, r.Error)
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("GET %s: %w", path, err)
+	}
+	return nil
+}
+
+// DeleteBackup removes the backup backup of name from the server.
+func (a *API) DeleteBackup(name, backup string) error {
+	r, err := a.do("DELETE", "/1.0/instances/"+url.PathEscape(name)+"/backups/"+url.PathEscape(backup), nil, nil)
+	if err != nil {
+		return err
+	}
+	return a.wait(r, nil)
+}
+
+// Project is the part of a project that can be changed.
+type Project struct {
+	Description string            `json:"description"`
+	Config      map[string]string `json:"config"`
+}
+
+// GetProject returns the project name, and its ETag for UpdateProject.
+func (a *API) GetProject(name string) (*Project, string, error) {
+	r, etag, err := a.doETag("GET", "/1.0/projects/"+url.PathEscape(name), nil, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	var p Project
+	if err := json.Unmarshal(r.Metadata, &p); err != nil {
+		return nil, "", fmt.Errorf("bad project %s: %w", name, err)
+	}
+	if p.Config == nil {
+		p.Config = make(map[string]string)
+	}
+	return &p, etag, nil
+}
+
+// UpdateProject replaces the project name with p, unless it changed since
+// it was read with the ETag etag, which gives an ErrChanged.
+func (a *API) UpdateProject(name string, p *Project, etag string) error {
+	_, _, err := a.doETag("PUT", "/1.0/projects/"+url.PathEscape(name), nil, p, etag)
+	return err
+}
@@ -0,0 +1,59 @@
+package lxdbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpdateProject(t *testing.T) {
+
+	project := Project{Config: map[string]string{}}
+	version := 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%d"`, version)
+		if r.URL.Path != "/1.0/projects/default" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(apiResponse{Type: "error", Error: "not found"})
+			return
+		}
+		switch r.Method {
+		case "GET":
+			d, _ := json.Marshal(project)
+			w.Header().Set("ETag", etag)
+			json.NewEncoder(w).Encode(apiResponse{Type: "sync", Metadata: d})
+		case "PUT":
+			if m := r.Header.Get("If-Match"); m != "" && m != etag {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				json.NewEncoder(w).Encode(apiResponse{Type: "error", Error: "ETag doesn't match"})
+				return
+			}
+			json.NewDecoder(r.Body).Decode(&project)
+			version++
+			json.NewEncoder(w).Encode(apiResponse{Type: "sync"})
+		}
+	}))
+	defer srv.Close()
+
+	a := &API{URL: srv.URL}
+	p1, etag1, err := a.GetProject("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p2, etag2, _ := a.GetProject("default")
+
+	p1.Config["user.lock"] = "one"
+	if err := a.UpdateProject("default", p1, etag1); err != nil {
+		t.Fatalf("first: %v", err)
+	}
+	p2.Config["user.lock"] = "two"
+	if err := a.UpdateProject("default", p2, etag2); !errors.Is(err, ErrChanged) {
+		t.Errorf("second: got %v, want ErrChanged", err)
+	}
+	if project.Config["user.lock"] != "one" {
+		t.Errorf("lock is %s", project.Config["user.lock"])
+	}
+}
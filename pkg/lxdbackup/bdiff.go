@@ -0,0 +1,307 @@
+package lxdbackup
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Binary diffs of large changed files, rsync style: the quarter version is
+// cut into blocks, and the new version is scanned with a rolling checksum for
+// blocks it still has. The patch is a list of copies from the quarter version
+// and literal data.
+const (
+	bdiffBlock  = 16 << 10
+	bdiffMagic  = "LXDBDIF1"
+	PAXPatch    = "LXDBACKUP.patch"        // Size of the patched file
+	PAXPatchSum = "LXDBACKUP.patch.sha256" // Checksum of the patched file
+)
+
+// BlockSig is the signature of the quarter version of a file.
+type BlockSig struct {
+	weak   map[uint32][]int64
+	strong map[int64][32]byte
+}
+
+func weakSum(b []byte) (uint32, uint32) {
+	var a, s uint32
+	n := uint32(len(b))
+	for i, c := range b {
+		a += uint32(c)
+		s += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, s & 0xffff
+}
+
+// MakeSignature reads the quarter version of a file for WriteDiff.
+func MakeSignature(r io.Reader) (*BlockSig, error) {
+	sig := &BlockSig{weak: make(map[uint32][]int64), strong: make(map[int64][32]byte)}
+	buf := make([]byte, bdiffBlock)
+	for off := int64(0); ; off += bdiffBlock {
+		if _, err := io.ReadFull(r, buf); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return sig, nil
+		} else if err != nil {
+			return nil, err
+		}
+		a, s := weakSum(buf)
+		sig.weak[a|s<<16] = append(sig.weak[a|s<<16], off)
+		sig.strong[off] = sha256.Sum256(buf)
+	}
+}
+
+type patchWriter struct {
+	w       *bufio.Writer
+	lit     []byte
+	copyOff int64
+	copyLen int64
+}
+
+func (p *patchWriter) flushCopy() {
+	if p.copyLen > 0 {
+		p.w.WriteByte('C')
+		binary.Write(p.w, binary.BigEndian, uint64(p.copyOff))
+		binary.Write(p.w, binary.BigEndian, uint64(p.copyLen))
+		p.copyLen = 0
+	}
+}
+
+func (p *patchWriter) flushLiteral() {
+	if len(p.lit) > 0 {
+		p.w.WriteByte('L')
+		binary.Write(p.w, binary.BigEndian, uint32(len(p.lit)))
+		p.w.Write(p.lit)
+		p.lit = p.lit[:0]
+	}
+}
+
+func (p *patchWriter) literal(b ...byte) {
+	p.flushCopy()
+	p.lit = append(p.lit, b...)
+	if len(p.lit) >= 1<<20 {
+		p.flushLiteral()
+	}
+}
+
+func (p *patchWriter) copy(off int64) {
+	p.flushLiteral()
+	if p.copyLen > 0 && p.copyOff+p.copyLen == off {
+		p.copyLen += bdiffBlock
+		return
+	}
+	p.flushCopy()
+	p.copyOff, p.copyLen = off, bdiffBlock
+}
+
+// WriteDiff writes a patch that turns the file sig was made from into what
+// r reads.
+func WriteDiff(sig *BlockSig, r io.Reader, w io.Writer) error {
+
+	br := bufio.NewReaderSize(r, 1<<20)
+	p := &patchWriter{w: bufio.NewWriter(w)}
+	p.w.WriteString(bdiffMagic)
+
+	win := make([]byte, bdiffBlock)
+	cur := make([]byte, bdiffBlock)
+	var pos int
+	var a, s uint32
+
+	fill := func() (bool, error) {
+		n, err := io.ReadFull(br, win)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			p.literal(win[:n]...)
+			return false, nil
+		}
+		pos = 0
+		a, s = weakSum(win)
+		return err == nil, err
+	}
+
+	more, err := fill()
+	for more && err == nil {
+		if offs, ok := sig.weak[a|s<<16]; ok {
+			copy(cur, win[pos:])
+			copy(cur[bdiffBlock-pos:], win[:pos])
+			strong := sha256.Sum256(cur)
+			matched := false
+			for _, off := range offs {
+				if sig.strong[off] == strong {
+					p.copy(off)
+					matched = true
+					break
+				}
+			}
+			if matched {
+				more, err = fill()
+				continue
+			}
+		}
+
+		c, rerr := br.ReadByte()
+		if errors.Is(rerr, io.EOF) {
+			p.literal(win[pos:]...)
+			p.literal(win[:pos]...)
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+		out := win[pos]
+		p.literal(out)
+		win[pos] = c
+		pos = (pos + 1) % bdiffBlock
+		a = (a - uint32(out) + uint32(c)) & 0xffff
+		s = (s - bdiffBlock*uint32(out) + a) & 0xffff
+	}
+	if err != nil {
+		return err
+	}
+
+	p.flushLiteral()
+	p.flushCopy()
+	p.w.WriteByte('E')
+	return p.w.Flush()
+}
+
+// ApplyPatch writes the file a patch describes, from the old version of it.
+func ApplyPatch(old io.ReaderAt, patch io.Reader, out io.Writer) error {
+
+	br := bufio.NewReader(patch)
+	magic := make([]byte, len(bdiffMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != bdiffMagic {
+		return fmt.Errorf("not a binary diff")
+	}
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case 'C':
+			var off, n uint64
+			binary.Read(br, binary.BigEndian, &off)
+			if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, io.NewSectionReader(old, int64(off), int64(n))); err != nil {
+				return err
+			}
+		case 'L':
+			var n uint32
+			if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(out, br, int64(n)); err != nil {
+				return err
+			}
+		case 'E':
+			return nil
+		default:
+			return fmt.Errorf("bad binary diff operation %q", op)
+		}
+	}
+}
+
+// IsPatched tells whether the delta entry hdr is a binary diff.
+func IsPatched(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[PAXPatch]
+	return ok
+}
+
+// WriteDiffEntry adds a changed file to a delta, as a patch against sig if
+// that is clearly smaller than the file. The file and the patch are spooled
+// to dir.
+func WriteDiffEntry(tw TarWriter, hdr *tar.Header, r io.Reader, sig *BlockSig, dir string) error {
+
+	content, err := os.CreateTemp(dir, ".lxd-backup-diff-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(content.Name())
+	defer content.Close()
+	patch, err := os.CreateTemp(dir, ".lxd-backup-patch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(patch.Name())
+	defer patch.Close()
+
+	h := sha256.New()
+	if err := WriteDiff(sig, io.TeeReader(r, io.MultiWriter(content, h)), patch); err != nil {
+		return fmt.Errorf("diff %s: %w", hdr.Name, err)
+	}
+	patchSize, _ := patch.Seek(0, io.SeekCurrent)
+
+	src := content
+	if patchSize < hdr.Size*9/10 {
+		src = patch
+		size := hdr.Size
+		hdr.Size = patchSize
+		hdr.Format = tar.FormatPAX
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[PAXPatch] = strconv.FormatInt(size, 10)
+		hdr.PAXRecords[PAXPatchSum] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// WritePatchedEntry writes the file the binary diff hdr of a delta, read
+// from patch, describes, applied to the file base.
+func WritePatchedEntry(tw TarWriter, hdr *tar.Header, patch io.Reader, base string) error {
+
+	size, err := strconv.ParseInt(hdr.PAXRecords[PAXPatch], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad binary diff of %s: %w", hdr.Name, err)
+	}
+	want := hdr.PAXRecords[PAXPatchSum]
+
+	h := *hdr
+	h.PAXRecords = make(map[string]string, len(hdr.PAXRecords))
+	for k, v := range hdr.PAXRecords {
+		if k != PAXPatch && k != PAXPatchSum {
+			h.PAXRecords[k] = v
+		}
+	}
+	h.Size = size
+	if err := tw.WriteHeader(&h); err != nil {
+		return err
+	}
+
+	// The tar writer refuses more than size bytes, and too few is caught by the checksum
+	return PatchEntry(hdr.Name, want, patch, base, tw)
+}
+
+// PatchEntry applies the binary diff of name to base, and writes the result
+// to w. want is its checksum.
+func PatchEntry(name, want string, patch io.Reader, base string, w io.Writer) error {
+
+	old, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	h := sha256.New()
+	if err := ApplyPatch(old, patch, io.MultiWriter(w, h)); err != nil {
+		return fmt.Errorf("apply binary diff of %s: %w", name, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != want {
+		return fmt.Errorf("binary diff of %s doesn't apply to the quarter backup", name)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestBinaryDiff(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	old := random(10 * bdiffBlock)
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	for name, c := range map[string]struct {
+		cur      []byte
+		maxPatch int // Patch size at most, 0 for any
+	}{
+		"same":     {cur: old, maxPatch: 100},
+		"appended": {cur: cat(old, []byte("more")), maxPatch: 100},
+		"inserted": {cur: cat(old[:3*bdiffBlock+7], []byte("in the middle"), old[3*bdiffBlock+7:]), maxPatch: 2*bdiffBlock + 100},
+		"cut":      {cur: old[:5*bdiffBlock+10], maxPatch: bdiffBlock + 100},
+		"empty":    {cur: nil},
+		"new":      {cur: random(3*bdiffBlock + 5)},
+		"short":    {cur: []byte("short")},
+	} {
+		sig, err := MakeSignature(bytes.NewReader(old))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var patch, out bytes.Buffer
+		if err := WriteDiff(sig, bytes.NewReader(c.cur), &patch); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if c.maxPatch > 0 && patch.Len() > c.maxPatch {
+			t.Errorf("%s: patch of %d bytes, want at most %d", name, patch.Len(), c.maxPatch)
+		}
+		if err := ApplyPatch(bytes.NewReader(old), &patch, &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), c.cur) {
+			t.Errorf("%s: patched file differs", name)
+		}
+	}
+
+	if err := ApplyPatch(bytes.NewReader(old), bytes.NewReader([]byte("LXDBDIF1X")), &bytes.Buffer{}); err == nil {
+		t.Error("no error for a bad operation")
+	}
+	if err := ApplyPatch(bytes.NewReader(old), bytes.NewReader([]byte("garbage")), &bytes.Buffer{}); err == nil {
+		t.Error("no error for what is not a binary diff")
+	}
+}
@@ -0,0 +1,141 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// borgTimeFormat is the time in the archive names, name-20221014T021337Z.
+const borgTimeFormat = "20060102T150405Z"
+
+// Borg is a SnapshotStore in a borg repository, through the borg command.
+// Each snapshot is an archive named after the name and when it was made.
+// The passphrase is taken from the environment, BORG_PASSCOMMAND and so
+// on, as borg itself does.
+type Borg struct {
+	// Repository is the repository as borg takes it, IE /srv/borg or
+	// ssh://backup@host/./borg.
+	Repository string
+	// Command makes the borg command for args. exec.Command("borg",
+	// args...) when nil.
+	Command func(args ...string) *exec.Cmd
+}
+
+func (b *Borg) command(args ...string) *exec.Cmd {
+	if b.Command != nil {
+		return b.Command(args...)
+	}
+	return exec.Command("borg", args...)
+}
+
+func (b *Borg) output(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := b.command(args...)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+		return nil, fmt.Errorf("borg %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exit.Stderr)))
+	} else if err != nil {
+		return nil, fmt.Errorf("borg %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (b *Borg) Store(name string, r io.Reader) (string, error) {
+	id := name + "-" + time.Now().UTC().Format(borgTimeFormat)
+	_, err := b.output(r, "create", "--stdin-name", name+".tar", b.Repository+"::"+id, "-")
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Snapshots tells the archives of name from those of other names by the
+// time after the name, so web-db-... are not taken for archives of web.
+func (b *Borg) Snapshots(name string) ([]Snapshot, error) {
+
+	out, err := b.output(nil, "list", "--json", b.Repository)
+	if err != nil {
+		return nil, err
+	}
+	var listed struct {
+		Archives []struct {
+			Name string `json:"name"`
+		} `json:"archives"`
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("borg list gave bad JSON: %w", err)
+	}
+
+	var snaps []Snapshot
+	for _, a := range listed.Archives {
+		ts, ok := strings.CutPrefix(a.Name, name+"-")
+		if !ok {
+			continue
+		}
+		if t, err := time.Parse(borgTimeFormat, ts); err == nil {
+			snaps = append(snaps, Snapshot{ID: a.Name, Time: t})
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+func (b *Borg) Fetch(name, id string, w io.Writer) error {
+
+	if id == "latest" {
+		snaps, err := b.Snapshots(name)
+		if err != nil {
+			return err
+		}
+		if len(snaps) == 0 {
+			return fmt.Errorf("no archive of %s in %s", name, b.Repository)
+		}
+		id = snaps[len(snaps)-1].ID
+	}
+
+	args := []string{"extract", "--stdout", b.Repository + "::" + id, name + ".tar"}
+	cmd := b.command(args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("borg %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("borg %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func (b *Borg) Forget(name string, keep int) error {
+	snaps, err := b.Snapshots(name)
+	if err != nil || len(snaps) <= keep {
+		return err
+	}
+	ids := make([]string, 0, len(snaps)-keep)
+	for _, s := range snaps[:len(snaps)-keep] {
+		ids = append(ids, s.ID)
+	}
+	return b.Delete(name, ids...)
+}
+
+// Delete removes the archives ids, and compacts the repository to free the
+// space they took.
+func (b *Borg) Delete(name string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := b.output(nil, append([]string{"delete", b.Repository}, ids...)...); err != nil {
+		return err
+	}
+	_, err := b.output(nil, "compact", b.Repository)
+	return err
+}
@@ -0,0 +1,59 @@
+package lxdbackup
+
+import (
+	"sort"
+	"strings"
+)
+
+// Changes compares the checksums of an export, sums, with those of the
+// full backup, full: changed has the files that are new or whose checksum
+// differs, and the hard links to them, removed those gone, sorted.
+func Changes(full, sums map[string]string) (changed map[string]bool, removed []string) {
+
+	changed = make(map[string]bool)
+	for fname, old := range full {
+		if cur, present := sums[fname]; !present {
+			removed = append(removed, fname)
+		} else if cur != old {
+			changed[fname] = true
+		}
+	}
+	for fname := range sums {
+		if _, present := full[fname]; !present {
+			changed[fname] = true
+		}
+	}
+	sort.Strings(removed)
+
+	// The link in the full backup would point to the old content otherwise
+	for fname, sum := range sums {
+		if target, ok := strings.CutPrefix(sum, "link:"); ok && changed[target] {
+			changed[fname] = true
+		}
+	}
+	return changed, removed
+}
+
+// MetaOnly returns the files of stats not in changed, with the same
+// content, but chmod, chown or touch since the full backup with fullStats.
+func MetaOnly(fullStats, stats map[string]FileStat, changed map[string]bool) map[string]bool {
+	meta := make(map[string]bool)
+	for fname, st := range stats {
+		if old, ok := fullStats[fname]; ok && !changed[fname] && MetaChanged(old, st) {
+			meta[fname] = true
+		}
+	}
+	return meta
+}
+
+// ChangedBytes returns how many bytes the files of changed are, and all
+// files of stats, to tell a delta that is nearly a full backup.
+func ChangedBytes(stats map[string]FileStat, changed map[string]bool) (changedBytes, totalBytes int64) {
+	for fname, st := range stats {
+		totalBytes += st.Size
+		if changed[fname] {
+			changedBytes += st.Size
+		}
+	}
+	return changedBytes, totalBytes
+}
@@ -0,0 +1,69 @@
+package lxdbackup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+
+	full := map[string]string{
+		"same":    "1",
+		"changed": "2",
+		"gone":    "3",
+		"link":    "link:changed",
+		"link2":   "link:same",
+		"dir/":    "dir:755:0:0",
+	}
+	sums := map[string]string{
+		"same":    "1",
+		"changed": "22",
+		"new":     "4",
+		"link":    "link:changed",
+		"link2":   "link:same",
+		"dir/":    "dir:700:0:0",
+	}
+	changed, removed := Changes(full, sums)
+	if want := map[string]bool{"changed": true, "new": true, "link": true, "dir/": true}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed: got %v, want %v", changed, want)
+	}
+	if want := []string{"gone"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed: got %v, want %v", removed, want)
+	}
+
+	if changed, removed := Changes(full, full); len(changed) > 0 || len(removed) > 0 {
+		t.Errorf("no changes: got %v and %v", changed, removed)
+	}
+}
+
+func TestMetaOnly(t *testing.T) {
+
+	fullStats := map[string]FileStat{
+		"touched": {Size: 1, MTime: 1, Meta: true},
+		"chmod":   {Size: 1, MTime: 1, Mode: 0644, Meta: true},
+		"old":     {Size: 1, MTime: 1},             // Of an older version, no mode and owner
+		"changed": {Size: 1, MTime: 1, Meta: true}, // Content changed too
+		"same":    {Size: 1, MTime: 1, Mode: 0644, Meta: true},
+	}
+	stats := map[string]FileStat{
+		"touched": {Size: 1, MTime: 2, Meta: true},
+		"chmod":   {Size: 1, MTime: 1, Mode: 0600, Meta: true},
+		"old":     {Size: 1, MTime: 1, Mode: 0600, UID: 1, Meta: true},
+		"changed": {Size: 2, MTime: 2, Meta: true},
+		"same":    {Size: 1, MTime: 1, Mode: 0644, Meta: true},
+		"new":     {Size: 1, MTime: 1, Meta: true},
+	}
+	got := MetaOnly(fullStats, stats, map[string]bool{"changed": true, "new": true})
+	if want := map[string]bool{"touched": true, "chmod": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestChangedBytes(t *testing.T) {
+
+	stats := map[string]FileStat{"a": {Size: 10}, "b": {Size: 30}, "c": {Size: 60}}
+	changed, total := ChangedBytes(stats, map[string]bool{"b": true, "gone": true})
+	if changed != 30 || total != 100 {
+		t.Errorf("got %d of %d, want 30 of 100", changed, total)
+	}
+}
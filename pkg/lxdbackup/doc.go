@@ -0,0 +1,12 @@
+// Package lxdbackup is the part of lxd-backup that other Go programs can
+// use, and that can be tested without LXD: the archive formats, the
+// checksum algorithms, a client for LXD and the storage backends the
+// backups go to, each behind an interface. On top of those, the checksums
+// of an export, what changed since the full backup, the deltas written of
+// it with their binary diffs, merging them with the full backup again, and
+// which files the retention tiers keep. Unlike the lxd-backup command, which gives up with
+// a message on the first failure, everything here returns errors.
+//
+// The lxd-backup command is moved over to it piece by piece. What is here
+// is what the command already uses.
+package lxdbackup
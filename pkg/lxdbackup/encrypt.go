@@ -0,0 +1,325 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// KeyObject is the name of the repository key of an Encrypted backend,
+// wrapped for its recipients, IE with age. It is not listed.
+const KeyObject = "lxd-backup-key.age"
+
+// KeyIDObject is the name of the KeyID of the repository key of an
+// Encrypted backend, to tell a key that doesn't belong to it without
+// unwrapping KeyObject. It is not listed either.
+const KeyIDObject = "lxd-backup-key.id"
+
+// KeyID identifies the repository key key, without giving anything of it
+// away: it is an HMAC of a fixed string.
+func KeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("lxd-backup repository key id"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Files of an Encrypted backend are the magic, a random salt the file key
+// is derived from with the repository key, and then chunks of
+// encryptChunk bytes, each sealed with AES-256-GCM. The nonce is the
+// number of the chunk and whether it is the last, so chunks can't be
+// reordered, dropped or cut off unnoticed.
+const (
+	encryptMagic = "LXDBENC1"
+	encryptSalt  = 16
+	encryptChunk = 64 << 10
+)
+
+// EncryptedSize is the size of a file of size bytes once encrypted.
+func EncryptedSize(size int64) int64 {
+	chunks := max((size+encryptChunk-1)/encryptChunk, 1)
+	return int64(len(encryptMagic)+encryptSalt) + size + chunks*16
+}
+
+// DecryptedSize is EncryptedSize the other way round, -1 if size can't be
+// of an encrypted file.
+func DecryptedSize(size int64) int64 {
+	size -= int64(len(encryptMagic) + encryptSalt)
+	chunks := max((size+encryptChunk+16-1)/(encryptChunk+16), 1)
+	if size < chunks*16 {
+		return -1
+	}
+	return size - chunks*16
+}
+
+func fileCipher(key, salt []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("repository key must be 32 bytes")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(n uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt writes what r gives to w, encrypted with the repository key.
+func Encrypt(w io.Writer, r io.Reader, key []byte) error {
+
+	salt := make([]byte, encryptSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := fileCipher(key, salt)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append([]byte(encryptMagic), salt...)); err != nil {
+		return err
+	}
+
+	// One chunk ahead, the last one is sealed as such
+	buf := make([]byte, encryptChunk)
+	next := make([]byte, encryptChunk)
+	n, err := io.ReadFull(r, buf)
+	for i := uint64(0); ; i++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		var m int
+		var nerr error
+		if err == nil {
+			m, nerr = io.ReadFull(r, next)
+		}
+		last := err != nil || m == 0
+		if _, werr := w.Write(aead.Seal(nil, chunkNonce(i, last), buf[:n], nil)); werr != nil {
+			return werr
+		}
+		if last {
+			if nerr != nil && nerr != io.EOF {
+				return nerr
+			}
+			return nil
+		}
+		buf, next = next, buf
+		n, err = m, nerr
+	}
+}
+
+// decrypter reads an encrypted file.
+type decrypter struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	n     uint64
+	plain []byte
+	chunk []byte
+	done  bool
+}
+
+// Decrypt reads what Encrypt wrote to r with the repository key.
+func Decrypt(r io.Reader, key []byte) (io.Reader, error) {
+
+	head := make([]byte, len(encryptMagic)+encryptSalt)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if !bytes.HasPrefix(head, []byte(encryptMagic)) {
+		return nil, errors.New("not encrypted by lxd-backup")
+	}
+	aead, err := fileCipher(key, head[len(encryptMagic):])
+	if err != nil {
+		return nil, err
+	}
+	// One byte more, to tell the last chunk
+	return &decrypter{r: r, aead: aead, chunk: make([]byte, encryptChunk+16+1)}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		// The byte read ahead of the chunk before starts this one
+		start := 0
+		if d.n > 0 {
+			start = 1
+		}
+		n, err := io.ReadFull(d.r, d.chunk[start:])
+		n += start
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+		last := n <= encryptChunk+16
+		sealed := d.chunk[:min(n, encryptChunk+16)]
+		plain, oerr := d.aead.Open(nil, chunkNonce(d.n, last), sealed, nil)
+		if oerr != nil {
+			return 0, fmt.Errorf("chunk %d is damaged, cut off or not of this key", d.n)
+		}
+		d.plain = plain
+		d.done = last
+		if !last {
+			d.chunk[0] = d.chunk[encryptChunk+16]
+		}
+		d.n++
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// Encrypted is a Backend that encrypts the files it puts to Backend, and
+// decrypts them again when they are read, with a repository key. Sizes are
+// those of the files decrypted.
+type Encrypted struct {
+	Backend
+	Key []byte
+
+	mu sync.Mutex
+	// What was put, for Checksum: md5 there, and md5 here
+	put map[string][2]string
+}
+
+// encrypting puts r encrypted with put, and returns the md5s of what was
+// put and of r.
+func (e *Encrypted) encrypting(r io.Reader, put func(io.Reader) error) ([2]string, error) {
+	plain, sealed := md5.New(), md5.New()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Encrypt(pw, io.TeeReader(r, plain), e.Key))
+	}()
+	err := put(io.TeeReader(pr, sealed))
+	// Lets Encrypt go if put gave up half way
+	pr.Close()
+	return [2]string{hex.EncodeToString(sealed.Sum(nil)), hex.EncodeToString(plain.Sum(nil))}, err
+}
+
+func (e *Encrypted) remember(name string, sums [2]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.put == nil {
+		e.put = make(map[string][2]string)
+	}
+	e.put[name] = sums
+}
+
+func (e *Encrypted) Put(name string, r io.Reader) error {
+	sums, err := e.encrypting(r, func(er io.Reader) error { return e.Backend.Put(name, er) })
+	if err != nil {
+		return err
+	}
+	e.remember(name, sums)
+	return nil
+}
+
+// PutLocked is Put, locked if Backend is an ObjectLocker.
+func (e *Encrypted) PutLocked(name string, r io.Reader, until time.Time) error {
+	l, ok := e.Backend.(ObjectLocker)
+	if !ok {
+		return e.Put(name, r)
+	}
+	sums, err := e.encrypting(r, func(er io.Reader) error { return l.PutLocked(name, er, until) })
+	if err != nil {
+		return err
+	}
+	e.remember(name, sums)
+	return nil
+}
+
+// PutMeta is PutLocked with the tags of meta, if Backend is a MetaPutter.
+// What is stored is encrypted, whatever the content type of meta.
+func (e *Encrypted) PutMeta(name string, r io.Reader, meta ObjectMeta, until time.Time) error {
+	p, ok := e.Backend.(MetaPutter)
+	if !ok && until.IsZero() {
+		return e.Put(name, r)
+	} else if !ok {
+		return e.PutLocked(name, r, until)
+	}
+	meta.ContentType = "application/octet-stream"
+	sums, err := e.encrypting(r, func(er io.Reader) error { return p.PutMeta(name, er, meta, until) })
+	if err != nil {
+		return err
+	}
+	e.remember(name, sums)
+	return nil
+}
+
+// encryptedReader closes the file being decrypted.
+type encryptedReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (e *Encrypted) Get(name string) (io.ReadCloser, error) {
+	rc, err := e.Backend.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Decrypt(rc, e.Key)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return &encryptedReader{r, rc}, nil
+}
+
+func (e *Encrypted) Stat(name string) (FileInfo, error) {
+	f, err := e.Backend.Stat(name)
+	if err == nil {
+		f.Size = DecryptedSize(f.Size)
+	}
+	return f, err
+}
+
+func (e *Encrypted) List(prefix string) ([]FileInfo, error) {
+	files, err := e.Backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	listed := files[:0]
+	for _, f := range files {
+		if f.Name != KeyObject && f.Name != KeyIDObject {
+			f.Size = DecryptedSize(f.Size)
+			listed = append(listed, f)
+		}
+	}
+	return listed, nil
+}
+
+// Checksum tells the md5 of a file put by this Encrypted as it was before
+// encryption, if Backend has what was put. Others are to be read back.
+func (e *Encrypted) Checksum(name, algo string) (string, error) {
+	c, ok := e.Backend.(Checksummer)
+	e.mu.Lock()
+	sums, put := e.put[name]
+	e.mu.Unlock()
+	if !ok || !put || algo != "md5" {
+		return "", nil
+	}
+	sum, err := c.Checksum(name, "md5")
+	if err != nil || sum != sums[0] {
+		return "", err
+	}
+	return sums[1], nil
+}
@@ -0,0 +1,245 @@
+package lxdbackup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// FormatOptions are how hard a Format compresses.
+type FormatOptions struct {
+	// Level is 1 to MaxLevel, 0 is the default of the format.
+	Level int
+	// Threads is how many cores to compress on, 0 is all of them.
+	Threads int
+}
+
+// Format is a compression of archives.
+type Format interface {
+	Name() string
+	// MaxLevel is the highest FormatOptions.Level, 0 when there are none.
+	MaxLevel() int
+	// Magic is what compressed data starts with, nil if it can't be told.
+	Magic() []byte
+	// Ext is what the name of a tarball in the format has after .tar, IE
+	// .zst, nothing for none.
+	Ext() string
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	NewWriter(w io.Writer, opts FormatOptions) (io.WriteCloser, error)
+}
+
+var formats = map[string]Format{
+	"zstd": zstdFormat{},
+	"gzip": gzipFormat{},
+	"xz":   xzFormat{},
+	"none": noneFormat{},
+}
+
+// FormatNames lists the formats there are, zstd first as the default.
+func FormatNames() []string {
+	names := make([]string, 0, len(formats))
+	for n := range formats {
+		if n != "zstd" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{"zstd"}, names...)
+}
+
+// LookupFormat returns the format called name.
+func LookupFormat(name string) (Format, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %s, supported: %s", name, strings.Join(FormatNames(), ", "))
+	}
+	return f, nil
+}
+
+// ArchiveExts lists the Ext of the formats there are, zstd first.
+func ArchiveExts() []string {
+	var exts []string
+	for _, n := range FormatNames() {
+		exts = append(exts, formats[n].Ext())
+	}
+	return exts
+}
+
+// ArchiveStem returns the name of the tarball fname up to .tar, IE
+// lxd-backup-web-Q20264.tar of lxd-backup-web-Q20264.tar.gz, and whether it
+// is one.
+func ArchiveStem(fname string) (string, bool) {
+	for _, ext := range ArchiveExts() {
+		if stem, found := strings.CutSuffix(fname, ext); found && strings.HasSuffix(stem, ".tar") {
+			return stem, true
+		}
+	}
+	return fname, false
+}
+
+// ArchiveExtPattern is a regular expression matching the Ext of any format,
+// which may be empty.
+func ArchiveExtPattern() string {
+	var alts []string
+	for _, ext := range ArchiveExts() {
+		if len(ext) > 0 {
+			alts = append(alts, regexp.QuoteMeta(ext))
+		}
+	}
+	return "(?:" + strings.Join(alts, "|") + ")?"
+}
+
+// NewReader decompresses r, in whatever format it turns out to be in, and
+// returns the format. Content that isn't compressed in a known format is
+// passed on as it is.
+func NewReader(r io.Reader) (io.ReadCloser, Format, error) {
+
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(8)
+	for _, n := range FormatNames() {
+		f := formats[n]
+		if m := f.Magic(); len(m) > 0 && bytes.HasPrefix(head, m) {
+			rc, err := f.NewReader(br)
+			if err != nil {
+				return nil, f, fmt.Errorf("reading as %s: %w", n, err)
+			}
+			return rc, f, nil
+		}
+	}
+	return io.NopCloser(br), formats["none"], nil
+}
+
+type zstdFormat struct{}
+
+func (zstdFormat) Name() string  { return "zstd" }
+func (zstdFormat) MaxLevel() int { return 19 }
+func (zstdFormat) Magic() []byte { return []byte{0x28, 0xb5, 0x2f, 0xfd} }
+func (zstdFormat) Ext() string   { return ".zst" }
+
+func (zstdFormat) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func (zstdFormat) NewWriter(w io.Writer, opts FormatOptions) (io.WriteCloser, error) {
+	threads := opts.Threads
+	if threads == 0 {
+		threads = runtime.GOMAXPROCS(0)
+	}
+	eopts := []zstd.EOption{zstd.WithEncoderConcurrency(threads)}
+	if opts.Level > 0 {
+		eopts = append(eopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	return zstd.NewWriter(w, eopts...)
+}
+
+type gzipFormat struct{}
+
+func (gzipFormat) Name() string  { return "gzip" }
+func (gzipFormat) MaxLevel() int { return 9 }
+func (gzipFormat) Magic() []byte { return []byte{0x1f, 0x8b} }
+func (gzipFormat) Ext() string   { return ".gz" }
+
+func (gzipFormat) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipFormat) NewWriter(w io.Writer, opts FormatOptions) (io.WriteCloser, error) {
+	level := gzip.DefaultCompression
+	if opts.Level > 0 {
+		level = opts.Level
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+// xzFormat runs the xz binary, there is no xz in the Go standard library.
+type xzFormat struct{}
+
+func (xzFormat) Name() string  { return "xz" }
+func (xzFormat) MaxLevel() int { return 9 }
+func (xzFormat) Magic() []byte { return []byte{0xfd, '7', 'z', 'X', 'Z', 0x00} }
+func (xzFormat) Ext() string   { return ".xz" }
+
+// xzStream is the end of a pipe to or from xz, which is waited for on close.
+type xzStream struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (x *xzStream) Close() error {
+	var err error
+	if x.WriteCloser != nil {
+		err = x.WriteCloser.Close()
+	} else if c, ok := x.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	if werr := x.cmd.Wait(); err == nil && x.WriteCloser != nil {
+		err = werr
+	}
+	return err
+}
+
+func (xzFormat) NewReader(r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "-dc")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &xzStream{Reader: out, cmd: cmd}, nil
+}
+
+func (xzFormat) NewWriter(w io.Writer, opts FormatOptions) (io.WriteCloser, error) {
+	args := []string{"-c", fmt.Sprintf("-T%d", opts.Threads)}
+	if opts.Level > 0 {
+		args = append(args, fmt.Sprintf("-%d", opts.Level))
+	}
+	cmd := exec.Command("xz", args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &xzStream{WriteCloser: in, cmd: cmd}, nil
+}
+
+type noneFormat struct{}
+
+func (noneFormat) Name() string  { return "none" }
+func (noneFormat) MaxLevel() int { return 0 }
+func (noneFormat) Magic() []byte { return nil }
+func (noneFormat) Ext() string   { return "" }
+
+func (noneFormat) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (noneFormat) NewWriter(w io.Writer, opts FormatOptions) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
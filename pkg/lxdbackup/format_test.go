@@ -0,0 +1,20 @@
+package lxdbackup
+
+import "testing"
+
+func TestArchiveStem(t *testing.T) {
+
+	for fname, want := range map[string]string{
+		"lxd-backup-web-Q20264.tar.zst":      "lxd-backup-web-Q20264.tar",
+		"lxd-backup-web-Q20264.tar.gz":       "lxd-backup-web-Q20264.tar",
+		"lxd-backup-web-WD3-delta.tar.xz":    "lxd-backup-web-WD3-delta.tar",
+		"lxd-backup-web-Q20264.tar":          "lxd-backup-web-Q20264.tar",
+		"lxd-backup-web-Q20264.tar.zst.stat": "",
+		"lxd-backup-web-WD3-delta.btrfs.zst": "",
+	} {
+		stem, ok := ArchiveStem(fname)
+		if (len(want) > 0) != ok || (ok && stem != want) {
+			t.Errorf("%s: got %s %v, want %s", fname, stem, ok, want)
+		}
+	}
+}
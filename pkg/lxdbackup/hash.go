@@ -0,0 +1,57 @@
+package lxdbackup
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// Hasher is a checksum algorithm for telling which files changed.
+type Hasher interface {
+	Name() string
+	New() hash.Hash
+}
+
+type stdHasher struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h stdHasher) Name() string   { return h.name }
+func (h stdHasher) New() hash.Hash { return h.new() }
+
+var hashers = map[string]Hasher{
+	"md5":    stdHasher{"md5", md5.New},
+	"sha1":   stdHasher{"sha1", sha1.New},
+	"sha256": stdHasher{"sha256", sha256.New},
+	"sha512": stdHasher{"sha512", sha512.New},
+}
+
+// HasherNames lists the checksum algorithms there are.
+func HasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for n := range hashers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupHasher returns the checksum algorithm called name. Backups made
+// before the algorithm was recorded use md5, which is what an empty name
+// gives.
+func LookupHasher(name string) (Hasher, error) {
+	if len(name) == 0 {
+		name = "md5"
+	}
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %s, supported: %s", name, strings.Join(HasherNames(), ", "))
+	}
+	return h, nil
+}
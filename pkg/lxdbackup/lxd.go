@@ -0,0 +1,146 @@
+package lxdbackup
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Instance is a container or VM as lxc list shows it.
+type Instance struct {
+	Name string
+	// Status is IE Running or Stopped.
+	Status   string
+	Location string
+	Profiles []string
+}
+
+// InstanceState is what LXD knows about a running or stopped instance.
+type InstanceState struct {
+	Status string `json:"status"`
+	Disk   map[string]struct {
+		Usage int64 `json:"usage"`
+	} `json:"disk"`
+}
+
+// DiskUsage is how much of its storage pool the root disk uses, 0 if LXD
+// doesn't know.
+func (s *InstanceState) DiskUsage() int64 {
+	return s.Disk["root"].Usage
+}
+
+// LXD is what lxd-backup asks of LXD.
+type LXD interface {
+	List() ([]Instance, error)
+	State(name string) (*InstanceState, error)
+	Start(name string) error
+	Stop(name string) error
+	// Pause freezes the processes of a running instance, Start thaws them.
+	Pause(name string) error
+	// Profile returns the profile name as lxc profile show has it.
+	Profile(name string) (string, error)
+}
+
+// CLI is LXD through the lxc command.
+type CLI struct {
+	// Command makes the lxc command for args, IE with a timeout or through
+	// sudo, and the function called once it is done. exec.Command("lxc",
+	// args...) when nil.
+	Command func(args ...string) (*exec.Cmd, context.CancelFunc)
+	// Stderr gets what lxc complains about. When nil, it is in the errors
+	// returned instead.
+	Stderr io.Writer
+}
+
+func (c *CLI) command(args ...string) (*exec.Cmd, context.CancelFunc) {
+	var cmd *exec.Cmd
+	cancel := context.CancelFunc(func() {})
+	if c.Command != nil {
+		cmd, cancel = c.Command(args...)
+	} else {
+		cmd = exec.Command("lxc", args...)
+	}
+	cmd.Stderr = c.Stderr
+	return cmd, cancel
+}
+
+func (c *CLI) output(args ...string) ([]byte, error) {
+	cmd, cancel := c.command(args...)
+	defer cancel()
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+		return nil, fmt.Errorf("lxc %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exit.Stderr)))
+	} else if err != nil {
+		return nil, fmt.Errorf("lxc %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (c *CLI) List() ([]Instance, error) {
+
+	out, err := c.output("list", "-c", "nsLP", "-f", "csv")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("lxc list gave bad CSV: %w", err)
+	}
+
+	instances := make([]Instance, 0, len(rows))
+	for _, r := range rows {
+		if len(r) != 4 {
+			return nil, fmt.Errorf("lxc list gave %d columns instead of 4: %v", len(r), r)
+		}
+		// The list says RUNNING where the state says Running
+		status := strings.ToLower(r[1])
+		if len(status) > 0 {
+			status = strings.ToUpper(status[:1]) + status[1:]
+		}
+		instances = append(instances, Instance{
+			Name:     r[0],
+			Status:   status,
+			Location: r[2],
+			Profiles: strings.Fields(r[3]),
+		})
+	}
+	return instances, nil
+}
+
+func (c *CLI) State(name string) (*InstanceState, error) {
+	out, err := c.output("query", "/1.0/instances/"+name+"/state")
+	if err != nil {
+		return nil, err
+	}
+	var s InstanceState
+	if err := json.Unmarshal(out, &s); err != nil {
+		return nil, fmt.Errorf("bad state of %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+func (c *CLI) Start(name string) error {
+	_, err := c.output("start", name)
+	return err
+}
+
+func (c *CLI) Stop(name string) error {
+	_, err := c.output("stop", name)
+	return err
+}
+
+func (c *CLI) Pause(name string) error {
+	_, err := c.output("pause", name)
+	return err
+}
+
+func (c *CLI) Profile(name string) (string, error) {
+	out, err := c.output("profile", "show", name)
+	return string(out), err
+}
@@ -0,0 +1,329 @@
+package lxdbackup
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TarWriter is what deltas and merged backups are written to, IE a
+// tar.Writer.
+type TarWriter interface {
+	WriteHeader(hdr *tar.Header) error
+	io.Writer
+}
+
+// EntryWriter writes the entry hdr with its content r, IE as a sparse
+// file. Nil writes it as it is.
+type EntryWriter func(hdr *tar.Header, r io.Reader) error
+
+func writeEntry(tw TarWriter, write EntryWriter, hdr *tar.Header, r io.Reader) error {
+	if write != nil {
+		return write(hdr, r)
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
+
+// PAXMeta marks a delta entry that only changes the mode, owner or mtime
+// of the file in the quarter backup. It has no content, the quarter version
+// is used with its header.
+const PAXMeta = "LXDBACKUP.meta"
+
+// IsMetaEntry tells whether the delta entry hdr is metadata only.
+func IsMetaEntry(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[PAXMeta]
+	return ok
+}
+
+// WriteMetaEntry writes hdr to tw as an entry without content.
+func WriteMetaEntry(tw TarWriter, hdr *tar.Header) error {
+	h := *hdr
+	h.Size = 0
+	h.Format = tar.FormatPAX
+	h.PAXRecords = make(map[string]string, len(hdr.PAXRecords)+1)
+	for k, v := range hdr.PAXRecords {
+		h.PAXRecords[k] = v
+	}
+	h.PAXRecords[PAXMeta] = "1"
+	return tw.WriteHeader(&h)
+}
+
+// ApplyMeta is the header of the quarter version of a file, hdr, with the
+// metadata of the entry meta of a delta.
+func ApplyMeta(hdr, meta *tar.Header) *tar.Header {
+	h := *hdr
+	h.Mode, h.Uid, h.Gid = meta.Mode, meta.Uid, meta.Gid
+	h.Uname, h.Gname = meta.Uname, meta.Gname
+	h.ModTime, h.AccessTime, h.ChangeTime = meta.ModTime, meta.AccessTime, meta.ChangeTime
+	return &h
+}
+
+// Delta is what goes in a delta of an export: the changed files, those
+// with a signature as binary diffs against the quarter backup, and those
+// only changed in their metadata as their header.
+type Delta struct {
+	Changed  map[string]bool
+	MetaOnly map[string]bool
+	Sigs     map[string]*BlockSig
+	// TempDir is where binary diffs are worked out.
+	TempDir    string
+	WriteEntry EntryWriter
+}
+
+// Entry writes the entry hdr of an export, with its content r, to the
+// delta tw if it changed.
+func (d *Delta) Entry(tw TarWriter, hdr *tar.Header, r io.Reader) error {
+	if d.MetaOnly[hdr.Name] {
+		return WriteMetaEntry(tw, hdr)
+	}
+	if !d.Changed[hdr.Name] {
+		return nil
+	}
+	if sig, present := d.Sigs[hdr.Name]; present {
+		return WriteDiffEntry(tw, hdr, r, sig, d.TempDir)
+	}
+	if err := writeEntry(tw, d.WriteEntry, hdr, r); err != nil {
+		return fmt.Errorf("write %s: %w", hdr.Name, err)
+	}
+	return nil
+}
+
+// CopyOptions are what CopyEntries leaves out or changes.
+type CopyOptions struct {
+	Skip map[string]bool
+	// Metas are the metadata only entries of a delta, their metadata is
+	// given to the entries of the same name.
+	Metas   map[string]*tar.Header
+	Rewrite map[string]func([]byte) []byte
+	// Bases are the files the binary diffs among the entries apply to.
+	Bases      map[string]string
+	WriteEntry EntryWriter
+}
+
+// CopyEntries copies the tarball r to tw.
+func CopyEntries(tw TarWriter, r io.Reader, o CopyOptions) error {
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if o.Skip[hdr.Name] {
+			continue
+		}
+		if meta, present := o.Metas[hdr.Name]; present {
+			hdr = ApplyMeta(hdr, meta)
+		}
+		if base, present := o.Bases[hdr.Name]; present {
+			if err := WritePatchedEntry(tw, hdr, tr, base); err != nil {
+				return err
+			}
+			continue
+		}
+		if fn, present := o.Rewrite[hdr.Name]; present {
+			d, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", hdr.Name, err)
+			}
+			d = fn(d)
+			hdr.Size = int64(len(d))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(d); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeEntry(tw, o.WriteEntry, hdr, tr); err != nil {
+			return fmt.Errorf("copy %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// ExtractEntries copies the named files out of the tarball r into
+// temporary files in dir, for binary diffs to be applied to. Those
+// extracted are returned even on error, to be removed.
+func ExtractEntries(r io.Reader, names map[string]bool, dir string) (map[string]string, error) {
+
+	files := make(map[string]string)
+	if len(names) == 0 {
+		return files, nil
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return files, err
+		}
+		if !names[hdr.Name] {
+			continue
+		}
+		f, err := os.CreateTemp(dir, ".lxd-backup-base-")
+		if err != nil {
+			return files, err
+		}
+		files[hdr.Name] = f.Name()
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return files, fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+	}
+	for n := range names {
+		if _, ok := files[n]; !ok {
+			return files, fmt.Errorf("%s is a binary diff, but missing in the quarter backup", n)
+		}
+	}
+	return files, nil
+}
+
+// ReadRemoved reads a list of removed files, one per line, as written
+// next to a delta.
+func ReadRemoved(r io.Reader) (map[string]bool, error) {
+	removed := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Text()) > 0 {
+			removed[scanner.Text()] = true
+		}
+	}
+	return removed, scanner.Err()
+}
+
+// Merge combines a quarter backup with a delta into the tarball the
+// container was exported as.
+type Merge struct {
+	// Full and Delta read the quarter backup and the delta, calling fn with
+	// them, each more than once. Delta is nil to only copy the quarter
+	// backup.
+	Full, Delta func(fn func(r io.Reader) error) error
+	// Removed are the files removed since the quarter backup.
+	Removed map[string]bool
+	// Rewrite changes the content of files, in whichever copy ends up in
+	// the result.
+	Rewrite map[string]func([]byte) []byte
+	// TempDir is where the files binary diffs apply to are extracted.
+	TempDir    string
+	WriteEntry EntryWriter
+	// Base writes the files of the base image the quarter backup links
+	// to, those in skip left out and those in metas with their metadata.
+	Base func(tw TarWriter, skip map[string]bool, metas map[string]*tar.Header) error
+}
+
+// scanDelta returns the names of the entries of the tarball r, the
+// metadata only ones and the binary diffs.
+func scanDelta(r io.Reader) (names map[string]bool, metas map[string]*tar.Header, patched map[string]bool, err error) {
+	names, metas, patched = make(map[string]bool), make(map[string]*tar.Header), make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, metas, patched, nil
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+		names[hdr.Name] = true
+		if IsMetaEntry(hdr) {
+			metas[hdr.Name] = hdr
+		}
+		if IsPatched(hdr) {
+			patched[hdr.Name] = true
+		}
+	}
+}
+
+// Write writes the merged tarball to tw.
+func (m *Merge) Write(tw TarWriter) error {
+
+	if m.Full == nil {
+		return errors.New("no quarter backup to merge")
+	}
+	skip := make(map[string]bool)
+	var metas map[string]*tar.Header
+	var patched map[string]bool
+	if m.Delta != nil {
+		// Metadata only entries take the content of the quarter backup
+		var names map[string]bool
+		err := m.Delta(func(r io.Reader) (err error) {
+			names, metas, patched, err = scanDelta(r)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("read delta: %w", err)
+		}
+		for n := range names {
+			if metas[n] == nil {
+				skip[n] = true
+			}
+		}
+		for n := range m.Removed {
+			skip[n] = true
+		}
+	}
+
+	deltaRewrite := make(map[string]func([]byte) []byte)
+	quarterRewrite := make(map[string]func([]byte) []byte)
+	for n, fn := range m.Rewrite {
+		if skip[n] {
+			deltaRewrite[n] = fn
+		} else {
+			quarterRewrite[n] = fn
+		}
+	}
+
+	// The files of the base image go first, the quarter backup may link to them
+	if m.Base != nil {
+		if err := m.Base(tw, skip, metas); err != nil {
+			return err
+		}
+	}
+	err := m.Full(func(r io.Reader) error {
+		return CopyEntries(tw, r, CopyOptions{Skip: skip, Metas: metas, Rewrite: quarterRewrite, WriteEntry: m.WriteEntry})
+	})
+	if err != nil {
+		return fmt.Errorf("copy quarter backup: %w", err)
+	}
+	if m.Delta == nil {
+		return nil
+	}
+
+	var bases map[string]string
+	defer func() {
+		for _, f := range bases {
+			os.Remove(f)
+		}
+	}()
+	err = m.Full(func(r io.Reader) (err error) {
+		bases, err = ExtractEntries(r, patched, m.TempDir)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	deltaSkip := make(map[string]bool, len(metas))
+	for n := range metas {
+		deltaSkip[n] = true
+	}
+	err = m.Delta(func(r io.Reader) error {
+		return CopyEntries(tw, r, CopyOptions{Skip: deltaSkip, Rewrite: deltaRewrite, Bases: bases, WriteEntry: m.WriteEntry})
+	})
+	if err != nil {
+		return fmt.Errorf("copy delta: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package lxdbackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tarFiles returns the content and mode of each file of a tarball.
+func tarFiles(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := io.ReadAll(tr)
+		files[hdr.Name] = string(d) + "|" + hdr.FileInfo().Mode().String()
+	}
+}
+
+func TestDeltaMerge(t *testing.T) {
+
+	big := strings.Repeat("0123456789abcdef", 4*bdiffBlock/16)
+	reg := func(name string, mode int64, data string) testEntry {
+		return testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode}, data: data}
+	}
+	full := testTar(t, reg("same", 0644, "same"), reg("changed", 0644, "old"), reg("gone", 0644, "gone"),
+		reg("chmod", 0644, "chmod"), reg("big", 0644, big)).Bytes()
+	export := testTar(t, reg("same", 0644, "same"), reg("changed", 0644, "new"), reg("chmod", 0600, "chmod"),
+		reg("big", 0644, big[:bdiffBlock]+"changed"+big[bdiffBlock+7:]), reg("new", 0644, "new")).Bytes()
+
+	sig, err := MakeSignature(strings.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Delta{Changed: map[string]bool{"changed": true, "big": true, "new": true}, MetaOnly: map[string]bool{"chmod": true},
+		Sigs: map[string]*BlockSig{"big": sig}, TempDir: t.TempDir()}
+	var delta bytes.Buffer
+	tw := tar.NewWriter(&delta)
+	tr := tar.NewReader(bytes.NewReader(export))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Entry(tw, hdr, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	if delta.Len() > len(big)/2 {
+		t.Errorf("delta of %d bytes, the big file isn't a binary diff", delta.Len())
+	}
+
+	reading := func(b []byte) func(fn func(r io.Reader) error) error {
+		return func(fn func(r io.Reader) error) error { return fn(bytes.NewReader(b)) }
+	}
+	m := &Merge{Full: reading(full), Delta: reading(delta.Bytes()), Removed: map[string]bool{"gone": true}, TempDir: t.TempDir(),
+		Rewrite: map[string]func([]byte) []byte{"same": bytes.ToUpper, "changed": bytes.ToUpper}}
+	var merged bytes.Buffer
+	tw = tar.NewWriter(&merged)
+	if err := m.Write(tw); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	want := tarFiles(t, bytes.NewReader(export))
+	want["same"] = strings.Replace(want["same"], "same", "SAME", 1)
+	want["changed"] = strings.Replace(want["changed"], "new", "NEW", 1)
+	if got := tarFiles(t, &merged); !reflect.DeepEqual(got, want) {
+		for n := range want {
+			if got[n] != want[n] {
+				t.Errorf("%s: got %.40q, want %.40q", n, got[n], want[n])
+			}
+		}
+		t.Errorf("got %d files, want %d", len(got), len(want))
+	}
+
+	// A binary diff of a file the quarter backup doesn't have
+	m.Full = reading(testTar(t, reg("same", 0644, "same")).Bytes())
+	if err := m.Write(tar.NewWriter(io.Discard)); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("got %v, want missing", err)
+	}
+}
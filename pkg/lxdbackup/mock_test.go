@@ -0,0 +1,79 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// memBackend is a Backend in memory, its files made one second apart in
+// the order they are put.
+type memBackend struct {
+	files map[string][]byte
+	times map[string]time.Time
+	now   time.Time
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{files: make(map[string][]byte), times: make(map[string]time.Time),
+		now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (m *memBackend) Put(name string, r io.Reader) error {
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.now = m.now.Add(time.Second)
+	m.files[name], m.times[name] = d, m.now
+	return nil
+}
+
+func (m *memBackend) Get(name string) (io.ReadCloser, error) {
+	d, ok := m.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(d)), nil
+}
+
+func (m *memBackend) Stat(name string) (FileInfo, error) {
+	d, ok := m.files[name]
+	if !ok {
+		return FileInfo{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return FileInfo{Name: name, Size: int64(len(d)), ModTime: m.times[name]}, nil
+}
+
+func (m *memBackend) List(prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	for n := range m.files {
+		if strings.HasPrefix(n, prefix) {
+			fi, _ := m.Stat(n)
+			files = append(files, fi)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (m *memBackend) Delete(name string) error {
+	if _, ok := m.files[name]; !ok {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	delete(m.files, name)
+	delete(m.times, name)
+	return nil
+}
+
+func (m *memBackend) Rename(from, to string) error {
+	if _, ok := m.files[from]; !ok {
+		return fmt.Errorf("%s: %w", from, os.ErrNotExist)
+	}
+	m.files[to], m.times[to] = m.files[from], m.times[from]
+	return m.Delete(from)
+}
@@ -0,0 +1,225 @@
+package lxdbackup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rclone is a Backend on any of the remotes rclone knows, through the rclone
+// command.
+type Rclone struct {
+	// Remote is remote:path as rclone takes it, IE b2:bucket/lxd, or a
+	// connection string like :s3,env_auth=true:bucket.
+	Remote string
+	// Command makes the rclone command for args. exec.Command("rclone",
+	// args...) when nil.
+	Command func(args ...string) *exec.Cmd
+	// Env is added to the environment of rclone, IE
+	// RCLONE_S3_SECRET_ACCESS_KEY=..., for secrets ps mustn't show.
+	Env []string
+}
+
+func (r *Rclone) path(name string) string {
+	if len(name) == 0 || strings.HasSuffix(r.Remote, ":") || strings.HasSuffix(r.Remote, "/") {
+		return r.Remote + name
+	}
+	return r.Remote + "/" + name
+}
+
+func (r *Rclone) command(args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if r.Command != nil {
+		cmd = r.Command(args...)
+	} else {
+		cmd = exec.Command("rclone", args...)
+	}
+	if len(r.Env) > 0 {
+		cmd.Env = append(cmd.Environ(), r.Env...)
+	}
+	return cmd
+}
+
+// rcloneError makes an error of a failed rclone command, wrapping
+// os.ErrNotExist for its exit codes of missing directories and files.
+func rcloneError(args []string, err error) error {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return fmt.Errorf("rclone %s: %w", strings.Join(args, " "), err)
+	}
+	msg := strings.TrimSpace(string(exit.Stderr))
+	if code := exit.ExitCode(); code == 3 || code == 4 {
+		return fmt.Errorf("rclone %s: %s: %w", strings.Join(args, " "), msg, os.ErrNotExist)
+	}
+	if len(msg) == 0 {
+		return fmt.Errorf("rclone %s: %w", strings.Join(args, " "), err)
+	}
+	return fmt.Errorf("rclone %s: %s", strings.Join(args, " "), msg)
+}
+
+func (r *Rclone) output(args ...string) ([]byte, error) {
+	out, err := r.command(args...).Output()
+	if err != nil {
+		return nil, rcloneError(args, err)
+	}
+	return out, nil
+}
+
+// Put streams r to rclone rcat. Remotes that can't upload atomically are
+// uploaded to a partial name and renamed by rclone itself.
+func (r *Rclone) Put(name string, rd io.Reader) error {
+	return r.PutMeta(name, rd, ObjectMeta{}, time.Time{})
+}
+
+// PutLocked is Put with S3 Object Lock retention until until, in
+// COMPLIANCE mode unless the remote sets object_lock_mode. The bucket
+// needs Object Lock enabled, other remotes don't lock.
+func (r *Rclone) PutLocked(name string, rd io.Reader, until time.Time) error {
+	return r.PutMeta(name, rd, ObjectMeta{}, until)
+}
+
+// PutMeta is Put with meta as rclone --metadata sets it, on the remotes
+// that keep metadata, IE S3, GCS and Azure Blob, the tags as user metadata.
+func (r *Rclone) PutMeta(name string, rd io.Reader, meta ObjectMeta, until time.Time) error {
+
+	args := []string{"rcat"}
+	what := "storing %s"
+	if !until.IsZero() {
+		args = append(args, "--s3-object-lock-mode", "COMPLIANCE",
+			"--s3-object-lock-retain-until-date", until.UTC().Format(time.RFC3339))
+		what = "storing %s locked"
+	}
+	if len(meta.ContentType) > 0 || len(meta.Tags) > 0 {
+		args = append(args, "--metadata")
+	}
+	if len(meta.ContentType) > 0 {
+		args = append(args, "--metadata-set", "content-type="+meta.ContentType)
+	}
+	keys := make([]string, 0, len(meta.Tags))
+	for k := range meta.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--metadata-set", k+"="+meta.Tags[k])
+	}
+	args = append(args, r.path(name))
+
+	cmd := r.command(args...)
+	cmd.Stdin = rd
+	if _, err := cmd.Output(); err != nil {
+		return fmt.Errorf(what+": %w", name, rcloneError(args, err))
+	}
+	return nil
+}
+
+// rcloneStream is the output of rclone cat, which is waited for on close.
+type rcloneStream struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	args []string
+}
+
+func (s *rcloneStream) Close() error {
+	s.ReadCloser.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return rcloneError(s.args, err)
+	}
+	return nil
+}
+
+func (r *Rclone) Get(name string) (io.ReadCloser, error) {
+
+	// rclone cat tells a file is missing only after the fact
+	if _, err := r.Stat(name); err != nil {
+		return nil, err
+	}
+
+	args := []string{"cat", r.path(name)}
+	cmd := r.command(args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, rcloneError(args, err)
+	}
+	return &rcloneStream{ReadCloser: out, cmd: cmd, args: args}, nil
+}
+
+// rcloneFile is a file as rclone lsjson lists it.
+type rcloneFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+func (f *rcloneFile) info() FileInfo {
+	return FileInfo{Name: f.Name, Size: f.Size, ModTime: f.ModTime}
+}
+
+func (r *Rclone) Stat(name string) (FileInfo, error) {
+	out, err := r.output("lsjson", "--stat", r.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	var f rcloneFile
+	if err := json.Unmarshal(out, &f); err != nil {
+		return FileInfo{}, fmt.Errorf("rclone lsjson gave bad JSON for %s: %w", name, err)
+	}
+	if f.IsDir {
+		return FileInfo{}, fmt.Errorf("%s is a directory", name)
+	}
+	f.Name = name
+	return f.info(), nil
+}
+
+func (r *Rclone) List(prefix string) ([]FileInfo, error) {
+	out, err := r.output("lsjson", "--files-only", "--max-depth", "1", r.path(""))
+	if err != nil {
+		return nil, err
+	}
+	var listed []rcloneFile
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("rclone lsjson gave bad JSON for %s: %w", r.Remote, err)
+	}
+	var files []FileInfo
+	for i := range listed {
+		if strings.HasPrefix(listed[i].Name, prefix) {
+			files = append(files, listed[i].info())
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (r *Rclone) Delete(name string) error {
+	_, err := r.output("deletefile", r.path(name))
+	return err
+}
+
+func (r *Rclone) Rename(from, to string) error {
+	_, err := r.output("moveto", r.path(from), r.path(to))
+	return err
+}
+
+// Checksum asks rclone hashsum for the checksum the remote has of name,
+// which most remotes know without the file being downloaded.
+func (r *Rclone) Checksum(name, algo string) (string, error) {
+	out, err := r.output("hashsum", algo, r.path(name))
+	if err != nil {
+		return "", err
+	}
+	f := strings.Fields(string(out))
+	if len(f) < 2 || f[0] == "UNSUPPORTED" {
+		return "", nil
+	}
+	return strings.ToLower(f[0]), nil
+}
@@ -0,0 +1,158 @@
+package lxdbackup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is one export kept by a SnapshotStore.
+type Snapshot struct {
+	ID   string
+	Time time.Time
+}
+
+// SnapshotStore is a backup program that keeps every export whole, and
+// deduplicates them itself, IE restic. Snapshots are of a name, the
+// container or volume they are a backup of.
+type SnapshotStore interface {
+	// Store keeps the uncompressed tarball r gives as a new snapshot of
+	// name, and returns its ID.
+	Store(name string, r io.Reader) (string, error)
+	// Snapshots returns the snapshots of name, oldest first.
+	Snapshots(name string) ([]Snapshot, error)
+	// Fetch writes the tarball of the snapshot id of name, or the newest
+	// one for latest, to w.
+	Fetch(name, id string, w io.Writer) error
+	// Forget removes all but the keep newest snapshots of name.
+	Forget(name string, keep int) error
+	// Delete removes the snapshots ids of name.
+	Delete(name string, ids ...string) error
+}
+
+// Restic is a SnapshotStore in a restic repository, through the restic
+// command. The password is taken from the environment, RESTIC_PASSWORD_FILE
+// and so on, as restic itself does.
+type Restic struct {
+	// Repository is the repository as restic -r takes it, IE /srv/restic
+	// or s3:s3.amazonaws.com/bucket.
+	Repository string
+	// Command makes the restic command for args. exec.Command("restic",
+	// args...) when nil.
+	Command func(args ...string) *exec.Cmd
+}
+
+func (r *Restic) command(args ...string) *exec.Cmd {
+	args = append([]string{"-r", r.Repository}, args...)
+	if r.Command != nil {
+		return r.Command(args...)
+	}
+	return exec.Command("restic", args...)
+}
+
+func resticError(args []string, err error) error {
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) > 0 {
+		return fmt.Errorf("restic %s: %s", strings.Join(args, " "), strings.TrimSpace(string(exit.Stderr)))
+	}
+	return fmt.Errorf("restic %s: %w", strings.Join(args, " "), err)
+}
+
+func (r *Restic) output(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := r.command(args...)
+	cmd.Stdin = stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, resticError(args, err)
+	}
+	return out, nil
+}
+
+// resticPath is where the snapshots of name have their tarball, which is
+// how they are told apart from those of other names.
+func resticPath(name string) string {
+	return "/" + name + ".tar"
+}
+
+func (r *Restic) Store(name string, rd io.Reader) (string, error) {
+
+	out, err := r.output(rd, "backup", "--json", "--stdin", "--stdin-filename", name+".tar", "--tag", "lxd-backup")
+	if err != nil {
+		return "", err
+	}
+
+	// The summary is the last of the status messages
+	var id string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		var msg struct {
+			MessageType string `json:"message_type"`
+			SnapshotID  string `json:"snapshot_id"`
+		}
+		if json.Unmarshal(sc.Bytes(), &msg) == nil && msg.MessageType == "summary" {
+			id = msg.SnapshotID
+		}
+	}
+	if len(id) == 0 {
+		return "", fmt.Errorf("restic backup of %s gave no snapshot id", name)
+	}
+	return id, nil
+}
+
+func (r *Restic) Snapshots(name string) ([]Snapshot, error) {
+
+	out, err := r.output(nil, "snapshots", "--json", "--tag", "lxd-backup", "--path", resticPath(name))
+	if err != nil {
+		return nil, err
+	}
+	var listed []struct {
+		ShortID string    `json:"short_id"`
+		Time    time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("restic snapshots gave bad JSON: %w", err)
+	}
+
+	snaps := make([]Snapshot, 0, len(listed))
+	for _, l := range listed {
+		snaps = append(snaps, Snapshot{ID: l.ShortID, Time: l.Time})
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+func (r *Restic) Fetch(name, id string, w io.Writer) error {
+	args := []string{"dump", "--tag", "lxd-backup", "--path", resticPath(name), id, resticPath(name)}
+	cmd := r.command(args...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("restic %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("restic %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func (r *Restic) Forget(name string, keep int) error {
+	_, err := r.output(nil, "forget", "--tag", "lxd-backup", "--path", resticPath(name),
+		"--keep-last", fmt.Sprint(keep), "--prune")
+	return err
+}
+
+func (r *Restic) Delete(name string, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := r.output(nil, append(append([]string{"forget"}, ids...), "--prune")...)
+	return err
+}
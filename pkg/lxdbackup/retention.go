@@ -0,0 +1,258 @@
+package lxdbackup
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tier is one level of the retention scheme. Name is the template the
+// backup files of the tier are named from, IE "M{month}". A new full backup
+// is made whenever the name of the full tier changes. A delta slot is made
+// over at the start of each Every period, or on every run with "run". With
+// Keep above zero, only the Keep newest files of the tier are kept. With
+// Generations above zero, a delta file is kept aside as a generation each
+// time it would be made over, up to Generations of them for the tier.
+type Tier struct {
+	Name        string `json:"name"`
+	Every       string `json:"every"`
+	Keep        int    `json:"keep"`
+	Generations int    `json:"generations"`
+}
+
+// Retention is the full tier and the delta tiers backups are kept by.
+type Retention struct {
+	Full   Tier   `json:"full"`
+	Deltas []Tier `json:"deltas"`
+}
+
+// DefaultRetention is a full backup a quarter, and deltas of the month, the
+// week and the day against it.
+func DefaultRetention() *Retention {
+	return &Retention{
+		Full: Tier{Name: "Q{year}{month/4}"}, // Lasts "forever"
+		Deltas: []Tier{
+			{Name: "M{month}", Every: "month"},     // Last a year
+			{Name: "WN{isoweek%4}", Every: "week"}, // Lasts a month
+			{Name: "WD{weekday}", Every: "run"},    // Last a week, 0 = Sunday
+		},
+	}
+}
+
+var tierField = regexp.MustCompile(`\{(\w+)(?:([%/])(\d+))?\}`)
+var tierLiteral = regexp.MustCompile(`^[A-Za-z0-9]*$`)
+
+func tierFieldValue(field string, t time.Time) (int, bool) {
+	switch field {
+	case "year":
+		return t.Year(), true
+	case "quarter":
+		return (int(t.Month())-1)/3 + 1, true
+	case "month":
+		return int(t.Month()), true
+	case "day":
+		return t.Day(), true
+	case "yday":
+		return t.YearDay(), true
+	case "isoweek":
+		_, w := t.ISOWeek()
+		return w, true
+	case "weekday":
+		return int(t.Weekday()), true
+	case "hour":
+		return t.Hour(), true
+	}
+	return 0, false
+}
+
+// Expand fills in the template of the tier for the time t.
+func (tc *Tier) Expand(t time.Time) string {
+	return tierField.ReplaceAllStringFunc(tc.Name, func(f string) string {
+		m := tierField.FindStringSubmatch(f)
+		v, _ := tierFieldValue(m[1], t)
+		if n, _ := strconv.Atoi(m[3]); n > 0 {
+			if m[2] == "%" {
+				v %= n
+			} else {
+				v /= n
+			}
+		}
+		return strconv.Itoa(v)
+	})
+}
+
+// PeriodStart returns when the current Every period of a delta tier began.
+// Delta files older than that belong to an earlier period.
+func (tc *Tier) PeriodStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch tc.Every {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	case "quarter":
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
+
+// Class is the retention class of the files of the tier, the letters of its
+// name, IE Q or WD, or other when it has none.
+func (tc *Tier) Class(other string) string {
+	if l := tierField.ReplaceAllString(tc.Name, ""); len(l) > 0 {
+		return l
+	}
+	return other
+}
+
+// Validate checks the tier, what it is, full or delta, for the errors.
+func (tc *Tier) Validate(what string, delta bool) error {
+
+	if len(tc.Name) == 0 {
+		return fmt.Errorf("the %s retention tier has no name", what)
+	}
+	for _, m := range tierField.FindAllStringSubmatch(tc.Name, -1) {
+		if _, ok := tierFieldValue(m[1], time.Time{}); !ok {
+			return fmt.Errorf("unknown field {%s} in retention tier %s", m[1], tc.Name)
+		}
+		if len(m[3]) > 0 && m[3] == strings.Repeat("0", len(m[3])) {
+			return fmt.Errorf("division by zero in retention tier %s", tc.Name)
+		}
+	}
+	if !tierLiteral.MatchString(tierField.ReplaceAllString(tc.Name, "")) {
+		return fmt.Errorf("retention tier %s may only contain letters, digits and {fields}", tc.Name)
+	}
+	if tc.Keep < 0 {
+		return fmt.Errorf("retention tier %s can't keep %d files", tc.Name, tc.Keep)
+	}
+	if tc.Generations < 0 {
+		return fmt.Errorf("retention tier %s can't keep %d generations", tc.Name, tc.Generations)
+	}
+	if !delta {
+		if tc.Generations > 0 {
+			return fmt.Errorf("retention tier %s is full backups, only deltas have generations", tc.Name)
+		}
+		return nil
+	}
+	switch tc.Every {
+	case "run", "hour", "day", "week", "month", "quarter", "year":
+	default:
+		return fmt.Errorf("retention tier %s needs every to be run, hour, day, week, month, quarter or year, not %q", tc.Name, tc.Every)
+	}
+	return nil
+}
+
+// Validate checks every tier, and that no delta tier is given twice.
+func (rc *Retention) Validate() error {
+	if err := rc.Full.Validate("full", false); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range rc.Deltas {
+		if err := rc.Deltas[i].Validate("delta", true); err != nil {
+			return err
+		}
+		if names[rc.Deltas[i].Name] {
+			return fmt.Errorf("retention tier %s is given twice", rc.Deltas[i].Name)
+		}
+		names[rc.Deltas[i].Name] = true
+	}
+	return nil
+}
+
+// FullSuffix is the file name suffix of the full backup in use at t, up to
+// .tar, as its Ext depends on the format it was made in.
+func (rc *Retention) FullSuffix(t time.Time) string {
+	return "-" + rc.Full.Expand(t) + ".tar"
+}
+
+// Pattern matches the names of the files of the tier, base, IE
+// lxd-backup-web, then the tier name and suffix. A suffix ending in .tar
+// matches the tarballs of any format, IE .tar.zst and .tar.gz.
+func (tc *Tier) Pattern(base, suffix string) *regexp.Regexp {
+	tail := regexp.QuoteMeta(suffix)
+	if strings.HasSuffix(suffix, ".tar") {
+		tail += ArchiveExtPattern()
+	}
+	return tc.tierRegexp(base, tail)
+}
+
+// GenerationPattern matches the generations of a delta tier, IE
+// WD3.20261014T021337.000000000Z after the time the delta was made.
+func (tc *Tier) GenerationPattern(base string) *regexp.Regexp {
+	return tc.tierRegexp(base, `\.\d{8}T\d{6}\.\d{9}Z`+regexp.QuoteMeta("-delta.tar")+ArchiveExtPattern())
+}
+
+func (tc *Tier) tierRegexp(base, tail string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^" + regexp.QuoteMeta(base+"-"))
+	for _, part := range tierField.Split(tc.Name, -1) {
+		b.WriteString(regexp.QuoteMeta(part) + `\d+`)
+	}
+	return regexp.MustCompile(strings.TrimSuffix(b.String(), `\d+`) + tail + "$")
+}
+
+// NewestFiles returns the names of the files of b starting with base that
+// re matches, newest first.
+func NewestFiles(b Backend, base string, re *regexp.Regexp) ([]string, error) {
+
+	files, err := b.List(base)
+	if err != nil {
+		return nil, err
+	}
+	var matched []FileInfo
+	for _, f := range files {
+		if re.MatchString(f.Name) {
+			matched = append(matched, f)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].ModTime.After(matched[j].ModTime) })
+
+	names := make([]string, len(matched))
+	for i := range matched {
+		names[i] = matched[i].Name
+	}
+	return names, nil
+}
+
+// Expired returns the files of the tier in b beyond the Keep newest, none
+// when it keeps all.
+func (tc *Tier) Expired(b Backend, base, suffix string) ([]string, error) {
+	if tc.Keep == 0 {
+		return nil, nil
+	}
+	files, err := NewestFiles(b, base, tc.Pattern(base, suffix))
+	if err != nil || len(files) <= tc.Keep {
+		return nil, err
+	}
+	return files[tc.Keep:], nil
+}
+
+// Retained returns the ids of the snapshots the tiers keep: the newest of
+// each name of each tier, as the files of the tier would be made over, and
+// of those only the Keep newest names. snaps are oldest first.
+func (rc *Retention) Retained(snaps []Snapshot) map[string]bool {
+
+	keep := make(map[string]bool)
+	for _, tc := range append([]Tier{rc.Full}, rc.Deltas...) {
+		seen := make(map[string]bool)
+		for i := len(snaps) - 1; i >= 0; i-- {
+			n := tc.Expand(snaps[i].Time.UTC())
+			if seen[n] || (tc.Keep > 0 && len(seen) == tc.Keep) {
+				continue
+			}
+			seen[n] = true
+			keep[snaps[i].ID] = true
+		}
+	}
+	return keep
+}
@@ -0,0 +1,155 @@
+package lxdbackup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTierExpand(t *testing.T) {
+
+	at := time.Date(2026, 10, 14, 2, 13, 37, 0, time.UTC) // A Wednesday of ISO week 42
+	for name, want := range map[string]string{
+		"Q{year}{month/4}": "Q20262",
+		"M{month}":         "M10",
+		"WN{isoweek%4}":    "WN2",
+		"WD{weekday}":      "WD3",
+		"H{hour}":          "H2",
+		"D{yday}":          "D287",
+	} {
+		tc := Tier{Name: name}
+		if got := tc.Expand(at); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestTierPeriodStart(t *testing.T) {
+
+	at := time.Date(2026, 10, 14, 2, 13, 37, 0, time.UTC)
+	for every, want := range map[string]time.Time{
+		"run":     at,
+		"hour":    time.Date(2026, 10, 14, 2, 0, 0, 0, time.UTC),
+		"day":     time.Date(2026, 10, 14, 0, 0, 0, 0, time.UTC),
+		"week":    time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), // Monday
+		"month":   time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		"quarter": time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		"year":    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		tc := Tier{Name: "X", Every: every}
+		if got := tc.PeriodStart(at); !got.Equal(want) {
+			t.Errorf("%s: got %s, want %s", every, got, want)
+		}
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+
+	if err := DefaultRetention().Validate(); err != nil {
+		t.Fatalf("default retention: %v", err)
+	}
+	for want, rc := range map[string]Retention{
+		"no name":          {},
+		"unknown field":    {Full: Tier{Name: "Q{fortnight}"}},
+		"division by zero": {Full: Tier{Name: "Q{month/0}"}},
+		"may only contain": {Full: Tier{Name: "Q-{month}"}},
+		"can't keep -1":    {Full: Tier{Name: "Q", Keep: -1}},
+		"only deltas":      {Full: Tier{Name: "Q", Generations: 2}},
+		"needs every":      {Full: Tier{Name: "Q"}, Deltas: []Tier{{Name: "D{day}", Every: "fortnight"}}},
+		"given twice":      {Full: Tier{Name: "Q"}, Deltas: []Tier{{Name: "D", Every: "run"}, {Name: "D", Every: "day"}}},
+	} {
+		err := rc.Validate()
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%+v: got %v, want %q", rc, err, want)
+		}
+	}
+}
+
+func TestTierPattern(t *testing.T) {
+
+	rc := DefaultRetention()
+	full := rc.Full.Pattern("lxd-backup-web", ".tar")
+	wd := rc.Deltas[2].Pattern("lxd-backup-web", "-delta.tar")
+	gen := rc.Deltas[2].GenerationPattern("lxd-backup-web")
+	for _, c := range []struct {
+		fname string
+		re    string
+		want  bool
+	}{
+		{"lxd-backup-web-Q20264.tar.zst", "full", true},
+		{"lxd-backup-web-Q20264.tar.gz", "full", true},
+		{"lxd-backup-web-Q20264.tar", "full", true},
+		{"lxd-backup-web-Q20264.tar.zst.md5sum", "full", false},
+		{"lxd-backup-web-2-Q20264.tar.zst", "full", false}, // Of web-2
+		{"lxd-backup-web-Q20264-delta.tar.zst", "full", false},
+		{"lxd-backup-web-WD3-delta.tar.zst", "wd", true},
+		{"lxd-backup-web-WD3-delta.tar.xz", "wd", true},
+		{"lxd-backup-web-XWD3-delta.tar.zst", "wd", false},
+		{"lxd-backup-web-WD3.20261014T021337.000000000Z-delta.tar.zst", "wd", false},
+		{"lxd-backup-web-WD3.20261014T021337.000000000Z-delta.tar.zst", "gen", true},
+		{"lxd-backup-web-WD3.20261014T021337.000000000Z-delta.tar.gz", "gen", true},
+	} {
+		re := map[string]bool{"full": full.MatchString(c.fname), "wd": wd.MatchString(c.fname), "gen": gen.MatchString(c.fname)}
+		if re[c.re] != c.want {
+			t.Errorf("%s against %s: got %v", c.fname, c.re, re[c.re])
+		}
+	}
+}
+
+func TestTierExpired(t *testing.T) {
+
+	b := newMemBackend()
+	for _, n := range []string{
+		"lxd-backup-web-M8-delta.tar.zst",
+		"lxd-backup-web-M9-delta.tar.gz",    // Made with -format gzip
+		"lxd-backup-web-2-M9-delta.tar.zst", // Of web-2
+		"lxd-backup-web-M10-delta.tar.zst",
+		"lxd-backup-web-M10-delta.tar.zst.md5sum",
+		"lxd-backup-web-WD3-delta.tar.zst",
+	} {
+		b.Put(n, strings.NewReader(n))
+	}
+
+	tc := Tier{Name: "M{month}", Every: "month", Keep: 2}
+	newest, err := NewestFiles(b, "lxd-backup-web", tc.Pattern("lxd-backup-web", "-delta.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lxd-backup-web-M10-delta.tar.zst", "lxd-backup-web-M9-delta.tar.gz", "lxd-backup-web-M8-delta.tar.zst"}; !reflect.DeepEqual(newest, want) {
+		t.Errorf("newest: got %v, want %v", newest, want)
+	}
+
+	expired, err := tc.Expired(b, "lxd-backup-web", "-delta.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lxd-backup-web-M8-delta.tar.zst"}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("expired: got %v, want %v", expired, want)
+	}
+
+	tc.Keep = 0
+	if expired, _ := tc.Expired(b, "lxd-backup-web", "-delta.tar"); len(expired) > 0 {
+		t.Errorf("keeping all: got %v expired", expired)
+	}
+}
+
+func TestRetentionRetained(t *testing.T) {
+
+	rc := &Retention{Full: Tier{Name: "M{month}", Keep: 2}, Deltas: []Tier{{Name: "D{day}", Every: "day"}}}
+	var snaps []Snapshot
+	for _, d := range []string{"2026-08-31T01:00:00Z", "2026-09-01T01:00:00Z", "2026-09-01T02:00:00Z",
+		"2026-10-01T01:00:00Z", "2026-10-02T01:00:00Z"} {
+		at, _ := time.Parse(time.RFC3339, d)
+		snaps = append(snaps, Snapshot{ID: d, Time: at})
+	}
+	want := map[string]bool{
+		"2026-10-02T01:00:00Z": true, // Newest of M10, and of D2
+		"2026-10-01T01:00:00Z": true, // Newest of D1
+		"2026-09-01T02:00:00Z": true, // Newest of M9, M8 is beyond Keep
+		"2026-08-31T01:00:00Z": true, // Newest of D31
+	}
+	if got := rc.Retained(snaps); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package lxdbackup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ResolveSecret returns the secret ref refers to, so that passwords, tokens
+// and keys needn't be on the command line, where ps shows them, or in a
+// config file:
+//
+//   - env:NAME is the environment variable NAME
+//   - file:/path is the contents of the file, without a trailing newline
+//   - cmd:command is what command writes, run by sh, IE cmd:pass show s3
+//
+// Anything else is the secret itself.
+func ResolveSecret(ref string) (string, error) {
+
+	kind, arg, _ := strings.Cut(ref, ":")
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return v, nil
+	case "file":
+		d, err := os.ReadFile(arg)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(d), "\r\n"), nil
+	case "cmd":
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", arg)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+				return "", fmt.Errorf("%s: %s", arg, msg)
+			}
+			return "", fmt.Errorf("%s: %w", arg, err)
+		}
+		s := strings.TrimRight(string(out), "\r\n")
+		if len(s) == 0 {
+			return "", errors.New(arg + " gave no secret")
+		}
+		return s, nil
+	}
+	return ref, nil
+}
@@ -0,0 +1,244 @@
+package lxdbackup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileInfo is a file of a Backend.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is where backups are stored. Names are relative to the backup
+// target and never contain directories. Errors for missing files wrap
+// os.ErrNotExist.
+type Backend interface {
+	// Put stores what r gives as name. A file by that name is complete,
+	// whether Put failed or not.
+	Put(name string, r io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Stat(name string) (FileInfo, error)
+	// List returns the files whose names start with prefix, sorted by name.
+	List(prefix string) ([]FileInfo, error)
+	Delete(name string) error
+	Rename(from, to string) error
+}
+
+// Checksummer is a Backend that can tell the checksum of a file it has,
+// without it being read back.
+type Checksummer interface {
+	// Checksum returns the hex checksum of name with algo, md5 or sha1, or
+	// "" when the backend doesn't know it.
+	Checksum(name, algo string) (string, error)
+}
+
+// ObjectLocker is a Backend that can store files write-once, IE S3 with
+// Object Lock, for them to survive whoever gets hold of the credentials.
+type ObjectLocker interface {
+	// PutLocked is Put, with name kept from being changed or deleted until
+	// until.
+	PutLocked(name string, r io.Reader, until time.Time) error
+}
+
+// ObjectMeta is what an object store keeps along with a file, so bucket
+// lifecycle rules and inventory reports work without parsing file names.
+type ObjectMeta struct {
+	ContentType string
+	Tags        map[string]string
+}
+
+// MetaPutter is a Backend that can store files with ObjectMeta.
+type MetaPutter interface {
+	// PutMeta is Put with meta, and PutLocked unless until is zero.
+	PutMeta(name string, r io.Reader, meta ObjectMeta, until time.Time) error
+}
+
+// OpenBackend returns the Backend target names:
+//
+//   - a directory, or file:///path, gives a Dir
+//   - rclone:remote:path gives an Rclone on a remote of the rclone config
+//   - s3://bucket/path and sftp://user@host:port/path give an Rclone too,
+//     configured from the URL, with the query parameters as options of the
+//     rclone backend, IE s3://bucket?provider=Minio&endpoint=https://minio
+//
+// S3 credentials are taken from the environment and SFTP ones from the
+// ssh agent, unless given as options. Options can be given as references
+// ResolveSecret takes, IE secret_access_key=file:/etc/lxd-backup/s3.
+func OpenBackend(target string) (Backend, error) {
+
+	if remote, ok := strings.CutPrefix(target, "rclone:"); ok {
+		if !strings.Contains(remote, ":") {
+			return nil, fmt.Errorf("bad rclone target %s, must be rclone:remote:path", target)
+		}
+		return &Rclone{Remote: remote}, nil
+	}
+	if !strings.Contains(target, "://") {
+		return &Dir{Path: target}, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	opts := u.Query()
+	// Secrets go to rclone in its environment, ps shows its arguments
+	var env []string
+	for k := range opts {
+		v, err := ResolveSecret(opts.Get(k))
+		if err != nil {
+			return nil, fmt.Errorf("option %s of %s: %w", k, u.Redacted(), err)
+		}
+		if v != opts.Get(k) {
+			env = append(env, "RCLONE_"+strings.ToUpper(u.Scheme+"_"+k)+"="+v)
+			opts.Del(k)
+		}
+	}
+	sort.Strings(env)
+	switch u.Scheme {
+	case "file":
+		return &Dir{Path: u.Path}, nil
+	case "s3":
+		if !opts.Has("env_auth") && !opts.Has("access_key_id") {
+			opts.Set("env_auth", "true")
+		}
+		return &Rclone{Remote: rcloneConnection("s3", opts) + u.Host + u.Path, Env: env}, nil
+	case "sftp":
+		opts.Set("host", u.Hostname())
+		if len(u.Port()) > 0 {
+			opts.Set("port", u.Port())
+		}
+		if u.User != nil {
+			opts.Set("user", u.User.Username())
+		}
+		return &Rclone{Remote: rcloneConnection("sftp", opts) + u.Path, Env: env}, nil
+	}
+	return nil, fmt.Errorf("unknown backup target %s, supported: a directory, file://, rclone:, s3:// and sftp://", target)
+}
+
+// rcloneConnection makes an rclone connection string, :backend,key=value:,
+// of opts.
+func rcloneConnection(backend string, opts url.Values) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := ":" + backend
+	for _, k := range keys {
+		v := opts.Get(k)
+		// Values with separators in them are quoted, quotes by doubling them
+		if strings.ContainsAny(v, ",:\"'") {
+			v = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		s += "," + k + "=" + v
+	}
+	return s + ":"
+}
+
+// Dir is a Backend on a local or mounted filesystem.
+type Dir struct {
+	Path string
+}
+
+func (d *Dir) path(name string) string {
+	return filepath.Join(d.Path, name)
+}
+
+func (d *Dir) Put(name string, r io.Reader) error {
+
+	f, err := os.CreateTemp(d.Path, "."+name+".partial-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), d.path(name))
+	}
+	if err != nil {
+		return fmt.Errorf("storing %s: %w", name, err)
+	}
+	return nil
+}
+
+// PutLocked is Put, with name made read-only. A directory can't refuse
+// root, until is up to the caller.
+func (d *Dir) PutLocked(name string, r io.Reader, until time.Time) error {
+	if err := d.Put(name, r); err != nil {
+		return err
+	}
+	return os.Chmod(d.path(name), 0444)
+}
+
+func (d *Dir) Checksum(name, algo string) (string, error) {
+	h, err := LookupHasher(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := h.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func (d *Dir) Get(name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+func (d *Dir) Stat(name string) (FileInfo, error) {
+	st, err := os.Stat(d.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (d *Dir) List(prefix string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if st, err := e.Info(); err == nil {
+			files = append(files, FileInfo{Name: e.Name(), Size: st.Size(), ModTime: st.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (d *Dir) Delete(name string) error {
+	return os.Remove(d.path(name))
+}
+
+func (d *Dir) Rename(from, to string) error {
+	return os.Rename(d.path(from), d.path(to))
+}
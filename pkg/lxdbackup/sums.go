@@ -0,0 +1,357 @@
+package lxdbackup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileStat is the size, mtime, mode and owner of a file in a backup, kept
+// in the .stat file next to the checksums of a full backup.
+type FileStat struct {
+	Size  int64
+	MTime int64 // Nanoseconds since the epoch
+	Mode  int64
+	UID   int
+	GID   int
+	Meta  bool // Mode and owner are known, not in stat files of older versions
+}
+
+// MetaChanged tells whether the file with the same content had its mode,
+// owner or mtime changed since old. Stat files of older versions don't
+// have the mode and owner, only the mtime is compared then.
+func MetaChanged(old, cur FileStat) bool {
+	if old.MTime != cur.MTime {
+		return true
+	}
+	return old.Meta && (old.Mode != cur.Mode || old.UID != cur.UID || old.GID != cur.GID)
+}
+
+// EntrySum stands in for the checksum of a tar entry that isn't a regular
+// file, made of what tells it apart: the target of a link, the numbers of
+// a device, the mode and owner, and its XattrSum. A changed one makes it
+// into the delta like a changed file. ok is false for regular files, which
+// are hashed.
+func EntrySum(hdr *tar.Header) (sum string, ok bool) {
+	if sum, ok = entryKind(hdr); ok {
+		sum += XattrSum(hdr)
+	}
+	return sum, ok
+}
+
+func entryKind(hdr *tar.Header) (sum string, ok bool) {
+
+	owner := fmt.Sprintf("%o:%d:%d", hdr.Mode&07777, hdr.Uid, hdr.Gid)
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		return "", false
+	case tar.TypeDir:
+		return "dir:" + owner, true
+	case tar.TypeSymlink:
+		return "symlink:" + owner + ":" + hdr.Linkname, true
+	case tar.TypeLink:
+		return "link:" + hdr.Linkname, true
+	case tar.TypeChar:
+		return fmt.Sprintf("char:%s:%d:%d", owner, hdr.Devmajor, hdr.Devminor), true
+	case tar.TypeBlock:
+		return fmt.Sprintf("block:%s:%d:%d", owner, hdr.Devmajor, hdr.Devminor), true
+	case tar.TypeFifo:
+		return "fifo:" + owner, true
+	}
+	return "", false
+}
+
+// xattrPrefixes are the PAX records holding extended attributes and ACLs,
+// IE security.capability of ping, as written by LXD, GNU tar and bsdtar.
+var xattrPrefixes = []string{"SCHILY.xattr.", "LIBARCHIVE.xattr.", "SCHILY.acl."}
+
+// xattrMarker separates the checksum of the content from that of the
+// extended attributes in a checksum file.
+const xattrMarker = "+xattr:"
+
+// XattrSum is a marker and a checksum of the extended attributes and ACLs
+// of hdr, "" without any, so the checksums of files without them are the
+// same as before they were looked at.
+func XattrSum(hdr *tar.Header) string {
+
+	var keys []string
+	for k := range hdr.PAXRecords {
+		for _, p := range xattrPrefixes {
+			if strings.HasPrefix(k, p) {
+				keys = append(keys, k)
+				break
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(hdr.PAXRecords[k]))
+		h.Write([]byte{0})
+	}
+	return xattrMarker + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// WithXattrs is sum with the XattrSum of hdr instead of the one it has.
+func WithXattrs(sum string, hdr *tar.Header) string {
+	sum, _, _ = strings.Cut(sum, xattrMarker)
+	return sum + XattrSum(hdr)
+}
+
+// SumOptions are how TarSums hashes a tarball.
+type SumOptions struct {
+	Hasher Hasher
+	// Workers is how many files are hashed at the same time, all cores
+	// when 0.
+	Workers int
+	// Known are checksums of an earlier backup, used as they are for the
+	// files Unchanged says are unchanged, IE by their size and mtime.
+	Known     map[string]string
+	Unchanged func(hdr *tar.Header) bool
+	// Entry, if not nil, is called for every entry before it is read.
+	Entry func(hdr *tar.Header)
+}
+
+// TarSums calculates the checksums of all regular files in the tarball r
+// gives, and their FileStat. Other entries get an EntrySum instead. Both
+// end in the XattrSum of the entry.
+func TarSums(r io.Reader, o SumOptions) (map[string]string, map[string]FileStat, error) {
+
+	sums := make(map[string]string)
+	stats := make(map[string]FileStat)
+
+	tr := tar.NewReader(r)
+	pool := newHashPool(o.Hasher, o.Workers, sums)
+	defer pool.wait()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if o.Entry != nil {
+			o.Entry(hdr)
+		}
+		if sum, ok := EntrySum(hdr); ok {
+			pool.set(hdr.Name, sum)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		stats[hdr.Name] = FileStat{Size: hdr.Size, MTime: hdr.ModTime.UnixNano(), Mode: hdr.Mode & 07777,
+			UID: hdr.Uid, GID: hdr.Gid, Meta: true}
+
+		if sum, present := o.Known[hdr.Name]; present && o.Unchanged != nil && o.Unchanged(hdr) {
+			pool.set(hdr.Name, WithXattrs(sum, hdr))
+			continue
+		}
+
+		if size, err := pool.add(hdr.Name, XattrSum(hdr), tr); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		} else if size != hdr.Size {
+			return nil, nil, fmt.Errorf("%s: read %d bytes of %d", hdr.Name, size, hdr.Size)
+		}
+	}
+	pool.wait()
+	return sums, stats, nil
+}
+
+// hashBlock is the unit files are handed to the hash workers in. At most
+// workers*4 blocks are in flight, whatever the size of the files.
+const hashBlock = 1 << 20
+
+// hashPool hashes files on its workers, while they are read on another
+// goroutine. Each file goes to one worker, so files are hashed in parallel,
+// but the blocks of a file in order.
+type hashPool struct {
+	hs    Hasher
+	free  chan []byte
+	files chan *hashFile
+	wg    sync.WaitGroup
+	done  sync.Once
+	mu    sync.Mutex
+	sums  map[string]string
+}
+
+type hashFile struct {
+	name   string
+	suffix string // Appended to the checksum, IE a XattrSum
+	blocks chan []byte
+}
+
+func newHashPool(hs Hasher, workers int, sums map[string]string) *hashPool {
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p := &hashPool{
+		hs:    hs,
+		free:  make(chan []byte, workers*4),
+		files: make(chan *hashFile),
+		sums:  sums,
+	}
+	for i := 0; i < cap(p.free); i++ {
+		p.free <- make([]byte, hashBlock)
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+func (p *hashPool) worker() {
+	defer p.wg.Done()
+	for f := range p.files {
+		h := p.hs.New()
+		for b := range f.blocks {
+			h.Write(b)
+			p.free <- b[:cap(b)]
+		}
+		p.set(f.name, hex.EncodeToString(h.Sum(nil))+f.suffix)
+	}
+}
+
+func (p *hashPool) set(name, sum string) {
+	p.mu.Lock()
+	p.sums[name] = sum
+	p.mu.Unlock()
+}
+
+// add reads a file from r and queues it for hashing, suffix goes after its
+// checksum. Returns how many bytes were read.
+func (p *hashPool) add(name, suffix string, r io.Reader) (int64, error) {
+
+	f := &hashFile{name: name, suffix: suffix, blocks: make(chan []byte, cap(p.free))}
+	p.files <- f
+	defer close(f.blocks)
+
+	var read int64
+	for {
+		b := <-p.free
+		n, err := io.ReadFull(r, b)
+		read += int64(n)
+		if n > 0 {
+			f.blocks <- b[:n]
+		} else {
+			p.free <- b
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return read, nil
+		} else if err != nil {
+			return read, err
+		}
+	}
+}
+
+// wait returns when every file added is hashed. It may be called again.
+func (p *hashPool) wait() {
+	p.done.Do(func() {
+		close(p.files)
+		p.wg.Wait()
+	})
+}
+
+// WriteSums writes checksums as the CSV file next to a full backup, sorted
+// by name.
+func WriteSums(w io.Writer, sums map[string]string) error {
+
+	names := make([]string, 0, len(sums))
+	for n := range sums {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	rows := make([][]string, 0, len(sums))
+	for _, n := range names {
+		rows = append(rows, []string{n, sums[n]})
+	}
+	return csv.NewWriter(w).WriteAll(rows)
+}
+
+// ReadSums reads the checksums WriteSums wrote.
+func ReadSums(r io.Reader) (map[string]string, error) {
+
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	sums := make(map[string]string, len(rows))
+	for _, l := range rows {
+		sums[l[0]] = l[1]
+	}
+	return sums, nil
+}
+
+// WriteStats writes stats as the .stat file next to a full backup, sorted
+// by name.
+func WriteStats(w io.Writer, stats map[string]FileStat) error {
+
+	names := make([]string, 0, len(stats))
+	for n := range stats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	rows := make([][]string, 0, len(stats))
+	for _, n := range names {
+		st := stats[n]
+		rows = append(rows, []string{n, strconv.FormatInt(st.Size, 10), strconv.FormatInt(st.MTime, 10),
+			strconv.FormatInt(st.Mode, 8), strconv.Itoa(st.UID), strconv.Itoa(st.GID)})
+	}
+	return csv.NewWriter(w).WriteAll(rows)
+}
+
+// ReadStats reads the stats WriteStats wrote, and those of older versions
+// with the size and mtime only.
+func ReadStats(r io.Reader) (map[string]FileStat, error) {
+
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	rows, err := c.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[string]FileStat, len(rows))
+	for _, l := range rows {
+		if len(l) != 3 && len(l) != 6 {
+			return nil, fmt.Errorf("bad line %v", l)
+		}
+		size, err1 := strconv.ParseInt(l[1], 10, 64)
+		mtime, err2 := strconv.ParseInt(l[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("bad line %v", l)
+		}
+		st := FileStat{Size: size, MTime: mtime}
+		if len(l) == 6 {
+			mode, err1 := strconv.ParseInt(l[3], 8, 64)
+			uid, err2 := strconv.Atoi(l[4])
+			gid, err3 := strconv.Atoi(l[5])
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, fmt.Errorf("bad line %v", l)
+			}
+			st.Mode, st.UID, st.GID, st.Meta = mode, uid, gid, true
+		}
+		stats[l[0]] = st
+	}
+	return stats, nil
+}
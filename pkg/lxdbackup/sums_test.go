@@ -0,0 +1,165 @@
+package lxdbackup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEntry is an entry of a tarball made by testTar.
+type testEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func testTar(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestTarSums(t *testing.T) {
+
+	mtime := time.Date(2026, 10, 14, 2, 13, 37, 0, time.UTC)
+	big := strings.Repeat("x", hashBlock+10) // Over more than one block
+	tarball := testTar(t,
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "rootfs/etc/", Mode: 0755}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "rootfs/etc/hosts", Mode: 0644, ModTime: mtime}, data: "127.0.0.1 localhost\n"},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "rootfs/big", Mode: 0600, Uid: 1000, Gid: 1000, ModTime: mtime}, data: big},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "rootfs/link", Linkname: "etc/hosts", Mode: 0777}},
+		testEntry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "rootfs/hard", Linkname: "rootfs/big"}},
+	)
+
+	md5h, _ := LookupHasher("md5")
+	var seen []string
+	sums, stats, err := TarSums(tarball, SumOptions{Hasher: md5h, Workers: 2, Entry: func(hdr *tar.Header) { seen = append(seen, hdr.Name) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"rootfs/etc/":      "dir:755:0:0",
+		"rootfs/etc/hosts": md5Hex("127.0.0.1 localhost\n"),
+		"rootfs/big":       md5Hex(big),
+		"rootfs/link":      "symlink:777:0:0:etc/hosts",
+		"rootfs/hard":      "link:rootfs/big",
+	}
+	if !reflect.DeepEqual(sums, want) {
+		t.Errorf("sums: got %v, want %v", sums, want)
+	}
+	if len(seen) != 5 {
+		t.Errorf("Entry called for %v", seen)
+	}
+	if st := stats["rootfs/big"]; st != (FileStat{Size: int64(len(big)), MTime: mtime.UnixNano(), Mode: 0600, UID: 1000, GID: 1000, Meta: true}) {
+		t.Errorf("stat of big: %+v", st)
+	}
+	if _, ok := stats["rootfs/etc/"]; ok || len(stats) != 2 {
+		t.Errorf("stats of other than regular files: %v", stats)
+	}
+}
+
+func TestTarSumsKnown(t *testing.T) {
+
+	entries := []testEntry{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0644}, data: "new a"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "b", Mode: 0644}, data: "new b"},
+	}
+	known := map[string]string{"a": "old-a", "b": "old-b"}
+	md5h, _ := LookupHasher("md5")
+	sums, _, err := TarSums(testTar(t, entries...), SumOptions{Hasher: md5h, Known: known,
+		Unchanged: func(hdr *tar.Header) bool { return hdr.Name == "a" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"a": "old-a", "b": md5Hex("new b")}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("got %v, want %v", sums, want)
+	}
+}
+
+func TestTarSumsXattrs(t *testing.T) {
+
+	hdr := tar.Header{Typeflag: tar.TypeReg, Name: "ping", Mode: 0755, Format: tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "\x01\x00\x00\x02"}}
+	md5h, _ := LookupHasher("md5")
+	sums, _, err := TarSums(testTar(t, testEntry{hdr: hdr, data: "elf"}), SumOptions{Hasher: md5h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := XattrSum(&hdr)
+	if !strings.HasPrefix(x, xattrMarker) || sums["ping"] != md5Hex("elf")+x {
+		t.Errorf("got %s, xattrs %s", sums["ping"], x)
+	}
+
+	// A known sum gets the xattrs of the export, not those it had
+	plain := tar.Header{Name: "ping"}
+	if got := WithXattrs("abc"+x, &plain); got != "abc" {
+		t.Errorf("without xattrs: got %s", got)
+	}
+	if got := WithXattrs("abc", &hdr); got != "abc"+x {
+		t.Errorf("with xattrs: got %s", got)
+	}
+}
+
+func TestTarSumsTruncated(t *testing.T) {
+
+	tarball := testTar(t, testEntry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "a", Mode: 0644}, data: strings.Repeat("a", 4096)})
+	md5h, _ := LookupHasher("md5")
+	if _, _, err := TarSums(bytes.NewReader(tarball.Bytes()[:2048]), SumOptions{Hasher: md5h}); err == nil {
+		t.Error("no error for a truncated tarball")
+	}
+}
+
+func TestSumsFiles(t *testing.T) {
+
+	sums := map[string]string{"b": "2", "a,with comma": "1"}
+	var buf bytes.Buffer
+	if err := WriteSums(&buf, sums); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadSums(&buf); err != nil || !reflect.DeepEqual(got, sums) {
+		t.Errorf("sums: got %v %v", got, err)
+	}
+
+	stats := map[string]FileStat{"a": {Size: 1, MTime: 2, Mode: 0644, UID: 3, GID: 4, Meta: true}}
+	buf.Reset()
+	if err := WriteStats(&buf, stats); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadStats(&buf); err != nil || !reflect.DeepEqual(got, stats) {
+		t.Errorf("stats: got %v %v", got, err)
+	}
+
+	// Older versions only kept the size and mtime
+	old, err := ReadStats(strings.NewReader("a,1,2\n"))
+	if err != nil || old["a"] != (FileStat{Size: 1, MTime: 2}) {
+		t.Errorf("old stats: got %v %v", old, err)
+	}
+	if _, err := ReadStats(strings.NewReader("a,1\n")); err == nil {
+		t.Error("no error for a bad line")
+	}
+}
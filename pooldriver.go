@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// storagePool is the storage pool an instance has its root disk on.
+type storagePool struct {
+	name   string
+	driver string // IE dir, zfs, btrfs or ceph
+	config map[string]string
+}
+
+// instancePool asks LXD which storage pool the root disk of name, in
+// project or the default one, is on.
+func instancePool(name, project string) (*storagePool, error) {
+
+	query := "/1.0/instances/" + name
+	if len(project) > 0 {
+		query += "?project=" + project
+	}
+	out, err := lxcOutput("query", query)
+	if err != nil {
+		return nil, fmt.Errorf("lxc query of %s: %w", name, err)
+	}
+	var inst struct {
+		ExpandedDevices map[string]map[string]string `json:"expanded_devices"`
+	}
+	if err := json.Unmarshal(out, &inst); err != nil {
+		return nil, fmt.Errorf("bad instance %s: %w", name, err)
+	}
+	pool := inst.ExpandedDevices["root"]["pool"]
+	if len(pool) == 0 {
+		return nil, fmt.Errorf("%s has no root disk", name)
+	}
+
+	out, err = lxcOutput("query", "/1.0/storage-pools/"+pool)
+	if err != nil {
+		return nil, fmt.Errorf("lxc query of pool %s: %w", pool, err)
+	}
+	var p struct {
+		Driver string            `json:"driver"`
+		Config map[string]string `json:"config"`
+	}
+	if err := json.Unmarshal(out, &p); err != nil {
+		return nil, fmt.Errorf("bad storage pool %s: %w", pool, err)
+	}
+	return &storagePool{name: pool, driver: p.Driver, config: p.Config}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess    = 1
+	ioprioClassBE       = 2
+	ioprioClassShift    = 13
+	ioprioLowestBELevel = 7
+)
+
+// lowerPriority is -nice: lxd-backup, and the compressors it runs, get
+// niceness 10 and the lowest best effort I/O priority. Both are per thread
+// on Linux, so all threads there are changed, and new ones inherit it.
+func lowerPriority() {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		slog.Warn("Failed to lower priority", "error", err)
+		return
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 10); err != nil {
+			slog.Warn("Failed to lower CPU priority", "error", err)
+		}
+		prio := ioprioClassBE<<ioprioClassShift | ioprioLowestBELevel
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+			slog.Warn("Failed to lower I/O priority", "error", errno)
+		}
+	}
+}
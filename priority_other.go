@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "log/slog"
+
+func lowerPriority() {
+	slog.Warn("-nice only works on Linux")
+}
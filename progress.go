@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type historyEntry struct {
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+}
+
+// fleetProgress tracks progress over all containers and volumes of a run.
+// Sizes and durations of the previous run are used for the estimates.
+type fleetProgress struct {
+	mu        sync.Mutex
+	fname     string
+	names     []string
+	done      int
+	bytesDone int64
+	start     time.Time
+	history   map[string]historyEntry
+}
+
+func newFleetProgress(lxdBackupPrefix string, names []string) *fleetProgress {
+
+	p := &fleetProgress{
+		fname:   lxdBackupPrefix + "history.json",
+		names:   names,
+		start:   time.Now(),
+		history: make(map[string]historyEntry),
+	}
+
+	if d, err := os.ReadFile(p.fname); err == nil {
+		if err := json.Unmarshal(d, &p.history); err != nil {
+			slog.Warn("Ignoring broken history", "file", p.fname, "error", err)
+		}
+	}
+	return p
+}
+
+func (p *fleetProgress) begin(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	slog.Info("Backing up", "name", name, "number", p.done+1, "of", len(p.names))
+}
+
+// skip counts a container as done without touching its history.
+func (p *fleetProgress) skip(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.report()
+}
+
+func (p *fleetProgress) finish(name string, bytes int64, d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	p.bytesDone += bytes
+	p.history[name] = historyEntry{Bytes: bytes, Seconds: d.Seconds()}
+	p.report()
+}
+
+// lastBytes is how much name exported the last time, 0 when unknown.
+func (p *fleetProgress) lastBytes(name string) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.history[name].Bytes
+}
+
+func (p *fleetProgress) report() {
+
+	if !verbose {
+		return
+	}
+
+	// Containers without history are assumed to be average
+	var knownBytes int64
+	var knownSeconds float64
+	var known int
+	for _, n := range p.names {
+		if h, present := p.history[n]; present {
+			knownBytes += h.Bytes
+			knownSeconds += h.Seconds
+			known++
+		}
+	}
+	var avgBytes int64
+	var avgSeconds float64
+	if known > 0 {
+		avgBytes = knownBytes / int64(known)
+		avgSeconds = knownSeconds / float64(known)
+	}
+
+	bytesTotal := p.bytesDone
+	var remaining float64
+	for _, n := range p.names[p.done:] {
+		if h, present := p.history[n]; present {
+			bytesTotal += h.Bytes
+			remaining += h.Seconds
+		} else {
+			bytesTotal += avgBytes
+			remaining += avgSeconds
+		}
+	}
+
+	eta := nowUTC().Add(time.Duration(remaining * float64(time.Second)))
+	slog.Info("Progress", "done", p.done, "of", len(p.names), "bytes", humanBytes(p.bytesDone),
+		"estimated-bytes", humanBytes(bytesTotal), "elapsed", time.Since(p.start).Round(time.Second), "eta", displayTime(eta))
+}
+
+func (p *fleetProgress) save() {
+
+	d, err := json.MarshalIndent(p.history, "", "  ")
+	if err == nil {
+		err = os.WriteFile(p.fname, d, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to save history", "file", p.fname, "error", err)
+	}
+}
+
+func humanBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+// progressBar shows how far one long step is, IE an export or a hash pass,
+// of how much it is expected to take. On a terminal it is a bar on stderr,
+// redrawn as it goes, with speed and ETA. Otherwise it is a log line every
+// 30 seconds.
+type progressBar struct {
+	name  string // Of the container or volume, "" when for none
+	label string
+	total int64
+	n     atomic.Int64
+	poll  func() int64 // Where n comes from, when nothing is counted
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// progressTTY tells whether stderr is a terminal, for drawing bars.
+var progressTTY = func() bool {
+	st, err := os.Stderr.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}()
+
+// startProgress starts showing the progress of label, out of total bytes.
+// A total of 0 or less is unknown, and only speed is shown.
+func startProgress(name, label string, total int64) *progressBar {
+	p := &progressBar{name: name, label: label, total: total, start: time.Now(),
+		stop: make(chan struct{}), done: make(chan struct{})}
+	if dash != nil {
+		dash.progress(p)
+	}
+	go p.run()
+	return p
+}
+
+// watchFile makes the progress the size of fname, or fname.partial while
+// it is written, for a step writing it in another process.
+func (p *progressBar) watchFile(fname string) {
+	p.poll = func() int64 {
+		for _, f := range []string{fname + ".partial", fname} {
+			if st, err := os.Stat(f); err == nil {
+				return st.Size()
+			}
+		}
+		return 0
+	}
+}
+
+// reader counts what is read from r.
+func (p *progressBar) reader(r io.Reader) io.Reader {
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progressBar
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.n.Add(int64(n))
+	return n, err
+}
+
+func (p *progressBar) current() int64 {
+	if p.poll != nil {
+		return p.poll()
+	}
+	return p.n.Load()
+}
+
+func (p *progressBar) run() {
+	defer close(p.done)
+
+	tty := progressTTY && !concurrentJobs
+	if dash != nil {
+		// The dashboard draws it
+		<-p.stop
+		return
+	}
+
+	interval := 30 * time.Second
+	if tty {
+		interval = 500 * time.Millisecond
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r\033[K%s\n", p.line())
+			}
+			return
+		case <-t.C:
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r\033[K%s", p.line())
+			} else {
+				p.log()
+			}
+		}
+	}
+}
+
+// rate is bytes per second so far, and the time left at that rate, 0 when
+// unknown.
+func (p *progressBar) rate(n int64) (float64, time.Duration) {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 || n <= 0 {
+		return 0, 0
+	}
+	speed := float64(n) / elapsed
+	if p.total <= n {
+		return speed, 0
+	}
+	return speed, time.Duration(float64(p.total-n) / speed * float64(time.Second))
+}
+
+func (p *progressBar) line() string {
+
+	const width = 30
+	n := p.current()
+	speed, left := p.rate(n)
+	s := p.label + " "
+	if p.total > 0 {
+		frac := min(float64(n)/float64(p.total), 1)
+		filled := int(frac * width)
+		s += "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]" +
+			fmt.Sprintf(" %3.0f%% ", frac*100)
+	}
+	s += humanBytes(n) + fmt.Sprintf(" %s/s", humanBytes(int64(speed)))
+	if left > 0 {
+		s += " ETA " + left.Round(time.Second).String()
+	}
+	return s
+}
+
+func (p *progressBar) log() {
+	n := p.current()
+	speed, left := p.rate(n)
+	args := []any{"step", p.label, "bytes", humanBytes(n), "speed", humanBytes(int64(speed)) + "/s"}
+	if p.total > 0 {
+		args = append(args, "percent", min(100*n/p.total, 100), "eta", displayTime(nowUTC().Add(left)))
+	}
+	slog.Info("Progress", args...)
+}
+
+// finish stops showing the progress, leaving the last bar on the terminal.
+func (p *progressBar) finish() {
+	close(p.stop)
+	<-p.done
+	if dash != nil {
+		dash.progressDone(p)
+	}
+}
+
+// exportWithProgress runs the export of j to fname, showing its progress
+// against the size of the previous export, or without one, the disk usage
+// of the container.
+func exportWithProgress(j *backupJob, fname, previous string) {
+	var expected int64
+	if len(previous) > 0 {
+		expected = archiveSize(previous)
+	}
+	if expected == 0 && j.diskUsage != nil {
+		expected = j.diskUsage()
+	}
+	bar := startProgress(j.name, "Exporting "+j.name, expected)
+	bar.watchFile(fname)
+	defer bar.finish()
+	j.export(fname)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// hostConfig is a host of the hosts section of the config file, whose
+// containers are backed up from here, without lxd-backup on it.
+type hostConfig struct {
+	// SSH is where lxc is run over ssh, IE root@web1.example.com. Without
+	// it the host is the lxc remote of its name, local being this LXD.
+	SSH        string   `json:"ssh"`
+	SSHOptions []string `json:"ssh-options"`
+}
+
+// pullHosts are the hosts of the config file. When there are any, their
+// containers are backed up instead of those of this LXD, named
+// host:container like lxc names them on a remote.
+var pullHosts map[string]hostConfig
+
+// onHost is name as lxc takes it on host, as is for this LXD.
+func onHost(host, name string) string {
+	if len(host) == 0 {
+		return name
+	}
+	return host + ":" + name
+}
+
+// cutHost splits the argument a into the pulled host in front of it and
+// the rest, ok is false if it names none.
+func cutHost(a string) (host, rest string, ok bool) {
+	host, rest, found := strings.Cut(a, ":")
+	if !found {
+		return "", a, false
+	}
+	_, ok = pullHosts[host]
+	return host, rest, ok
+}
+
+// commandHost is the pulled host the lxc command what, IE lxc export
+// web1:c1, is run on, "" for this LXD.
+func commandHost(what string) string {
+	for _, a := range strings.Fields(what) {
+		if h, _, ok := cutHost(a); ok {
+			return h
+		}
+		if _, after, found := strings.Cut(a, "/instances/"); found {
+			if h, _, ok := cutHost(after); ok {
+				return h
+			}
+		}
+	}
+	return ""
+}
+
+// pullCommand is the command running lxc with args where they say, on a
+// pulled host over ssh or through its lxc remote, or here. The host is
+// taken from the first argument naming one, IE web1:c1, or a query path
+// of one of its instances.
+func pullCommand(args []string) (string, []string) {
+
+	host := commandHost(strings.Join(args, " "))
+	if len(host) == 0 {
+		return "lxc", args
+	}
+	h := pullHosts[host]
+
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		if _, rest, ok := cutHost(a); ok {
+			if len(h.SSH) > 0 {
+				a = rest
+			}
+		} else if before, after, found := strings.Cut(a, "/instances/"); found {
+			if _, rest, ok := cutHost(after); ok {
+				a = before + "/instances/" + rest
+				// lxc wants the remote in front of the path
+				if len(h.SSH) == 0 {
+					a = host + ":" + a
+				}
+			}
+		}
+		if len(a) > 0 {
+			out = append(out, a)
+		}
+	}
+	if len(h.SSH) == 0 {
+		return "lxc", out
+	}
+
+	// ssh runs it with the shell of the host
+	quoted := make([]string, 0, len(out)+1)
+	quoted = append(quoted, "lxc")
+	for _, a := range out {
+		quoted = append(quoted, shellQuote(a))
+	}
+	sshArgs := append([]string{"-o", "BatchMode=yes"}, h.SSHOptions...)
+	return "ssh", append(sshArgs, h.SSH, "--", strings.Join(quoted, " "))
+}
+
+// overSSH tells whether the lxc command args runs on a host over ssh,
+// where what it writes to files stays.
+func overSSH(args []string) bool {
+	return len(pullHosts[commandHost(strings.Join(args, " "))].SSH) > 0
+}
+
+// pullList lists the containers of all pulled hosts, named host:container,
+// on their host, or host/member in a cluster.
+func pullList() []*containerState {
+
+	hosts := make([]string, 0, len(pullHosts))
+	for h := range pullHosts {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	var containers []*containerState
+	for _, h := range hosts {
+		cli := &lxdbackup.CLI{Command: func(args ...string) (*exec.Cmd, context.CancelFunc) {
+			// Names the host for pullCommand, lxc list takes it too
+			if len(args) > 0 && args[0] == "list" {
+				args = append([]string{"list", h + ":"}, args[1:]...)
+			}
+			return lxcCommand(args...)
+		}}
+		for _, c := range listInstances(cli, h) {
+			c.name = onHost(h, c.name)
+			if len(c.host) > 0 {
+				c.host = h + "/" + c.host
+			} else {
+				c.host = h
+			}
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// validateHosts checks the hosts section of the config file.
+func validateHosts(hosts map[string]hostConfig) {
+	for name := range hosts {
+		if len(name) == 0 || strings.ContainsAny(name, ":/ ") {
+			fatalf("Bad host name %q in the config file.\n", name)
+		}
+	}
+}
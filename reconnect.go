@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// How long to wait for LXD to come back, IE after a snap refresh restarted it
+var lxdReconnectTimeout = 10 * time.Minute
+
+// lxcTimeout is -lxc-timeout, how long an lxc command may take before it is
+// killed, and lxcExportTimeout is -export-timeout, the same for exports and
+// imports, which take as long as the container is big. 0 means forever.
+var lxcTimeout = 10 * time.Minute
+var lxcExportTimeout time.Duration
+
+// lxcRetries is -lxc-retries, how many times stopping, starting and
+// exporting are tried again when they fail with LXD still there, waiting
+// lxcRetryDelay, doubled each time, in between.
+var lxcRetries = 2
+var lxcRetryDelay = 5 * time.Second
+
+// lxcTimeoutFor is the timeout of the lxc command args.
+func lxcTimeoutFor(args []string) time.Duration {
+	switch {
+	case len(args) > 0 && (args[0] == "export" || args[0] == "import" || args[0] == "copy"):
+		return lxcExportTimeout
+	case len(args) > 1 && args[0] == "image" && (args[1] == "export" || args[1] == "import"):
+		return lxcExportTimeout
+	case len(args) > 2 && args[0] == "storage" && args[1] == "volume" && (args[2] == "export" || args[2] == "import"):
+		return lxcExportTimeout
+	case len(args) > 0 && args[0] == "snapshot" && args[len(args)-1] == "--stateful":
+		// Dumps all the memory of the container
+		return lxcExportTimeout
+	}
+	return lxcTimeout
+}
+
+// timeoutContext is done after d, or never when d is 0, or once cancelled.
+func timeoutContext(d time.Duration) (context.Context, context.CancelFunc) {
+	if d == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), d)
+}
+
+func lxdReachable(host string) bool {
+	return lxcRun("query", onHost(host, "/1.0")) == nil
+}
+
+// waitForLxd polls LXD, of host if a pulled one, with exponential backoff
+// until it answers again.
+func waitForLxd(host string) bool {
+
+	deadline := time.Now().Add(lxdReconnectTimeout)
+	delay := 2 * time.Second
+
+	for time.Now().Before(deadline) {
+		time.Sleep(delay)
+		if lxdReachable(host) {
+			slog.Info("LXD is back")
+			return true
+		}
+		if delay *= 2; delay > time.Minute {
+			delay = time.Minute
+		}
+	}
+	return false
+}
+
+// retryLxc runs op, and if it fails because LXD went away, waits for LXD to
+// come back and tries again. Other failures, IE a timeout, are tried again
+// up to retries times, with exponential backoff. done is asked first before
+// trying again, in case the operation went through anyway.
+func retryLxc(what string, retries int, op func() error, done func() bool) error {
+
+	delay := lxcRetryDelay
+	host := commandHost(what)
+	for {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		if lxdReachable(host) {
+			if retries == 0 {
+				return err
+			}
+			retries--
+			slog.Warn("LXD command failed, trying again", "command", what, "error", err, "in", delay)
+			time.Sleep(delay)
+			delay *= 2
+		} else {
+			slog.Warn("Lost connection to LXD, waiting for it to come back", "during", what)
+			if !waitForLxd(host) {
+				return fmt.Errorf("%v, and LXD didn't come back within %s", err, lxdReconnectTimeout)
+			}
+		}
+		if done != nil && done() {
+			return nil
+		}
+	}
+}
+
+// lxcInstanceStatus returns IE Running or Stopped, or an empty string if unknown.
+func lxcInstanceStatus(name string) string {
+	s, err := lxd.State(name)
+	if err != nil {
+		return ""
+	}
+	return s.Status
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Content defined chunking: a chunk ends where the gear hash of the last
+// bytes has chunkBits zero bits, so an insert or change only moves the chunk
+// boundaries next to it. Average chunk size is 1 MiB.
+const (
+	chunkMin  = 256 << 10
+	chunkMax  = 8 << 20
+	chunkBits = 20
+)
+
+var gearTable = func() (t [256]uint64) {
+	// splitmix64, the table must never change or nothing deduplicates
+	x := uint64(0x6c78642d6261636b)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// nextChunk reads the next chunk of at most limit bytes from br.
+func nextChunk(br *bufio.Reader, limit int64, buf []byte) ([]byte, error) {
+
+	const mask = uint64(1)<<chunkBits - 1
+
+	buf = buf[:0]
+	var h uint64
+	for int64(len(buf)) < limit && len(buf) < chunkMax {
+		b, err := br.ReadByte()
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, b)
+		h = h<<1 + gearTable[b]
+		if len(buf) >= chunkMin && h&(mask<<(64-chunkBits)) == 0 {
+			break
+		}
+	}
+	return buf, nil
+}
+
+// repoEntry is a member of an export, its tar header and the chunks of its
+// content.
+type repoEntry struct {
+	Header *tar.Header `json:"header"`
+	Chunks []string    `json:"chunks,omitempty"`
+}
+
+// repoSnapshot is one export stored in the repository.
+type repoSnapshot struct {
+	Name     string      `json:"name"`
+	RunID    string      `json:"run-id"`
+	Time     string      `json:"time"`
+	Manifest *manifest   `json:"manifest,omitempty"`
+	Entries  []repoEntry `json:"entries"`
+}
+
+// repo is a content addressed store of chunks, deduplicated across runs and
+// containers, in lxd-backup-repo of the backup directory:
+//
+//	chunks/ab/abcdef...          zstd compressed chunk, named by its sha256
+//	snapshots/name/run.json.zst  what an export was made of
+type repo struct {
+	dir string
+}
+
+func openRepo(backupTarget string) *repo {
+	r := &repo{dir: filepath.Join(backupTarget, "lxd-backup-repo")}
+	for _, d := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(r.dir, d), 0755); err != nil {
+			fatalf("Failed to create repository %s. Error: %v\n", r.dir, err)
+		}
+	}
+	return r
+}
+
+func (r *repo) chunkName(id string) string {
+	return filepath.Join(r.dir, "chunks", id[:2], id)
+}
+
+// writeFileAtomic writes through a temporary file, so a crash never leaves
+// a half written file under the final name.
+func writeFileAtomic(fname string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fname), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	zw, err := newZstdWriter(f)
+	if err == nil {
+		err = write(zw)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
+
+// putChunk stores a chunk unless it is there already. Returns its id and
+// whether it was new.
+func (r *repo) putChunk(data []byte) (string, bool) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	fname := r.chunkName(id)
+	if fileExists(fname) {
+		return id, false
+	}
+	err := writeFileAtomic(fname, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		fatalf("Failed to store chunk %s. Error: %v\n", fname, err)
+	}
+	return id, true
+}
+
+// store chunks an export into the repository and records it as a snapshot.
+// Returns how many chunks and bytes were new.
+func (r *repo) store(export string, snap *repoSnapshot) (int, int64) {
+
+	slog.Info("Storing in repository", "name", snap.Name, "repo", r.dir)
+
+	in := openArchive(export)
+	defer in.Close()
+
+	tarreader := tar.NewReader(in)
+	br := bufio.NewReaderSize(tarreader, 1<<20)
+	buf := make([]byte, 0, chunkMax)
+
+	var newChunks int
+	var newBytes int64
+
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", export, err)
+		}
+		br.Reset(tarreader)
+
+		e := repoEntry{Header: hdr}
+		for left := hdr.Size; left > 0; {
+			chunk, err := nextChunk(br, left, buf)
+			if err != nil && !(errors.Is(err, io.EOF) && int64(len(chunk)) == left) {
+				fatalf("Failed to read %s inside %s. Error: %v\n", hdr.Name, export, err)
+			}
+			left -= int64(len(chunk))
+			id, isNew := r.putChunk(chunk)
+			if isNew {
+				newChunks++
+				newBytes += int64(len(chunk))
+			}
+			e.Chunks = append(e.Chunks, id)
+		}
+		snap.Entries = append(snap.Entries, e)
+	}
+
+	fname := filepath.Join(r.dir, "snapshots", snap.Name, snap.RunID+".json.zst")
+	err := writeFileAtomic(fname, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snap)
+	})
+	if err != nil {
+		fatalf("Failed to write snapshot %s. Error: %v\n", fname, err)
+	}
+
+	slog.Info("Stored in repository", "name", snap.Name, "chunks", newChunks, "new", humanBytes(newBytes))
+	return newChunks, newBytes
+}
+
+// snapshots returns the run ids of the snapshots of name, oldest first.
+func (r *repo) snapshots(name string) []string {
+	files, _ := filepath.Glob(filepath.Join(r.dir, "snapshots", name, "*.json.zst"))
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(f), ".json.zst"))
+	}
+	sort.Strings(ids) // Run ids are timestamps
+	return ids
+}
+
+func (r *repo) loadSnapshot(name, runID string) *repoSnapshot {
+	fname := filepath.Join(r.dir, "snapshots", name, runID+".json.zst")
+	in := openArchive(fname)
+	defer in.Close()
+	var snap repoSnapshot
+	if err := json.NewDecoder(in).Decode(&snap); err != nil {
+		fatalf("Failed to decode snapshot %s. Error: %v\n", fname, err)
+	}
+	return &snap
+}
+
+// rebuild writes a snapshot back as the tarball lxc export made.
+func (r *repo) rebuild(snap *repoSnapshot, dest string) {
+
+	slog.Info("Rebuilding from repository", "name", snap.Name, "run", snap.RunID)
+
+	fout, err := os.OpenFile(dest, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dest, err)
+	}
+	defer fout.Close()
+
+	out, err := newZstdWriter(fout)
+	if err != nil {
+		fatalf("Failed write %s as zstd compressed file. Error: %v\n", dest, err)
+	}
+	defer out.Close()
+
+	tarwriter := tar.NewWriter(out)
+	defer tarwriter.Close()
+
+	for _, e := range snap.Entries {
+		if err := tarwriter.WriteHeader(e.Header); err != nil {
+			fatalf("Failed to write tar header for %s. Error: %v\n", e.Header.Name, err)
+		}
+		for _, id := range e.Chunks {
+			in := openArchive(r.chunkName(id))
+			_, err := io.Copy(tarwriter, in)
+			in.Close()
+			if err != nil {
+				fatalf("Failed to copy chunk %s of %s. Error: %v\n", id, e.Header.Name, err)
+			}
+		}
+	}
+}
+
+// prunable returns the run ids of the snapshots of name past the keep
+// newest ones.
+func (r *repo) prunable(name string, keep int) []string {
+	ids := r.snapshots(name)
+	if len(ids) <= keep {
+		return nil
+	}
+	return ids[:len(ids)-keep]
+}
+
+func (r *repo) removeSnapshot(name, runID string) {
+	if err := os.Remove(filepath.Join(r.dir, "snapshots", name, runID+".json.zst")); err != nil {
+		slog.Warn("Failed to remove snapshot", "name", name, "run", runID, "error", err)
+	}
+}
+
+// prune keeps the keep newest snapshots of name.
+func (r *repo) prune(name string, keep int) {
+	for _, id := range r.prunable(name, keep) {
+		r.removeSnapshot(name, id)
+	}
+}
+
+// names returns the containers and volumes with snapshots.
+func (r *repo) names() []string {
+	var names []string
+	dirs, _ := os.ReadDir(filepath.Join(r.dir, "snapshots"))
+	for _, d := range dirs {
+		if d.IsDir() {
+			names = append(names, d.Name())
+		}
+	}
+	return names
+}
+
+// unreferenced returns the chunks no snapshot refers to, ignoring the
+// snapshots in drop, and their size on disk.
+func (r *repo) unreferenced(drop map[string]map[string]bool) ([]string, int64) {
+
+	used := make(map[string]bool)
+	for _, n := range r.names() {
+		for _, id := range r.snapshots(n) {
+			if drop[n][id] {
+				continue
+			}
+			for _, e := range r.loadSnapshot(n, id).Entries {
+				for _, c := range e.Chunks {
+					used[c] = true
+				}
+			}
+		}
+	}
+
+	var unused []string
+	var size int64
+	chunks, _ := filepath.Glob(filepath.Join(r.dir, "chunks", "*", "*"))
+	for _, c := range chunks {
+		if !used[filepath.Base(c)] && !strings.HasPrefix(filepath.Base(c), ".tmp-") {
+			unused = append(unused, c)
+			if st, err := os.Stat(c); err == nil {
+				size += st.Size()
+			}
+		}
+	}
+	return unused, size
+}
+
+// gc removes the chunks no snapshot refers to anymore.
+func (r *repo) gc() {
+	unused, size := r.unreferenced(nil)
+	for _, c := range unused {
+		os.Remove(c)
+	}
+	slog.Info("Repository cleaned", "removed", len(unused), "freed", humanBytes(size))
+}
+
+// backupToRepo is backup for the repository mode, every run stores the
+// whole export and deduplication takes care of the space.
+func backupToRepo(j *backupJob, s *schedule) {
+
+	defer j.stage("")
+
+	j.stage("stop")
+	j.before()
+	defer j.after()
+
+	exportName := tempExportName(s.tempDir, j.name)
+	exportIntent := intents.begin("write", j.name, exportName, "")
+	defer intents.done(exportIntent)
+
+	j.stage("export")
+	exportWithProgress(j, exportName, "")
+
+	j.stage("start")
+	j.after()
+
+	if st, err := os.Stat(exportName); err == nil {
+		j.exported = st.Size()
+	}
+	filterExport(j, exportName)
+
+	j.stage("store")
+	j.manifest.RunID = s.runID
+	newChunks, _ := s.repo.store(exportName, &repoSnapshot{
+		Name:     j.name,
+		RunID:    s.runID,
+		Time:     timestamp(s.now),
+		Manifest: j.manifest,
+	})
+	os.Remove(exportName)
+
+	if s.repoKeep > 0 {
+		s.repo.prune(j.name, s.repoKeep)
+	}
+
+	j.status = "stored"
+	appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+		Changed: newChunks, Bytes: j.exported})
+}
+
+// rebuildSnapshot writes the snapshot runID of name, or the newest one, to a
+// temporary tarball in tempDir, and returns it with its manifest.
+func rebuildSnapshot(backupTarget, tempDir, name, runID string) (string, *manifest) {
+
+	r := &repo{dir: filepath.Join(backupTarget, "lxd-backup-repo")}
+	if len(runID) == 0 {
+		ids := r.snapshots(name)
+		if len(ids) == 0 {
+			fatalf("No snapshot of %s found in %s.\n", name, r.dir)
+		}
+		runID = ids[len(ids)-1]
+	}
+	snap := r.loadSnapshot(name, runID)
+
+	fname := filepath.Join(tempDir, "lxd-temporary-rebuild-"+fileTimestamp(nowUTC())+".tar.zst")
+	r.rebuild(snap, fname)
+	return fname, snap.Manifest
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type stageTiming struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type jobResult struct {
+	Name    string        `json:"name"`
+	Status  string        `json:"status"`
+	Bytes   int64         `json:"bytes"`
+	Seconds float64       `json:"seconds"`
+	Ratio   float64       `json:"ratio,omitempty"`
+	Changed int           `json:"changed,omitempty"` // Files changed or added, all for a full backup
+	Removed int           `json:"removed,omitempty"`
+	Files   []string      `json:"files,omitempty"` // What the backup was written to
+	Error   string        `json:"error,omitempty"`
+	Stages  []stageTiming `json:"stages,omitempty"`
+
+	start time.Time
+}
+
+// runReport is the outcome of a whole run, what notifications are made from.
+type runReport struct {
+	Host     string        `json:"host"`
+	Start    string        `json:"start"`
+	End      string        `json:"end"`
+	Results  []*jobResult  `json:"results"`
+	Error    string        `json:"error,omitempty"`
+	Warnings []string      `json:"warnings,omitempty"`
+	Copies   []*copyResult `json:"copies,omitempty"`
+
+	mu      sync.Mutex
+	running []*jobResult // Being backed up
+	html    []byte       // The HTML report, when one is made
+}
+
+func newRunReport() *runReport {
+	host, _ := os.Hostname()
+	return &runReport{Host: host, Start: timestamp(nowUTC())}
+}
+
+// begin records that name is being backed up. The result is filled in by
+// the caller, and finished with end.
+func (r *runReport) begin(name string) *jobResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := &jobResult{Name: name, Status: "running", start: time.Now()}
+	r.Results = append(r.Results, res)
+	r.running = append(r.running, res)
+	dash.begin(name)
+	return res
+}
+
+func (r *runReport) end(res *jobResult, status string, bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endLocked(res, status, bytes)
+}
+
+func (r *runReport) endLocked(res *jobResult, status string, bytes int64) {
+	i := slices.Index(r.running, res)
+	if i < 0 {
+		return
+	}
+	r.running = slices.Delete(r.running, i, i+1)
+	res.Status = status
+	res.Bytes = bytes
+	res.Seconds = time.Since(res.start).Seconds()
+	dash.end(res.Name, status, bytes)
+}
+
+// runningJobs are the names being backed up.
+func (r *runReport) runningJobs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var names []string
+	for _, res := range r.running {
+		names = append(names, res.Name)
+	}
+	return names
+}
+
+// fail records why the run gave up, on the jobs being backed up if any.
+func (r *runReport) fail(msg string) {
+	msg = strings.TrimSpace(msg)
+	r.mu.Lock()
+	if len(r.running) > 0 {
+		for _, res := range slices.Clone(r.running) {
+			res.Error = msg
+			r.endLocked(res, "failed", res.Bytes)
+		}
+	} else {
+		r.Error = msg
+	}
+	r.mu.Unlock()
+	r.finish()
+}
+
+// warn records a problem that didn't fail the run, but needs attention.
+func (r *runReport) warn(msg string) {
+	slog.Warn(msg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, msg)
+}
+
+func (r *runReport) finish() {
+	r.End = timestamp(nowUTC())
+}
+
+// save keeps the report of the last run, for lxd-backup report.
+func (r *runReport) save(lxdBackupPrefix string) {
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = os.WriteFile(lxdBackupPrefix+"lastrun.json", d, 0644)
+	}
+	if err != nil {
+		slog.Warn("Failed to save run report", "error", err)
+	}
+}
+
+// writeJSON writes the report to fname, - for stdout, for -report-json.
+func (r *runReport) writeJSON(fname string) {
+	d, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		slog.Warn("Failed to encode run report", "error", err)
+		return
+	}
+	d = append(d, '\n')
+	if fname == "-" {
+		os.Stdout.Write(d)
+		return
+	}
+	if err := os.WriteFile(fname, d, 0644); err != nil {
+		slog.Warn("Failed to write run report", "file", fname, "error", err)
+	}
+}
+
+func loadRunReport(lxdBackupPrefix string) *runReport {
+	d, err := os.ReadFile(lxdBackupPrefix + "lastrun.json")
+	if err != nil {
+		fatalf("Failed to read report of the last run. Error: %v\n", err)
+	}
+	var r runReport
+	if err := json.Unmarshal(d, &r); err != nil {
+		fatalf("Failed to decode report of the last run. Error: %v\n", err)
+	}
+	return &r
+}
+
+func (r *runReport) failed() bool {
+	if len(r.Error) > 0 {
+		return true
+	}
+	for _, res := range r.Results {
+		if res.Status == "failed" {
+			return true
+		}
+	}
+	for _, c := range r.Copies {
+		if c.Status == "failed" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *runReport) summary() (subject, body string) {
+
+	var ok, failed int
+	var bytes int64
+	var b strings.Builder
+
+	for _, res := range r.Results {
+		switch res.Status {
+		case "failed":
+			failed++
+		case "skipped":
+		default:
+			ok++
+		}
+		bytes += res.Bytes
+		fmt.Fprintf(&b, "%-30s %-12s %10s %6.0fs", res.Name, res.Status, humanBytes(res.Bytes), res.Seconds)
+		if res.Ratio > 0 {
+			fmt.Fprintf(&b, " %5.1fx", res.Ratio)
+		}
+		if len(res.Error) > 0 {
+			fmt.Fprintf(&b, "  %s", res.Error)
+		}
+		b.WriteString("\n")
+	}
+	if len(r.Copies) > 0 {
+		b.WriteString("\n")
+	}
+	for _, c := range r.Copies {
+		fmt.Fprintf(&b, "Copy to %s: %s, %d files, %s", c.Target, c.Status, c.Files, humanBytes(c.Bytes))
+		if c.Deleted > 0 {
+			fmt.Fprintf(&b, ", %d deleted", c.Deleted)
+		}
+		if c.Failed > 0 {
+			fmt.Fprintf(&b, ", %d failed", c.Failed)
+		}
+		b.WriteString("\n")
+	}
+	if len(r.Error) > 0 {
+		fmt.Fprintf(&b, "\nError: %s\n", r.Error)
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "\nWarning: %s\n", w)
+	}
+
+	state := "OK"
+	if len(r.Warnings) > 0 {
+		state = "WARNING"
+	}
+	if r.failed() {
+		state = "FAILED"
+	}
+	subject = fmt.Sprintf("lxd-backup on %s %s: %d backed up, %d failed, %s", r.Host, state, ok, failed, humanBytes(bytes))
+	body = fmt.Sprintf("Run started %s, ended %s.\n\n%s", r.Start, r.End, b.String())
+	return subject, body
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// reproducible is -reproducible. Archives are written with their entries
+// sorted by name, without access and change times, and with one zstd
+// thread, so the same content gives the same bytes.
+var reproducible bool
+
+// spooledEntry is an entry read by eachEntry, its content is at off in the
+// spool file.
+type spooledEntry struct {
+	hdr *tar.Header
+	off int64
+}
+
+// normalizeHeader drops what differs between exports of the same content:
+// access and change times, and the mtime of what isn't in the rootfs, IE
+// the backup.yaml written by the export. Owners and mtimes of files are
+// kept, they are restored.
+func normalizeHeader(hdr *tar.Header) {
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	delete(hdr.PAXRecords, "atime")
+	delete(hdr.PAXRecords, "ctime")
+	if _, ok := rootfsPath(hdr.Name); !ok {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+}
+
+// eachEntry calls fn for each entry of tr. With -reproducible the content
+// is first spooled to a file in dir, and fn gets the entries sorted by
+// name, hard links last so their targets are there before them.
+func eachEntry(tr *tar.Reader, dir string, fn func(hdr *tar.Header, r io.Reader) error) error {
+
+	if !reproducible {
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := fn(hdr, tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := os.CreateTemp(dir, "lxd-temporary-sorted-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	os.Remove(f.Name()) // Gone on close, whatever happens
+
+	var entries []spooledEntry
+	var off int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, tr)
+		if err != nil {
+			return err
+		}
+		normalizeHeader(hdr)
+		entries = append(entries, spooledEntry{hdr: hdr, off: off})
+		off += n
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		li, lj := entries[i].hdr.Typeflag == tar.TypeLink, entries[j].hdr.Typeflag == tar.TypeLink
+		if li != lj {
+			return lj
+		}
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+
+	for _, e := range entries {
+		if err := fn(e.hdr, io.NewSectionReader(f, e.off, e.hdr.Size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
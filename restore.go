@@ -0,0 +1,544 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// latestQuarter returns the newest quarter backup, or full backup of another
+// retention tier, of a container, or an empty string.
+func latestQuarter(lxdBackupPrefix, name string, rc *retentionConfig) string {
+
+	q := tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full)
+	if len(q) == 0 {
+		return ""
+	}
+	return q[0]
+}
+
+// generationQuarter returns the full backup the generation delta of name
+// was made against, the newest one not made after it, as the slot may have
+// moved on to a newer full since.
+func generationQuarter(lxdBackupPrefix, name, delta string, rc *retentionConfig) string {
+
+	st, err := os.Stat(delta)
+	if err != nil {
+		return ""
+	}
+	for _, q := range tierFiles(lxdBackupPrefix, name, ".tar", &rc.Full) {
+		if qst, err := os.Stat(q); err == nil && !qst.ModTime().After(st.ModTime()) {
+			return q
+		}
+	}
+	return ""
+}
+
+func loadRemoved(fname string) map[string]bool {
+
+	f, err := os.Open(fname)
+	if err != nil {
+		fatalf("Failed to open list of removed files %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+
+	removed, err := lxdbackup.ReadRemoved(f)
+	if err != nil {
+		fatalf("Failed to read list of removed files %s. Error: %v\n", fname, err)
+	}
+	return removed
+}
+
+// copyTarEntries copies src into tarwriter, leaving out skip and giving
+// the entries in metas their metadata.
+func copyTarEntries(src string, tarwriter *tarArchive, skip map[string]bool, metas map[string]*tar.Header) {
+
+	in := openArchive(src)
+	defer in.Close()
+
+	err := lxdbackup.CopyEntries(tarwriter, in, lxdbackup.CopyOptions{Skip: skip, Metas: metas,
+		WriteEntry: func(hdr *tar.Header, r io.Reader) error { return writeEntry(tarwriter, hdr, r) }})
+	if err != nil {
+		fatalf("Failed to copy %s. Error: %v\n", src, err)
+	}
+}
+
+func tarEntryNames(src string) map[string]bool {
+
+	in := openArchive(src)
+	defer in.Close()
+
+	names := make(map[string]bool)
+	tarreader := tar.NewReader(in)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", src, err)
+		}
+		names[hdr.Name] = true
+	}
+	return names
+}
+
+// archiveReading reads the archive fname for lxdbackup.Merge.
+func archiveReading(fname string) func(fn func(r io.Reader) error) error {
+	return func(fn func(r io.Reader) error) error {
+		in := openArchive(fname)
+		defer in.Close()
+		return fn(in)
+	}
+}
+
+// mergeBackup combines a quarter backup with a delta into a tarball that lxc import accepts.
+func mergeBackup(quarter, delta, dest string, rewrite map[string]func([]byte) []byte) {
+
+	slog.Info("Merging", "quarter", quarter, "delta", delta)
+
+	tarwriter := createArchive(dest, 0600)
+	defer tarwriter.Close()
+
+	m := &lxdbackup.Merge{Full: archiveReading(quarter), Rewrite: rewrite, TempDir: filepath.Dir(dest),
+		WriteEntry: func(hdr *tar.Header, r io.Reader) error { return writeEntry(tarwriter, hdr, r) }}
+	if len(delta) > 0 {
+		m.Delta = archiveReading(delta)
+		m.Removed = loadRemoved(delta + ".removed")
+	}
+	if qm := readManifest(quarter); qm != nil && len(qm.BaseImage) > 0 {
+		m.Base = func(_ lxdbackup.TarWriter, skip map[string]bool, metas map[string]*tar.Header) error {
+			copyImageEntries(quarter, qm.BaseImage, tarwriter, skip, metas)
+			return nil
+		}
+	}
+	if err := m.Write(tarwriter); err != nil {
+		fatalf("Failed to merge %s and %s. Error: %v\n", quarter, delta, err)
+	}
+}
+
+// projectArgs appends --project to lxc arguments when restoring into another project.
+func projectArgs(project string, args ...string) []string {
+	if len(project) > 0 {
+		args = append(args, "--project", project)
+	}
+	return args
+}
+
+// remoteName is an instance or profile on remote, or on the default remote
+// without one.
+func remoteName(remote, name string) string {
+	if len(remote) == 0 {
+		return name
+	}
+	return remote + ":" + name
+}
+
+func lxcImport(fname, name, project, remote string) {
+	slog.Info("Importing", "file", fname, "container", name, "remote", remote)
+
+	args := []string{"import"}
+	if len(remote) > 0 {
+		args = append(args, remote+":")
+	}
+	args = projectArgs(project, append(args, fname, name)...)
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+}
+
+// isolateNetwork masks all network devices of a restored instance, so that
+// it can be started next to the original without address conflicts.
+func isolateNetwork(m *manifest, name, project string) {
+	for _, dev := range m.nicDevices() {
+		slog.Info("Disconnecting network device", "container", name, "device", dev)
+		// Only works for devices of the instance itself, not from profiles
+		lxcRun(projectArgs(project, "config", "device", "remove", name, dev)...)
+
+		cmd, cancel := lxcCommand(projectArgs(project, "config", "device", "add", name, dev, "none")...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			fatalf("Failed to disconnect %s from %s. Error: %v\n", dev, name, err)
+		}
+	}
+}
+
+// profileBody is the YAML of lxc profile show without what is about the
+// instances using the profile, to compare the profile itself by.
+func profileBody(data string) string {
+	var lines []string
+	usedBy := false
+	for _, l := range strings.Split(strings.TrimRight(data, "\n"), "\n") {
+		if strings.HasPrefix(l, "used_by:") {
+			usedBy = true
+			continue
+		}
+		if usedBy && (strings.HasPrefix(l, "- ") || strings.HasPrefix(l, " ")) {
+			continue
+		}
+		usedBy = false
+		lines = append(lines, l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkProfiles warns about profiles listed in the manifest that are missing
+// on the server, or differ from the ones backed up. With create, missing
+// ones are made from the backed up YAML, those that differ are left as they
+// are.
+func checkProfiles(m *manifest, project, remote string, create bool) {
+	for _, p := range m.Profiles {
+		ref := remoteName(remote, p.Name)
+		current, err := lxcOutput(projectArgs(project, "profile", "show", ref)...)
+		switch {
+		case err == nil && profileBody(string(current)) != profileBody(p.Data):
+			slog.Warn("Profile differs from the one backed up", "profile", p.Name, "container", m.Container)
+		case err == nil:
+		case !create:
+			slog.Warn("Profile is missing on this server, -create-profiles makes it", "profile", p.Name, "container", m.Container)
+		case len(p.Data) == 0:
+			slog.Warn("Profile is missing on this server, and the backup has no copy of it", "profile", p.Name, "container", m.Container)
+		default:
+			slog.Info("Creating profile", "profile", p.Name, "container", m.Container)
+			createProfile(ref, project, p.Data)
+		}
+	}
+}
+
+// createProfile creates the profile ref as data, the YAML of lxc profile
+// show.
+func createProfile(ref, project, data string) {
+	args := projectArgs(project, "profile", "create", ref)
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+	args = projectArgs(project, "profile", "edit", ref)
+	cmd, cancel = lxcCommand(args...)
+	defer cancel()
+	cmd.Stdin = strings.NewReader(data)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+}
+
+// assignProfiles gives the restored instance ref the profiles of the
+// manifest, in order, of those the server has.
+func assignProfiles(m *manifest, ref, project, remote string) {
+	var names []string
+	for _, p := range m.Profiles {
+		if lxcRun(projectArgs(project, "profile", "show", remoteName(remote, p.Name))...) == nil {
+			names = append(names, p.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	args := projectArgs(project, "profile", "assign", ref, strings.Join(names, ","))
+	cmd, cancel := lxcCommand(args...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+}
+
+// parseAnywhere is fs.Parse, but also takes flags after the arguments, IE
+// restore web1 -as web1-test. Returns the arguments.
+func parseAnywhere(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return pos
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func restoreMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, displayTimezone string
+	var configFile, snapshot string
+	var serverConfig, useRepo bool
+	var volume string
+	var image string
+	var project, suffix string
+	var isolate bool
+	var requireSig string
+	var as, remote string
+	var baseImage string
+	var backend string
+	var noSnapshots, resume bool
+	var createProfiles bool
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	lxdOpts := addLxdFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&tempDir, "t", "", "Temporary directory.")
+	fs.StringVar(&deltaName, "d", "", "Delta to apply on top of the quarter backup, IE M10, WN2 or WD3.")
+	fs.BoolVar(&serverConfig, "server-config", false, "Restore the newest server configuration backup instead of a container.")
+	fs.StringVar(&volume, "volume", "", "Restore the custom storage volume pool/volume instead of a container.")
+	fs.StringVar(&image, "image", "", "Restore the image with this fingerprint instead of a container.")
+	fs.StringVar(&project, "project", "", "Restore into this project.")
+	fs.StringVar(&suffix, "suffix", "", "Append this to the name of the restored container, IE -test.")
+	fs.StringVar(&as, "as", "", "Restore the container under this name.")
+	fs.StringVar(&remote, "remote", "", "Restore onto this lxc remote instead of the default one.")
+	fs.BoolVar(&isolate, "isolate-network", false, "Disconnect all network devices of the restored container.")
+	fs.StringVar(&displayTimezone, "display-timezone", "", "Timezone for human readable output.")
+	fs.BoolVar(&useRepo, "repo", false, "Restore from the repository instead of quarters and deltas.")
+	fs.StringVar(&backend, "backend", "", "Restore from this backup program, as the backups were made with -backend.")
+	fs.StringVar(&snapshot, "snapshot", "", "Run id of the repository snapshot, or id of the -backend snapshot, to restore. Default is the newest.")
+	fs.StringVar(&requireSig, "require-signature", "", "Only restore backups whose manifests are signed by the private key of this ed25519 public key in PEM.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups were made with.")
+	fs.StringVar(&baseImage, "base-image", "", "Image to launch the container from when restoring a partial backup and it doesn't exist.")
+	fs.BoolVar(&resume, "resume", false, "Start a live backup after the import, resuming its processes where they were checkpointed.")
+	fs.BoolVar(&createProfiles, "create-profiles", false, "Create the profiles of the container missing on the server from the backup, and assign them after the import.")
+	fs.BoolVar(&noSnapshots, "no-snapshots", false, "Remove the snapshots a backup made with -snapshots has again after the import.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s restore [options] container\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s restore [options] -server-config\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s restore [options] -image fingerprint\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	pos := parseAnywhere(fs, args)
+
+	logOpts.setup()
+	// An lxc remote is reached as lxc has it configured
+	defer lxdOpts.setup(len(remote) == 0)()
+
+	setDisplayTimezone(displayTimezone)
+
+	conf := loadConfig(configFile)
+
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	if serverConfig {
+		dump := latestServerConfig(lxdBackupPrefix)
+		if len(dump) == 0 {
+			fatalf("No server configuration backup found in %s.\n", backupTarget)
+		}
+		restoreServerConfig(dump)
+		return
+	}
+
+	if len(image) > 0 {
+		restoreImage(lxdBackupPrefix, image)
+		return
+	}
+
+	var name string
+	var vol *volumeState
+
+	if len(volume) > 0 {
+		pool, vname, found := strings.Cut(volume, "/")
+		if !found || len(pos) != 0 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		vol = &volumeState{pool: pool, name: vname}
+		name = vol.backupName()
+		if len(as) > 0 || len(suffix) > 0 || len(remote) > 0 {
+			fatal("Volumes can't be restored under another name or onto another remote.")
+		}
+	} else {
+		if len(pos) != 1 {
+			fs.Usage()
+			os.Exit(1)
+		}
+		name = pos[0]
+	}
+	if len(as) > 0 && len(suffix) > 0 {
+		fatal("Give either -as or -suffix, not both.")
+	}
+	target := name + suffix
+	if len(as) > 0 {
+		target = as
+	}
+
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+
+	o := &restoreOptions{
+		backupTarget:   backupTarget,
+		tempDir:        tempDir,
+		deltaName:      deltaName,
+		project:        project,
+		remote:         remote,
+		isolate:        isolate,
+		useRepo:        useRepo,
+		store:          openSnapshotStore(backend),
+		snapshot:       snapshot,
+		requireSig:     requireSig,
+		retention:      conf.Retention,
+		baseImage:      baseImage,
+		noSnapshots:    noSnapshots,
+		resume:         resume,
+		createProfiles: createProfiles,
+	}
+	name = restoreInstance(o, name, target, vol)
+
+	slog.Info("Restore done", "name", name)
+}
+
+// restoreOptions are the flags of restore, as test-restore restores too.
+type restoreOptions struct {
+	backupTarget, tempDir, deltaName string
+	project, remote                  string
+	isolate, useRepo                 bool
+	store                            lxdbackup.SnapshotStore
+	snapshot, requireSig             string
+	retention                        *retentionConfig
+	baseImage                        string // To launch a missing instance from, for partial backups
+	noSnapshots, resume              bool
+	createProfiles                   bool
+}
+
+// restoreInstance restores the container or volume name as target, and
+// returns the name it can be found by with lxc.
+func restoreInstance(o *restoreOptions, name, target string, vol *volumeState) string {
+
+	prefix := filepath.Join(o.backupTarget, "lxd-backup-")
+
+	var quarter, delta string
+	var m *manifest
+
+	if o.useRepo {
+		quarter, m = rebuildSnapshot(o.backupTarget, o.tempDir, name, o.snapshot)
+		defer os.Remove(quarter)
+	} else if o.store != nil {
+		quarter = fetchSnapshot(o.store, o.tempDir, name, o.snapshot)
+		defer os.Remove(quarter)
+	} else {
+		quarter = latestQuarter(prefix, name, o.retention)
+		if len(quarter) == 0 {
+			fatalf("No quarter backup of %s found in %s.\n", name, o.backupTarget)
+		}
+	}
+
+	var btrfsDelta, rbdDelta string
+	manifestOf := quarter
+	if len(o.deltaName) > 0 && !o.useRepo && o.store == nil {
+		if btrfsDelta = namedBtrfsDelta(prefix, name, o.deltaName); len(btrfsDelta) > 0 {
+			manifestOf = btrfsDelta
+		} else if rbdDelta = namedRBDDelta(prefix, name, o.deltaName); len(rbdDelta) > 0 {
+			manifestOf = rbdDelta
+		} else {
+			delta = namedDelta(prefix, name, o.deltaName)
+			manifestOf = delta
+			if isGeneration(delta) {
+				if quarter = generationQuarter(prefix, name, delta, o.retention); len(quarter) == 0 {
+					fatalf("No quarter backup of %s found for %s.\n", name, filepath.Base(delta))
+				}
+			}
+		}
+	}
+	if len(btrfsDelta) > 0 && (vol != nil || len(o.remote) > 0) {
+		fatal("Btrfs deltas can only be restored as containers onto this host.")
+	}
+	if len(rbdDelta) > 0 && (vol != nil || len(o.remote) > 0) {
+		fatal("RBD deltas can only be restored as containers onto this host.")
+	}
+
+	// Repository snapshots come with theirs, archives made before there
+	// were manifests get one made up
+	if m == nil {
+		m = readManifest(manifestOf)
+	}
+	if m != nil {
+		if t, err := time.Parse(time.RFC3339, m.Created); err == nil {
+			slog.Info("Restoring", "name", name, "as-of", displayTime(t))
+		}
+		if vol == nil {
+			checkProfiles(m, o.project, o.remote, o.createProfiles)
+		}
+	}
+
+	if len(o.requireSig) > 0 {
+		if o.useRepo || o.store != nil {
+			fatal("Repository snapshots have no signatures to require.")
+		}
+		pub := loadVerifyKey(o.requireSig)
+		for _, a := range []string{quarter, delta, btrfsDelta, rbdDelta} {
+			if len(a) == 0 {
+				continue
+			}
+			if err := verifyArchive(a, pub); err != nil {
+				fatalf("Refusing to restore %s. Error: %v\n", filepath.Base(a), err)
+			}
+		}
+	}
+
+	restoreName := filepath.Join(o.tempDir, "lxd-temporary-restore-"+fileTimestamp(nowUTC())+".tar.zst")
+	rewrites := compatRewrites(m, lxdRemoteVersion(o.remote))
+	if vol == nil && target != name {
+		rewrites = addRewrites(rewrites, renameRewrites(name, target))
+	}
+	if m != nil && m.Live {
+		// Exported as the copy of its checkpoint
+		rewrites = addRewrites(rewrites, renameRewrites(liveCopy(name), target))
+	}
+	mergeBackup(quarter, delta, restoreName, rewrites)
+	defer os.Remove(restoreName)
+
+	if m != nil && m.partial() {
+		if vol != nil {
+			fatal("Volumes have no partial backups.")
+		}
+		return overlayPartial(o, restoreName, target, m)
+	}
+
+	if vol != nil {
+		lxcVolumeImport(vol.pool, vol.name, restoreName)
+	} else {
+		lxcImport(restoreName, target, o.project, o.remote)
+		if len(btrfsDelta) > 0 {
+			receiveBtrfsDelta(quarter, btrfsDelta, target, o.project)
+		}
+		if len(rbdDelta) > 0 {
+			importRBDDelta(quarter, rbdDelta, target, o.project)
+		}
+		ref := remoteName(o.remote, target)
+		// Older versions locked the instance in its own config, and exported
+		// the lock along
+		lxcRun(projectArgs(o.project, "config", "unset", ref, lockKey)...)
+		if m != nil && o.createProfiles {
+			assignProfiles(m, ref, o.project, o.remote)
+		}
+		if m != nil && m.Live {
+			resumeLive(ref, o.project, o.resume)
+		}
+		if m != nil && len(m.Snapshots) > 0 {
+			if o.noSnapshots {
+				dropSnapshots(m, ref, o.project)
+			} else {
+				slog.Info("Recreated snapshots", "container", ref, "snapshots", strings.Join(m.Snapshots, ","))
+			}
+		}
+		if o.isolate && m != nil {
+			isolateNetwork(m, ref, o.project)
+		} else if o.isolate {
+			fatalf("Can't isolate %s without a manifest listing its devices.\n", target)
+		}
+		return ref
+	}
+	return name
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// planArchive is an archive of a restore plan, files relative to the
+// backup directory.
+type planArchive struct {
+	// Delta is the name restore -d takes, none for the full backup
+	Delta string `json:"delta,omitempty"`
+	// Files are the parts of the archive, to be put together in order
+	Files   []string `json:"files"`
+	Format  string   `json:"format"`
+	SHA256  string   `json:"sha256,omitempty"`
+	Made    string   `json:"made"`
+	Removed string   `json:"removed,omitempty"`
+	// Unsupported is why only lxd-backup can restore it, IE binary diffs
+	Unsupported string `json:"unsupported,omitempty"`
+}
+
+// restorePlan says how a container is restored from its backups without
+// lxd-backup: the full backup unpacked, a delta unpacked over it and its
+// removed files removed, profiles missing created, and the result packed
+// into a tarball again for Import.
+type restorePlan struct {
+	Name     string         `json:"name"`
+	Made     string         `json:"made"`
+	Full     planArchive    `json:"full"`
+	Deltas   []planArchive  `json:"deltas"`
+	Profiles []profileEntry `json:"profiles,omitempty"`
+	Import   []string       `json:"import"`
+}
+
+func restorePlanFile(lxdBackupPrefix, name string) string {
+	return containerPrefix(lxdBackupPrefix, name) + name + "-restore.json"
+}
+
+func restoreScriptFile(lxdBackupPrefix, name string) string {
+	return containerPrefix(lxdBackupPrefix, name) + name + "-restore.sh"
+}
+
+// planned describes the archive fname, going by what the plan before had
+// on it when it is the same archive still. Full backups are exports, only
+// deltas are looked into.
+func planned(fname string, delta bool, before map[string]planArchive) planArchive {
+
+	a := planArchive{Files: []string{filepath.Base(fname)}}
+	if parts := loadParts(fname); parts != nil {
+		a.Files = a.Files[:0]
+		for i := range parts {
+			a.Files = append(a.Files, filepath.Base(partName(fname, i)))
+		}
+	}
+	if st, err := os.Stat(fname); err == nil {
+		a.Made = timestamp(st.ModTime())
+	}
+	m := readManifest(fname)
+	if m != nil {
+		a.SHA256 = m.SHA256
+	}
+	if fileExists(fname + ".removed") {
+		a.Removed = filepath.Base(fname + ".removed")
+	}
+
+	if b, ok := before[a.Files[0]]; ok && b.Made == a.Made && b.SHA256 == a.SHA256 {
+		a.Format, a.Unsupported = b.Format, b.Unsupported
+		return a
+	}
+	a.Format, a.Unsupported = scriptable(fname, delta)
+	if m != nil && len(m.BaseImage) > 0 {
+		a.Unsupported = "its image is backed up on its own, with -image-base"
+	} else if m != nil && len(m.Included) > 0 {
+		a.Unsupported = "it is a partial backup"
+	}
+	return a
+}
+
+// scriptable tells the compression of an archive, and with scan why tar
+// alone can't restore it, if it can't: entries that only change the
+// metadata of the file in the full backup, or binary diffs against it.
+func scriptable(fname string, scan bool) (string, string) {
+
+	f, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+	in, format, err := lxdbackup.NewReader(f)
+	if err != nil {
+		fatalf("Failed to read %s. Error: %v\n", fname, err)
+	}
+	defer in.Close()
+	if !scan {
+		return format.Name(), ""
+	}
+
+	tarreader := tar.NewReader(in)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			return format.Name(), ""
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", fname, err)
+		}
+		if _, ok := hdr.PAXRecords[lxdbackup.PAXPatch]; ok {
+			return format.Name(), "it has binary diffs"
+		}
+		if lxdbackup.IsMetaEntry(hdr) {
+			return format.Name(), "it has files whose owner, mode or time changed only"
+		}
+	}
+}
+
+// writeRestorePlan writes the restore plan of name, and the shell script
+// doing it, next to its backups. Without a full backup there is none.
+func writeRestorePlan(lxdBackupPrefix, name string, rc *retentionConfig) {
+
+	full := latestQuarter(lxdBackupPrefix, name, rc)
+	if len(full) == 0 {
+		return
+	}
+
+	before := make(map[string]planArchive)
+	if d, err := os.ReadFile(restorePlanFile(lxdBackupPrefix, name)); err == nil {
+		var old restorePlan
+		if json.Unmarshal(d, &old) == nil {
+			for _, a := range append(old.Deltas, old.Full) {
+				if len(a.Files) > 0 {
+					before[a.Files[0]] = a
+				}
+			}
+		}
+	}
+
+	p := &restorePlan{Name: name, Made: timestamp(nowUTC()), Full: planned(full, false, before),
+		Import: []string{"lxc", "import", "backup.tar", name}}
+	if m := readManifest(full); m != nil {
+		p.Profiles = m.Profiles
+	}
+	deltaPrefix := filepath.Base(lxdBackupPrefix+name) + "-"
+	for _, d := range deltasOf(lxdBackupPrefix, name, full, rc) {
+		a := planned(d, true, before)
+		a.Delta = strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archiveStem(d)), deltaPrefix), "-delta.tar")
+		p.Deltas = append(p.Deltas, a)
+	}
+
+	d, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = writeFilePartial(restorePlanFile(lxdBackupPrefix, name), d, 0644)
+	}
+	if err == nil {
+		err = writeFilePartial(restoreScriptFile(lxdBackupPrefix, name), []byte(p.script()), 0755)
+	}
+	if err != nil {
+		slog.Warn("Failed to write restore plan", "name", name, "error", err)
+	}
+}
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// script is the plan as a shell script, run from anywhere.
+func (p *restorePlan) script() string {
+
+	var b strings.Builder
+	w := func(format string, args ...any) { fmt.Fprintf(&b, format, args...) }
+
+	names := make([]string, 0, len(p.Deltas))
+	for _, d := range p.Deltas {
+		names = append(names, d.Delta)
+	}
+
+	w("#!/bin/sh\n")
+	w("# Restores %s from the backups next to this script, without lxd-backup:\n", p.Name)
+	w("# the full backup is unpacked, a delta over it, and the result imported\n")
+	w("# with lxc import. Needs tar, sha256sum, zstd, gzip or xz as the\n")
+	w("# archives are compressed and lxc, and root for the owners of the files.\n")
+	w("#\n")
+	w("#   sh %s [delta [name]]\n", filepath.Base(restoreScriptFile("lxd-backup-", p.Name)))
+	w("#\n")
+	if len(names) > 0 {
+		w("# delta is one of %s, none for the full backup alone.\n", strings.Join(names, " "))
+	} else {
+		w("# There are no deltas, the full backup is restored as is.\n")
+	}
+	w("# Made by lxd-backup at %s, as %s says.\n", p.Made, filepath.Base(restorePlanFile("lxd-backup-", p.Name)))
+	w("set -eu\n")
+	w("cd \"$(dirname \"$0\")\"\n")
+	w("delta=${1:-}\n")
+	w("name=${2:-%s}\n\n", shellQuote(p.Name))
+
+	w("case $delta in\n")
+	w("\"\")\n\t;;\n")
+	for _, d := range p.Deltas {
+		w("%s)\n", shellQuote(d.Delta))
+		if len(d.Unsupported) > 0 {
+			w("\techo %s >&2\n\texit 1\n", shellQuote(fmt.Sprintf("%s can't be restored without lxd-backup, %s. Use: lxd-backup restore -d %s %s", d.Delta, d.Unsupported, d.Delta, p.Name)))
+		}
+		w("\t;;\n")
+	}
+	w("*)\n\techo \"No delta $delta, there are: %s\" >&2\n\texit 1\n\t;;\nesac\n", strings.Join(names, " "))
+	if len(p.Full.Unsupported) > 0 {
+		w("echo %s >&2\nexit 1\n", shellQuote(fmt.Sprintf("%s can't be restored without lxd-backup, %s.", p.Name, p.Full.Unsupported)))
+	}
+
+	w(`
+work=$(mktemp -d "${TMPDIR:-/var/tmp}/lxd-backup-restore-XXXXXX")
+trap 'rm -rf "$work"' EXIT
+mkdir "$work/root"
+
+# unpack sha256 format part... checks an archive and unpacks it into root
+unpack() {
+	sum=$1
+	format=$2
+	shift 2
+	if [ -n "$sum" ] && [ "$(cat "$@" | sha256sum | cut -d ' ' -f 1)" != "$sum" ]; then
+		echo "$1 is damaged, its sha256 is not $sum." >&2
+		exit 1
+	fi
+	echo "Unpacking $1"
+	case $format in
+	zstd) cat "$@" | zstd -dc ;;
+	gzip) cat "$@" | gzip -dc ;;
+	xz) cat "$@" | xz -dc ;;
+	*) cat "$@" ;;
+	esac | tar -x -p --numeric-owner --xattrs --xattrs-include='*' -C "$work/root"
+}
+
+`)
+	unpack := func(a planArchive) {
+		w("unpack %s %s", shellQuote(a.SHA256), shellQuote(a.Format))
+		for _, f := range a.Files {
+			w(" %s", shellQuote(f))
+		}
+		w("\n")
+	}
+	unpack(p.Full)
+	w("case $delta in\n")
+	for _, d := range p.Deltas {
+		if len(d.Unsupported) > 0 {
+			continue
+		}
+		w("%s)\n\t", shellQuote(d.Delta))
+		unpack(d)
+		if len(d.Removed) > 0 {
+			w("\twhile IFS= read -r f; do\n\t\tif [ -n \"$f\" ]; then rm -rf \"$work/root/$f\"; fi\n\tdone < %s\n", shellQuote(d.Removed))
+		}
+		w("\t;;\n")
+	}
+	w("esac\n\n")
+
+	for _, pr := range p.Profiles {
+		w("if ! lxc profile show %s >/dev/null 2>&1; then\n", shellQuote(pr.Name))
+		w("\techo %s\n", shellQuote("Creating profile "+pr.Name))
+		w("\tlxc profile create %s\n", shellQuote(pr.Name))
+		w("\tlxc profile edit %s <<'LXD_BACKUP_PROFILE'\n%s\nLXD_BACKUP_PROFILE\nfi\n", shellQuote(pr.Name), strings.TrimRight(pr.Data, "\n"))
+	}
+
+	w(`
+echo "Importing $name"
+tar -c --numeric-owner --xattrs -f "$work/backup.tar" -C "$work/root" backup
+lxc import "$work/backup.tar" "$name"
+`)
+	return b.String()
+}
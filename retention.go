@@ -0,0 +1,295 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// tierConfig and retentionConfig are the retention scheme of the config,
+// see lxdbackup.Tier.
+type tierConfig = lxdbackup.Tier
+type retentionConfig = lxdbackup.Retention
+
+func validateRetention(rc *retentionConfig) {
+	if err := rc.Validate(); err != nil {
+		fatalf("Bad retention: %v.\n", err)
+	}
+}
+
+// deltaSlot is a delta file that is to be written this run.
+type deltaSlot struct {
+	suffix string    // Up to .tar, the archive is named for its format
+	since  time.Time // Older files in the slot are from an earlier period
+	tier   *tierConfig
+}
+
+func deltaSlots(rc *retentionConfig, t time.Time) []deltaSlot {
+	slots := make([]deltaSlot, 0, len(rc.Deltas))
+	for i := range rc.Deltas {
+		tc := &rc.Deltas[i]
+		slots = append(slots, deltaSlot{suffix: "-" + tc.Expand(t) + "-delta.tar", since: tc.PeriodStart(t), tier: tc})
+	}
+	return slots
+}
+
+// tierFiles returns the files of a tier for name, newest first.
+func tierFiles(lxdBackupPrefix, name, suffix string, tc *tierConfig) []string {
+	lxdBackupPrefix = backupPrefix(lxdBackupPrefix, name, suffix)
+	base := filepath.Base(lxdBackupPrefix + name)
+	return newestFiles(filepath.Dir(lxdBackupPrefix), base, tc.Pattern(base, suffix))
+}
+
+// tierGenerations returns the generations of a delta tier for name, newest
+// first.
+func tierGenerations(lxdBackupPrefix, name string, tc *tierConfig) []string {
+	lxdBackupPrefix = backupPrefix(lxdBackupPrefix, name, "-delta.tar")
+	base := filepath.Base(lxdBackupPrefix + name)
+	return newestFiles(filepath.Dir(lxdBackupPrefix), base, tc.GenerationPattern(base))
+}
+
+// newestFiles returns the files of dir starting with base whose name
+// matches re, newest first.
+func newestFiles(dir, base string, re *regexp.Regexp) []string {
+	names, _ := lxdbackup.NewestFiles(&lxdbackup.Dir{Path: dir}, base, re) // None when dir is missing
+	for i := range names {
+		names[i] = filepath.Join(dir, names[i])
+	}
+	return names
+}
+
+// isGeneration tells whether the delta fname is a generation of its tier
+// and not the slot itself.
+func isGeneration(fname string) bool {
+	return generationName.MatchString(filepath.Base(fname))
+}
+
+var generationName = regexp.MustCompile(`\.\d{8}T\d{6}\.\d{9}Z-delta\.tar(\.\w+)?$`)
+
+// keepGeneration moves the delta fname of the tier tc aside, named after
+// the time it was made, instead of it being made over. Only the
+// Generations newest generations of the tier are kept, and those still
+// write-once.
+func keepGeneration(lxdBackupPrefix, name, fname string, tc *tierConfig) {
+
+	st, err := os.Stat(fname)
+	if err != nil {
+		return
+	}
+	stem := archiveStem(fname)
+	gen := strings.TrimSuffix(stem, "-delta.tar") + "." + fileTimestamp(st.ModTime()) + "-delta.tar" + strings.TrimPrefix(fname, stem)
+
+	// The delta last, without it the sidecars are left over and not a
+	// generation
+	sidecars := sidecarFiles(fname)
+	for _, f := range append(sidecars, fname) {
+		if err := os.Rename(f, movedSidecar(fname, f, gen)); err != nil {
+			fatalf("Failed to rename %s to keep it as a generation. Error: %v\n", f, err)
+		}
+	}
+	moveWriteOnce(fname, gen)
+	slog.Info("Kept generation", "name", name, "delta", filepath.Base(gen))
+
+	gens := tierGenerations(lxdBackupPrefix, name, tc)
+	for i := tc.Generations; i < len(gens); i++ {
+		removeBackupFile(gens[i])
+	}
+}
+
+// sidecarFiles returns the files next to the backup file fname, its
+// checksums, manifest, parts and so on. Those of an archive of the same
+// name in another format, IE x.tar.zst next to x.tar, are not.
+func sidecarFiles(fname string) []string {
+	files, _ := filepath.Glob(fname + ".*")
+	if m := manifestFile(fname); m != fname+".manifest.json" {
+		manifests, _ := filepath.Glob(m + "*")
+		files = append(files, manifests...)
+	}
+	if !strings.HasSuffix(fname, ".tar") {
+		return files
+	}
+	sidecars := files[:0]
+	for _, f := range files {
+		rest := strings.TrimPrefix(f, fname)
+		other := false
+		for _, ext := range lxdbackup.ArchiveExts() {
+			other = other || (len(ext) > 0 && (rest == ext || strings.HasPrefix(rest, ext+".")))
+		}
+		if !other {
+			sidecars = append(sidecars, f)
+		}
+	}
+	return sidecars
+}
+
+// removeBackupFile removes a backup file along with the checksums, profile,
+// manifest and list of removed files next to it, unless it is write-once
+// still.
+func removeBackupFile(fname string) {
+	if err := writeOnceError(fname); err != nil {
+		slog.Info("Keeping write-once backup file", "reason", err)
+		return
+	}
+	sidecars := sidecarFiles(fname)
+	for _, f := range append(sidecars, fname) {
+		os.Remove(f)
+	}
+}
+
+// pruneTier removes all but the Keep newest files of a tier.
+func pruneTier(lxdBackupPrefix, name, suffix string, tc *tierConfig) {
+	lxdBackupPrefix = backupPrefix(lxdBackupPrefix, name, suffix)
+	dir := filepath.Dir(lxdBackupPrefix)
+	files, _ := tc.Expired(&lxdbackup.Dir{Path: dir}, filepath.Base(lxdBackupPrefix+name), suffix)
+	for _, f := range files {
+		removeBackupFile(filepath.Join(dir, f))
+	}
+}
+
+// namedDelta returns the delta deltaName of name, IE WD3, given in either
+// case.
+func namedDelta(lxdBackupPrefix, name, deltaName string) string {
+	lxdBackupPrefix = backupPrefix(lxdBackupPrefix, name, "-delta.tar")
+	delta := findArchive(lxdBackupPrefix + name + "-" + deltaName + "-delta.tar")
+	if !fileExists(delta) {
+		delta = findArchive(lxdBackupPrefix + name + "-" + strings.ToUpper(deltaName) + "-delta.tar")
+	}
+	if !fileExists(delta) {
+		fatalf("Failed to find delta %s.\n", delta)
+	}
+	return delta
+}
+
+// namedBtrfsDelta is namedDelta for a delta made with -btrfs-send, "" when
+// there is none.
+func namedBtrfsDelta(lxdBackupPrefix, name, deltaName string) string {
+	return namedStreamDelta(lxdBackupPrefix, name, deltaName, "-delta.btrfs.zst")
+}
+
+// namedRBDDelta is namedBtrfsDelta for -rbd-diff.
+func namedRBDDelta(lxdBackupPrefix, name, deltaName string) string {
+	return namedStreamDelta(lxdBackupPrefix, name, deltaName, "-delta.rbd.zst")
+}
+
+func namedStreamDelta(lxdBackupPrefix, name, deltaName, suffix string) string {
+	lxdBackupPrefix = backupPrefix(lxdBackupPrefix, name, suffix)
+	for _, n := range []string{deltaName, strings.ToUpper(deltaName)} {
+		if delta := lxdBackupPrefix + name + "-" + n + suffix; fileExists(delta) {
+			return delta
+		}
+	}
+	return ""
+}
+
+// deltasOf returns the deltas of name made against the full backup full,
+// generations too, newest first.
+func deltasOf(lxdBackupPrefix, name, full string, rc *retentionConfig) []string {
+
+	st, err := os.Stat(full)
+	if err != nil {
+		return nil
+	}
+
+	type file struct {
+		name  string
+		mtime time.Time
+	}
+	var files []file
+	for i := range rc.Deltas {
+		tc := &rc.Deltas[i]
+		for _, f := range append(tierFiles(lxdBackupPrefix, name, "-delta.tar", tc), tierGenerations(lxdBackupPrefix, name, tc)...) {
+			if dst, err := os.Stat(f); err == nil && !dst.ModTime().Before(st.ModTime()) {
+				files = append(files, file{f, dst.ModTime()})
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.After(files[j].mtime) })
+
+	names := make([]string, len(files))
+	for i := range files {
+		names[i] = files[i].name
+	}
+	return names
+}
+
+// promotePartial is where a new full backup of name is made ready, along
+// with its sidecars, before commitFull puts it in place of the old one.
+func promotePartial(lxdBackupPrefix, name string) string {
+	return lxdBackupPrefix + name + "-promote.partial" // Known by the intent log
+}
+
+// stageFull moves a new export of name to partial, to become its full
+// backup once its sidecars are written next to it.
+func stageFull(name, full, partial, export string) {
+
+	if err := writeOnceError(full); err != nil {
+		fatalf("Failed to replace the full backup of %s. Error: %v\n", name, err)
+	}
+	if err := moveFile(export, partial); err != nil {
+		fatalf("Failed to move %s to %s. Error: %v\n", export, partial, err)
+	}
+	if fileExists(export + ".index.json") {
+		if err := moveFile(export+".index.json", partial+".index.json"); err != nil {
+			fatalf("Failed to move index of %s. Error: %v\n", export, err)
+		}
+	}
+}
+
+// commitFull replaces the full backup of name with the one staged as
+// partial, once its manifest is written, and drops the deltas made against
+// the old one since they don't apply to the new. Until then the old full
+// backup is left as it is. The archive is moved first and the manifest
+// last, so that when a crash cuts it short, recover finishes it. The new
+// full backup is named for its format, full may be of another, and its
+// name is returned.
+func commitFull(lxdBackupPrefix, name, full, partial string, rc *retentionConfig) string {
+
+	m := readManifest(partial)
+	if m == nil {
+		fatalf("Failed to replace the full backup of %s, %s has no manifest.\n", name, partial)
+	}
+	stem := archiveStem(full)
+	next := archiveName(stem, m.Format)
+	if fileExists(partial) {
+		if old := findArchive(stem); fileExists(old) {
+			for _, f := range deltasOf(lxdBackupPrefix, name, old, rc) {
+				removeBackupFile(f)
+			}
+		}
+		for _, ext := range lxdbackup.ArchiveExts() {
+			removeBackupFile(stem + ext)
+		}
+		if err := os.Rename(partial, next); err != nil {
+			fatalf("Failed to rename %s to %s. Error: %v\n", partial, next, err)
+		}
+	}
+	files, _ := filepath.Glob(partial + ".*")
+	var sidecars []string
+	for _, f := range files {
+		if f != partial+".manifest.json" {
+			sidecars = append(sidecars, f)
+		}
+	}
+	for _, f := range append(sidecars, partial+".manifest.json") {
+		if err := os.Rename(f, sidecarFile(next, strings.TrimPrefix(f, partial))); err != nil {
+			fatalf("Failed to rename %s. Error: %v\n", f, err)
+		}
+	}
+	return next
+}
+
+// renameArchive renames the archive from, not finished yet, to to, along
+// with what is next to it already, IE its index or btrfs send stream.
+func renameArchive(from, to string) {
+	for _, f := range append(sidecarFiles(from), from) {
+		if err := os.Rename(f, movedSidecar(from, f, to)); err != nil {
+			fatalf("Failed to rename %s. Error: %v\n", f, err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// concurrentJobs is set when more than one container is backed up at a
+// time, so progress bars are logged instead of drawn over each other.
+var concurrentJobs bool
+
+// runByHost calls run for each of containers, at most jobs at a time and
+// at most hostJobs of those on the same cluster member, so the members
+// share the load while none of them has its disks hammered by several
+// exports. Containers are started in the order given, a container that has
+// to wait for its member lets the ones of other members go first.
+//
+// In parallel, fatalf only gives up on the container it is about, see
+// backupWithBudget. When what fails is about the whole run, IE the backup
+// target is gone, no more containers are started, and lxd-backup exits once
+// those running are done, instead of cutting their exports off.
+func runByHost(containers []*containerState, jobs, hostJobs int, run func(c *containerState)) {
+
+	if jobs <= 1 {
+		for _, c := range containers {
+			run(c)
+		}
+		return
+	}
+	concurrentJobs = true
+
+	panics := fatalPanics
+	fatalPanics = true
+	var failed *fatalError
+	defer func() {
+		fatalPanics = panics
+		if failed != nil {
+			exit(failed.code, failed.msg+"\n")
+		}
+	}()
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	running := 0
+	perHost := make(map[string]int)
+	pending := append([]*containerState(nil), containers...)
+
+	var wg sync.WaitGroup
+	mu.Lock()
+	for len(pending) > 0 && failed == nil {
+		i := -1
+		if running < jobs {
+			for n, c := range pending {
+				if perHost[c.host] < hostJobs {
+					i = n
+					break
+				}
+			}
+		}
+		if i < 0 {
+			cond.Wait()
+			continue
+		}
+		c := pending[i]
+		pending = append(pending[:i], pending[i+1:]...)
+		running++
+		perHost[c.host]++
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				r := recover()
+				mu.Lock()
+				defer mu.Unlock()
+				running--
+				perHost[c.host]--
+				cond.Signal()
+				if e, ok := r.(fatalError); ok && failed == nil {
+					failed = &e
+				} else if r != nil && failed == nil {
+					msg := fmt.Sprintf("Panic: %v\n%s", r, debug.Stack())
+					slog.Error(msg)
+					failed = &fatalError{msg, 1}
+				}
+			}()
+			run(c)
+		}()
+	}
+	mu.Unlock()
+	wg.Wait()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// scrubRecord is when an archive was last verified, and what was wrong
+// with it then.
+type scrubRecord struct {
+	Time  string `json:"time"`
+	Error string `json:"error,omitempty"`
+}
+
+// scrubStateFile keeps the scrubRecord of every archive, by file name.
+func scrubStateFile(lxdBackupPrefix string) string {
+	return lxdBackupPrefix + "scrub.json"
+}
+
+func loadScrubState(lxdBackupPrefix string) map[string]scrubRecord {
+	state := make(map[string]scrubRecord)
+	if d, err := os.ReadFile(scrubStateFile(lxdBackupPrefix)); err == nil {
+		json.Unmarshal(d, &state)
+	}
+	return state
+}
+
+func saveScrubState(lxdBackupPrefix string, state map[string]scrubRecord) {
+	d, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFilePartial(scrubStateFile(lxdBackupPrefix), d, 0644)
+	}
+	if err != nil {
+		fatalf("Failed to write %s. Error: %v\n", scrubStateFile(lxdBackupPrefix), err)
+	}
+}
+
+// scrubShare picks the archives to verify tonight so that every one of
+// them is verified within period: a night's share of them, never verified
+// and verified longest ago first, and any overdue on top.
+func scrubShare(archives []string, state map[string]scrubRecord, period time.Duration, now time.Time) []string {
+
+	last := func(a string) time.Time {
+		t, _ := time.Parse(time.RFC3339, state[filepath.Base(a)].Time)
+		return t
+	}
+	sorted := append([]string(nil), archives...)
+	sort.SliceStable(sorted, func(i, j int) bool { return last(sorted[i]).Before(last(sorted[j])) })
+
+	nights := max(int(period/(24*time.Hour)), 1)
+	share := (len(sorted) + nights - 1) / nights
+	var picked []string
+	for i, a := range sorted {
+		if t := last(a); i < share || (!t.IsZero() && now.Sub(t) >= period) {
+			picked = append(picked, a)
+		}
+	}
+	return picked
+}
+
+// nextScrub is when the nightly scrub at, IE 03:00, is next after now.
+func nextScrub(at time.Time, now time.Time) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// scrubNightly starts a scrub of the backup directory every night at at,
+// verifying its share of the archives at low priority.
+func (s *server) scrubNightly(at time.Time, period time.Duration) {
+	for {
+		time.Sleep(time.Until(nextScrub(at, time.Now())))
+		s.start("scrub", "", []string{"verify", "-b", s.backupTarget, "-scrub", period.String(), "-nice"}, 0)
+	}
+}
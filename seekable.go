@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// seekable is -seekable. zstd archives written by lxd-backup are cut into
+// independent frames at the start of tar entries, and an index next to
+// them tells which frame each entry starts in. Any zstd decoder still reads
+// them as one stream.
+var seekable bool
+
+// seekFrameSize is how much uncompressed tar goes into a frame at least.
+// Fetching a file decompresses at most this much before it.
+const seekFrameSize = 4 << 20
+
+// indexEntry is where an entry of a seekable archive is: the frame starts
+// Frame bytes into the file, and the tar header Offset bytes into the frame.
+type indexEntry struct {
+	Name   string `json:"name"`
+	Frame  int64  `json:"frame"`
+	Offset int64  `json:"offset"`
+}
+
+// tarArchive is a tarball being written by lxd-backup, compressed in
+// -format and seekable with -seekable. It is written to a .partial file,
+// which only gets its name once closed.
+type tarArchive struct {
+	*tar.Writer
+	name string
+	f    *os.File
+	comp io.WriteCloser
+	raw  *countingWriter // The tar bytes, before compression
+	file *countingWriter // What is written to f
+
+	zw         *zstd.Encoder // Set when seekable
+	frame      int64
+	frameStart int64
+	index      []indexEntry
+}
+
+func createArchive(dest string, perm os.FileMode) *tarArchive {
+
+	f, err := os.OpenFile(dest+".partial", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, perm)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dest, err)
+	}
+
+	a := &tarArchive{name: dest, f: f, file: &countingWriter{w: throttleWriter(f)}}
+	a.comp, err = newArchiveWriter(a.file)
+	if err != nil {
+		fatalf("Failed write %s as %s compressed file. Error: %v\n", dest, archiveFormat, err)
+	}
+	if zw, ok := a.comp.(*zstd.Encoder); ok && seekable {
+		a.zw = zw
+	}
+	a.raw = &countingWriter{w: a.comp}
+	a.Writer = tar.NewWriter(a.raw)
+	return a
+}
+
+// WriteHeader is tar.Writer.WriteHeader, which also starts a new frame when
+// the current one is big enough, and indexes the entry.
+func (a *tarArchive) WriteHeader(hdr *tar.Header) error {
+	if err := a.startEntry(hdr.Name); err != nil {
+		return err
+	}
+	return a.Writer.WriteHeader(hdr)
+}
+
+func (a *tarArchive) startEntry(name string) error {
+
+	if a.zw == nil {
+		return nil
+	}
+	// The padding of the entry before belongs to it
+	if err := a.Writer.Flush(); err != nil {
+		return err
+	}
+	if a.raw.n-a.frameStart >= seekFrameSize {
+		if err := a.zw.Close(); err != nil {
+			return err
+		}
+		a.zw.Reset(a.file)
+		a.frame, a.frameStart = a.file.n, a.raw.n
+	}
+	a.index = append(a.index, indexEntry{Name: name, Frame: a.frame, Offset: a.raw.n - a.frameStart})
+	return nil
+}
+
+// writeRaw starts the entry name, encoded by the caller as head, for what
+// tar.Writer can't write. The rest of the entry, padding included, goes to
+// the returned writer.
+func (a *tarArchive) writeRaw(name string, head []byte) (io.Writer, error) {
+	if err := a.Writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := a.startEntry(name); err != nil {
+		return nil, err
+	}
+	_, err := a.raw.Write(head)
+	return a.raw, err
+}
+
+// Close finishes the archive, writes its index, puts it in place and
+// returns its compression ratio.
+func (a *tarArchive) Close() float64 {
+
+	err := a.Writer.Close()
+	if err == nil {
+		err = a.comp.Close()
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatalf("Failed to write %s. Error: %v\n", a.name, err)
+	}
+
+	if a.zw != nil {
+		d, err := json.Marshal(a.index)
+		if err == nil {
+			err = os.WriteFile(a.name+".index.json", d, 0644)
+		}
+		if err != nil {
+			fatalf("Failed to write index of %s. Error: %v\n", a.name, err)
+		}
+	}
+	commitPartial(a.name+".partial", a.name)
+	return logCompression(a.name, a.raw.n)
+}
+
+// abort throws away an archive that won't be finished.
+func (a *tarArchive) abort() {
+	a.f.Close()
+	os.Remove(a.name + ".partial")
+}
+
+// copyTarStream writes the tarball r reads into a.
+func copyTarStream(r io.Reader, a *tarArchive) error {
+	tarreader := tar.NewReader(r)
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := a.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(a, tarreader); err != nil {
+			return err
+		}
+	}
+}
+
+func loadIndex(archive string) map[string]indexEntry {
+	d, err := os.ReadFile(archive + ".index.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		fatalf("Failed to read index of %s. Error: %v\n", archive, err)
+	}
+	var entries []indexEntry
+	if err := json.Unmarshal(d, &entries); err != nil {
+		fatalf("Failed to decode index of %s. Error: %v\n", archive, err)
+	}
+	index := make(map[string]indexEntry, len(entries))
+	for _, e := range entries {
+		index[e.Name] = e
+	}
+	return index
+}
+
+// readEntry calls fn with the entry name of archive, and tells whether it
+// was there. With an index only the frame the entry is in is read.
+func readEntry(archive, name string, fn func(hdr *tar.Header, r io.Reader)) bool {
+
+	index := loadIndex(archive)
+	if index == nil {
+		in := openArchive(archive)
+		defer in.Close()
+		return findTarEntry(archive, tar.NewReader(in), name, fn)
+	}
+
+	e, ok := index[name]
+	if !ok {
+		return false
+	}
+	f, err := openParts(archive)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", archive, err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(e.Frame, io.SeekStart); err != nil {
+		fatalf("Failed to seek in %s. Error: %v\n", archive, err)
+	}
+	in, err := zstd.NewReader(f)
+	if err != nil {
+		fatalf("Failed to read %s as zstd compressed file. Error: %v\n", archive, err)
+	}
+	defer in.Close()
+	if _, err := io.CopyN(io.Discard, in, e.Offset); err != nil {
+		fatalf("Failed to read %s. Error: %v\n", archive, err)
+	}
+	if !findTarEntry(archive, tar.NewReader(in), name, fn) {
+		fatalf("Index of %s is wrong about %s.\n", archive, name)
+	}
+	return true
+}
+
+func findTarEntry(archive string, tarreader *tar.Reader, name string, fn func(hdr *tar.Header, r io.Reader)) bool {
+	for {
+		hdr, err := tarreader.Next()
+		if err == io.EOF {
+			return false
+		} else if err != nil {
+			fatalf("Failed to read content of tarfile: %s. Error: %v\n", archive, err)
+		}
+		if hdr.Name == name {
+			fn(hdr, tarreader)
+			return true
+		}
+	}
+}
+
+// archiveEntries lists the entries of archive, from its index when it has
+// one.
+func archiveEntries(archive string) map[string]bool {
+	index := loadIndex(archive)
+	if index == nil {
+		return tarEntryNames(archive)
+	}
+	names := make(map[string]bool, len(index))
+	for n := range index {
+		names[n] = true
+	}
+	return names
+}
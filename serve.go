@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// containerStatus is what the daemon tells about one container or volume,
+// from its run history and the files in the backup directory.
+type containerStatus struct {
+	Name        string `json:"name"`
+	LastRun     string `json:"last-run,omitempty"`
+	LastStatus  string `json:"last-status,omitempty"`
+	LastError   string `json:"last-error,omitempty"`
+	LastSuccess string `json:"last-success,omitempty"`
+	AgeSeconds  int64  `json:"age-seconds,omitempty"` // Since the last success
+	Stale       bool   `json:"stale"`
+	Files       int    `json:"files"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// serveJob is an ad-hoc backup or restore test started from the daemon.
+type serveJob struct {
+	ID     int      `json:"id"`
+	Kind   string   `json:"kind"`
+	Name   string   `json:"name"`
+	Start  string   `json:"start"`
+	End    string   `json:"end,omitempty"`
+	Status string   `json:"status"`
+	Args   []string `json:"args"`
+	Output string   `json:"output,omitempty"` // The last of it
+
+	out *bytes.Buffer
+}
+
+// server is lxd-backup serve.
+type server struct {
+	backupTarget string
+	prefix       string
+	maxAge       time.Duration
+	token        string
+	backupArgs   []string // Given to lxd-backup for an ad-hoc backup
+	restoreArgs  []string // Given to lxd-backup test-restore
+	scrubPeriod  time.Duration
+	maxJobs      int // Started from the API at the same time
+
+	mu     sync.Mutex
+	jobs   []*serveJob
+	lastID int
+}
+
+// serveOutputMax is how much of the output of a job is kept.
+const serveOutputMax = 16 << 10
+
+// serveJobsMax is how many jobs are kept after they are done.
+const serveJobsMax = 100
+
+// statuses is the state of every container and volume with a run history.
+// Backup files are counted to the longest name they start with, as one
+// name may start with another, IE web and web-2.
+func (s *server) statuses() []*containerStatus {
+
+	names := historyNames(s.prefix)
+	byName := make(map[string]*containerStatus, len(names))
+	var list []*containerStatus
+	now := nowUTC()
+	for _, n := range names {
+		st := &containerStatus{Name: n}
+		if recs := recentRunRecords(s.prefix, n, 1); len(recs) > 0 {
+			st.LastRun, st.LastStatus, st.LastError = recs[0].Time, recs[0].Status, recs[0].Error
+		}
+		if last := lastSuccess(s.prefix, n); !last.IsZero() {
+			st.LastSuccess = timestamp(last)
+			st.AgeSeconds = int64(now.Sub(last).Seconds())
+			st.Stale = now.Sub(last) > s.maxAge
+		} else {
+			st.Stale = true
+		}
+		byName[n] = st
+		list = append(list, st)
+	}
+
+	for _, f := range globBackups(filepath.Dir(s.prefix), filepath.Base(s.prefix)+"*") {
+		rest := strings.TrimPrefix(filepath.Base(f), filepath.Base(s.prefix))
+		var owner *containerStatus
+		for n, st := range byName {
+			if strings.HasPrefix(rest, n) && (owner == nil || len(n) > len(owner.Name)) {
+				owner = st
+			}
+		}
+		if owner == nil {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil && fi.Mode().IsRegular() {
+			owner.Files++
+			owner.Bytes += fi.Size()
+		}
+	}
+	return list
+}
+
+// storage is how much the backup directory holds, and how much more it has
+// room for.
+func (s *server) storage() map[string]int64 {
+	used := make(map[string]int64)
+	var total int64
+	for _, st := range s.statuses() {
+		used[st.Name] = st.Bytes
+		total += st.Bytes
+	}
+	res := map[string]int64{"total": total}
+	if free, err := diskFree(s.backupTarget); err == nil {
+		res["free"] = free
+	}
+	for n, b := range used {
+		res["container/"+n] = b
+	}
+	return res
+}
+
+// start runs lxd-backup with args as job kind of name, in the background.
+// Returns nil when limit jobs of kind are running already, 0 means any
+// number of them.
+func (s *server) start(kind, name string, args []string, limit int) *serveJob {
+
+	s.mu.Lock()
+	running := 0
+	for _, j := range s.jobs {
+		if j.Kind == kind && j.Status == "running" {
+			running++
+		}
+	}
+	if limit > 0 && running >= limit {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastID++
+	j := &serveJob{ID: s.lastID, Kind: kind, Name: name, Start: timestamp(nowUTC()), Status: "running",
+		Args: args, out: &bytes.Buffer{}}
+	s.jobs = append(s.jobs, j)
+	s.trimJobs()
+	started := *j
+	s.mu.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	slog.Info("Starting", "job", j.ID, "kind", kind, "name", name)
+	go func() {
+		defer recoverPanic()
+		cmd := exec.Command(exe, args...)
+		w := &lockedWriter{mu: &s.mu, w: j.out}
+		cmd.Stdout, cmd.Stderr = w, w
+		err := cmd.Run()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		j.End = timestamp(nowUTC())
+		j.Status = "ok"
+		if err != nil {
+			j.Status = "failed"
+			slog.Warn("Job failed", "job", j.ID, "kind", kind, "name", name, "error", err)
+		}
+	}()
+	return &started
+}
+
+// trimJobs forgets the oldest of the jobs that are done, beyond serveJobsMax.
+func (s *server) trimJobs() {
+	over := len(s.jobs) - serveJobsMax
+	kept := s.jobs[:0]
+	for _, j := range s.jobs {
+		if over > 0 && j.Status != "running" {
+			over--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	s.jobs = kept
+}
+
+// lockedWriter keeps the output of a job, its last serveOutputMax bytes.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(p)
+	if over := l.w.Len() - serveOutputMax; over > 0 {
+		l.w.Next(over)
+	}
+	return len(p), nil
+}
+
+func (s *server) jobList() []*serveJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*serveJob, len(s.jobs))
+	for i, j := range s.jobs {
+		c := *j
+		c.Output = j.out.String()
+		list[len(s.jobs)-1-i] = &c
+	}
+	return list
+}
+
+func (s *server) authorized(r *http.Request) bool {
+	if len(s.token) == 0 {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, pass, ok := r.BasicAuth(); ok {
+		given = pass
+	}
+	return subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) == 1
+}
+
+// sameOrigin tells whether r comes from the dashboard or outside a browser,
+// not from another web page, which the browser would give the basic auth
+// password along to.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	if o := r.Header.Get("Origin"); len(o) > 0 {
+		u, err := url.Parse(o)
+		return err == nil && u.Host == r.Host
+	}
+	return true
+}
+
+// jobName tells whether name can be given to lxd-backup as a container or
+// volume, IE not as more -ic entries or as an option.
+func jobName(name string) bool {
+	return len(name) > 0 && !strings.HasPrefix(name, "-") && !strings.ContainsAny(name, ",/ ")
+}
+
+func writeJSONResponse(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="lxd-backup"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		s.dashboard(w)
+	case path == "/api/containers" && r.Method == http.MethodGet:
+		writeJSONResponse(w, s.statuses())
+	case strings.HasPrefix(path, "/api/containers/") && strings.HasSuffix(path, "/history") && r.Method == http.MethodGet:
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/api/containers/"), "/history")
+		writeJSONResponse(w, recentRunRecords(s.prefix, name, 1000))
+	case path == "/api/storage" && r.Method == http.MethodGet:
+		writeJSONResponse(w, s.storage())
+	case path == "/api/lastrun" && r.Method == http.MethodGet:
+		d, err := os.ReadFile(s.prefix + "lastrun.json")
+		if err != nil {
+			http.Error(w, "no run report", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(d)
+	case path == "/api/scrub" && r.Method == http.MethodGet:
+		writeJSONResponse(w, loadScrubState(s.prefix))
+	case path == "/api/jobs" && r.Method == http.MethodGet:
+		writeJSONResponse(w, s.jobList())
+	case strings.HasPrefix(path, "/api/backup/") && r.Method == http.MethodPost:
+		name := strings.TrimPrefix(path, "/api/backup/")
+		args := append(append([]string{}, s.backupArgs...), "-b", s.backupTarget, "-ic", name)
+		s.startJob(w, r, "backup", name, args)
+	case strings.HasPrefix(path, "/api/test-restore/") && r.Method == http.MethodPost:
+		name := strings.TrimPrefix(path, "/api/test-restore/")
+		args := append(append([]string{"test-restore"}, s.restoreArgs...), "-b", s.backupTarget, name)
+		s.startJob(w, r, "test-restore", name, args)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// startJob starts a job of kind for name from the API, and answers with it:
+// the job for the API, and back to the dashboard for its buttons. Only with
+// a token, as the backups stop containers.
+func (s *server) startJob(w http.ResponseWriter, r *http.Request, kind, name string, args []string) {
+	if len(s.token) == 0 {
+		http.Error(w, "starting jobs needs -token-file", http.StatusForbidden)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	if !jobName(name) {
+		http.Error(w, "bad name", http.StatusBadRequest)
+		return
+	}
+	j := s.start(kind, name, args, s.maxJobs)
+	if j == nil {
+		http.Error(w, fmt.Sprintf("%d jobs of kind %s running already", s.maxJobs, kind), http.StatusTooManyRequests)
+		return
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSONResponse(w, j)
+}
+
+// dashboard is the web page of the daemon, the containers and the jobs.
+func (s *server) dashboard(w io.Writer) {
+
+	list := s.statuses()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	fmt.Fprint(w, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>lxd-backup</title><meta http-equiv="refresh" content="30">
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+td.n { text-align: right; }
+tr.stale { background: #f8d7da; }
+form { display: inline; }
+</style></head><body>
+`)
+	var total int64
+	for _, st := range list {
+		total += st.Bytes
+	}
+	fmt.Fprintf(w, "<h1>lxd-backup: %s</h1>\n<p>%s in %d backups", html.EscapeString(s.backupTarget), humanBytes(total), len(list))
+	if free, err := diskFree(s.backupTarget); err == nil {
+		fmt.Fprintf(w, ", %s free", humanBytes(free))
+	}
+	fmt.Fprint(w, ".</p>\n")
+	if s.scrubPeriod > 0 {
+		var within, failed int
+		for _, rec := range loadScrubState(s.prefix) {
+			if t, err := time.Parse(time.RFC3339, rec.Time); err == nil && nowUTC().Sub(t) < s.scrubPeriod {
+				within++
+			}
+			if len(rec.Error) > 0 {
+				failed++
+			}
+		}
+		fmt.Fprintf(w, "<p>%d archives scrubbed within %s, %d failed.</p>\n", within, s.scrubPeriod, failed)
+	}
+
+	fmt.Fprint(w, "<table>\n<tr><th>Name</th><th>Last run</th><th>Status</th><th>Last success</th><th>Age</th><th>Files</th><th>Size</th><th></th></tr>\n")
+	for _, st := range list {
+		class := ""
+		if st.Stale {
+			class = ` class="stale"`
+		}
+		var age string
+		if len(st.LastSuccess) > 0 {
+			age = (time.Duration(st.AgeSeconds) * time.Second).Truncate(time.Minute).String()
+		}
+		name := html.EscapeString(st.Name)
+		fmt.Fprintf(w, "<tr%s><td>%s</td><td>%s</td><td title=\"%s\">%s</td><td>%s</td><td class=\"n\">%s</td><td class=\"n\">%d</td><td class=\"n\">%s</td>",
+			class, name, html.EscapeString(st.LastRun), html.EscapeString(st.LastError), html.EscapeString(st.LastStatus),
+			html.EscapeString(st.LastSuccess), age, st.Files, humanBytes(st.Bytes))
+		if len(s.token) > 0 && jobName(st.Name) {
+			fmt.Fprintf(w, "<td><form method=\"post\" action=\"/api/backup/%s\"><button>Back up</button></form> ", name)
+			fmt.Fprintf(w, "<form method=\"post\" action=\"/api/test-restore/%s\"><button>Test restore</button></form></td></tr>\n", name)
+		} else {
+			fmt.Fprint(w, "<td></td></tr>\n")
+		}
+	}
+	fmt.Fprint(w, "</table>\n")
+
+	if jobs := s.jobList(); len(jobs) > 0 {
+		fmt.Fprint(w, "<h2>Jobs</h2>\n<table>\n<tr><th>#</th><th>Kind</th><th>Name</th><th>Started</th><th>Ended</th><th>Status</th></tr>\n")
+		for _, j := range jobs {
+			fmt.Fprintf(w, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td title=\"%s\">%s</td></tr>\n",
+				j.ID, j.Kind, html.EscapeString(j.Name), j.Start, j.End, html.EscapeString(j.Output), j.Status)
+		}
+		fmt.Fprint(w, "</table>\n")
+	}
+	fmt.Fprintln(w, "</body></html>")
+}
+
+// serveMain is lxd-backup serve, the daemon with a web page and a JSON API
+// over the backup directory. Arguments after -- are given to lxd-backup for
+// the ad-hoc backups it starts.
+func serveMain(args []string) {
+
+	var backupTarget, listen, tokenFile, restoreArgs, scrubAt string
+	var maxAge, scrubPeriod time.Duration
+	var maxJobs int
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&listen, "listen", "127.0.0.1:8080", "Address to serve on.")
+	fs.StringVar(&tokenFile, "token-file", "", "File with the token that must be given, as bearer token or basic auth password. Default is none, and no jobs can be started.")
+	fs.IntVar(&maxJobs, "max-jobs", 1, "Backups, and test-restores, started from the API that may run at the same time.")
+	fs.DurationVar(&maxAge, "max-age", 26*time.Hour, "Containers without a successful backup this long are shown as stale.")
+	fs.DurationVar(&scrubPeriod, "scrub-period", 0, "Verify a share of the archives every night, so each is verified within this period, IE 720h. 0 means never.")
+	fs.StringVar(&scrubAt, "scrub-at", "03:00", "Local time of the nightly scrub.")
+	fs.StringVar(&restoreArgs, "test-restore-args", "", "Arguments for test-restore, space separated, IE \"-project drills\".")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve [options] [-- backup options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	logOpts.setup()
+
+	if len(backupTarget) == 0 || maxJobs < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	s := &server{
+		backupTarget: backupTarget,
+		prefix:       filepath.Join(backupTarget, "lxd-backup-"),
+		maxAge:       maxAge,
+		backupArgs:   fs.Args(),
+		restoreArgs:  strings.Fields(restoreArgs),
+		scrubPeriod:  scrubPeriod,
+		maxJobs:      maxJobs,
+	}
+	if len(tokenFile) > 0 {
+		d, err := os.ReadFile(tokenFile)
+		if err != nil {
+			fatalf("Failed to read %s. Error: %v\n", tokenFile, err)
+		}
+		s.token = strings.TrimSpace(string(d))
+	}
+
+	if scrubPeriod > 0 {
+		at, err := time.Parse("15:04", scrubAt)
+		if err != nil {
+			fatalf("Bad -scrub-at %s, IE 03:00.\n", scrubAt)
+		}
+		go s.scrubNightly(at, scrubPeriod)
+	}
+
+	slog.Info("Serving", "address", listen, "backup-target", backupTarget)
+	if err := http.ListenAndServe(listen, s); err != nil {
+		fatalf("Failed to serve on %s. Error: %v\n", listen, err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// backupServerConfig dumps profiles, networks, storage pools and projects as
+// an lxd init preseed, one file per day.
+func backupServerConfig(lxdBackupPrefix string) {
+
+	slog.Info("Dumping server configuration")
+
+	cmd, cancel := lxdCommand("init", "--dump")
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	dump, err := cmd.Output()
+	if err != nil {
+		fatalf("Failed to run: lxd init --dump. Error: %v\n", err)
+	}
+
+	dest := lxdBackupPrefix + "server-" + nowUTC().Format("20060102") + ".preseed.yaml"
+	if err := os.WriteFile(dest, dump, 0600); err != nil {
+		fatalf("Failed to write server configuration to: %s: %v\n", dest, err)
+	}
+
+	slog.Info("Server configuration saved", "file", dest)
+}
+
+func latestServerConfig(lxdBackupPrefix string) string {
+
+	dumps, err := filepath.Glob(lxdBackupPrefix + "server-*.preseed.yaml")
+	if err != nil {
+		fatalf("Failed to look for server configuration backups. Error: %v\n", err)
+	}
+	if len(dumps) == 0 {
+		return ""
+	}
+	sort.Strings(dumps)
+	return dumps[len(dumps)-1]
+}
+
+// restoreServerConfig feeds a preseed back to lxd init. Existing objects
+// with the same names are updated.
+func restoreServerConfig(fname string) {
+
+	slog.Info("Restoring server configuration", "file", fname)
+
+	f, err := os.Open(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command("lxd", "init", "--preseed")
+	cmd.Stdin = f
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxd init --preseed < %s. Error: %v\n", fname, err)
+	}
+}
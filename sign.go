@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// signKey is the key of -sign-key. When set, every manifest lxd-backup
+// writes is signed, and the signature is stored next to it as
+// <archive>.manifest.json.sig. As the manifest holds the sha256 of the
+// archive, the signature covers the archive too.
+var signKey ed25519.PrivateKey
+
+func readPEM(fname, what string) []byte {
+	d, err := os.ReadFile(fname)
+	if err != nil {
+		fatalf("Failed to read %s %s. Error: %v\n", what, fname, err)
+	}
+	b, _ := pem.Decode(d)
+	if b == nil {
+		fatalf("%s is not a PEM encoded %s.\n", fname, what)
+	}
+	return b.Bytes
+}
+
+// loadSignKey loads an ed25519 private key in PKCS #8 PEM, as made by
+// openssl genpkey -algorithm ed25519.
+func loadSignKey(fname string) ed25519.PrivateKey {
+	k, err := x509.ParsePKCS8PrivateKey(readPEM(fname, "private key"))
+	if err != nil {
+		fatalf("Failed to decode private key %s. Error: %v\n", fname, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		fatalf("%s is not an ed25519 key.\n", fname)
+	}
+	return key
+}
+
+// loadVerifyKey loads an ed25519 public key in PKIX PEM, as made by
+// openssl pkey -pubout.
+func loadVerifyKey(fname string) ed25519.PublicKey {
+	k, err := x509.ParsePKIXPublicKey(readPEM(fname, "public key"))
+	if err != nil {
+		fatalf("Failed to decode public key %s. Error: %v\n", fname, err)
+	}
+	key, ok := k.(ed25519.PublicKey)
+	if !ok {
+		fatalf("%s is not an ed25519 key.\n", fname)
+	}
+	return key
+}
+
+// archiveSHA256 is the sha256 of an archive as stored, all parts together.
+func archiveSHA256(fname string) string {
+	f, err := openParts(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, throttleReader(f)); err != nil {
+		fatalf("Failed to read %s. Error: %v\n", fname, err)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedSidecars are the files next to archive its manifest has the sha256
+// of: the checksums, the list of removed files and the profiles. The
+// manifest, the parts, the parity and the index are left out, as they are
+// checked on their own or written after it.
+func signedSidecars(archive string) []string {
+	var files []string
+	for _, f := range sidecarFiles(archive) {
+		if !strings.HasPrefix(f, archive+".") || strings.Contains(f, ".manifest.json") || strings.Contains(f, ".parity") ||
+			partFile.MatchString(f) || strings.HasSuffix(f, ".index.json") || strings.HasSuffix(f, ".partial") {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// sidecarSums are the sha256 of the signed sidecars of archive, by what
+// follows its name.
+func sidecarSums(archive string) map[string]string {
+	sums := make(map[string]string)
+	for _, f := range signedSidecars(archive) {
+		d, err := os.ReadFile(f)
+		if err != nil {
+			fatalf("Failed to read %s. Error: %v\n", f, err)
+		}
+		sum := sha256.Sum256(d)
+		sums[strings.TrimPrefix(f, archive)] = hex.EncodeToString(sum[:])
+	}
+	return sums
+}
+
+// checkSidecars checks the sidecars of archive against the sums in its
+// manifest m, none may be missing or added.
+func checkSidecars(archive string, m *manifest) error {
+	sums := sidecarSums(archive)
+	for s, want := range m.Sidecars {
+		if sum, present := sums[s]; !present {
+			return fmt.Errorf("%s is missing", filepath.Base(archive+s))
+		} else if sum != want {
+			return fmt.Errorf("checksum of %s is %s, manifest says %s", filepath.Base(archive+s), sum, want)
+		}
+	}
+	for s := range sums {
+		if _, present := m.Sidecars[s]; !present {
+			return fmt.Errorf("%s is not in the manifest", filepath.Base(archive+s))
+		}
+	}
+	return nil
+}
+
+// signManifest signs the manifest of archive with -sign-key.
+func signManifest(archive string, d []byte) {
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(signKey, d)) + "\n"
+	if err := os.WriteFile(manifestFile(archive)+".sig", []byte(sig), 0644); err != nil {
+		fatalf("Failed to write signature of %s. Error: %v\n", archive, err)
+	}
+}
+
+// verifyArchive checks archive and its sidecars against the sha256 in its
+// manifest, and the signature of the manifest when pub is set.
+func verifyArchive(archive string, pub ed25519.PublicKey) error {
+
+	d, err := os.ReadFile(manifestFile(archive))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("no manifest")
+	} else if err != nil {
+		return err
+	}
+
+	if pub != nil {
+		s, err := os.ReadFile(manifestFile(archive) + ".sig")
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("manifest is not signed")
+		} else if err != nil {
+			return err
+		}
+		sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(s)))
+		if err != nil || !ed25519.Verify(pub, d, sig) {
+			return errors.New("bad signature of manifest")
+		}
+	}
+
+	m := loadManifest(manifestFile(archive))
+	if len(m.SHA256) == 0 {
+		return errors.New("manifest has no checksum of the archive")
+	}
+	if sum := archiveSHA256(archive); sum != m.SHA256 {
+		return fmt.Errorf("checksum is %s, manifest says %s", sum, m.SHA256)
+	}
+	if m.Version < 3 {
+		// Older manifests have no sums of the sidecars
+		if pub != nil {
+			slog.Warn("Manifest is too old to cover the files next to the archive", "file", archive, "version", m.Version)
+		}
+		return nil
+	}
+	return checkSidecars(archive, m)
+}
+
+// verifyMain checks archives against their manifests without unpacking them.
+func verifyMain(args []string) {
+
+	var backupTarget, pubKey string
+	var scrub time.Duration
+	var nice bool
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory, to check every archive with a manifest in it.")
+	fs.StringVar(&pubKey, "pubkey", "", "ed25519 public key in PEM. Manifests must be signed with its private key.")
+	fs.DurationVar(&scrub, "scrub", 0, "With -b, only check the share of the archives due, so each is checked within this period when run every night, IE 720h, and record when.")
+	fs.BoolVar(&nice, "nice", false, "Run at low CPU and I/O priority.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [options] -b dir\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s verify [options] archive...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logOpts.setup()
+	if nice {
+		lowerPriority()
+	}
+
+	var pub ed25519.PublicKey
+	if len(pubKey) > 0 {
+		pub = loadVerifyKey(pubKey)
+	}
+
+	archives := fs.Args()
+	if len(backupTarget) > 0 {
+		files := globBackups(backupTarget, "lxd-backup-*.manifest.json")
+		for _, f := range files {
+			archives = append(archives, manifestArchive(f))
+		}
+	}
+	if (len(archives) == 0 && scrub == 0) || (scrub > 0 && (len(backupTarget) == 0 || fs.NArg() > 0)) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	sort.Strings(archives)
+
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+	var state map[string]scrubRecord
+	if scrub > 0 {
+		state = loadScrubState(lxdBackupPrefix)
+		// Of archives pruned since
+		present := make(map[string]bool)
+		for _, a := range archives {
+			present[filepath.Base(a)] = true
+		}
+		for a := range state {
+			if !present[a] {
+				delete(state, a)
+			}
+		}
+		all := len(archives)
+		archives = scrubShare(archives, state, scrub, nowUTC())
+		slog.Info("Scrubbing", "archives", len(archives), "of", all)
+	}
+
+	failed := 0
+	for _, a := range archives {
+		err := verifyArchive(a, pub)
+		if state != nil {
+			rec := scrubRecord{Time: timestamp(nowUTC())}
+			if err != nil {
+				rec.Error = err.Error()
+			}
+			state[filepath.Base(a)] = rec
+			saveScrubState(lxdBackupPrefix, state)
+		}
+		if err != nil {
+			fmt.Printf("FAILED %s: %v\n", filepath.Base(a), err)
+			failed++
+			continue
+		}
+		if m := loadManifest(manifestFile(a)); len(m.Excluded) > 0 {
+			slog.Info("Verified, paths left out on purpose", "file", a, "excluded", strings.Join(m.Excluded, ","))
+		} else {
+			slog.Info("Verified", "file", a)
+		}
+	}
+	if failed > 0 {
+		fatalf("%d of %d archives failed verification.\n", failed, len(archives))
+	}
+	fmt.Printf("All %d archives verified.\n", len(archives))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// backupSnapshots is -snapshots. Exports include the snapshots of the
+// instances, not --instance-only, and restore recreates them.
+var backupSnapshots bool
+
+// lxcSnapshots returns the names of the snapshots of the instance name.
+func lxcSnapshots(name string) []string {
+	var urls []string
+	out := execLxc([]string{"query", "/1.0/instances/" + name + "/snapshots"})
+	if err := json.Unmarshal([]byte(out), &urls); err != nil {
+		fatalf("Failed to list snapshots of %s. Error: %v\n", name, err)
+	}
+	snaps := make([]string, 0, len(urls))
+	for _, u := range urls {
+		snaps = append(snaps, path.Base(u))
+	}
+	return snaps
+}
+
+// dropSnapshots removes the snapshots of the backup m from the restored
+// instance ref, which lxc import recreated.
+func dropSnapshots(m *manifest, ref, project string) {
+	for _, s := range m.Snapshots {
+		slog.Info("Removing snapshot", "container", ref, "snapshot", s)
+		args := projectArgs(project, "delete", ref+"/"+s)
+		cmd, cancel := lxcCommand(args...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+		}
+	}
+}
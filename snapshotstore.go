@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// openSnapshotStore returns the backup program -backend names, or nil when
+// there is none and backups are made as quarters and deltas.
+func openSnapshotStore(backend string) lxdbackup.SnapshotStore {
+	if len(backend) == 0 {
+		return nil
+	}
+	if repo, ok := strings.CutPrefix(backend, "restic://"); ok && len(repo) > 0 {
+		return &lxdbackup.Restic{Repository: repo}
+	}
+	if repo, ok := strings.CutPrefix(backend, "borg://"); ok && len(repo) > 0 {
+		return &lxdbackup.Borg{Repository: repo}
+	}
+	fatalf("Unknown -backend %s. Supported are restic://repository and borg://repository.\n", backend)
+	return nil
+}
+
+// backupToStore is backup for a -backend, every run gives the whole export
+// to it, uncompressed so it can deduplicate it.
+func backupToStore(j *backupJob, s *schedule) {
+
+	defer j.stage("")
+
+	j.stage("stop")
+	j.before()
+	defer j.after()
+
+	exportName := tempExportName(s.tempDir, j.name)
+	exportIntent := intents.begin("write", j.name, exportName, "")
+	defer intents.done(exportIntent)
+
+	j.stage("export")
+	exportWithProgress(j, exportName, "")
+
+	j.stage("start")
+	j.after()
+
+	if st, err := os.Stat(exportName); err == nil {
+		j.exported = st.Size()
+	}
+	filterExport(j, exportName)
+
+	j.stage("store")
+	in := openArchive(exportName)
+	id, err := s.store.Store(j.name, in)
+	in.Close()
+	os.Remove(exportName)
+	if err != nil {
+		fatalf("Failed to store %s. Error: %v\n", j.name, err)
+	}
+	slog.Info("Stored", "name", j.name, "snapshot", id)
+
+	if err := pruneSnapshots(s, j.name); err != nil {
+		slog.Warn("Failed to remove old snapshots", "name", j.name, "error", err)
+	}
+
+	j.status = "stored"
+	appendRunRecord(s.prefix, s.historyMaxSize, runRecord{RunID: s.runID, Name: j.name, Status: j.status,
+		Bytes: j.exported})
+}
+
+// pruneSnapshots removes the snapshots of name beyond -repo-keep, or
+// without it, those the retention tiers don't keep.
+func pruneSnapshots(s *schedule, name string) error {
+
+	if s.repoKeep > 0 {
+		return s.store.Forget(name, s.repoKeep)
+	}
+
+	snaps, err := s.store.Snapshots(name)
+	if err != nil {
+		return err
+	}
+	keep := s.retention.Retained(snaps)
+	var drop []string
+	for _, sn := range snaps {
+		if !keep[sn.ID] {
+			drop = append(drop, sn.ID)
+		}
+	}
+	if len(drop) > 0 {
+		slog.Info("Removing snapshots the retention tiers don't keep", "name", name, "snapshots", len(drop))
+	}
+	return s.store.Delete(name, drop...)
+}
+
+// fetchSnapshot writes the snapshot id of name, or the newest one, to a
+// temporary tarball in tempDir.
+func fetchSnapshot(store lxdbackup.SnapshotStore, tempDir, name, id string) string {
+
+	if len(id) == 0 {
+		id = "latest"
+	}
+	fname := filepath.Join(tempDir, "lxd-temporary-rebuild-"+fileTimestamp(nowUTC())+".tar")
+	f, err := os.Create(fname)
+	if err != nil {
+		fatalf("Failed to create %s. Error: %v\n", fname, err)
+	}
+	slog.Info("Fetching", "name", name, "snapshot", id)
+	err = store.Fetch(name, id, throttleWriter(f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fname)
+		fatalf("Failed to fetch snapshot %s of %s. Error: %v\n", id, name, err)
+	}
+	return fname
+}
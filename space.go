@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+)
+
+// spaceMargin is -space-margin, how many percent more free space than the
+// estimated size of an export there must be before it is started. Negative
+// turns the check off.
+var spaceMargin int
+
+// lxcDiskUsage returns how much of its storage pool an instance uses, 0 if
+// LXD doesn't know.
+func lxcDiskUsage(name string) int64 {
+	s, err := lxd.State(name)
+	if err != nil {
+		return 0
+	}
+	return s.DiskUsage()
+}
+
+// lxcVolumeUsage is lxcDiskUsage for a custom storage volume.
+func lxcVolumeUsage(v *volumeState) int64 {
+
+	out, err := lxcOutput("query", "/1.0/storage-pools/"+v.pool+"/volumes/custom/"+v.name+"/state")
+	if err != nil {
+		return 0
+	}
+
+	var state struct {
+		Usage struct {
+			Used int64 `json:"used"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(out, &state) != nil {
+		return 0
+	}
+	return state.Usage.Used
+}
+
+// estimateExport guesses the size of the export of j. The last export is the
+// best guess, as it is compressed like the next one. Without one, or when the
+// container shrank, the disk usage is used, which only compression makes
+// smaller.
+func estimateExport(j *backupJob, last int64) int64 {
+	var usage int64
+	if j.diskUsage != nil {
+		usage = j.diskUsage()
+	}
+	if last > 0 && (usage == 0 || last < usage) {
+		return last
+	}
+	return usage
+}
+
+// checkSpace tells whether there is room for the backup of j. The export
+// goes to the temporary directory when a delta is made of it, and the delta
+// to the backup target, so both must have room for it.
+func checkSpace(j *backupJob, s *schedule, last int64) error {
+
+	if spaceMargin < 0 {
+		return nil
+	}
+	est := estimateExport(j, last)
+	if est == 0 {
+		slog.Debug("Size of export unknown, not checking free space", "name", j.name)
+		return nil
+	}
+	est += est * int64(spaceMargin) / 100
+
+	backupTarget := filepath.Dir(s.prefix)
+	need := map[string]int64{backupTarget: est}
+	if fileExists(findArchive(backupPrefix(s.prefix, j.name, s.quarter) + j.name + s.quarter)) {
+		need[filepath.Clean(s.tempDir)] += est
+	}
+
+	for dir, n := range need {
+		free, err := diskFree(dir)
+		if err != nil {
+			slog.Debug("Free space unknown, not checking it", "dir", dir, "error", err)
+			continue
+		}
+		slog.Debug("Free space", "name", j.name, "dir", dir, "needed", humanBytes(n), "free", humanBytes(free))
+		if n > free {
+			return fmt.Errorf("needs about %s in %s, only %s is free", humanBytes(n), dir, humanBytes(free))
+		}
+	}
+	return nil
+}
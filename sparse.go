@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sparseFiles is -sparse. Regular files with holes are written as GNU
+// sparse entries, PAX format 1.0, which archive/tar reads but can't write.
+var sparseFiles bool
+
+const (
+	// sparseBlock is the unit holes are found in, the usual block size
+	sparseBlock = 4096
+	// sparseMinSize is the size below which holes aren't looked for
+	sparseMinSize = 1 << 20
+)
+
+// dataSegment is a part of a sparse file that isn't a hole.
+type dataSegment struct {
+	off, n int64
+}
+
+// writeEntry writes hdr and its content r to tw. With -sparse, a regular
+// file with a quarter or more of it in holes is written as a sparse entry.
+// It is spooled next to the archive to find them, sparse on disk too.
+func writeEntry(tw *tarArchive, hdr *tar.Header, r io.Reader) error {
+
+	if !sparseFiles || hdr.Typeflag != tar.TypeReg || hdr.Size < sparseMinSize {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(tw.name), "lxd-temporary-sparse-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	os.Remove(f.Name()) // Gone on close, whatever happens
+
+	var segs []dataSegment
+	var data, off int64
+	buf := make([]byte, sparseBlock)
+	zero := make([]byte, sparseBlock)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else {
+				if _, err := f.Write(buf[:n]); err != nil {
+					return err
+				}
+				if l := len(segs) - 1; l >= 0 && segs[l].off+segs[l].n == off {
+					segs[l].n += int64(n)
+				} else {
+					segs = append(segs, dataSegment{off: off, n: int64(n)})
+				}
+				data += int64(n)
+			}
+			off += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if off != hdr.Size {
+		return fmt.Errorf("%s is %d bytes, header says %d", hdr.Name, off, hdr.Size)
+	}
+
+	if (hdr.Size-data)*4 < hdr.Size {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(tw, f, hdr.Size)
+		return err
+	}
+	return writeSparse(tw, hdr, segs, data, f)
+}
+
+// writeSparse writes hdr as a PAX 1.0 sparse entry: a sparse map of the
+// data segments, then the data, taken from f at the same offsets.
+func writeSparse(tw *tarArchive, hdr *tar.Header, segs []dataSegment, data int64, f *os.File) error {
+
+	// A trailing hole still needs an entry, so the size comes out right
+	if l := len(segs) - 1; l < 0 || segs[l].off+segs[l].n < hdr.Size {
+		segs = append(segs, dataSegment{off: hdr.Size})
+	}
+	var sm strings.Builder
+	fmt.Fprintf(&sm, "%d\n", len(segs))
+	for _, s := range segs {
+		fmt.Fprintf(&sm, "%d\n%d\n", s.off, s.n)
+	}
+	smap := make([]byte, blockPadded(int64(sm.Len())))
+	copy(smap, sm.String())
+
+	name := hdr.Name
+	stored := path.Join(path.Dir(name), "GNUSparseFile.0", path.Base(name))
+	size := int64(len(smap)) + data
+
+	records := map[string]string{
+		"path":                stored,
+		"size":                strconv.FormatInt(size, 10),
+		"mtime":               fmt.Sprintf("%d.%09d", hdr.ModTime.Unix(), hdr.ModTime.Nanosecond()),
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+		"uname":               hdr.Uname,
+		"gname":               hdr.Gname,
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	for k, v := range hdr.PAXRecords {
+		if _, ok := records[k]; !ok && !strings.HasPrefix(k, "GNU.sparse.") && k != "atime" && k != "ctime" {
+			records[k] = v
+		}
+	}
+	pax := paxRecords(records)
+
+	var head bytes.Buffer
+	head.Write(ustarHeader("PaxHeaders.0/"+path.Base(name), 0644, int64(len(pax)), hdr.ModTime.Unix(), tar.TypeXHeader, 0, 0, "", ""))
+	head.Write(pax)
+	head.Write(make([]byte, blockPadded(int64(len(pax)))-int64(len(pax))))
+	head.Write(ustarHeader(stored, hdr.Mode, size, hdr.ModTime.Unix(), tar.TypeReg, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname))
+	head.Write(smap)
+
+	w, err := tw.writeRaw(name, head.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if s.n == 0 {
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, s.off, s.n)); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(make([]byte, blockPadded(size)-size))
+	return err
+}
+
+func blockPadded(n int64) int64 {
+	return (n + 511) / 512 * 512
+}
+
+// paxRecords encodes records as the content of a PAX extended header.
+func paxRecords(records map[string]string) []byte {
+
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		rec := " " + k + "=" + records[k] + "\n"
+		// The length counts its own digits
+		n := len(rec) + len(strconv.Itoa(len(rec)))
+		if len(strconv.Itoa(n)) != len(strconv.Itoa(len(rec))) {
+			n++
+		}
+		b.WriteString(strconv.Itoa(n) + rec)
+	}
+	return b.Bytes()
+}
+
+// ustarHeader is a header block. What doesn't fit is left out, the PAX
+// header before it has it all.
+func ustarHeader(name string, mode, size, mtime int64, typeflag byte, uid, gid int, uname, gname string) []byte {
+
+	b := make([]byte, 512)
+	field := func(off, width int, s string) {
+		if len(s) > width {
+			s = s[:width]
+		}
+		copy(b[off:off+width], s)
+	}
+	octal := func(off, width int, v int64) {
+		s := strconv.FormatInt(v, 8)
+		if v >= 0 && len(s) < width {
+			field(off, width, strings.Repeat("0", width-1-len(s))+s)
+		}
+	}
+
+	field(0, 100, name)
+	octal(100, 8, mode&07777)
+	octal(108, 8, int64(uid))
+	octal(116, 8, int64(gid))
+	octal(124, 12, size)
+	octal(136, 12, mtime)
+	b[156] = typeflag
+	field(257, 6, "ustar")
+	field(263, 2, "00")
+	field(265, 32, uname)
+	field(297, 32, gname)
+
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
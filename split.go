@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// volumeSize is -volume-size, archives bigger than this are split into
+// parts. 0 means never.
+var volumeSize int64
+
+// archivePart is a part of a split archive. The first part keeps the name
+// of the archive, so existing tools and the tier rotation see it as usual,
+// the others are name.part2, name.part3 and so on.
+type archivePart struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+var partFile = regexp.MustCompile(`\.(part\d+|parts\.json)$`)
+
+func partName(fname string, i int) string {
+	if i == 0 {
+		return fname
+	}
+	return fmt.Sprintf("%s.part%d", fname, i+1)
+}
+
+// parseSize parses a size like 4G or 700M, in bytes without a suffix.
+func parseSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	mult := int64(1)
+	if i := strings.IndexAny(s, "KMGTkmgt"); i == len(s)-1 {
+		mult = int64(1) << (10 * (strings.IndexByte("KMGT", strings.ToUpper(s[i:])[0]) + 1))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %s", s)
+	}
+	return n * mult, nil
+}
+
+// loadParts returns the parts of a split archive, nil if it isn't split.
+func loadParts(fname string) []archivePart {
+	d, err := os.ReadFile(fname + ".parts.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		fatalf("Failed to read parts of %s. Error: %v\n", fname, err)
+	}
+	var parts []archivePart
+	if err := json.Unmarshal(d, &parts); err != nil {
+		fatalf("Failed to decode parts of %s. Error: %v\n", fname, err)
+	}
+	return parts
+}
+
+// archiveSize is the size of an archive, all parts together.
+func archiveSize(fname string) int64 {
+	if parts := loadParts(fname); parts != nil {
+		var size int64
+		for _, p := range parts {
+			size += p.Size
+		}
+		return size
+	}
+	if st, err := os.Stat(fname); err == nil {
+		return st.Size()
+	}
+	return 0
+}
+
+// splitArchive cuts an archive bigger than -volume-size into parts. The
+// parts and their list are written before the first part is cut short, and
+// readers only read as much of it as the list says, so a crash half way
+// leaves a readable archive.
+func splitArchive(fname string) {
+
+	st, err := os.Stat(fname)
+	if volumeSize == 0 || err != nil || st.Size() <= volumeSize || loadParts(fname) != nil {
+		return
+	}
+
+	f, err := os.Open(fname)
+	if err != nil {
+		fatalf("Failed to open %s. Error: %v\n", fname, err)
+	}
+	defer f.Close()
+
+	var parts []archivePart
+	for i, left := 0, st.Size(); left > 0; i++ {
+		n := min(left, volumeSize)
+		h := sha256.New()
+		var w io.Writer = h
+		var out *os.File
+		if i > 0 {
+			out, err = os.OpenFile(partName(fname, i), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				fatalf("Failed to create %s. Error: %v\n", partName(fname, i), err)
+			}
+			w = io.MultiWriter(h, out)
+		}
+		_, err := io.CopyN(w, f, n)
+		if out != nil {
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fatalf("Failed to write %s. Error: %v\n", partName(fname, i), err)
+		}
+		parts = append(parts, archivePart{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+		left -= n
+	}
+
+	d, err := json.MarshalIndent(parts, "", "  ")
+	if err == nil {
+		err = os.WriteFile(fname+".parts.json", d, 0644)
+	}
+	if err == nil {
+		err = os.Truncate(fname, volumeSize)
+	}
+	if err != nil {
+		fatalf("Failed to split %s. Error: %v\n", fname, err)
+	}
+	slog.Info("Split archive", "file", fname, "parts", len(parts))
+}
+
+// finishArchive splits a finished archive with -volume-size and makes its
+// parity with -parity.
+func finishArchive(fname string) {
+	splitArchive(fname)
+	writeParity(fname)
+}
+
+// partsReader reads the parts of a split archive as one file. Read
+// through from the start, each part is checked against its checksum.
+type partsReader struct {
+	fname  string
+	files  []*os.File
+	parts  []archivePart
+	starts []int64
+	size   int64
+
+	off     int64
+	verify  bool
+	hashing int // Part being hashed
+	hash    hash.Hash
+}
+
+// openParts opens an archive, split or not.
+func openParts(fname string) (io.ReadSeekCloser, error) {
+
+	parts := loadParts(fname)
+	if parts == nil {
+		return os.Open(fname)
+	}
+
+	p := &partsReader{fname: fname, parts: parts, verify: true, hash: sha256.New()}
+	for i := range parts {
+		f, err := os.Open(partName(fname, i))
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.files = append(p.files, f)
+		p.starts = append(p.starts, p.size)
+		p.size += parts[i].Size
+	}
+	return p, nil
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+
+	if p.off >= p.size {
+		return 0, io.EOF
+	}
+	i := len(p.starts) - 1
+	for p.starts[i] > p.off {
+		i--
+	}
+	at := p.off - p.starts[i]
+	if left := p.parts[i].Size - at; int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := p.files[i].ReadAt(b, at)
+	if errors.Is(err, io.EOF) && n == len(b) {
+		err = nil
+	} else if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("part %d of %s is short", i+1, p.fname)
+	}
+	p.off += int64(n)
+
+	if p.verify && i == p.hashing {
+		p.hash.Write(b[:n])
+		if at+int64(n) == p.parts[i].Size {
+			if hex.EncodeToString(p.hash.Sum(nil)) != p.parts[i].SHA256 {
+				return n, fmt.Errorf("part %d of %s is damaged", i+1, p.fname)
+			}
+			p.hash.Reset()
+			p.hashing++
+		}
+	}
+	return n, err
+}
+
+func (p *partsReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += p.off
+	case io.SeekEnd:
+		offset += p.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek before the start of %s", p.fname)
+	}
+	if offset != p.off {
+		p.verify = false // Only checked when read through
+	}
+	p.off = offset
+	return offset, nil
+}
+
+func (p *partsReader) Close() error {
+	for _, f := range p.files {
+		f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitArchive(t *testing.T) {
+
+	defer func(v int64) { volumeSize = v }(volumeSize)
+	volumeSize = 1000
+
+	data := make([]byte, 2500)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, c := range []struct {
+		size  int
+		parts int
+	}{
+		{500, 1}, {1000, 1}, {1001, 2}, {2500, 3},
+	} {
+		fname := filepath.Join(t.TempDir(), "lxd-backup-web-Q20264.tar.zst")
+		if err := os.WriteFile(fname, data[:c.size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		splitArchive(fname)
+		if n := max(len(loadParts(fname)), 1); n != c.parts {
+			t.Errorf("%d bytes: %d parts, want %d", c.size, n, c.parts)
+		}
+		if size := archiveSize(fname); size != int64(c.size) {
+			t.Errorf("%d bytes: size %d", c.size, size)
+		}
+
+		r, err := openParts(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data[:c.size]) {
+			t.Errorf("%d bytes: read back %d bytes, %v", c.size, len(got), err)
+		}
+
+		// Seeking, as parity and seekable archives do
+		if _, err := r.Seek(int64(c.size/2), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, data[c.size/2:c.size]) {
+			t.Errorf("%d bytes: read back %d bytes from the middle, %v", c.size, len(got), err)
+		}
+		r.Close()
+	}
+}
+
+func TestPartsReaderDamage(t *testing.T) {
+
+	defer func(v int64) { volumeSize = v }(volumeSize)
+	volumeSize = 100
+
+	for _, c := range []struct {
+		name string
+		part int
+		data string
+	}{
+		{"damaged", 1, strings.Repeat("y", 100)},
+		{"short", 2, "x"},
+	} {
+		fname := filepath.Join(t.TempDir(), "lxd-backup-web-Q20264.tar.zst")
+		os.WriteFile(fname, bytes.Repeat([]byte("x"), 250), 0644)
+		splitArchive(fname)
+		os.WriteFile(partName(fname, c.part), []byte(c.data), 0644)
+
+		r, err := openParts(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil || !strings.Contains(err.Error(), c.name) {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Nagios plugin exit codes.
+const (
+	nagiosOK       = 0
+	nagiosCritical = 2
+	nagiosUnknown  = 3
+)
+
+// lastSuccess returns when the newest successful run in the history of name
+// was, looking into rotated history files as well. Zero if there is none.
+func lastSuccess(lxdBackupPrefix, name string) time.Time {
+	return lastRun(lxdBackupPrefix, name, func(r *runRecord) bool { return r.Status != "failed" })
+}
+
+// lastRun is lastSuccess for the runs match picks.
+func lastRun(lxdBackupPrefix, name string, match func(r *runRecord) bool) time.Time {
+
+	fname := containerPrefix(lxdBackupPrefix, name) + name + ".log.jsonl"
+
+	for i := 0; i < 4; i++ {
+		f := fname
+		if i > 0 {
+			f = fmt.Sprintf("%s.%d", fname, i)
+		}
+		fh, err := os.Open(f)
+		if err != nil {
+			continue
+		}
+
+		var last time.Time
+		sc := bufio.NewScanner(fh)
+		for sc.Scan() {
+			var r runRecord
+			if json.Unmarshal(sc.Bytes(), &r) != nil || !match(&r) {
+				continue
+			}
+			if t, err := time.Parse(time.RFC3339, r.Time); err == nil && t.After(last) {
+				last = t
+			}
+		}
+		fh.Close()
+
+		if !last.IsZero() {
+			return last
+		}
+	}
+	return time.Time{}
+}
+
+// historyNames lists the containers and volumes that have a run history in
+// the backup directory.
+func historyNames(lxdBackupPrefix string) []string {
+	var names []string
+	for _, f := range globBackups(filepath.Dir(lxdBackupPrefix), filepath.Base(lxdBackupPrefix)+"*.log.jsonl") {
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), filepath.Base(lxdBackupPrefix)), ".log.jsonl"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func statusMain(args []string) {
+
+	var backupTarget, contExcStr, contIncStr string
+	var maxAge time.Duration
+
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.DurationVar(&maxAge, "max-age", 26*time.Hour, "Newest successful backup must be younger than this.")
+	fs.StringVar(&contExcStr, "ec", "", "Containers to leave out. Comma separated.")
+	fs.StringVar(&contIncStr, "ic", "", "Only check these containers, also if they never were backed up. Comma separated.")
+	fs.Parse(args)
+
+	if st, err := os.Stat(backupTarget); err != nil || !st.IsDir() {
+		fmt.Printf("LXD-BACKUP UNKNOWN - Backup directory %q is not available\n", backupTarget)
+		os.Exit(nagiosUnknown)
+	}
+
+	lxdBackupPrefix := filepath.Join(backupTarget, "lxd-backup-")
+
+	names := historyNames(lxdBackupPrefix)
+	if len(contIncStr) > 0 {
+		names = strings.Split(contIncStr, ",")
+	}
+	exclude := make(map[string]bool)
+	for _, n := range strings.Split(contExcStr, ",") {
+		exclude[n] = true
+	}
+
+	now := nowUTC()
+	var stale []string
+	checked := 0
+	for _, name := range names {
+		if exclude[name] {
+			continue
+		}
+		checked++
+		last := lastSuccess(lxdBackupPrefix, name)
+		switch {
+		case last.IsZero():
+			stale = append(stale, name+" (never)")
+		case now.Sub(last) > maxAge:
+			stale = append(stale, fmt.Sprintf("%s (%s ago)", name, now.Sub(last).Truncate(time.Minute)))
+		}
+	}
+
+	perf := fmt.Sprintf("stale=%d;;1;0;%d total=%d", len(stale), checked, checked)
+
+	if checked == 0 {
+		fmt.Printf("LXD-BACKUP UNKNOWN - No backups found in %s | %s\n", backupTarget, perf)
+		os.Exit(nagiosUnknown)
+	}
+	if len(stale) > 0 {
+		fmt.Printf("LXD-BACKUP CRITICAL - %d of %d without a successful backup in %s: %s | %s\n",
+			len(stale), checked, maxAge, strings.Join(stale, ", "), perf)
+		os.Exit(nagiosCritical)
+	}
+	fmt.Printf("LXD-BACKUP OK - All %d backed up within %s | %s\n", checked, maxAge, perf)
+	os.Exit(nagiosOK)
+}
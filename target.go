@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// targetTimeout is how long a write to the backup target may take before it
+// is considered unavailable, IE a hung NFS mount.
+const targetTimeout = 30 * time.Second
+
+// probeTarget checks that a file can be written to dir. dir is not created
+// when it is missing, IE an unmounted mount point that went away, as the
+// backups would fill the filesystem below it.
+func probeTarget(dir string) error {
+
+	if len(dir) == 0 {
+		dir = "."
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer recoverPanic()
+		if st, err := os.Stat(dir); err != nil {
+			done <- err
+			return
+		} else if !st.IsDir() {
+			done <- fmt.Errorf("%s is not a directory", dir)
+			return
+		}
+		f, err := os.CreateTemp(dir, ".lxd-backup-probe-")
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = f.WriteString("lxd-backup\n")
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		os.Remove(f.Name())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(targetTimeout):
+		return fmt.Errorf("no answer in %s", targetTimeout)
+	}
+}
+
+// checkTarget gives up with exitTargetUnavailable unless the backup and
+// temporary directories can be written to. It is done before containers are
+// stopped, so a missing mount doesn't leave them down for nothing.
+func checkTarget(backupTarget, tempDir string, requireMount bool) {
+
+	if requireMount {
+		mounted, err := isMountPoint(backupTarget)
+		if err != nil {
+			fatalExit(exitTargetUnavailable, "Backup target %s is not available. Error: %v\n", backupTarget, err)
+		}
+		if !mounted {
+			fatalExit(exitTargetUnavailable, "Backup target %s is not mounted.\n", backupTarget)
+		}
+	}
+
+	for _, dir := range []string{backupTarget, tempDir} {
+		if err := probeTarget(dir); err != nil {
+			fatalExit(exitTargetUnavailable, "Backup target %s is not available. Error: %v\n", dir, err)
+		}
+	}
+}
+
+// defaultTempDir is where exports deltas are made from go without -tmpdir:
+// the backup directory, unless it is on network storage, which is slow to
+// write an export to and read it back from. Then it is $TMPDIR or /var/tmp,
+// not /tmp which is often in memory.
+func defaultTempDir(backupTarget string) string {
+	kind, err := networkFilesystem(backupTarget)
+	if err != nil || len(kind) == 0 {
+		return backupTarget
+	}
+	dir := os.Getenv("TMPDIR")
+	if len(dir) == 0 {
+		dir = "/var/tmp"
+	}
+	slog.Info("Backup directory is on network storage, using local temporary directory", "fs", kind, "dir", dir)
+	return dir
+}
+
+// tempExportName is the name of a temporary export in dir, IE of the
+// container name. It has the host and pid of the run in it, for
+// removeTempExports to tell the exports of runs still going.
+func tempExportName(dir, name string) string {
+	host, _ := os.Hostname()
+	return filepath.Join(dir, fmt.Sprintf("lxd-temporary-backup-%d_%s_%s-%s.tar.zstd", os.Getpid(), host, name, fileTimestamp(nowUTC())))
+}
+
+var tempExportRun = regexp.MustCompile(`^lxd-temporary-backup-(\d+)_([^_]+)_`)
+
+// removeTempExports removes the temporary exports crashed runs on this host
+// left in dir. Those of runs still going, or on other hosts sharing dir,
+// are left alone.
+func removeTempExports(dir string) {
+	host, _ := os.Hostname()
+	files, _ := filepath.Glob(filepath.Join(dir, "lxd-temporary-backup-*"))
+	for _, f := range files {
+		m := tempExportRun.FindStringSubmatch(filepath.Base(f))
+		if m == nil {
+			slog.Warn("Not removing temporary export of an unknown run", "file", f)
+			continue
+		}
+		pid, _ := strconv.Atoi(m[1])
+		if m[2] != host || pid <= 0 || !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH) {
+			continue
+		}
+		slog.Warn("Removing temporary export of a crashed run", "file", f)
+		os.Remove(f)
+	}
+}
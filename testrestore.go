@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// drillName is the name of the throwaway instance a test restore of name is
+// restored as. It has the time in it, so a drill never hits an instance
+// that exists, and LXD limits names to 63 characters.
+func drillName(name string) string {
+	suffix := "-drill-" + nowUTC().Format("20060102150405")
+	if len(name)+len(suffix) > 63 {
+		name = strings.TrimRight(name[:63-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// execArgs is lxc exec of command in the instance ref with sh -c.
+func execArgs(ref, project, command string) []string {
+	return append(projectArgs(project, "exec", ref), "--", "sh", "-c", command)
+}
+
+// isolateDisks masks all disk devices of the restored instance ref but its
+// root disk, so that the drill can't write to host directories or custom
+// volumes the original uses.
+func isolateDisks(ref, project string) {
+	out, err := lxcOutput(projectArgs(project, "config", "show", ref, "--expanded")...)
+	if err != nil {
+		fatalf("Failed to read the config of %s. Error: %v\n", ref, err)
+	}
+	m := &manifest{Config: string(out)}
+	for _, dev := range m.diskDevices() {
+		slog.Info("Disconnecting disk device", "container", ref, "device", dev)
+		// Only works for devices of the instance itself, not from profiles
+		lxcRun(projectArgs(project, "config", "device", "remove", ref, dev)...)
+
+		cmd, cancel := lxcCommand(projectArgs(project, "config", "device", "add", ref, dev, "none")...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		cancel()
+		if err != nil {
+			fatalf("Failed to disconnect %s from %s. Error: %v\n", dev, ref, err)
+		}
+	}
+	out, err = lxcOutput(projectArgs(project, "config", "show", ref, "--expanded")...)
+	if err != nil {
+		fatalf("Failed to read the config of %s. Error: %v\n", ref, err)
+	}
+	if left := (&manifest{Config: string(out)}).diskDevices(); len(left) > 0 {
+		fatalf("Disk devices %s of %s are still there, not starting it.\n", strings.Join(left, ","), ref)
+	}
+}
+
+// testRestoreMain is a fire drill: it restores the latest backup of a
+// container as a throwaway instance, boots it, runs a health command in it
+// and deletes it again. Run from cron, it proves that the backups can
+// actually be restored, while there still is something to restore from.
+func testRestoreMain(args []string) {
+
+	var backupTarget, tempDir, deltaName, configFile string
+	var project, remote, health string
+	var isolate, useRepo, keep bool
+	var snapshot, requireSig, backend string
+	var timeout time.Duration
+	var hc healthcheck
+
+	fs := flag.NewFlagSet("test-restore", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	fs.StringVar(&backupTarget, "b", "", "Backup directory.")
+	fs.StringVar(&tempDir, "t", "", "Temporary directory.")
+	fs.StringVar(&deltaName, "d", "", "Delta to apply on top of the quarter backup, IE M10, WN2 or WD3.")
+	fs.StringVar(&project, "project", "", "Restore into this project, IE one kept for fire drills.")
+	fs.StringVar(&remote, "remote", "", "Restore onto this lxc remote instead of the default one.")
+	fs.BoolVar(&isolate, "isolate-network", true, "Disconnect all network devices of the restored container, so it can't clash with the original.")
+	fs.StringVar(&health, "health", "", "Command run with sh -c in the restored container, IE \"systemctl is-system-running --wait\". Default is only checking that it boots and runs commands.")
+	fs.DurationVar(&timeout, "timeout", 5*time.Minute, "How long the container gets to boot and pass the health command.")
+	fs.BoolVar(&keep, "keep", false, "Keep the restored container when the test fails, to look into why.")
+	fs.BoolVar(&useRepo, "repo", false, "Restore from the repository instead of quarters and deltas.")
+	fs.StringVar(&backend, "backend", "", "Restore from this backup program, as the backups were made with -backend.")
+	fs.StringVar(&snapshot, "snapshot", "", "Run id of the repository snapshot, or id of the -backend snapshot, to restore. Default is the newest.")
+	fs.StringVar(&requireSig, "require-signature", "", "Only restore backups whose manifests are signed by the private key of this ed25519 public key in PEM.")
+	fs.StringVar(&configFile, "config", "", "JSON config file, for the retention tiers the backups were made with.")
+	fs.StringVar(&hc.url, "healthcheck-url", "", "Ping this URL at start (/start), success and failure (/fail) of the test.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s test-restore [options] container\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	pos := parseAnywhere(fs, args)
+
+	logOpts.setup()
+
+	if len(pos) != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	name := pos[0]
+	if len(tempDir) == 0 {
+		tempDir = backupTarget
+	}
+	if len(health) == 0 {
+		health = "true"
+	}
+
+	conf := loadConfig(configFile)
+
+	target := drillName(name)
+	ref := remoteName(remote, target)
+	if lxcRun(projectArgs(project, "config", "show", ref)...) == nil {
+		fatalf("%s already exists, not restoring over it.\n", ref)
+	}
+
+	hc.ping(hc.url, "/start", "")
+
+	// From here on, whatever happens, the drill instance must not be left behind
+	cleanup := func(failed bool) {
+		if failed && keep {
+			slog.Warn("Keeping the restored container", "name", ref)
+			return
+		}
+		slog.Info("Deleting", "container", ref)
+		cmd, cancel := lxcCommand(projectArgs(project, "delete", "--force", ref)...)
+		defer cancel()
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil && lxcRun(projectArgs(project, "config", "show", ref)...) == nil {
+			slog.Error("Failed to delete the restored container", "name", ref, "error", err)
+		}
+	}
+	atExit(func(msg string) {
+		cleanup(true)
+		hc.ping(hc.url, "/fail", fmt.Sprintf("Test restore of %s failed: %s", name, msg))
+	})
+
+	o := &restoreOptions{
+		backupTarget: backupTarget,
+		tempDir:      tempDir,
+		deltaName:    deltaName,
+		project:      project,
+		remote:       remote,
+		isolate:      isolate,
+		useRepo:      useRepo,
+		store:        openSnapshotStore(backend),
+		snapshot:     snapshot,
+		requireSig:   requireSig,
+		retention:    conf.Retention,
+	}
+	restoreInstance(o, name, target, nil)
+	isolateDisks(ref, project)
+
+	started := time.Now()
+	slog.Info("Starting", "container", ref)
+	cmd, cancel := lxcCommand(projectArgs(project, "start", ref)...)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to start %s. Error: %v\n", ref, err)
+	}
+
+	// Containers run commands right away, VMs once their agent is up, and
+	// services may need a while longer, so the health command is retried
+	deadline := started.Add(timeout)
+	var out []byte
+	var err error
+	for {
+		cmd, cancel := timedCommand(time.Until(deadline), "lxc", execArgs(ref, project, health))
+		out, err = cmd.CombinedOutput()
+		cancel()
+		if err == nil || !time.Now().Add(5*time.Second).Before(deadline) {
+			break
+		}
+		slog.Debug("Health command failed, trying again", "container", ref, "error", err)
+		time.Sleep(5 * time.Second)
+	}
+	if err != nil {
+		fatalf("Health command %q failed in %s within %s. Error: %v\n%s", health, ref, timeout, err, out)
+	}
+
+	msg := fmt.Sprintf("Test restore of %s passed, healthy after %s.", name, time.Since(started).Round(time.Second))
+	cleanup(false)
+	hc.ping(hc.url, "", msg)
+	fmt.Println(msg)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bwLimit is -bwlimit, in bytes per second, shared by everything lxd-backup
+// reads and writes of archives. 0 means no limit.
+var bwLimit int64
+
+// tokenBucket lets through rate bytes per second, and bursts of up to a
+// second's worth after being idle.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+var bandwidth tokenBucket
+
+// wait blocks until n bytes may pass.
+func (b *tokenBucket) wait(n int) {
+
+	if bwLimit == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	if b.rate == 0 {
+		b.rate, b.tokens, b.last = float64(bwLimit), float64(bwLimit), now
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	// Taken up front, so others wait behind this one
+	b.tokens -= float64(n)
+	short := -b.tokens
+	b.mu.Unlock()
+
+	if short > 0 {
+		time.Sleep(time.Duration(short / b.rate * float64(time.Second)))
+	}
+}
+
+type throttledReader struct {
+	r io.Reader
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the bursts small
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err := t.r.Read(p)
+	bandwidth.wait(n)
+	return n, err
+}
+
+type throttledWriter struct {
+	w io.Writer
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), 64<<10)]
+		bandwidth.wait(len(chunk))
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttleReader limits r to -bwlimit.
+func throttleReader(r io.Reader) io.Reader {
+	if bwLimit == 0 {
+		return r
+	}
+	return throttledReader{r}
+}
+
+// throttleWriter limits w to -bwlimit.
+func throttleWriter(w io.Writer) io.Writer {
+	if bwLimit == 0 {
+		return w
+	}
+	return throttledWriter{w}
+}
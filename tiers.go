@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tierState is when each delta tier of each container was last written, by
+// container name and tier name, kept in lxd-backup-tiers.json. A slot is due
+// when it wasn't written during the current period of its tier, IE the
+// host was off on the 1st and no run has written the month tier since. Due
+// slots are written even if nothing changed, so they never hold a period
+// long gone.
+type tierState struct {
+	mu      sync.Mutex
+	fname   string
+	written map[string]map[string]string
+}
+
+func loadTierState(lxdBackupPrefix string) *tierState {
+	ts := &tierState{fname: lxdBackupPrefix + "tiers.json", written: make(map[string]map[string]string)}
+	d, err := os.ReadFile(ts.fname)
+	if errors.Is(err, os.ErrNotExist) {
+		return ts
+	} else if err != nil {
+		fatalf("Failed to read tier state %s. Error: %v\n", ts.fname, err)
+	}
+	if err := json.Unmarshal(d, &ts.written); err != nil {
+		slog.Warn("Ignoring broken tier state, going by file times", "file", ts.fname, "error", err)
+		ts.written = make(map[string]map[string]string)
+	}
+	return ts
+}
+
+// due tells whether the slot d of name is to be written this run.
+func (ts *tierState) due(lxdBackupPrefix, name string, d deltaSlot) bool {
+	st, err := os.Stat(findArchive(backupPrefix(lxdBackupPrefix, name, d.suffix) + name + d.suffix))
+	if err != nil {
+		return true
+	}
+	ts.mu.Lock()
+	written := ts.written[name][d.tier.Name]
+	ts.mu.Unlock()
+	if w, err := time.Parse(time.RFC3339, written); err == nil {
+		return w.Before(d.since)
+	}
+	// Made before the state was kept
+	return st.ModTime().Before(d.since)
+}
+
+// anyDue tells whether any of the slots of this run is due for name.
+func (ts *tierState) anyDue(s *schedule, name string) bool {
+	for _, d := range s.deltas {
+		if ts.due(s.prefix, name, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// record notes that the slot d of name was written at t.
+func (ts *tierState) record(name string, d deltaSlot, t time.Time) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.written[name] == nil {
+		ts.written[name] = make(map[string]string)
+	}
+	ts.written[name][d.tier.Name] = timestamp(t)
+
+	data, err := json.MarshalIndent(ts.written, "", "  ")
+	if err == nil {
+		err = writeFilePartial(ts.fname, data, 0644)
+	}
+	if err != nil {
+		fatalf("Failed to write tier state %s. Error: %v\n", ts.fname, err)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"time"
+)
+
+// All timestamps lxd-backup stores, in filenames, logs and manifests, are UTC.
+// Only output meant for humans is shown in displayLocation.
+var displayLocation = time.UTC
+
+// fileTimeFormat is RFC3339 without the characters that are troublesome in filenames.
+const fileTimeFormat = "20060102T150405.000000000Z"
+
+func nowUTC() time.Time {
+	return time.Now().UTC()
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func fileTimestamp(t time.Time) string {
+	return t.UTC().Format(fileTimeFormat)
+}
+
+func displayTime(t time.Time) string {
+	return t.In(displayLocation).Format(time.RFC3339)
+}
+
+func setDisplayTimezone(name string) {
+	if len(name) == 0 {
+		return
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		fatalf("Unknown timezone %s. Error: %v\n", name, err)
+	}
+	displayLocation = loc
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lxd-backup/pkg/lxdbackup"
+)
+
+// trustToken is what a token of lxc config trust add holds.
+type trustToken struct {
+	ClientName  string   `json:"client_name"`
+	Fingerprint string   `json:"fingerprint"`
+	Addresses   []string `json:"addresses"`
+	Secret      string   `json:"secret"`
+}
+
+// trustDir is where lxd-backup trust add keeps what LXD is reached with:
+// client.crt, client.key, server.crt and url.
+func trustDir() string {
+	d, err := os.UserConfigDir()
+	if err != nil {
+		d = "/etc"
+	}
+	return filepath.Join(d, "lxd-backup")
+}
+
+// trusted fills in a from trustDir, unless it already says how to reach
+// LXD. It tells whether there was anything there.
+func (a *lxdAccess) trusted() bool {
+
+	dir := trustDir()
+	u, err := os.ReadFile(filepath.Join(dir, "url"))
+	if len(a.url)+len(a.socket) > 0 || err != nil {
+		return false
+	}
+	a.url = strings.TrimSpace(string(u))
+	a.cert = filepath.Join(dir, "client.crt")
+	a.key = filepath.Join(dir, "client.key")
+	if fileExists(filepath.Join(dir, "server.crt")) {
+		a.serverCert = filepath.Join(dir, "server.crt")
+	}
+	return true
+}
+
+// decodeTrustToken decodes a token of lxc config trust add.
+func decodeTrustToken(token string) (*trustToken, error) {
+
+	d, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		d, err = base64.RawURLEncoding.DecodeString(token)
+	}
+	if err != nil {
+		return nil, errors.New("not a trust token")
+	}
+	var t trustToken
+	if err := json.Unmarshal(d, &t); err != nil || len(t.Secret) == 0 {
+		return nil, errors.New("not a trust token")
+	}
+	return &t, nil
+}
+
+// clientCertificate makes a self-signed client certificate and its key in
+// dir, as LXD trusts clients by their certificate and not a CA.
+func clientCertificate(dir, name string) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		fatalf("Failed to generate key. Error: %v\n", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		fatalf("Failed to generate serial number. Error: %v\n", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"lxd-backup"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		fatalf("Failed to create certificate. Error: %v\n", err)
+	}
+	k, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fatalf("Failed to encode key. Error: %v\n", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "client.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: k}), 0600); err != nil {
+		fatalf("Failed to write key. Error: %v\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "client.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		fatalf("Failed to write certificate. Error: %v\n", err)
+	}
+}
+
+// serverCertificate returns the certificate LXD at addr, host:port,
+// presents, without trusting it yet.
+func serverCertificate(addr string) *x509.Certificate {
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		fatalf("Failed to connect to LXD at %s. Error: %v\n", addr, err)
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		fatalf("LXD at %s has no certificate.\n", addr)
+	}
+	return certs[0]
+}
+
+func fingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// trustMain is lxd-backup trust add: it makes a client certificate, has
+// LXD trust it, and keeps it in trustDir for the runs after it.
+func trustMain(args []string) {
+
+	var lxdURL, token, password, name, dir string
+
+	fs := flag.NewFlagSet("trust", flag.ExitOnError)
+	logOpts := addLogFlags(fs)
+	confirmOpts := addConfirmFlags(fs)
+	host, _ := os.Hostname()
+	fs.StringVar(&lxdURL, "url", "", "LXD to be trusted by, IE https://lxd.example.com:8443. Default is the first address of the token.")
+	fs.StringVar(&token, "token", "", "Trust token of lxc config trust add, or env:NAME, file:path or cmd:command giving it.")
+	fs.StringVar(&password, "password", "", "Trust password, core.trust_password, of LXD without tokens, or env:NAME, file:path or cmd:command giving it.")
+	fs.StringVar(&name, "name", "lxd-backup-"+host, "Name of the certificate in LXD.")
+	fs.StringVar(&dir, "dir", trustDir(), "Directory to keep the certificate and key in.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s trust add [options] -token token\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s trust add [options] -url url -password password\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "add" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	fs.Parse(args[1:])
+
+	logOpts.setup()
+
+	if (len(token) == 0) == (len(password) == 0) || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	for _, s := range []*string{&token, &password} {
+		v, err := lxdbackup.ResolveSecret(*s)
+		if err != nil {
+			fatalf("Failed to get the trust secret. Error: %v\n", err)
+		}
+		*s = v
+	}
+
+	var t *trustToken
+	if len(token) > 0 {
+		var err error
+		if t, err = decodeTrustToken(token); err != nil {
+			fatalf("Bad -token. Error: %v\n", err)
+		}
+		if len(lxdURL) == 0 && len(t.Addresses) > 0 {
+			lxdURL = "https://" + t.Addresses[0]
+		}
+	}
+	if len(lxdURL) == 0 {
+		fatal("-url is needed, the token has no address.")
+	}
+	u, err := url.Parse(lxdURL)
+	if err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+		fatalf("Bad -url %s, IE https://lxd.example.com:8443.\n", lxdURL)
+	}
+	addr := u.Host
+	if len(u.Port()) == 0 {
+		addr += ":8443"
+	}
+
+	// The token says which server it is of, a password doesn't
+	server := serverCertificate(addr)
+	fp := fingerprint(server)
+	if t != nil && !strings.EqualFold(t.Fingerprint, fp) {
+		fatalf("LXD at %s has certificate %s, the token is of %s.\n", addr, fp, t.Fingerprint)
+	}
+	if t == nil && !confirmOpts.confirm("Trust LXD at "+addr+" with certificate fingerprint", []string{fp}) {
+		return
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		fatalf("Failed to create %s. Error: %v\n", dir, err)
+	}
+	if !fileExists(filepath.Join(dir, "client.crt")) || !fileExists(filepath.Join(dir, "client.key")) {
+		clientCertificate(dir, name)
+	}
+	serverPEM := filepath.Join(dir, "server.crt")
+	if err := os.WriteFile(serverPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Raw}), 0644); err != nil {
+		fatalf("Failed to write %s. Error: %v\n", serverPEM, err)
+	}
+
+	a := &lxdAccess{url: "https://" + addr, cert: filepath.Join(dir, "client.crt"), key: filepath.Join(dir, "client.key"), serverCert: serverPEM}
+	api := &lxdbackup.API{URL: a.url, TLS: a.tlsConfig()}
+	if err := api.AddCertificate(name, token, password); err != nil {
+		fatalf("LXD at %s didn't trust the certificate. Error: %v\n", addr, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "url"), []byte(a.url+"\n"), 0644); err != nil {
+		fatalf("Failed to write %s. Error: %v\n", filepath.Join(dir, "url"), err)
+	}
+	fmt.Printf("LXD at %s trusts %s as %s. lxd-backup reaches it with that from now on.\n", a.url, a.cert, name)
+}
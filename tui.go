@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tui is -tui.
+var tui bool
+
+// dash is the live dashboard of -tui, nil without it.
+var dash *dashboard
+
+// startDashboard starts drawing the dashboard, and takes the log over from
+// stdout. It is drawn a last time when lxd-backup exits, either way.
+func startDashboard() {
+	if !progressTTY {
+		fatal("-tui needs a terminal on stderr.")
+	}
+	dash = newDashboard()
+	logOutput = dash
+	go dash.run()
+	// Registered first, so it runs last
+	atExit(func(string) { dash.close() })
+}
+
+// dashRow is one container or volume of the dashboard.
+type dashRow struct {
+	name  string
+	state string
+	start time.Time
+	end   time.Time
+	bytes int64
+}
+
+// dashboard is a table of what a run backs up, redrawn on stderr every
+// second: the state of each, how long it took or has taken, and how much
+// it exported. The log is shown under it, its last lines only.
+type dashboard struct {
+	mu    sync.Mutex
+	rows  []*dashRow
+	byKey map[string]*dashRow
+	log   []string
+	bars  map[string]*progressBar // By the name they are of
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// dashLogLines is how many lines of the log the dashboard shows.
+const dashLogLines = 8
+
+// dashStates are what the stages of a backup are shown as.
+var dashStates = map[string]string{
+	"stop": "stopping", "export": "exporting", "start": "starting", "hash": "hashing",
+}
+
+func newDashboard() *dashboard {
+	return &dashboard{byKey: make(map[string]*dashRow), bars: make(map[string]*progressBar), start: time.Now(),
+		stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run draws the dashboard until close.
+func (d *dashboard) run() {
+	defer close(d.done)
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	fmt.Fprint(os.Stderr, "\033[?25l")
+	for {
+		d.draw()
+		select {
+		case <-d.stop:
+			d.draw()
+			fmt.Fprint(os.Stderr, "\033[?25h")
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (d *dashboard) close() {
+	if d == nil {
+		return
+	}
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+	<-d.done
+}
+
+// Write takes the log, instead of stdout, so it doesn't scroll the table
+// away.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.log = append(d.log, l)
+	}
+	if n := len(d.log); n > dashLogLines {
+		d.log = d.log[n-dashLogLines:]
+	}
+	return len(p), nil
+}
+
+// names adds the rows of what the run is about to back up.
+func (d *dashboard) names(names []string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, n := range names {
+		d.row(n)
+	}
+}
+
+func (d *dashboard) row(name string) *dashRow {
+	r, ok := d.byKey[name]
+	if !ok {
+		r = &dashRow{name: name, state: "waiting"}
+		d.byKey[name] = r
+		d.rows = append(d.rows, r)
+	}
+	return r
+}
+
+func (d *dashboard) begin(name string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.row(name)
+	r.state = "started"
+	r.start = time.Now()
+}
+
+// stage shows name in the stage of backup, "" when done with a stage.
+func (d *dashboard) stage(name, stage string) {
+	if d == nil || len(stage) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := dashStates[stage]; ok {
+		stage = s
+	}
+	d.row(name).state = stage
+}
+
+func (d *dashboard) end(name, status string, bytes int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r := d.row(name)
+	r.state = status
+	r.end = time.Now()
+	r.bytes = bytes
+}
+
+// progress makes bar, the one of the running step of its container,
+// shown in the table instead of on its own.
+func (d *dashboard) progress(bar *progressBar) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.bars[bar.name] = bar
+}
+
+func (d *dashboard) progressDone(bar *progressBar) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.bars[bar.name] == bar {
+		delete(d.bars, bar.name)
+	}
+}
+
+func (d *dashboard) draw() {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b bytes.Buffer
+	b.WriteString("\033[H\033[2J")
+	done := 0
+	for _, r := range d.rows {
+		if !r.end.IsZero() {
+			done++
+		}
+	}
+	fmt.Fprintf(&b, "lxd-backup  %d of %d done  elapsed %s\n\n", done, len(d.rows),
+		time.Since(d.start).Round(time.Second))
+	fmt.Fprintf(&b, "%-30s %-18s %10s %12s\n", "NAME", "STATE", "ELAPSED", "SIZE")
+
+	for _, r := range d.rows {
+		bar := d.bars[r.name]
+		var elapsed, size string
+		switch {
+		case !r.end.IsZero():
+			elapsed = r.end.Sub(r.start).Round(time.Second).String()
+			size = humanBytes(r.bytes)
+		case !r.start.IsZero():
+			elapsed = time.Since(r.start).Round(time.Second).String()
+			if bar != nil {
+				size = humanBytes(bar.current())
+			}
+		}
+		fmt.Fprintf(&b, "%-30s %-18s %10s %12s\n", r.name, r.state, elapsed, size)
+		if r.end.IsZero() && !r.start.IsZero() && bar != nil {
+			fmt.Fprintf(&b, "  %s\n", bar.line())
+		}
+	}
+
+	if len(d.log) > 0 {
+		b.WriteString("\n")
+		for _, l := range d.log {
+			fmt.Fprintf(&b, "%s\n", l)
+		}
+	}
+	os.Stderr.Write(b.Bytes())
+}
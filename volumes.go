@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+type volumeState struct {
+	pool string
+	name string
+}
+
+// backupName is used instead of a container name in the backup filenames.
+// Container names can't contain dots, so these never collide.
+func (v *volumeState) backupName() string {
+	return "volume." + v.pool + "." + v.name
+}
+
+func lxcVolumeList() []*volumeState {
+
+	r := csv.NewReader(strings.NewReader(execLxc([]string{"storage", "list", "-f", "csv"})))
+	r.FieldsPerRecord = -1
+	pools, err := r.ReadAll()
+	if err != nil {
+		fatalf("Failed to convert raw CSV to [][]string. Error: %v\n", err)
+	}
+
+	var volumes []*volumeState
+
+	for _, p := range pools {
+		r := csv.NewReader(strings.NewReader(execLxc([]string{"storage", "volume", "list", p[0], "-f", "csv"})))
+		r.FieldsPerRecord = -1
+		vols, err := r.ReadAll()
+		if err != nil {
+			fatalf("Failed to convert raw CSV to [][]string. Error: %v\n", err)
+		}
+		for _, v := range vols {
+			// Snapshots are listed as volume/snapshot
+			if len(v) < 2 || v[0] != "custom" || strings.Contains(v[1], "/") {
+				continue
+			}
+			volumes = append(volumes, &volumeState{pool: p[0], name: v[1]})
+		}
+	}
+	return volumes
+}
+
+func filterVolumes(volumes []*volumeState, exclude map[string]bool) []*volumeState {
+
+	if len(exclude) == 0 {
+		return volumes
+	}
+
+	vtmp := make([]*volumeState, 0, len(volumes))
+
+	for i := range volumes {
+		if _, present := exclude[volumes[i].pool+"/"+volumes[i].name]; !present {
+			vtmp = append(vtmp, volumes[i])
+		}
+	}
+	return vtmp
+}
+
+func lxcVolumeExport(v *volumeState, to string, extraArgs []string) {
+	slog.Info("Exporting volume", "pool", v.pool, "volume", v.name)
+
+	args := []string{"storage", "volume", "export", v.pool, v.name, to, "--volume-only", "-q"}
+	compress := compressHere && !hasExportArg(extraArgs, "--compression")
+	if !hasExportArg(extraArgs, "--compression") {
+		args = append(args, "--compression", exportCompression())
+	}
+	args = append(args, extraArgs...)
+
+	err := retryLxc("lxc storage volume export "+v.pool+"/"+v.name, lxcRetries, func() error {
+		os.Remove(to)
+		cmd, done := exportCommand(args, to, compress)
+		defer done()
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}, nil)
+	if err != nil {
+		fatalf("Failed to run: lxc %s. Error: %v\n", strings.Join(args, " "), err)
+	}
+	slog.Info("Exported volume", "pool", v.pool, "volume", v.name)
+}
+
+func lxcVolumeImport(pool, name, fname string) {
+	slog.Info("Importing volume", "file", fname, "pool", pool, "volume", name)
+
+	cmd, cancel := lxcCommand("storage", "volume", "import", pool, fname, name)
+	defer cancel()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalf("Failed to run: lxc storage volume import %s %s %s. Error: %v\n", pool, fname, name, err)
+	}
+}
+
+func volumeJob(v *volumeState, conf *config) *backupJob {
+
+	name := v.backupName()
+
+	m := &manifest{
+		Container:  name,
+		Kind:       "volume",
+		Created:    timestamp(nowUTC()),
+		Config:     execLxc([]string{"storage", "volume", "show", v.pool, v.name}),
+		ExportArgs: conf.container(name).ExportArgs,
+		LXDVersion: lxdServerVersion(),
+	}
+
+	return &backupJob{
+		name:      name,
+		before:    func() {},
+		after:     func() {},
+		export:    func(to string) { lxcVolumeExport(v, to, m.ExportArgs) },
+		diskUsage: func() int64 { return lxcVolumeUsage(v) },
+		manifest:  m,
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// immutableDays is -immutable, how many days archives are write-once
+// after they are made, 0 for not at all.
+var immutableDays int
+
+// wormMu guards the write-once state files of all backup directories.
+var wormMu sync.Mutex
+
+// wormStateFile keeps until when each archive of dir is write-once,
+// by file name.
+func wormStateFile(dir string) string {
+	return filepath.Join(dir, "lxd-backup-worm.json")
+}
+
+func loadWriteOnce(dir string) map[string]string {
+	worm := make(map[string]string)
+	if d, err := os.ReadFile(wormStateFile(dir)); err == nil {
+		json.Unmarshal(d, &worm)
+	}
+	return worm
+}
+
+func saveWriteOnce(dir string, worm map[string]string) {
+	d, err := json.MarshalIndent(worm, "", "  ")
+	if err == nil {
+		err = writeFilePartial(wormStateFile(dir), d, 0644)
+	}
+	if err != nil {
+		fatalf("Failed to write %s. Error: %v\n", wormStateFile(dir), err)
+	}
+}
+
+// makeWriteOnce makes the archive fname, and its parts, read-only and
+// notes it is not to be removed or made over until until.
+func makeWriteOnce(fname string, until time.Time) {
+
+	parts, _ := filepath.Glob(fname + ".part*")
+	for _, f := range append(parts, fname) {
+		if err := os.Chmod(f, 0444); err != nil && !os.IsNotExist(err) {
+			fatalf("Failed to make %s read-only. Error: %v\n", f, err)
+		}
+	}
+
+	wormMu.Lock()
+	defer wormMu.Unlock()
+	dir := filepath.Dir(fname)
+	worm := loadWriteOnce(dir)
+	worm[filepath.Base(fname)] = timestamp(until)
+	// Expired ones are forgotten on the way
+	now := time.Now()
+	for f, u := range worm {
+		if t, err := time.Parse(time.RFC3339, u); err != nil || !t.After(now) {
+			delete(worm, f)
+		}
+	}
+	saveWriteOnce(dir, worm)
+}
+
+// writeOnceUntil is until when the archive fname is write-once, the zero time
+// if it is not.
+func writeOnceUntil(fname string) time.Time {
+
+	dir := filepath.Dir(fname)
+	if !fileExists(wormStateFile(dir)) {
+		return time.Time{}
+	}
+	wormMu.Lock()
+	u := loadWriteOnce(dir)[filepath.Base(fname)]
+	wormMu.Unlock()
+	t, err := time.Parse(time.RFC3339, u)
+	if err != nil || !t.After(time.Now()) {
+		return time.Time{}
+	}
+	return t
+}
+
+// moveWriteOnce takes the write-once state of the archive from along when it is renamed to,
+// also into another directory.
+func moveWriteOnce(from, to string) {
+
+	wormMu.Lock()
+	defer wormMu.Unlock()
+	dir := filepath.Dir(from)
+	worm := loadWriteOnce(dir)
+	u, ok := worm[filepath.Base(from)]
+	if !ok {
+		return
+	}
+	delete(worm, filepath.Base(from))
+	if filepath.Dir(to) != dir {
+		saveWriteOnce(dir, worm)
+		dir = filepath.Dir(to)
+		worm = loadWriteOnce(dir)
+	}
+	worm[filepath.Base(to)] = u
+	saveWriteOnce(dir, worm)
+}
+
+// writeOnceError tells that the archive fname is still write-once, or nil.
+func writeOnceError(fname string) error {
+	if until := writeOnceUntil(fname); !until.IsZero() {
+		return fmt.Errorf("%s is write-once until %s", filepath.Base(fname), displayTime(until))
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// zfsSnapshotPrefix is what the ZFS snapshots lxd-backup makes are named
+// with, after the @.
+const zfsSnapshotPrefix = "lxd-backup-"
+
+// zfsDetector asks ZFS what changed since the quarter backup. With the
+// quarter backup, a snapshot of the dataset of the container is made, and a
+// delta diffs it with one made when the delta is, which takes seconds
+// instead of hashing every file. Containers not on ZFS, or without the
+// snapshot of their quarter backup, are hashed in full.
+type zfsDetector struct{}
+
+// zfsDataset is the dataset of the container name, or "" when it isn't on
+// ZFS.
+func zfsDataset(name string) string {
+	pool, err := instancePool(name, "")
+	if err != nil {
+		slog.Warn("Storage pool unknown, hashing every file", "name", name, "error", err)
+		return ""
+	}
+	if pool.driver != "zfs" {
+		return ""
+	}
+	zpool := pool.config["zfs.pool_name"]
+	if len(zpool) == 0 {
+		zpool = pool.name
+	}
+	return zpool + "/containers/" + name
+}
+
+func zfsRun(args ...string) ([]byte, error) {
+	out, err := exec.Command("zfs", args...).Output()
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return nil, fmt.Errorf("zfs %s: %s", strings.Join(args, " "), strings.TrimSpace(string(ee.Stderr)))
+	} else if err != nil {
+		return nil, fmt.Errorf("zfs %s: %w", strings.Join(args, " "), err)
+	}
+	return out, nil
+}
+
+func (zfsDetector) full(j *backupJob) {
+
+	dataset := zfsDataset(j.name)
+	if len(dataset) == 0 {
+		return
+	}
+
+	// The snapshots of the previous quarter are of no use anymore
+	out, err := zfsRun("list", "-H", "-t", "snapshot", "-o", "name", "-d", "1", dataset)
+	if err != nil {
+		slog.Warn("Failed to list ZFS snapshots", "name", j.name, "error", err)
+		return
+	}
+	for _, snap := range strings.Fields(string(out)) {
+		if strings.HasPrefix(snap, dataset+"@"+zfsSnapshotPrefix) {
+			if _, err := zfsRun("destroy", snap); err != nil {
+				slog.Warn("Failed to destroy ZFS snapshot", "snapshot", snap, "error", err)
+			}
+		}
+	}
+
+	snap := dataset + "@" + zfsSnapshotPrefix + fileTimestamp(nowUTC())
+	if _, err := zfsRun("snapshot", snap); err != nil {
+		slog.Warn("Failed to make ZFS snapshot, deltas will hash every file", "name", j.name, "error", err)
+		return
+	}
+	j.manifest.ZFSSnapshot = snap
+}
+
+func (zfsDetector) delta(j *backupJob, s *schedule, quarter *manifest) func(hdr *tar.Header) bool {
+
+	if len(quarter.ZFSSnapshot) == 0 {
+		return nil
+	}
+	dataset, _, _ := strings.Cut(quarter.ZFSSnapshot, "@")
+	if dataset != zfsDataset(j.name) {
+		return nil
+	}
+
+	snap := dataset + "@" + zfsSnapshotPrefix + "delta-" + fileTimestamp(nowUTC())
+	if _, err := zfsRun("snapshot", snap); err != nil {
+		slog.Warn("Failed to make ZFS snapshot, hashing every file", "name", j.name, "error", err)
+		return nil
+	}
+	defer zfsRun("destroy", snap)
+
+	out, err := zfsRun("diff", "-H", "-F", quarter.ZFSSnapshot, snap)
+	if err != nil {
+		slog.Warn("Failed to diff ZFS snapshots, hashing every file", "name", j.name, "error", err)
+		return nil
+	}
+	changed, ok := zfsChanges(out, j.name)
+	if !ok {
+		slog.Warn("Unexpected zfs diff output, hashing every file", "name", j.name)
+		return nil
+	}
+	slog.Info("Using zfs diff", "name", j.name, "changed", len(changed))
+	// backup/index.yaml and the like are not in the dataset
+	return func(hdr *tar.Header) bool {
+		return strings.HasPrefix(hdr.Name, "backup/container/") && !journalCovers(changed, hdr.Name)
+	}
+}
+
+// zfsEscape is how zfs diff writes characters that aren't printable, IE a
+// space is \0040.
+var zfsEscape = regexp.MustCompile(`\\0([0-7]{3})`)
+
+func zfsUnescape(p string) string {
+	return zfsEscape.ReplaceAllStringFunc(p, func(e string) string {
+		c, _ := strconv.ParseUint(e[2:], 8, 8)
+		return string([]byte{byte(c)})
+	})
+}
+
+// zfsChanges turns zfs diff -H -F output into the tar entries that changed,
+// in the form journalCovers takes. A modified directory only means that
+// something in it was added or removed, which is listed too, so they are
+// left out, or every file in them would be hashed.
+func zfsChanges(diff []byte, name string) (map[string]bool, bool) {
+
+	// Datasets are mounted at <lxd>/storage-pools/<pool>/containers/<name>
+	marker := "/containers/" + name + "/"
+
+	changed := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(diff))
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), "\t")
+		if len(f) < 3 {
+			return nil, false
+		}
+		if f[0] == "M" && f[1] == "/" {
+			continue
+		}
+		for _, p := range f[2:] {
+			p = zfsUnescape(p)
+			i := strings.Index(p, marker)
+			if i < 0 {
+				return nil, false
+			}
+			changed["backup/container/"+p[i+len(marker):]] = true
+		}
+	}
+	return changed, sc.Err() == nil
+}